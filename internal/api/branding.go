@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,9 +18,13 @@ func init() {
 	os.MkdirAll("uploads/logos", 0755)
 }
 
-func RegisterBrandingRoutes(r *gin.RouterGroup) {
+// RegisterBrandingRoutes adds the branding routes behind the given
+// middleware (authentication and permission checks), open only to plans
+// that include custom branding.
+func RegisterBrandingRoutes(r *gin.RouterGroup, middleware ...gin.HandlerFunc) {
 	branding := r.Group("/branding")
-	branding.Use(checkProPlanMiddleware())
+	branding.Use(middleware...)
+	branding.Use(checkBrandingPlanMiddleware())
 	{
 		branding.POST("/upload-logo", UploadLogo)
 		branding.GET("/settings", GetBranding)
@@ -27,32 +32,29 @@ func RegisterBrandingRoutes(r *gin.RouterGroup) {
 	}
 }
 
-func checkProPlanMiddleware() gin.HandlerFunc {
+func checkBrandingPlanMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Mock entitlement check
-		// In a real app, we check c.Get("role") or query DB for subscription status
-		// For MVP: allow all authenticated users (or just check existence of user_id)
-		userID := c.GetString("user_id")
-		if userID == "" {
+		if getUserIDInt(c) == 0 {
 			c.AbortWithStatusJSON(401, gin.H{"error": "Unauthorized"})
 			return
 		}
-		// Assume "Pro"
+		plan, err := db.NewPlanRepository(db.GetService()).Effective(c.Request.Context())
+		if err != nil {
+			c.AbortWithStatusJSON(500, gin.H{"error": "Failed to resolve plan"})
+			return
+		}
+		if err := plan.AllowsBranding(); err != nil {
+			c.AbortWithStatusJSON(403, gin.H{"error": err.Error()})
+			return
+		}
 		c.Next()
 	}
 }
 
-// Helper to reliably get integer user ID (mocked for MVP since auth uses string IDs)
+// getUserIDInt returns the ID of the authenticated user, or 0.
 func getUserIDInt(c *gin.Context) int {
-	// For MVP, we map admin-001 to 1, or just hash it.
-	// Since the DB requires INT, and Auth uses UUID/String, we face a mismatch.
-	// We'll hardcode 1 for the demo purpose if ID is "admin-001".
-	uidStr := c.GetString("user_id")
-	if uidStr == "admin-001" {
-		return 1
-	}
-	// Fallback or hash implementation could go here
-	return 1
+	id, _ := strconv.Atoi(c.GetString("user_id"))
+	return id
 }
 
 func UploadLogo(c *gin.Context) {
@@ -10,6 +10,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"aexon/internal/db"
 	"aexon/internal/events"
 	"aexon/internal/monitor"
 	"aexon/internal/provider/lxc"
@@ -156,6 +157,8 @@ type TelemetryClient struct {
 	sendChan        chan *TelemetryMessage
 	instanceService *lxc.InstanceService
 	metricProcessor func([]lxc.InstanceMetric)
+	scope           db.Scope
+	admin           bool // Sees the whole fleet; otherwise only scope's project
 	
 	ctx             context.Context
 	cancel          context.CancelFunc
@@ -179,6 +182,8 @@ func NewTelemetryClient(
 	conn *websocket.Conn,
 	instanceService *lxc.InstanceService,
 	metricProcessor func([]lxc.InstanceMetric),
+	scope db.Scope,
+	admin bool,
 ) *TelemetryClient {
 	ctx, cancel := context.WithCancel(context.Background())
 	
@@ -188,6 +193,8 @@ func NewTelemetryClient(
 		sendChan:        make(chan *TelemetryMessage, telemetryChannelBufferSize),
 		instanceService: instanceService,
 		metricProcessor: metricProcessor,
+		scope:           scope,
+		admin:           admin,
 		ctx:             ctx,
 		cancel:          cancel,
 	}
@@ -239,6 +246,11 @@ func (c *TelemetryClient) metricsPoller() {
 			return
 			
 		case <-ticker.C:
+			// Host and instance metrics cover the whole fleet
+			if !c.admin {
+				continue
+			}
+
 			// Collect instance metrics
 			if err := c.collectInstanceMetrics(); err != nil {
 				log.Printf("[Telemetry] Client %s: metrics collection error: %v", c.id, err)
@@ -255,6 +267,9 @@ func (c *TelemetryClient) metricsPoller() {
 }
 
 func (c *TelemetryClient) collectInstanceMetrics() error {
+	if c.instanceService == nil {
+		return nil
+	}
 	metrics, err := c.instanceService.ListInstances()
 	if err != nil {
 		return fmt.Errorf("ListInstances failed: %w", err)
@@ -364,6 +379,15 @@ func (c *TelemetryClient) pingLoop() {
 	}
 }
 
+// Visible reports whether the client may see evt: admins see every event,
+// other clients only those of the project they act in.
+func (c *TelemetryClient) Visible(evt events.Event) bool {
+	if c.admin {
+		return true
+	}
+	return evt.ProjectID != nil && *evt.ProjectID == c.scope.ProjectID
+}
+
 func (c *TelemetryClient) SendEvent(event interface{}) {
 	if c.state.Load() != clientStateRunning {
 		return
@@ -507,7 +531,7 @@ func InitBroadcaster() {
 	}()
 }
 
-func broadcastEvent(event interface{}) {
+func broadcastEvent(event events.Event) {
 	telemetryMutex.RLock()
 	clients := make([]*TelemetryClient, 0, len(telemetryClients))
 	for _, client := range telemetryClients {
@@ -516,7 +540,9 @@ func broadcastEvent(event interface{}) {
 	telemetryMutex.RUnlock()
 
 	for _, client := range clients {
-		client.SendEvent(event)
+		if client.Visible(event) {
+			client.SendEvent(event)
+		}
 	}
 }
 
@@ -617,8 +643,9 @@ func StreamTelemetry(
 	clientID := fmt.Sprintf("telemetry-%d", time.Now().UnixNano())
 	log.Printf("[Telemetry] New client: %s", clientID)
 
-	// Create client
-	client := NewTelemetryClient(clientID, conn, instanceService, metricProcessor)
+	// Create client, limited to the events of the caller's scope
+	scope, ok := db.ScopeFrom(c.Request.Context())
+	client := NewTelemetryClient(clientID, conn, instanceService, metricProcessor, scope, ok && scope.Admin)
 
 	if err := client.Start(); err != nil {
 		log.Printf("[Telemetry] Client %s start failed: %v", clientID, err)
@@ -728,23 +755,13 @@ func ShutdownAllTelemetryHandler(c *gin.Context) {
 // ROUTER REGISTRATION
 // ============================================================================
 
-func RegisterTelemetryRoutes(r *gin.Engine, instanceService *lxc.InstanceService) {
-	// WebSocket endpoint
-	r.GET("/ws/telemetry", func(c *gin.Context) {
-		StreamTelemetry(c, instanceService, func(metrics []lxc.InstanceMetric) {
-			// Process metrics (e.g., save to database)
-			// This is called in the metrics poller goroutine
-		})
+// RegisterTelemetryRoutes registers the telemetry WebSocket behind
+// middleware, which must authenticate the caller: the stream is limited to
+// the scope the middleware sets. instanceService may be nil when instances
+// do not run on LXD.
+func RegisterTelemetryRoutes(r *gin.RouterGroup, instanceService *lxc.InstanceService, middleware ...gin.HandlerFunc) {
+	handlers := append(middleware, func(c *gin.Context) {
+		StreamTelemetry(c, instanceService, nil)
 	})
-	
-	// Metrics endpoint
-	r.GET("/telemetry/metrics", GetTelemetryMetrics)
-	
-	// Admin endpoints
-	admin := r.Group("/telemetry/admin")
-	{
-		admin.GET("/clients", ListTelemetryClientsHandler)
-		admin.DELETE("/clients/:id", CloseTelemetryClientHandler)
-		admin.POST("/shutdown", ShutdownAllTelemetryHandler)
-	}
+	r.GET("/ws/telemetry", handlers...)
 }
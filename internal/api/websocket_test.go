@@ -0,0 +1,34 @@
+package api
+
+import (
+	"testing"
+
+	"aexon/internal/db"
+	"aexon/internal/events"
+)
+
+func TestTelemetryClientVisible(t *testing.T) {
+	project := func(id int) *int { return &id }
+	tenant := &TelemetryClient{scope: db.Scope{UserID: 7, ProjectID: 3}}
+	admin := &TelemetryClient{scope: db.Scope{UserID: 1, Admin: true}, admin: true}
+	outsider := &TelemetryClient{scope: db.Scope{UserID: 8}}
+
+	tests := []struct {
+		name   string
+		client *TelemetryClient
+		event  events.Event
+		want   bool
+	}{
+		{"own project", tenant, events.Event{Type: events.JobUpdate, ProjectID: project(3)}, true},
+		{"other project", tenant, events.Event{Type: events.JobLog, ProjectID: project(4)}, false},
+		{"outside any project", tenant, events.Event{Type: events.JobProgress}, false},
+		{"admin", admin, events.Event{Type: events.TrafficQuota, ProjectID: project(4)}, true},
+		{"admin, outside any project", admin, events.Event{Type: events.JobUpdate}, true},
+		{"caller without a project", outsider, events.Event{Type: events.JobUpdate}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.client.Visible(tt.event); got != tt.want {
+			t.Errorf("%s: Visible() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
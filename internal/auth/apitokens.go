@@ -0,0 +1,254 @@
+package auth
+
+import (
+	"aexon/internal/db"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// API TOKENS
+// ============================================================================
+
+// APITokenPrefix starts every API token, telling them apart from JWTs.
+const APITokenPrefix = "axk_"
+
+const (
+	apiTokenBytes     = 24
+	apiTokenPrefixLen = len(APITokenPrefix) + 8 // Shown in listings
+	maxAPITokenName   = 64
+)
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateAPIToken() (string, error) {
+	b := make([]byte, apiTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return APITokenPrefix + hex.EncodeToString(b), nil
+}
+
+// ValidateAPIToken authenticates an API token presented from ip and returns
+// claims equivalent to an access token limited to the token's permissions.
+func (s *AuthService) ValidateAPIToken(c *gin.Context, token string) (*AxionClaims, error) {
+	globalAuthMetrics.tokenValidations.Add(1)
+
+	t, err := s.apiTokens.Authenticate(c.Request.Context(), hashAPIToken(token))
+	if err != nil {
+		globalAuthMetrics.tokenRejections.Add(1)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrTokenInvalid(errors.New("unknown, expired or revoked API token"))
+		}
+		return nil, err
+	}
+
+	ip := c.ClientIP()
+	if !cidrsAllow(t.AllowedCIDRs, ip) {
+		globalAuthMetrics.tokenRejections.Add(1)
+		log.Printf("[Auth] API token %s used from disallowed address %s", t.Prefix, ip)
+		return nil, NewAuthError(ErrCodeSourceNotAllowed, "API token not allowed from this address", nil)
+	}
+
+	if err := s.apiTokens.Touch(c.Request.Context(), t.ID, ip); err != nil {
+		log.Printf("[Auth] Recording API token use failed: %v", err)
+	}
+
+	c.Set("api_token_id", t.ID)
+	uid := strconv.Itoa(t.UserID)
+	claims := &AxionClaims{
+		UserID:      uid,
+		Username:    t.UserEmail,
+		Role:        t.UserRole,
+		Permissions: t.Permissions,
+		TokenType:   "api",
+	}
+	claims.ID = t.ID
+	claims.Subject = uid
+	return claims, nil
+}
+
+// cidrsAllow reports whether ip is inside one of the networks; no networks
+// allow every address.
+func cidrsAllow(cidrs []string, ip string) bool {
+	if len(cidrs) == 0 {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, cidr := range cidrs {
+		if _, n, err := net.ParseCIDR(cidr); err == nil && n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeCIDR accepts a network or a single address.
+func normalizeCIDR(s string) (string, bool) {
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		return n.String(), true
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return "", false
+	}
+	if ip.To4() != nil {
+		return ip.String() + "/32", true
+	}
+	return ip.String() + "/128", true
+}
+
+// coveredBy reports whether every catalog permission matched by pattern is
+// also granted by limit, so that scoped tokens cannot mint broader ones.
+func coveredBy(pattern string, limit []string) bool {
+	for _, p := range Catalog {
+		if MatchPermission(pattern, p.Name) && !HasPermission(limit, p.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// ============================================================================
+// API TOKEN HANDLERS
+// ============================================================================
+
+func currentUserID(c *gin.Context) (int, bool) {
+	uid, err := strconv.Atoi(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "invalid user"})
+		return 0, false
+	}
+	return uid, true
+}
+
+func ListAPITokensHandler(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	tokens, err := GetAuthService().apiTokens.ListForUser(c.Request.Context(), uid)
+	if err != nil {
+		log.Printf("[Auth] List API tokens error: %v", err)
+		c.JSON(500, gin.H{"error": "failed to fetch API tokens"})
+		return
+	}
+	if tokens == nil {
+		tokens = []db.APIToken{}
+	}
+	c.JSON(200, gin.H{"tokens": tokens})
+}
+
+func CreateAPITokenHandler(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name         string     `json:"name" binding:"required"`
+		Permissions  []string   `json:"permissions" binding:"required"`
+		AllowedCIDRs []string   `json:"allowed_cidrs"`
+		ExpiresAt    *time.Time `json:"expires_at"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "invalid request"})
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > maxAPITokenName {
+		c.JSON(400, gin.H{"error": "name must be 1-64 characters"})
+		return
+	}
+	if len(req.Permissions) == 0 {
+		c.JSON(400, gin.H{"error": "at least one permission is required"})
+		return
+	}
+	limit := c.GetStringSlice("token_permissions")
+	for _, p := range req.Permissions {
+		if !validPattern(p) {
+			c.JSON(400, gin.H{"error": "unknown permission", "permission": p})
+			return
+		}
+		if len(limit) > 0 && !coveredBy(p, limit) {
+			c.JSON(403, gin.H{"error": "permission exceeds the calling token", "permission": p})
+			return
+		}
+	}
+	cidrs := make([]string, 0, len(req.AllowedCIDRs))
+	for _, cidr := range req.AllowedCIDRs {
+		n, ok := normalizeCIDR(strings.TrimSpace(cidr))
+		if !ok {
+			c.JSON(400, gin.H{"error": "invalid CIDR", "cidr": cidr})
+			return
+		}
+		cidrs = append(cidrs, n)
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		c.JSON(400, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+
+	secret, err := generateAPIToken()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to generate token"})
+		return
+	}
+	t := &db.APIToken{
+		UserID:       uid,
+		Name:         req.Name,
+		Prefix:       secret[:apiTokenPrefixLen],
+		Permissions:  req.Permissions,
+		AllowedCIDRs: cidrs,
+		ExpiresAt:    req.ExpiresAt,
+	}
+	if err := GetAuthService().apiTokens.Create(c.Request.Context(), t, hashAPIToken(secret)); err != nil {
+		log.Printf("[Auth] Create API token error: %v", err)
+		c.JSON(500, gin.H{"error": "failed to create API token"})
+		return
+	}
+
+	AuditTarget(c, "/api-tokens/"+t.ID)
+	log.Printf("[Auth] API token %s created for user %d", t.Prefix, uid)
+	// The secret is only ever shown here
+	c.JSON(201, gin.H{
+		"token":     secret,
+		"api_token": t,
+	})
+}
+
+func RevokeAPITokenHandler(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	err := GetAuthService().apiTokens.Revoke(c.Request.Context(), uid, c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(404, gin.H{"error": "API token not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("[Auth] Revoke API token error: %v", err)
+		c.JSON(500, gin.H{"error": "failed to revoke API token"})
+		return
+	}
+	c.JSON(200, gin.H{"status": "revoked"})
+}
@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCIDRsAllow(t *testing.T) {
+	cases := []struct {
+		cidrs []string
+		ip    string
+		want  bool
+	}{
+		{nil, "203.0.113.9", true},
+		{[]string{"10.0.0.0/8"}, "10.1.2.3", true},
+		{[]string{"10.0.0.0/8"}, "192.168.1.1", false},
+		{[]string{"192.168.1.0/24", "2001:db8::/32"}, "2001:db8::1", true},
+		{[]string{"10.0.0.0/8"}, "not-an-ip", false},
+	}
+	for _, tc := range cases {
+		if got := cidrsAllow(tc.cidrs, tc.ip); got != tc.want {
+			t.Errorf("cidrsAllow(%v, %q) = %v, want %v", tc.cidrs, tc.ip, got, tc.want)
+		}
+	}
+
+	for in, want := range map[string]string{
+		"10.1.2.3/8":  "10.0.0.0/8",
+		"10.1.2.3":    "10.1.2.3/32",
+		"2001:db8::1": "2001:db8::1/128",
+	} {
+		if got, ok := normalizeCIDR(in); !ok || got != want {
+			t.Errorf("normalizeCIDR(%q) = %q, %v, want %q", in, got, ok, want)
+		}
+	}
+	if _, ok := normalizeCIDR("10.0.0.0/33"); ok {
+		t.Error("invalid prefix length accepted")
+	}
+}
+
+func TestCoveredBy(t *testing.T) {
+	limit := []string{"instances:*", PermJobsRead}
+	if !coveredBy(PermInstancesCreate, limit) || !coveredBy("instances:*", limit) {
+		t.Error("patterns inside the limit must be covered")
+	}
+	if coveredBy("*", limit) || coveredBy("*:read", limit) || coveredBy(PermNetworksManage, limit) {
+		t.Error("patterns beyond the limit must not be covered")
+	}
+}
+
+func TestGenerateAPIToken(t *testing.T) {
+	a, err := generateAPIToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := generateAPIToken()
+	if a == b || !strings.HasPrefix(a, APITokenPrefix) || len(a) != len(APITokenPrefix)+2*apiTokenBytes {
+		t.Errorf("unexpected tokens %q, %q", a, b)
+	}
+	if hashAPIToken(a) == hashAPIToken(b) || len(hashAPIToken(a)) != 64 {
+		t.Error("token hashes must be distinct SHA-256 hex digests")
+	}
+}
@@ -0,0 +1,338 @@
+package auth
+
+import (
+	"aexon/internal/db"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// AUDIT LOG
+// ============================================================================
+
+const (
+	maxAuditBody      = 16 << 10 // JSON bodies up to this size are summarised
+	maxAuditString    = 256
+	auditWriteTimeout = 5 * time.Second
+	auditRedacted     = "[redacted]"
+
+	defaultAuditPageSize = 100
+	maxAuditPageSize     = 1000
+)
+
+// Context keys of the explicit audit hooks.
+const (
+	auditActionKey  = "audit_action"
+	auditTargetKey  = "audit_target"
+	auditActorKey   = "audit_actor"
+	auditDetailsKey = "audit_details"
+)
+
+// AuditLog stores audit events. The default one appends to the database.
+type AuditLog interface {
+	Append(ctx context.Context, e *db.AuditEvent) error
+}
+
+type dbAuditLog struct{}
+
+func (dbAuditLog) Append(ctx context.Context, e *db.AuditEvent) error {
+	if db.GetService() == nil {
+		return errors.New("database unavailable")
+	}
+	return db.NewAuditRepository(db.GetService()).Append(ctx, e)
+}
+
+var auditLog AuditLog = dbAuditLog{}
+
+// SetAuditLog replaces the audit log and returns a function restoring the
+// previous one.
+func SetAuditLog(l AuditLog) func() {
+	prev := auditLog
+	auditLog = l
+	return func() { auditLog = prev }
+}
+
+// RecordAuditEvent appends an event raised outside of a request, such as a
+// background job or an automatic lockout. Failures are logged, never fatal.
+func RecordAuditEvent(ctx context.Context, e *db.AuditEvent) {
+	if e.Actor == "" {
+		e.Actor = "system"
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), auditWriteTimeout)
+	defer cancel()
+	if err := auditLog.Append(ctx, e); err != nil {
+		log.Printf("[Audit] Recording %s on %q failed: %v", e.Action, e.Target, err)
+	}
+}
+
+// AuditAction names the action of the request, overriding the route's, and
+// makes read-only requests that change state (a GET logging someone in)
+// recorded too.
+func AuditAction(c *gin.Context, action string) {
+	c.Set(auditActionKey, action)
+}
+
+// AuditTarget names the resource the request acted on when the path does
+// not, e.g. the instance a POST /instances created.
+func AuditTarget(c *gin.Context, target string) {
+	c.Set(auditTargetKey, target)
+}
+
+// AuditActor names the user of a request that is not authenticated yet,
+// e.g. the account a login attempt was for.
+func AuditActor(c *gin.Context, userID int, email string) {
+	c.Set(auditActorKey, auditActor{id: userID, email: email})
+}
+
+type auditActor struct {
+	id    int
+	email string
+}
+
+// AuditDetail adds a value to the request summary of the event.
+func AuditDetail(c *gin.Context, key string, value interface{}) {
+	details, _ := c.Get(auditDetailsKey)
+	m, ok := details.(map[string]interface{})
+	if !ok {
+		m = make(map[string]interface{})
+		c.Set(auditDetailsKey, m)
+	}
+	m[key] = value
+}
+
+func mutating(method string) bool {
+	switch method {
+	case "POST", "PUT", "PATCH", "DELETE":
+		return true
+	}
+	return false
+}
+
+// sensitiveField reports whether a body field must not reach the audit log.
+func sensitiveField(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range []string{"password", "secret", "token", "code", "key"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redact drops credentials and shortens long strings in a decoded body.
+func redact(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, inner := range v {
+			if sensitiveField(k) {
+				v[k] = auditRedacted
+			} else {
+				v[k] = redact(inner)
+			}
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = redact(v[i])
+		}
+		return v
+	case string:
+		if len(v) > maxAuditString {
+			return v[:maxAuditString] + "…"
+		}
+	}
+	return v
+}
+
+// readAuditBody decodes a small JSON body, leaving it in place for the
+// handler. Uploads and other bodies are left alone.
+func readAuditBody(c *gin.Context) interface{} {
+	req := c.Request
+	if req.Body == nil || req.ContentLength <= 0 || req.ContentLength > maxAuditBody ||
+		!strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		return nil
+	}
+	raw, err := io.ReadAll(io.LimitReader(req.Body, maxAuditBody))
+	req.Body = io.NopCloser(bytes.NewReader(raw))
+	if err != nil {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var body interface{}
+	if dec.Decode(&body) != nil {
+		return nil
+	}
+	return redact(body)
+}
+
+func auditOutcome(status int) string {
+	switch {
+	case status == 401 || status == 403:
+		return db.AuditDenied
+	case status >= 400:
+		return db.AuditFailure
+	}
+	return db.AuditSuccess
+}
+
+// AuditMiddleware records every mutating request, and those marked with
+// AuditAction, once the handler has answered. actions maps "METHOD route"
+// to the action recorded; handlers refine events with the Audit* hooks.
+func AuditMiddleware(actions map[string]string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body interface{}
+		if mutating(c.Request.Method) {
+			body = readAuditBody(c)
+		}
+		c.Next()
+
+		route := c.FullPath()
+		action := c.GetString(auditActionKey)
+		if action == "" && (!mutating(c.Request.Method) || route == "") {
+			return // Reads, and requests matching no route
+		}
+		if action == "" {
+			action = actions[c.Request.Method+" "+route]
+		}
+		if action == "" {
+			action = c.Request.Method + " " + route
+		}
+
+		e := &db.AuditEvent{
+			Actor:      "anonymous",
+			SourceIP:   c.ClientIP(),
+			Action:     action,
+			Target:     c.GetString(auditTargetKey),
+			Outcome:    auditOutcome(c.Writer.Status()),
+			StatusCode: c.Writer.Status(),
+		}
+		actor, _ := c.Get(auditActorKey)
+		if uid, err := strconv.Atoi(c.GetString("user_id")); err == nil {
+			e.ActorID, e.Actor = &uid, c.GetString("username")
+		} else if a, ok := actor.(auditActor); ok {
+			e.ActorID, e.Actor = &a.id, a.email
+		}
+		if pid := c.GetInt("project_id"); pid > 0 {
+			e.ProjectID = &pid
+		}
+		if e.Target == "" && len(c.Params) > 0 {
+			e.Target = strings.TrimPrefix(c.Request.URL.Path, "/api/v1")
+		}
+
+		summary := map[string]interface{}{"method": c.Request.Method, "path": c.Request.URL.Path}
+		if body != nil {
+			summary["body"] = body
+		}
+		if q := c.Request.URL.Query(); len(q) > 0 {
+			query := make(map[string]interface{}, len(q))
+			for k, v := range q {
+				query[k] = strings.Join(v, ",")
+				if sensitiveField(k) {
+					query[k] = auditRedacted
+				}
+			}
+			summary["query"] = query
+		}
+		if id := c.GetString("api_token_id"); id != "" {
+			summary["api_token_id"] = id
+		}
+		if details, ok := c.Get(auditDetailsKey); ok {
+			summary["details"] = details
+		}
+		if len(c.Errors) > 0 {
+			summary["errors"] = c.Errors.Errors()
+		}
+		if e.Request, _ = json.Marshal(summary); e.Request == nil {
+			e.Request = json.RawMessage("{}")
+		}
+
+		RecordAuditEvent(c.Request.Context(), e)
+	}
+}
+
+// ============================================================================
+// AUDIT HANDLERS
+// ============================================================================
+
+// ListAuditEventsHandler serves GET /audit, filtered by actor_id, action
+// ("instance.*" for a prefix), target, outcome, project_id and an RFC 3339
+// since/until range.
+func ListAuditEventsHandler(c *gin.Context) {
+	f := db.AuditFilter{
+		Action:  c.Query("action"),
+		Target:  c.Query("target"),
+		Outcome: c.Query("outcome"),
+		Limit:   defaultAuditPageSize,
+	}
+	var err error
+	ints := []struct {
+		name string
+		dst  *int
+	}{{"actor_id", &f.ActorID}, {"project_id", &f.ProjectID}, {"limit", &f.Limit}, {"offset", &f.Offset}}
+	for _, p := range ints {
+		if v := c.Query(p.name); v != "" {
+			if *p.dst, err = strconv.Atoi(v); err != nil || *p.dst < 0 {
+				c.JSON(400, gin.H{"error": "invalid " + p.name})
+				return
+			}
+		}
+	}
+	if f.Limit < 1 || f.Limit > maxAuditPageSize {
+		c.JSON(400, gin.H{"error": "limit must be between 1 and 1000"})
+		return
+	}
+	times := []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &f.Since}, {"until", &f.Until}}
+	for _, p := range times {
+		if v := c.Query(p.name); v != "" {
+			if *p.dst, err = time.Parse(time.RFC3339, v); err != nil {
+				c.JSON(400, gin.H{"error": "invalid " + p.name + ", want RFC 3339"})
+				return
+			}
+		}
+	}
+	switch f.Outcome {
+	case "", db.AuditSuccess, db.AuditFailure, db.AuditDenied:
+	default:
+		c.JSON(400, gin.H{"error": "outcome must be success, failure or denied"})
+		return
+	}
+
+	events, total, err := db.NewAuditRepository(db.GetService()).List(c.Request.Context(), f)
+	if err != nil {
+		log.Printf("[Audit] List events error: %v", err)
+		c.JSON(500, gin.H{"error": "failed to list audit events"})
+		return
+	}
+	if events == nil {
+		events = []db.AuditEvent{}
+	}
+	c.JSON(200, gin.H{"events": events, "total": total})
+}
+
+// VerifyAuditLogHandler recomputes the hash chain, reporting the first event
+// that was altered or whose predecessor was removed.
+func VerifyAuditLogHandler(c *gin.Context) {
+	result, err := db.NewAuditRepository(db.GetService()).Verify(c.Request.Context())
+	if err != nil {
+		log.Printf("[Audit] Verify error: %v", err)
+		c.JSON(500, gin.H{"error": "failed to verify audit log"})
+		return
+	}
+	if !result.Valid {
+		log.Printf("[Audit] Hash chain broken at event %d", *result.BrokenAt)
+	}
+	c.JSON(200, result)
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"aexon/internal/db"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+type recordingAuditLog struct {
+	events []*db.AuditEvent
+}
+
+func (l *recordingAuditLog) Append(ctx context.Context, e *db.AuditEvent) error {
+	l.events = append(l.events, e)
+	return nil
+}
+
+func TestAuditMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	rec := &recordingAuditLog{}
+	t.Cleanup(SetAuditLog(rec))
+
+	r := gin.New()
+	r.Use(AuditMiddleware(map[string]string{"POST /login": "auth.login"}))
+	r.POST("/login", func(c *gin.Context) {
+		var req struct{ Email, Password string }
+		if err := c.ShouldBindJSON(&req); err != nil || req.Password != "hunter22" {
+			t.Errorf("handler lost the body: %+v, %v", req, err)
+		}
+		AuditActor(c, 7, req.Email)
+		AuditTarget(c, req.Email)
+		c.JSON(401, gin.H{"error": "invalid credentials"})
+	})
+	r.DELETE("/instances/:name", func(c *gin.Context) {
+		c.Set("user_id", "3")
+		c.Set("username", "ops@example.com")
+		c.Set("project_id", 5)
+		AuditDetail(c, "force", true)
+		c.JSON(200, gin.H{"status": "deleted"})
+	})
+	r.GET("/instances", func(c *gin.Context) { c.JSON(200, gin.H{}) })
+
+	body := `{"email":"alice@example.com","password":"hunter22","nested":{"api_token":"x"}}`
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/instances/web?token=abc", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/instances", nil))
+
+	if len(rec.events) != 2 {
+		t.Fatalf("recorded %d events, want 2 (reads are not audited)", len(rec.events))
+	}
+
+	login := rec.events[0]
+	if login.Action != "auth.login" || login.Outcome != db.AuditDenied || login.StatusCode != 401 ||
+		login.ActorID == nil || *login.ActorID != 7 || login.Target != "alice@example.com" {
+		t.Errorf("login event = %+v", login)
+	}
+	if s := string(login.Request); strings.Contains(s, "hunter22") || strings.Contains(s, `"x"`) {
+		t.Errorf("credentials reached the audit log: %s", s)
+	}
+
+	del := rec.events[1]
+	if del.Action != "DELETE /instances/:name" || del.Outcome != db.AuditSuccess || del.Actor != "ops@example.com" ||
+		del.Target != "/instances/web" || del.ProjectID == nil || *del.ProjectID != 5 {
+		t.Errorf("delete event = %+v", del)
+	}
+	var summary struct {
+		Query   map[string]string      `json:"query"`
+		Details map[string]interface{} `json:"details"`
+	}
+	if err := json.Unmarshal(del.Request, &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Query["token"] != auditRedacted || summary.Details["force"] != true {
+		t.Errorf("delete summary = %s", del.Request)
+	}
+}
@@ -4,11 +4,13 @@ import (
 	"aexon/internal/db"
 	"context"
 	"crypto/rand"
+	"database/sql"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -36,6 +38,9 @@ const (
 	ErrCodeRateLimitExceeded
 	ErrCodeSecretNotConfigured
 	ErrCodeClaimsMissing
+	ErrCodeTokenReused
+	ErrCodeSourceNotAllowed
+	ErrCodeAccountInactive
 )
 
 type AuthError struct {
@@ -90,9 +95,16 @@ const (
 	defaultTokenDuration = 24 * time.Hour
 	refreshTokenDuration = 7 * 24 * time.Hour
 	maxLoginAttempts     = 5
+	maxAccountAttempts   = 10
+	maxMFAAttempts       = 5
 	rateLimitWindow      = 15 * time.Minute
+	lockoutDuration      = 15 * time.Minute
+	maxLockoutDuration   = 24 * time.Hour
+	maxAccountLockout    = 15 * time.Minute
 	bcryptCost           = 12
 	minPasswordLength    = 8
+	minSecretLength      = 32
+	defaultKeyRotation   = 30 * 24 * time.Hour
 	tokenIssuer          = "axion-control-plane"
 )
 
@@ -101,15 +113,28 @@ type Config struct {
 	TokenDuration     time.Duration
 	RefreshDuration   time.Duration
 	EnableRateLimit   bool
-	MaxLoginAttempts  int
+	MaxLoginAttempts  int // Failed attempts per client IP within RateLimitWindow
 	RateLimitWindow   time.Duration
 	RequireStrongPass bool
+	AllowRegistration bool        // Self-service sign-up through /register
+	OIDC              *OIDCConfig // Single sign-on; nil when disabled
+
+	SigningAlgorithm    string        // AlgHS256 (with SecretKey), AlgEdDSA or AlgRS256; empty means HS256
+	KeyRotationInterval time.Duration // Age at which asymmetric keys are replaced; 0 disables rotation
+
+	MaxAccountAttempts int           // Failed attempts per account within RateLimitWindow, from any IP; 0 disables
+	LockoutDuration    time.Duration // First lockout; each further one doubles, up to MaxLockoutDuration
+	MaxLockoutDuration time.Duration
+	MaxAccountLockout  time.Duration // Longest lockout of an account, which anyone knowing its email can cause; 0 means MaxLockoutDuration
+	MaxMFAAttempts     int           // Failed second-factor codes per user within RateLimitWindow; 0 disables
+	PersistRateLimit   bool          // Keep login throttles in Postgres, shared by instances and across restarts
+	TrustedProxies     []string      // Proxies (IPs or CIDRs) whose forwarding headers name the client; none by default
 }
 
 func DefaultConfig() *Config {
 	secret := getSecret()
-	if len(secret) < 32 {
-		log.Printf("[SECURITY WARNING] JWT secret is weak (length: %d). Use at least 32 characters in production!", len(secret))
+	if secret != "" && len(secret) < minSecretLength {
+		log.Printf("[SECURITY WARNING] JWT secret is weak (length: %d). Use at least %d characters in production!", len(secret), minSecretLength)
 	}
 
 	return &Config{
@@ -120,16 +145,26 @@ func DefaultConfig() *Config {
 		MaxLoginAttempts:  maxLoginAttempts,
 		RateLimitWindow:   rateLimitWindow,
 		RequireStrongPass: getEnv("REQUIRE_STRONG_PASSWORD", "true") == "true",
+		AllowRegistration: getEnv("ALLOW_REGISTRATION", "false") == "true",
+		OIDC:              OIDCConfigFromEnv(),
+
+		SigningAlgorithm:    getEnv("JWT_SIGNING_ALG", AlgEdDSA),
+		KeyRotationInterval: getEnvDuration("JWT_KEY_ROTATION", defaultKeyRotation),
+
+		MaxAccountAttempts: maxAccountAttempts,
+		LockoutDuration:    lockoutDuration,
+		MaxLockoutDuration: maxLockoutDuration,
+		MaxAccountLockout:  maxAccountLockout,
+		MaxMFAAttempts:     maxMFAAttempts,
+		PersistRateLimit:   getEnv("RATE_LIMIT_STORE", "memory") == "postgres",
+		TrustedProxies:     getEnvList("TRUSTED_PROXIES"),
 	}
 }
 
+// getSecret returns JWT_SECRET. Without it a random key is generated on
+// first start and kept in the database (see loadSigningKey).
 func getSecret() string {
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		log.Println("[SECURITY WARNING] JWT_SECRET not set! Using insecure fallback. Set JWT_SECRET environment variable in production!")
-		return "axion-insecure-secret-key-change-me"
-	}
-	return secret
+	return os.Getenv("JWT_SECRET")
 }
 
 func getEnv(key, fallback string) string {
@@ -139,6 +174,30 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
+// getEnvList splits a comma-separated variable, dropping empty items.
+func getEnvList(key string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("[Auth] Invalid %s %q, using %v", key, value, fallback)
+		return fallback
+	}
+	return d
+}
+
 // ============================================================================
 // METRICS
 // ============================================================================
@@ -150,6 +209,7 @@ type AuthMetrics struct {
 	tokenValidations  atomic.Uint64
 	tokenRejections   atomic.Uint64
 	rateLimitHits     atomic.Uint64
+	lockouts          atomic.Uint64
 	tokensRevoked     atomic.Uint64
 	refreshTokensUsed atomic.Uint64
 }
@@ -164,6 +224,7 @@ func (m *AuthMetrics) Snapshot() map[string]interface{} {
 		"token_validations":   m.tokenValidations.Load(),
 		"token_rejections":    m.tokenRejections.Load(),
 		"rate_limit_hits":     m.rateLimitHits.Load(),
+		"lockouts":            m.lockouts.Load(),
 		"tokens_revoked":      m.tokensRevoked.Load(),
 		"refresh_tokens_used": m.refreshTokensUsed.Load(),
 	}
@@ -189,23 +250,27 @@ func (c *AxionClaims) Validate() error {
 	if c.Role == "" {
 		return NewAuthError(ErrCodeClaimsMissing, "role missing", nil)
 	}
-	if c.TokenType != "access" && c.TokenType != "refresh" {
+	if c.TokenType != "access" && c.TokenType != "refresh" && c.TokenType != "mfa" {
 		return NewAuthError(ErrCodeTokenInvalid, "invalid token type", nil)
 	}
 	return nil
 }
 
 // ============================================================================
-// TOKEN REVOCATION (IN-MEMORY)
+// TOKEN REVOCATION
 // ============================================================================
 
+// TokenRevocationStore caches the revocations persisted in the database so
+// that validating a token needs no query. It is loaded at startup.
 type TokenRevocationStore struct {
-	revoked map[string]time.Time // token_id -> expiration
-	mu      sync.RWMutex
+	revoked  map[string]time.Time // token_id -> expiration
+	sessions map[string]time.Time // user_id -> tokens issued up to here are revoked
+	mu       sync.RWMutex
 }
 
 var revokedTokens = &TokenRevocationStore{
-	revoked: make(map[string]time.Time),
+	revoked:  make(map[string]time.Time),
+	sessions: make(map[string]time.Time),
 }
 
 func (s *TokenRevocationStore) Revoke(tokenID string, expiresAt time.Time) {
@@ -234,6 +299,26 @@ func (s *TokenRevocationStore) IsRevoked(tokenID string) bool {
 	return true
 }
 
+// RevokeSessions rejects every token of the user issued up to at.
+func (s *TokenRevocationStore) RevokeSessions(userID string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[userID] = at
+}
+
+// SessionRevoked reports whether the token was issued before its user
+// logged out of all sessions.
+func (s *TokenRevocationStore) SessionRevoked(claims *AxionClaims) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cutoff, exists := s.sessions[claims.UserID]
+	if !exists || claims.IssuedAt == nil {
+		return exists
+	}
+	// iat only has second precision: a token from the cutoff's second is rejected
+	return !claims.IssuedAt.Time.After(cutoff)
+}
+
 func (s *TokenRevocationStore) Cleanup() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -244,6 +329,12 @@ func (s *TokenRevocationStore) Cleanup() {
 			delete(s.revoked, tokenID)
 		}
 	}
+	// Past the longest token lifetime a cutoff no longer matches anything
+	for userID, at := range s.sessions {
+		if now.Sub(at) > refreshTokenDuration {
+			delete(s.sessions, userID)
+		}
+	}
 }
 
 // Periodic cleanup
@@ -255,98 +346,9 @@ func StartRevocationCleanup(ctx context.Context) {
 		select {
 		case <-ticker.C:
 			revokedTokens.Cleanup()
-		case <-ctx.Done():
-			return
-		}
-	}
-}
-
-// ============================================================================
-// RATE LIMITING
-// ============================================================================
-
-type RateLimiter struct {
-	attempts map[string][]time.Time // IP -> timestamps
-	mu       sync.RWMutex
-	config   *Config
-}
-
-var rateLimiter = &RateLimiter{
-	attempts: make(map[string][]time.Time),
-}
-
-func (r *RateLimiter) SetConfig(cfg *Config) {
-	r.config = cfg
-}
-
-func (r *RateLimiter) CheckLimit(ip string) bool {
-	if r.config == nil || !r.config.EnableRateLimit {
-		return true
-	}
-
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	now := time.Now()
-	cutoff := now.Add(-r.config.RateLimitWindow)
-
-	// Clean old attempts
-	if attempts, exists := r.attempts[ip]; exists {
-		valid := []time.Time{}
-		for _, t := range attempts {
-			if t.After(cutoff) {
-				valid = append(valid, t)
-			}
-		}
-		r.attempts[ip] = valid
-
-		if len(valid) >= r.config.MaxLoginAttempts {
-			globalAuthMetrics.rateLimitHits.Add(1)
-			return false
-		}
-	}
-
-	// Record attempt
-	r.attempts[ip] = append(r.attempts[ip], now)
-	return true
-}
-
-func (r *RateLimiter) Reset(ip string) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	delete(r.attempts, ip)
-}
-
-func (r *RateLimiter) Cleanup() {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	now := time.Now()
-	cutoff := now.Add(-r.config.RateLimitWindow)
-
-	for ip, attempts := range r.attempts {
-		valid := []time.Time{}
-		for _, t := range attempts {
-			if t.After(cutoff) {
-				valid = append(valid, t)
+			if err := GetAuthService().tokens.PurgeExpired(ctx); err != nil {
+				log.Printf("[Auth] Purging expired tokens failed: %v", err)
 			}
-		}
-		if len(valid) > 0 {
-			r.attempts[ip] = valid
-		} else {
-			delete(r.attempts, ip)
-		}
-	}
-}
-
-func StartRateLimitCleanup(ctx context.Context) {
-	ticker := time.NewTicker(10 * time.Minute)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			rateLimiter.Cleanup()
 		case <-ctx.Done():
 			return
 		}
@@ -360,6 +362,20 @@ func StartRateLimitCleanup(ctx context.Context) {
 type AuthService struct {
 	config *Config
 	repo   *db.UserRepository
+	tokens *db.TokenRepository
+
+	apiTokens  *db.APITokenRepository
+	mfa        *db.MFARepository
+	identities *db.IdentityRepository
+	projects   *db.ProjectRepository
+	secrets    *db.SecretRepository
+
+	signingKeys *db.SigningKeyRepository
+	keys        keyring
+
+	setup setupState
+
+	oidc *oidcProvider // nil when SSO is disabled
 }
 
 var globalAuthService *AuthService
@@ -373,11 +389,25 @@ func InitAuthService(cfg *Config) *AuthService {
 		globalAuthService = &AuthService{
 			config: cfg,
 			repo:   db.NewUserRepository(db.GetService()),
+			tokens: db.NewTokenRepository(db.GetService()),
+
+			apiTokens: db.NewAPITokenRepository(db.GetService()),
+			mfa:       db.NewMFARepository(db.GetService()),
+
+			identities: db.NewIdentityRepository(db.GetService()),
+			projects:   db.NewProjectRepository(db.GetService()),
+			secrets:    db.NewSecretRepository(db.GetService()),
+
+			signingKeys: db.NewSigningKeyRepository(db.GetService()),
+		}
+		if cfg.OIDC != nil {
+			globalAuthService.oidc = newOIDCProvider(cfg.OIDC)
+			log.Printf("[Auth] Single sign-on enabled (issuer=%s)", cfg.OIDC.Issuer)
 		}
 		rateLimiter.SetConfig(cfg)
 
-		log.Printf("[Auth] Service initialized (token_duration=%v, rate_limit=%v)",
-			cfg.TokenDuration, cfg.EnableRateLimit)
+		log.Printf("[Auth] Service initialized (token_duration=%v, rate_limit=%v, persistent=%v)",
+			cfg.TokenDuration, cfg.EnableRateLimit, cfg.PersistRateLimit)
 	})
 	return globalAuthService
 }
@@ -408,12 +438,24 @@ func (s *AuthService) GenerateAccessToken(userID, username, role string, permiss
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(s.config.SecretKey)
+	return s.sign(claims)
 }
 
-func (s *AuthService) GenerateRefreshToken(userID, username string) (string, error) {
+// GenerateRefreshToken issues the first refresh token of a new family.
+func (s *AuthService) GenerateRefreshToken(ctx context.Context, userID int, username string) (string, error) {
 	tokenID := generateTokenID()
+	token, expiresAt, err := s.signRefreshToken(tokenID, strconv.Itoa(userID), username)
+	if err != nil {
+		return "", err
+	}
+	if err := s.tokens.CreateRefreshToken(ctx, tokenID, generateTokenID(), userID, expiresAt); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (s *AuthService) signRefreshToken(tokenID, userID, username string) (string, time.Time, error) {
+	expiresAt := time.Now().Add(s.config.RefreshDuration)
 
 	claims := AxionClaims{
 		UserID:    userID,
@@ -422,7 +464,7 @@ func (s *AuthService) GenerateRefreshToken(userID, username string) (string, err
 		TokenType: "refresh",
 		RegisteredClaims: jwt.RegisteredClaims{
 			ID:        tokenID,
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(s.config.RefreshDuration)),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			NotBefore: jwt.NewNumericDate(time.Now()),
 			Issuer:    tokenIssuer,
@@ -430,20 +472,14 @@ func (s *AuthService) GenerateRefreshToken(userID, username string) (string, err
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(s.config.SecretKey)
+	signed, err := s.sign(claims)
+	return signed, expiresAt, err
 }
 
 func (s *AuthService) ValidateToken(tokenString string) (*AxionClaims, error) {
 	globalAuthMetrics.tokenValidations.Add(1)
 
-	token, err := jwt.ParseWithClaims(tokenString, &AxionClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, NewAuthError(ErrCodeInvalidSigningMethod,
-				fmt.Sprintf("unexpected signing method: %v", token.Header["alg"]), nil)
-		}
-		return s.config.SecretKey, nil
-	})
+	token, err := jwt.ParseWithClaims(tokenString, &AxionClaims{}, s.verificationKey)
 
 	if err != nil {
 		globalAuthMetrics.tokenRejections.Add(1)
@@ -466,7 +502,7 @@ func (s *AuthService) ValidateToken(tokenString string) (*AxionClaims, error) {
 	}
 
 	// Check if token is revoked
-	if revokedTokens.IsRevoked(claims.ID) {
+	if revokedTokens.IsRevoked(claims.ID) || revokedTokens.SessionRevoked(claims) {
 		globalAuthMetrics.tokenRejections.Add(1)
 		return nil, NewAuthError(ErrCodeTokenRevoked, "token has been revoked", nil)
 	}
@@ -474,30 +510,109 @@ func (s *AuthService) ValidateToken(tokenString string) (*AxionClaims, error) {
 	return claims, nil
 }
 
-func (s *AuthService) RevokeToken(tokenString string) error {
+// RevokeToken revokes an access token, or the whole family of a refresh
+// token.
+func (s *AuthService) RevokeToken(ctx context.Context, tokenString string) error {
 	claims, err := s.ValidateToken(tokenString)
 	if err != nil {
 		return err
 	}
 
+	if claims.TokenType == "refresh" {
+		if err := s.tokens.RevokeFamily(ctx, claims.ID); err != nil {
+			return err
+		}
+	}
+	if err := s.tokens.Revoke(ctx, claims.ID, claims.ExpiresAt.Time); err != nil {
+		return err
+	}
 	revokedTokens.Revoke(claims.ID, claims.ExpiresAt.Time)
 	return nil
 }
 
-func (s *AuthService) RefreshAccessToken(refreshTokenString string) (string, error) {
+// RevokeSessions logs the user out everywhere: every token issued so far is
+// rejected.
+func (s *AuthService) RevokeSessions(ctx context.Context, userID int) error {
+	at, err := s.tokens.RevokeSessions(ctx, userID)
+	if err != nil {
+		return err
+	}
+	revokedTokens.RevokeSessions(strconv.Itoa(userID), at)
+	globalAuthMetrics.tokensRevoked.Add(1)
+	return nil
+}
+
+// RefreshTokens exchanges a refresh token for a new access token and a new
+// refresh token of the same family. Replaying a refresh token that was
+// already exchanged revokes its family.
+func (s *AuthService) RefreshTokens(ctx context.Context, refreshTokenString string) (access, refresh string, err error) {
 	claims, err := s.ValidateToken(refreshTokenString)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	if claims.TokenType != "refresh" {
-		return "", NewAuthError(ErrCodeTokenInvalid, "not a refresh token", nil)
+		return "", "", NewAuthError(ErrCodeTokenInvalid, "not a refresh token", nil)
+	}
+
+	next := generateTokenID()
+	refresh, expiresAt, err := s.signRefreshToken(next, claims.UserID, claims.Username)
+	if err != nil {
+		return "", "", err
+	}
+
+	uid, err := s.tokens.RotateRefreshToken(ctx, claims.ID, next, expiresAt)
+	switch {
+	case errors.Is(err, db.ErrRefreshTokenReused):
+		log.Printf("[Auth] Refresh token reuse for user %d, session family revoked", uid)
+		return "", "", NewAuthError(ErrCodeTokenReused, "refresh token reuse detected", nil)
+	case errors.Is(err, db.ErrRefreshTokenInvalid):
+		return "", "", NewAuthError(ErrCodeTokenRevoked, "token has been revoked", nil)
+	case err != nil:
+		return "", "", err
 	}
 
 	globalAuthMetrics.refreshTokensUsed.Add(1)
 
-	// Generate new access token
-	return s.GenerateAccessToken(claims.UserID, claims.Username, "admin", nil)
+	// The role is read again so that demotions apply at the next refresh
+	user, err := s.repo.GetByID(ctx, uid)
+	if err != nil {
+		return "", "", err
+	}
+	if user == nil {
+		return "", "", ErrTokenInvalid(errors.New("user no longer exists"))
+	}
+	if user.Status != db.UserStatusActive {
+		return "", "", NewAuthError(ErrCodeAccountInactive, "account is "+user.Status, nil)
+	}
+
+	access, err = s.GenerateAccessToken(claims.UserID, user.Email, user.Role, nil)
+	if err != nil {
+		return "", "", err
+	}
+	return access, refresh, nil
+}
+
+// loadRevocations fills the in-memory store from the database.
+func (s *AuthService) loadRevocations(ctx context.Context) error {
+	revoked, err := s.tokens.Revoked(ctx)
+	if err != nil {
+		return err
+	}
+	cutoffs, err := s.tokens.SessionCutoffs(ctx)
+	if err != nil {
+		return err
+	}
+
+	revokedTokens.mu.Lock()
+	defer revokedTokens.mu.Unlock()
+	for jti, expiresAt := range revoked {
+		revokedTokens.revoked[jti] = expiresAt
+	}
+	for uid, at := range cutoffs {
+		revokedTokens.sessions[strconv.Itoa(uid)] = at
+	}
+	return nil
 }
 
 // ============================================================================
@@ -584,7 +699,16 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		claims, err := service.ValidateToken(tokenString)
+		var claims *AxionClaims
+		var err error
+		if strings.HasPrefix(tokenString, APITokenPrefix) {
+			claims, err = service.ValidateAPIToken(c, tokenString)
+		} else {
+			claims, err = service.ValidateToken(tokenString)
+			if err == nil && claims.TokenType != "access" {
+				err = NewAuthError(ErrCodeTokenInvalid, "not an access token", nil)
+			}
+		}
 		if err != nil {
 			authErr, ok := err.(*AuthError)
 			if ok {
@@ -605,85 +729,96 @@ func AuthMiddleware() gin.HandlerFunc {
 		c.Set("user_id", claims.UserID)
 		c.Set("username", claims.Username)
 		c.Set("role", claims.Role)
-		c.Set("permissions", claims.Permissions)
-
-		c.Next()
-	}
-}
+		c.Set("token_permissions", claims.Permissions)
 
-func RequireRole(allowedRoles ...string) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		role, exists := c.Get("role")
-		if !exists {
-			c.AbortWithStatusJSON(403, gin.H{"error": "role not found"})
+		// Scope every repository call of this request to the caller's project
+		uid, _ := strconv.Atoi(claims.UserID)
+		scope, err := resolveScope(c, uid, claims.Role == "admin")
+		if err != nil {
+			if errors.Is(err, errProjectAccess) {
+				c.AbortWithStatusJSON(403, gin.H{"error": err.Error()})
+			} else {
+				log.Printf("[Auth] Project lookup failed: %v", err)
+				c.AbortWithStatusJSON(500, gin.H{"error": "internal error"})
+			}
 			return
 		}
-
-		roleStr := role.(string)
-		for _, allowed := range allowedRoles {
-			if roleStr == allowed {
-				c.Next()
-				return
-			}
+		if err := setScope(c, scope); err != nil {
+			log.Printf("[Auth] Permission lookup failed: %v", err)
+			c.AbortWithStatusJSON(500, gin.H{"error": "internal error"})
+			return
 		}
 
-		c.AbortWithStatusJSON(403, gin.H{"error": "insufficient permissions"})
+		c.Next()
 	}
 }
 
-func RequirePermission(permission string) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		perms, exists := c.Get("permissions")
-		if !exists {
-			c.AbortWithStatusJSON(403, gin.H{"error": "permissions not found"})
-			return
-		}
-
-		permissions := perms.([]string)
-		for _, p := range permissions {
-			if p == permission {
-				c.Next()
-				return
-			}
-		}
+// ProjectHeader selects the project a request acts in. WebSocket clients,
+// which cannot set headers, use the "project" query parameter instead.
+const ProjectHeader = "X-Project-ID"
 
-		c.AbortWithStatusJSON(403, gin.H{"error": "permission denied"})
-	}
-}
+var errProjectAccess = errors.New("not a member of the requested project")
 
-// ============================================================================
-// DB SEEDING
-// ============================================================================
+// resolveScope picks the project of the request (explicitly requested or
+// the user's default one) and the caller's role in it. Platform admins may
+// act in any project.
+func resolveScope(c *gin.Context, uid int, admin bool) (db.Scope, error) {
+	scope := db.Scope{UserID: uid, Admin: admin}
+	ctx := c.Request.Context()
 
-func (s *AuthService) SeedAdmin(ctx context.Context) error {
-	count, err := s.repo.Count(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to check user count: %w", err)
+	requested := c.GetHeader(ProjectHeader)
+	if requested == "" {
+		requested = c.Query("project")
 	}
-
-	if count > 0 {
-		return nil // Already initialized
+	if requested == "" {
+		pid, role, err := directory.DefaultProject(ctx, uid)
+		if err == sql.ErrNoRows {
+			return scope, nil // Member of nothing: only admins see anything
+		}
+		scope.ProjectID, scope.Role = pid, role
+		return scope, err
 	}
 
-	log.Println("[Auth] Seeding default admin user...")
-
-	hash, err := HashPassword("admin")
+	pid, err := strconv.Atoi(requested)
 	if err != nil {
-		return err
+		return scope, errProjectAccess
 	}
-
-	admin := &db.User{
-		Email:        "admin@admin",
-		PasswordHash: hash,
-		Role:         "admin",
+	role, err := directory.ProjectRole(ctx, pid, uid)
+	switch {
+	case err == sql.ErrNoRows && admin:
+		role = db.ProjectRoleOwner
+	case err == sql.ErrNoRows:
+		return scope, errProjectAccess
+	case err != nil:
+		return scope, err
 	}
+	scope.ProjectID, scope.Role = pid, role
+	return scope, nil
+}
 
-	if err := s.repo.Create(ctx, admin); err != nil {
-		return fmt.Errorf("failed to create admin: %w", err)
+// Allowed reports whether the caller's roles, and its token's permission
+// list if any, grant permission; for handlers whose answer depends on it.
+func Allowed(c *gin.Context, permission string) bool {
+	if limit := c.GetStringSlice("token_permissions"); len(limit) > 0 && !HasPermission(limit, permission) {
+		return false
 	}
+	return HasPermission(c.GetStringSlice("permissions"), permission)
+}
 
-	log.Println("[Auth] Default admin created: admin@admin / admin")
-	return nil
+// RequirePermission rejects callers whose roles do not grant permission.
+// Tokens carrying a permission list (scoped tokens) are further limited to
+// that list.
+func RequirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !Allowed(c, permission) {
+			c.AbortWithStatusJSON(403, gin.H{
+				"error":    "permission denied",
+				"required": permission,
+			})
+			return
+		}
+		c.Next()
+	}
 }
 
 // ============================================================================
@@ -694,18 +829,6 @@ func LoginHandler(c *gin.Context) {
 	service := GetAuthService()
 	globalAuthMetrics.loginAttempts.Add(1)
 
-	// Rate limiting
-	clientIP := c.ClientIP()
-	if !rateLimiter.CheckLimit(clientIP) {
-		globalAuthMetrics.loginFailures.Add(1)
-		c.JSON(429, gin.H{
-			"error":       "too many login attempts",
-			"code":        ErrCodeRateLimitExceeded,
-			"retry_after": int(rateLimitWindow.Seconds()),
-		})
-		return
-	}
-
 	var req struct {
 		Email    string `json:"email"`
 		Username string `json:"username"`
@@ -726,6 +849,13 @@ func LoginHandler(c *gin.Context) {
 	// If user sends "admin" (not email format), we might want to allow "admin" -> "admin@admin"?
 	// The prompt specified "admin@admin".
 
+	// Rate limiting by client IP; the account's lockout is checked once the
+	// password is known
+	if throttled(c, "") {
+		globalAuthMetrics.loginFailures.Add(1)
+		return
+	}
+
 	// DB Lookup
 	user, err := service.repo.GetByEmail(c.Request.Context(), email)
 	if err != nil {
@@ -735,16 +865,35 @@ func LoginHandler(c *gin.Context) {
 	}
 
 	// Constant time comparison happens inside bcrypt mostly, but here we just check validity
+	AuditTarget(c, email)
 	valid := false
 	if user != nil {
+		AuditActor(c, user.ID, user.Email)
 		valid = CheckPasswordHash(req.Password, user.PasswordHash)
 	} else {
 		// Fake comparison to mitigate timing attacks
 		CheckPasswordHash("dummy", "$2a$12$EixZaYVK1fsbw1ZfbX3OXePaWrn96pzwPenWzJ41pgard.dnD.U1q")
 	}
 
+	ctx := c.Request.Context()
+	var mfa *db.MFAState
+	if valid {
+		if mfa, err = service.mfa.Get(ctx, user.ID); err != nil {
+			log.Printf("[Auth] 2FA state lookup error: %v", err)
+			c.JSON(500, gin.H{"error": "internal error"})
+			return
+		}
+	}
+	// With 2FA, the right password only leads to the code, which has its
+	// own throttle, so a locked-out account does not lock out its owner
+	if (mfa == nil || !mfa.Enabled) && throttled(c, email) {
+		globalAuthMetrics.loginFailures.Add(1)
+		return
+	}
+
 	if !valid {
 		globalAuthMetrics.loginFailures.Add(1)
+		rateLimiter.Fail(c.Request.Context(), c.ClientIP(), email)
 		c.JSON(401, gin.H{
 			"error": "invalid credentials",
 			"code":  ErrCodeInvalidCredentials,
@@ -752,31 +901,135 @@ func LoginHandler(c *gin.Context) {
 		return
 	}
 
-	// Success - reset rate limiter
-	rateLimiter.Reset(clientIP)
-	globalAuthMetrics.loginSuccesses.Add(1)
+	// Success - reset the account's throttle
+	rateLimiter.Reset(c.Request.Context(), email)
+
+	if !checkActive(c, user) {
+		return
+	}
 
-	// Generate tokens
-	// UserID is now user.ID (int), converts to string
 	uidStr := fmt.Sprintf("%d", user.ID)
 
-	accessToken, err := service.GenerateAccessToken(uidStr, user.Email, user.Role, []string{"*"})
+	if mfa.Enabled {
+		challenge, err := service.generateChallengeToken(uidStr, user.Email)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "failed to generate token"})
+			return
+		}
+		c.JSON(200, gin.H{
+			"mfa_required":    true,
+			"challenge_token": challenge,
+			"expires_in":      int(mfaChallengeDuration.Seconds()),
+		})
+		return
+	}
+
+	required, err := service.mfaRequired(ctx, user.Role)
+	if err != nil {
+		log.Printf("[Auth] 2FA policy lookup error: %v", err)
+		c.JSON(500, gin.H{"error": "internal error"})
+		return
+	}
+	if required {
+		// Only good for enrolling; a full session needs a new login with 2FA
+		accessToken, err := service.GenerateAccessToken(uidStr, user.Email, user.Role, []string{PermMFAManage})
+		if err != nil {
+			c.JSON(500, gin.H{"error": "failed to generate token"})
+			return
+		}
+		c.JSON(200, gin.H{
+			"mfa_enrollment_required": true,
+			"access_token":            accessToken,
+			"token_type":              "Bearer",
+			"expires_in":              int(service.config.TokenDuration.Seconds()),
+		})
+		return
+	}
+
+	service.completeLogin(c, user)
+}
+
+// checkActive rejects logins of disabled and locked accounts.
+func checkActive(c *gin.Context, user *db.User) bool {
+	if user.Status == db.UserStatusActive {
+		return true
+	}
+	globalAuthMetrics.loginFailures.Add(1)
+	c.JSON(403, gin.H{
+		"error": "account is " + user.Status,
+		"code":  ErrCodeAccountInactive,
+	})
+	return false
+}
+
+// completeLogin issues a session once every factor was checked, or a token
+// only good for changing the password when an administrator demanded that.
+func (s *AuthService) completeLogin(c *gin.Context, user *db.User) {
+	if !checkActive(c, user) {
+		return
+	}
+	if !user.PasswordResetRequired {
+		s.issueSession(c, user)
+		return
+	}
+
+	accessToken, err := s.GenerateAccessToken(strconv.Itoa(user.ID), user.Email, user.Role, []string{PermPasswordChange})
 	if err != nil {
 		c.JSON(500, gin.H{"error": "failed to generate token"})
 		return
 	}
+	c.JSON(200, gin.H{
+		"password_change_required": true,
+		"access_token":             accessToken,
+		"token_type":               "Bearer",
+		"expires_in":               int(s.config.TokenDuration.Seconds()),
+	})
+}
+
+// session is the pair of tokens a completed login yields.
+type session struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresIn    int // Seconds
+}
+
+func (s *AuthService) newSession(ctx context.Context, user *db.User) (*session, error) {
+	globalAuthMetrics.loginSuccesses.Add(1)
+
+	// UserID is now user.ID (int), converts to string
+	uidStr := fmt.Sprintf("%d", user.ID)
+
+	accessToken, err := s.GenerateAccessToken(uidStr, user.Email, user.Role, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := s.GenerateRefreshToken(ctx, user.ID, user.Email)
+	if err != nil {
+		return nil, fmt.Errorf("refresh token: %w", err)
+	}
 
-	refreshToken, err := service.GenerateRefreshToken(uidStr, user.Email)
+	return &session{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(s.config.TokenDuration.Seconds()),
+	}, nil
+}
+
+// issueSession completes a login with an access and a refresh token.
+func (s *AuthService) issueSession(c *gin.Context, user *db.User) {
+	sess, err := s.newSession(c.Request.Context(), user)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "failed to generate refresh token"})
+		log.Printf("[Auth] Session error: %v", err)
+		c.JSON(500, gin.H{"error": "failed to generate token"})
 		return
 	}
 
 	c.JSON(200, gin.H{
-		"access_token":  accessToken,
-		"refresh_token": refreshToken,
+		"access_token":  sess.AccessToken,
+		"refresh_token": sess.RefreshToken,
 		"token_type":    "Bearer",
-		"expires_in":    int(service.config.TokenDuration.Seconds()),
+		"expires_in":    sess.ExpiresIn,
 		"user": gin.H{
 			"id":    user.ID,
 			"email": user.Email,
@@ -788,6 +1041,11 @@ func LoginHandler(c *gin.Context) {
 func RegisterHandler(c *gin.Context) {
 	service := GetAuthService()
 
+	if !service.config.AllowRegistration {
+		c.JSON(403, gin.H{"error": "registration is disabled"})
+		return
+	}
+
 	var req struct {
 		Email    string `json:"email" binding:"required"`
 		Password string `json:"password" binding:"required"`
@@ -835,6 +1093,8 @@ func RegisterHandler(c *gin.Context) {
 		c.JSON(500, gin.H{"error": "failed to create user"})
 		return
 	}
+	AuditActor(c, newUser.ID, newUser.Email)
+	AuditTarget(c, "/users/"+strconv.Itoa(newUser.ID))
 
 	c.JSON(201, gin.H{
 		"status": "created",
@@ -855,7 +1115,7 @@ func RefreshTokenHandler(c *gin.Context) {
 		return
 	}
 
-	newAccessToken, err := service.RefreshAccessToken(req.RefreshToken)
+	newAccessToken, newRefreshToken, err := service.RefreshTokens(c.Request.Context(), req.RefreshToken)
 	if err != nil {
 		authErr, ok := err.(*AuthError)
 		if ok {
@@ -864,15 +1124,17 @@ func RefreshTokenHandler(c *gin.Context) {
 				"code":  authErr.Code,
 			})
 		} else {
+			log.Printf("[Auth] Refresh error: %v", err)
 			c.JSON(401, gin.H{"error": "invalid refresh token"})
 		}
 		return
 	}
 
 	c.JSON(200, gin.H{
-		"access_token": newAccessToken,
-		"token_type":   "Bearer",
-		"expires_in":   int(service.config.TokenDuration.Seconds()),
+		"access_token":  newAccessToken,
+		"refresh_token": newRefreshToken,
+		"token_type":    "Bearer",
+		"expires_in":    int(service.config.TokenDuration.Seconds()),
 	})
 }
 
@@ -888,7 +1150,7 @@ func RevokeTokenHandler(c *gin.Context) {
 		return
 	}
 
-	if err := service.RevokeToken(req.Token); err != nil {
+	if err := service.RevokeToken(c.Request.Context(), req.Token); err != nil {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
@@ -896,6 +1158,23 @@ func RevokeTokenHandler(c *gin.Context) {
 	c.JSON(200, gin.H{"status": "token revoked"})
 }
 
+// LogoutAllHandler revokes every access and refresh token of the caller.
+func LogoutAllHandler(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	if err := GetAuthService().RevokeSessions(c.Request.Context(), uid); err != nil {
+		log.Printf("[Auth] Revoke sessions error: %v", err)
+		c.JSON(500, gin.H{"error": "failed to revoke sessions"})
+		return
+	}
+
+	log.Printf("[Auth] All sessions of user %d revoked", uid)
+	c.JSON(200, gin.H{"status": "all sessions revoked"})
+}
+
 func GetAuthMetricsHandler(c *gin.Context) {
 	c.JSON(200, globalAuthMetrics.Snapshot())
 }
@@ -904,14 +1183,32 @@ func GetAuthMetricsHandler(c *gin.Context) {
 // INITIALIZATION & SHUTDOWN
 // ============================================================================
 
-func Init(cfg *Config) {
+func Init(cfg *Config) error {
 	service := InitAuthService(cfg)
-	log.Printf("[Auth] Initialized with token duration: %v", service.config.TokenDuration)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if len(service.config.SecretKey) == 0 {
+		if err := service.loadSigningKey(ctx); err != nil {
+			return fmt.Errorf("loading JWT signing key: %w", err)
+		}
+	}
+	if err := service.initSigningKeys(ctx); err != nil {
+		return fmt.Errorf("loading JWT signing key pairs: %w", err)
+	}
+	if err := service.loadRevocations(ctx); err != nil {
+		log.Printf("[Auth] Loading token revocations failed: %v", err)
+	}
+
+	log.Printf("[Auth] Initialized with token duration: %v, signing algorithm: %s",
+		service.config.TokenDuration, service.config.SigningAlgorithm)
+	return nil
 }
 
 func StartBackgroundServices(ctx context.Context) {
 	go StartRevocationCleanup(ctx)
 	go StartRateLimitCleanup(ctx)
+	go StartKeyRotation(ctx)
 	log.Println("[Auth] Background services started")
 }
 
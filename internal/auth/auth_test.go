@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestSessionRevoked(t *testing.T) {
+	store := &TokenRevocationStore{
+		revoked:  make(map[string]time.Time),
+		sessions: make(map[string]time.Time),
+	}
+	cutoff := time.Now().Truncate(time.Second).Add(500 * time.Millisecond)
+	store.RevokeSessions("1", cutoff)
+
+	issued := func(uid string, at time.Time) *AxionClaims {
+		return &AxionClaims{UserID: uid, RegisteredClaims: jwt.RegisteredClaims{IssuedAt: jwt.NewNumericDate(at)}}
+	}
+	cases := []struct {
+		name   string
+		claims *AxionClaims
+		want   bool
+	}{
+		{"before cutoff", issued("1", cutoff.Add(-time.Hour)), true},
+		{"same second", issued("1", cutoff), true},
+		{"after cutoff", issued("1", cutoff.Add(time.Second)), false},
+		{"other user", issued("2", cutoff.Add(-time.Hour)), false},
+	}
+	for _, tc := range cases {
+		if got := store.SessionRevoked(tc.claims); got != tc.want {
+			t.Errorf("%s: SessionRevoked = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1
+	key := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:         "94287082",
+		1111111109: "07081804",
+		1234567890: "89005924",
+		2000000000: "69279037",
+	}
+	for unix, want := range vectors {
+		if got := totpCode(key, unix/totpPeriod, 8); got != want {
+			t.Errorf("totpCode(T=%d) = %s, want %s", unix, got, want)
+		}
+	}
+
+	secret := totpEncoding.EncodeToString(key)
+	now := time.Unix(1234567890, 0)
+	code := totpCode(key, now.Unix()/totpPeriod, totpDigits)
+	if step, ok := verifyTOTP(secret, code, now.Add(totpPeriod*time.Second)); !ok || step != now.Unix()/totpPeriod {
+		t.Errorf("code from the previous step must be accepted: step %d, %v", step, ok)
+	}
+	if _, ok := verifyTOTP(secret, code, now.Add(3*totpPeriod*time.Second)); ok {
+		t.Error("code outside the skew window accepted")
+	}
+	if _, ok := verifyTOTP(secret, "12345", now); ok {
+		t.Error("short code accepted")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("got %d codes, %d hashes", len(codes), len(hashes))
+	}
+	typed := strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))
+	if hashRecoveryCode(typed) != hashes[0] {
+		t.Error("recovery codes must match regardless of case and separator")
+	}
+}
+
+func TestSetupHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	service := &AuthService{config: &Config{TokenDuration: time.Hour}}
+	prev := globalAuthService
+	globalAuthService = service
+	t.Cleanup(func() { globalAuthService = prev })
+
+	setup := func(token string) int {
+		body := `{"setup_token":"` + token + `","email":"root@example.com","password":"Str0ng!Passw0rd"}`
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/api/v1/setup", strings.NewReader(body))
+		c.Request.Header.Set("Content-Type", "application/json")
+		SetupHandler(c)
+		return w.Code
+	}
+
+	if code := setup("correct-setup-token"); code != 409 {
+		t.Errorf("setup outside setup mode: %d, want 409", code)
+	}
+
+	service.setup.active = true
+	service.setup.tokenHash = sha256.Sum256([]byte("correct-setup-token"))
+	if code := setup("wrong-token"); code != 401 {
+		t.Errorf("setup with a wrong token: %d, want 401", code)
+	}
+}
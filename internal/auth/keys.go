@@ -0,0 +1,493 @@
+package auth
+
+import (
+	"aexon/internal/db"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ============================================================================
+// SIGNING KEYS
+// ============================================================================
+
+// Token signing algorithms. HS256 signs with the shared secret; the others
+// sign with key pairs kept in the database, whose public halves are
+// published at /.well-known/jwks.json.
+const (
+	AlgHS256 = "HS256"
+	AlgEdDSA = "EdDSA"
+	AlgRS256 = "RS256"
+)
+
+const (
+	rsaKeyBits = 3072
+	kidBytes   = 12
+
+	keyringRefresh    = time.Minute      // Picks up keys rotated by other instances
+	keyringMissReload = 30 * time.Second // Minimum gap between reloads for unknown kids
+)
+
+// onlyIfNone makes a rotation store a key only when there is no signing key.
+const onlyIfNone = time.Duration(math.MaxInt64)
+
+var errNoSigningKey = errors.New("no active signing key")
+
+// ringKey is a usable key; private is nil once it has been retired.
+type ringKey struct {
+	kid       string
+	alg       string
+	public    crypto.PublicKey
+	private   crypto.Signer
+	createdAt time.Time
+	retiredAt *time.Time
+	expiresAt *time.Time
+}
+
+func (k *ringKey) method() jwt.SigningMethod {
+	if k.alg == AlgRS256 {
+		return jwt.SigningMethodRS256
+	}
+	return jwt.SigningMethodEdDSA
+}
+
+// keyring caches the signing keys of the database.
+type keyring struct {
+	mu           sync.RWMutex
+	signer       *ringKey
+	keys         map[string]*ringKey
+	firstCreated time.Time // Tokens signed with the shared secret predate it
+	missAt       time.Time
+}
+
+func (r *keyring) set(keys []*ringKey, firstCreated time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys = make(map[string]*ringKey, len(keys))
+	r.signer = nil
+	for _, k := range keys {
+		r.keys[k.kid] = k
+		if k.retiredAt == nil && (r.signer == nil || k.createdAt.After(r.signer.createdAt)) {
+			r.signer = k
+		}
+	}
+	r.firstCreated = firstCreated
+}
+
+func (r *keyring) current() *ringKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.signer
+}
+
+func (r *keyring) lookup(kid string) *ringKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	k := r.keys[kid]
+	if k == nil || (k.expiresAt != nil && !time.Now().Before(*k.expiresAt)) {
+		return nil
+	}
+	return k
+}
+
+// list returns the usable keys, newest first.
+func (r *keyring) list() []*ringKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	keys := make([]*ringKey, 0, len(r.keys))
+	now := time.Now()
+	for _, k := range r.keys {
+		if k.expiresAt == nil || now.Before(*k.expiresAt) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].createdAt.After(keys[j].createdAt) })
+	return keys
+}
+
+// reloadDue rate-limits the reloads triggered by unknown kids, which anyone
+// can put in a token.
+func (r *keyring) reloadDue() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.missAt) < keyringMissReload {
+		return false
+	}
+	r.missAt = time.Now()
+	return true
+}
+
+// acceptsLegacy reports whether a token signed with the shared secret and
+// issued at iat may still be in use: it predates the first key pair, which
+// is younger than the longest token lifetime.
+func (r *keyring) acceptsLegacy(iat time.Time, lifetime time.Duration) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return !r.firstCreated.IsZero() && iat.Before(r.firstCreated) && time.Since(r.firstCreated) < lifetime
+}
+
+// asymmetric reports whether tokens are signed with key pairs.
+func (s *AuthService) asymmetric() bool {
+	return s.config.SigningAlgorithm == AlgEdDSA || s.config.SigningAlgorithm == AlgRS256
+}
+
+func validSigningAlgorithm(alg string) bool {
+	switch alg {
+	case "", AlgHS256, AlgEdDSA, AlgRS256:
+		return true
+	}
+	return false
+}
+
+// sign issues a token signed with the current key, naming it in the kid
+// header.
+func (s *AuthService) sign(claims jwt.Claims) (string, error) {
+	if !s.asymmetric() {
+		if len(s.config.SecretKey) == 0 {
+			return "", NewAuthError(ErrCodeSecretNotConfigured, "signing key not configured", nil)
+		}
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.config.SecretKey)
+	}
+
+	key := s.keys.current()
+	if key == nil {
+		return "", NewAuthError(ErrCodeSecretNotConfigured, "signing key not configured", errNoSigningKey)
+	}
+	token := jwt.NewWithClaims(key.method(), claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.private)
+}
+
+// verificationKey is the jwt.Keyfunc of ValidateToken. It insists on the
+// algorithm the key was made for, so a public key is never used as an HMAC
+// secret.
+func (s *AuthService) verificationKey(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		if len(s.config.SecretKey) == 0 {
+			return nil, NewAuthError(ErrCodeSecretNotConfigured, "signing key not configured", nil)
+		}
+		if s.asymmetric() {
+			iat, err := token.Claims.GetIssuedAt()
+			if err != nil || iat == nil || !s.keys.acceptsLegacy(iat.Time, s.config.RefreshDuration) {
+				return nil, NewAuthError(ErrCodeInvalidSigningMethod,
+					fmt.Sprintf("unexpected signing method: %v", token.Header["alg"]), nil)
+			}
+		}
+		return s.config.SecretKey, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key := s.keys.lookup(kid)
+	if key == nil && kid != "" && s.signingKeys != nil && s.keys.reloadDue() {
+		// Possibly rotated by another instance since the last refresh
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := s.loadKeyring(ctx); err != nil {
+			log.Printf("[Auth] Reloading signing keys failed: %v", err)
+		}
+		cancel()
+		key = s.keys.lookup(kid)
+	}
+	if key == nil {
+		return nil, NewAuthError(ErrCodeTokenInvalid, fmt.Sprintf("unknown signing key %q", kid), nil)
+	}
+	if token.Method.Alg() != key.alg {
+		return nil, NewAuthError(ErrCodeInvalidSigningMethod,
+			fmt.Sprintf("unexpected signing method: %v", token.Header["alg"]), nil)
+	}
+	return key.public, nil
+}
+
+// ============================================================================
+// KEY MANAGEMENT
+// ============================================================================
+
+func generateSigningKey(alg string) (*db.SigningKey, error) {
+	var private crypto.Signer
+	var err error
+	switch alg {
+	case AlgEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	case AlgRS256:
+		private, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(private.Public())
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(publicDER)
+	return &db.SigningKey{
+		KID:        base64.RawURLEncoding.EncodeToString(sum[:kidBytes]),
+		Algorithm:  alg,
+		PrivateKey: privateDER,
+		PublicKey:  publicDER,
+	}, nil
+}
+
+func parseSigningKey(k db.SigningKey) (*ringKey, error) {
+	public, err := x509.ParsePKIXPublicKey(k.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	switch public.(type) {
+	case ed25519.PublicKey:
+		if k.Algorithm != AlgEdDSA {
+			return nil, fmt.Errorf("key %s: Ed25519 key stored for %s", k.KID, k.Algorithm)
+		}
+	case *rsa.PublicKey:
+		if k.Algorithm != AlgRS256 {
+			return nil, fmt.Errorf("key %s: RSA key stored for %s", k.KID, k.Algorithm)
+		}
+	default:
+		return nil, fmt.Errorf("key %s: unsupported key type %T", k.KID, public)
+	}
+
+	key := &ringKey{
+		kid:       k.KID,
+		alg:       k.Algorithm,
+		public:    public,
+		createdAt: k.CreatedAt,
+		retiredAt: k.RetiredAt,
+		expiresAt: k.ExpiresAt,
+	}
+	if k.RetiredAt == nil {
+		private, err := x509.ParsePKCS8PrivateKey(k.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := private.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("key %s: private key cannot sign", k.KID)
+		}
+		key.private = signer
+	}
+	return key, nil
+}
+
+func (s *AuthService) loadKeyring(ctx context.Context) error {
+	stored, err := s.signingKeys.ListUsable(ctx)
+	if err != nil {
+		return err
+	}
+	first, err := s.signingKeys.FirstCreated(ctx)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]*ringKey, 0, len(stored))
+	for _, k := range stored {
+		key, err := parseSigningKey(k)
+		if err != nil {
+			// One bad row must not stop verification with the others
+			log.Printf("[Auth] Skipping signing key: %v", err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	s.keys.set(keys, first)
+	return nil
+}
+
+// rotateSigningKey replaces the signing key unless it is younger than
+// minAge. The retired key keeps verifying until the tokens it signed have
+// expired.
+func (s *AuthService) rotateSigningKey(ctx context.Context, minAge time.Duration) (bool, error) {
+	next, err := generateSigningKey(s.config.SigningAlgorithm)
+	if err != nil {
+		return false, err
+	}
+	rotated, err := s.signingKeys.Rotate(ctx, next, s.config.RefreshDuration, minAge)
+	if err != nil {
+		return false, err
+	}
+	if rotated {
+		log.Printf("[Auth] Signing key rotated (kid=%s, alg=%s)", next.KID, next.Algorithm)
+	}
+	return rotated, s.loadKeyring(ctx)
+}
+
+// initSigningKeys loads the key pairs, creating the first one on the first
+// start with an asymmetric algorithm.
+func (s *AuthService) initSigningKeys(ctx context.Context) error {
+	if !validSigningAlgorithm(s.config.SigningAlgorithm) {
+		return fmt.Errorf("unsupported JWT_SIGNING_ALG %q", s.config.SigningAlgorithm)
+	}
+	if !s.asymmetric() {
+		return nil
+	}
+	if err := s.loadKeyring(ctx); err != nil {
+		return err
+	}
+	if key := s.keys.current(); key != nil && key.alg == s.config.SigningAlgorithm {
+		return nil
+	}
+
+	// None yet, or the algorithm was changed
+	minAge := onlyIfNone
+	if s.keys.current() != nil {
+		minAge = 0
+	}
+	_, err := s.rotateSigningKey(ctx, minAge)
+	return err
+}
+
+// StartKeyRotation refreshes the keyring and rotates the signing key once
+// it is older than KeyRotationInterval.
+func StartKeyRotation(ctx context.Context) {
+	service := GetAuthService()
+	if !service.asymmetric() {
+		return
+	}
+	ticker := time.NewTicker(keyringRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			interval := service.config.KeyRotationInterval
+			if key := service.keys.current(); interval > 0 && key != nil && time.Since(key.createdAt) >= interval {
+				// Instances racing here rotate once: the loser finds a fresh key
+				if _, err := service.rotateSigningKey(ctx, interval); err != nil {
+					log.Printf("[Auth] Signing key rotation failed: %v", err)
+				}
+				continue
+			}
+			if err := service.loadKeyring(ctx); err != nil {
+				log.Printf("[Auth] Refreshing signing keys failed: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ============================================================================
+// KEY HANDLERS
+// ============================================================================
+
+// jwk is an entry of a JSON Web Key Set (RFC 7517).
+type jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+func (k *ringKey) jwk() jwk {
+	out := jwk{Use: "sig", Alg: k.alg, Kid: k.kid}
+	switch public := k.public.(type) {
+	case ed25519.PublicKey:
+		out.Kty, out.Crv = "OKP", "Ed25519"
+		out.X = base64.RawURLEncoding.EncodeToString(public)
+	case *rsa.PublicKey:
+		out.Kty = "RSA"
+		out.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		out.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	}
+	return out
+}
+
+// JWKSHandler publishes the public keys that verify tokens, retired ones
+// included, so that other services can check them offline.
+func JWKSHandler(c *gin.Context) {
+	keys := []jwk{}
+	for _, k := range GetAuthService().keys.list() {
+		keys = append(keys, k.jwk())
+	}
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(keyringRefresh.Seconds())))
+	c.JSON(200, gin.H{"keys": keys})
+}
+
+type signingKeyInfo struct {
+	KID       string     `json:"kid"`
+	Algorithm string     `json:"algorithm"`
+	Active    bool       `json:"active"`
+	CreatedAt time.Time  `json:"created_at"`
+	RetiredAt *time.Time `json:"retired_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func ListSigningKeysHandler(c *gin.Context) {
+	service := GetAuthService()
+	if !service.asymmetric() {
+		c.JSON(200, gin.H{"algorithm": AlgHS256, "keys": []signingKeyInfo{}})
+		return
+	}
+
+	stored, err := service.signingKeys.ListUsable(c.Request.Context())
+	if err != nil {
+		log.Printf("[Auth] List signing keys error: %v", err)
+		c.JSON(500, gin.H{"error": "failed to list signing keys"})
+		return
+	}
+	keys := make([]signingKeyInfo, 0, len(stored))
+	for _, k := range stored {
+		keys = append(keys, signingKeyInfo{
+			KID:       k.KID,
+			Algorithm: k.Algorithm,
+			Active:    k.RetiredAt == nil,
+			CreatedAt: k.CreatedAt,
+			RetiredAt: k.RetiredAt,
+			ExpiresAt: k.ExpiresAt,
+		})
+	}
+	c.JSON(200, gin.H{
+		"algorithm":         service.config.SigningAlgorithm,
+		"rotation_interval": service.config.KeyRotationInterval.String(),
+		"keys":              keys,
+	})
+}
+
+// RotateSigningKeyHandler replaces the signing key at once, e.g. when the
+// current one may have leaked. Tokens it signed stay valid until they expire;
+// revoke sessions to end them sooner.
+func RotateSigningKeyHandler(c *gin.Context) {
+	service := GetAuthService()
+	if !service.asymmetric() {
+		c.JSON(409, gin.H{"error": "tokens are signed with the shared secret (JWT_SIGNING_ALG=HS256)"})
+		return
+	}
+	_, err := service.rotateSigningKey(c.Request.Context(), 0)
+	key := service.keys.current()
+	if err == nil && key == nil {
+		err = errNoSigningKey
+	}
+	if err != nil {
+		log.Printf("[Auth] Rotate signing key error: %v", err)
+		c.JSON(500, gin.H{"error": "failed to rotate signing key"})
+		return
+	}
+
+	AuditTarget(c, key.kid)
+	log.Printf("[Auth] Signing key rotated by user %s", c.GetString("user_id"))
+	c.JSON(200, gin.H{"kid": key.kid, "algorithm": key.alg, "created_at": key.createdAt})
+}
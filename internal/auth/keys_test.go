@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testKeyService returns a service signing with a fresh key pair, without a
+// database behind its keyring.
+func testKeyService(t *testing.T, alg string) *AuthService {
+	t.Helper()
+	stored, err := generateSigningKey(alg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored.CreatedAt = time.Now()
+	key, err := parseSigningKey(*stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &AuthService{config: &Config{
+		SecretKey:        []byte("legacy-secret-0123456789abcdefghijkl"),
+		TokenDuration:    time.Hour,
+		RefreshDuration:  24 * time.Hour,
+		SigningAlgorithm: alg,
+	}}
+	s.keys.set([]*ringKey{key}, stored.CreatedAt)
+	return s
+}
+
+func TestSigningKeys(t *testing.T) {
+	for _, alg := range []string{AlgEdDSA, AlgRS256} {
+		t.Run(alg, func(t *testing.T) {
+			s := testKeyService(t, alg)
+			signed, err := s.GenerateAccessToken("1", "user@example.com", "user", nil)
+			if err != nil {
+				t.Fatalf("sign: %v", err)
+			}
+			claims, err := s.ValidateToken(signed)
+			if err != nil || claims.UserID != "1" {
+				t.Fatalf("ValidateToken = %+v, %v", claims, err)
+			}
+
+			// Tokens signed with a retired key verify until it expires
+			old := s.keys.current()
+			next, _ := generateSigningKey(alg)
+			next.CreatedAt = time.Now()
+			fresh, _ := parseSigningKey(*next)
+			retired, expires := time.Now(), time.Now().Add(time.Hour)
+			old.retiredAt, old.expiresAt, old.private = &retired, &expires, nil
+			s.keys.set([]*ringKey{fresh, old}, old.createdAt)
+			if _, err := s.ValidateToken(signed); err != nil {
+				t.Errorf("retired key: %v", err)
+			}
+			if s.keys.current() != fresh {
+				t.Error("retired key still signs")
+			}
+			expired := time.Now().Add(-time.Second)
+			old.expiresAt = &expired
+			if _, err := s.ValidateToken(signed); err == nil {
+				t.Error("expired key accepted")
+			}
+		})
+	}
+}
+
+func TestSigningKeyConfusion(t *testing.T) {
+	s := testKeyService(t, AlgEdDSA)
+	key := s.keys.current()
+	claims := &AxionClaims{
+		UserID: "1", Role: "admin", TokenType: "access",
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+
+	// The public key as an HMAC secret
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	forged.Header["kid"] = key.kid
+	signed, _ := forged.SignedString([]byte(key.public.(ed25519.PublicKey)))
+	if _, err := s.ValidateToken(signed); err == nil {
+		t.Error("HMAC token with the public key accepted")
+	}
+
+	// A key pair the service does not know
+	_, other, _ := ed25519.GenerateKey(nil)
+	unknown := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	unknown.Header["kid"] = "unknown"
+	signed, _ = unknown.SignedString(other)
+	if _, err := s.ValidateToken(signed); err == nil {
+		t.Error("token with an unknown kid accepted")
+	}
+
+	// Tokens from before the switch to key pairs, while they can be in use
+	legacy := func(issued time.Time) string {
+		c := *claims
+		c.IssuedAt = jwt.NewNumericDate(issued)
+		signed, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, &c).SignedString(s.config.SecretKey)
+		return signed
+	}
+	if _, err := s.ValidateToken(legacy(time.Now().Add(-time.Minute))); err != nil {
+		t.Errorf("legacy token rejected: %v", err)
+	}
+	if _, err := s.ValidateToken(legacy(time.Now().Add(time.Minute))); err == nil {
+		t.Error("HMAC token issued after the first key pair accepted")
+	}
+	s.keys.firstCreated = time.Now().Add(-s.config.RefreshDuration)
+	if _, err := s.ValidateToken(legacy(time.Now().Add(-2 * s.config.RefreshDuration))); err == nil {
+		t.Error("legacy token accepted after the transition")
+	}
+}
+
+func TestJWKSHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	prev := globalAuthService
+	globalAuthService = testKeyService(t, AlgEdDSA)
+	t.Cleanup(func() { globalAuthService = prev })
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/.well-known/jwks.json", nil)
+	JWKSHandler(c)
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &set); err != nil || len(set.Keys) != 1 {
+		t.Fatalf("JWKS = %s, %v", w.Body.String(), err)
+	}
+	got, key := set.Keys[0], globalAuthService.keys.current()
+	x, _ := base64.RawURLEncoding.DecodeString(got.X)
+	if got.Kty != "OKP" || got.Crv != "Ed25519" || got.Kid != key.kid || got.Alg != AlgEdDSA ||
+		!ed25519.PublicKey(x).Equal(key.public) {
+		t.Errorf("JWK = %+v", got)
+	}
+}
@@ -0,0 +1,408 @@
+package auth
+
+import (
+	"aexon/internal/db"
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ============================================================================
+// TWO-FACTOR AUTHENTICATION
+// ============================================================================
+
+// mfaChallengeDuration bounds the time between password and code.
+const mfaChallengeDuration = 5 * time.Minute
+
+// generateChallengeToken is handed out instead of an access token when the
+// password was right but a second factor is still due.
+func (s *AuthService) generateChallengeToken(userID, username string) (string, error) {
+	claims := AxionClaims{
+		UserID:    userID,
+		Username:  username,
+		Role:      "mfa",
+		TokenType: "mfa",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        generateTokenID(),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(mfaChallengeDuration)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			NotBefore: jwt.NewNumericDate(time.Now()),
+			Issuer:    tokenIssuer,
+			Subject:   userID,
+		},
+	}
+
+	return s.sign(claims)
+}
+
+// mfaRequired reports whether the policy demands 2FA for the platform role.
+func (s *AuthService) mfaRequired(ctx context.Context, role string) (bool, error) {
+	roles, err := s.mfa.RequiredRoles(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range roles {
+		if r == role {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkSecondFactor accepts a current TOTP code or an unused recovery code.
+// Each is accepted only once.
+func (s *AuthService) checkSecondFactor(ctx context.Context, userID int, st *db.MFAState, code string) (bool, error) {
+	if st == nil || !st.Enabled {
+		return false, nil
+	}
+	if step, ok := verifyTOTP(st.Secret, code, time.Now()); ok {
+		return s.mfa.ConsumeStep(ctx, userID, step)
+	}
+	return s.mfa.ConsumeRecoveryCode(ctx, userID, hashRecoveryCode(code))
+}
+
+// ============================================================================
+// 2FA HANDLERS
+// ============================================================================
+
+// VerifyMFAHandler completes a login with the challenge token and a code.
+func VerifyMFAHandler(c *gin.Context) {
+	service := GetAuthService()
+
+	var req struct {
+		ChallengeToken string `json:"challenge_token" binding:"required"`
+		Code           string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "invalid request"})
+		return
+	}
+
+	claims, err := service.ValidateToken(req.ChallengeToken)
+	if err != nil || claims.TokenType != "mfa" {
+		c.JSON(401, gin.H{"error": "invalid or expired challenge", "code": ErrCodeTokenInvalid})
+		return
+	}
+	uid, _ := strconv.Atoi(claims.UserID)
+
+	ctx := c.Request.Context()
+	user, err := service.repo.GetByID(ctx, uid)
+	if err != nil {
+		log.Printf("[Auth] 2FA user lookup error: %v", err)
+		c.JSON(500, gin.H{"error": "internal error"})
+		return
+	}
+	if user == nil {
+		c.JSON(401, gin.H{"error": "invalid or expired challenge", "code": ErrCodeTokenInvalid})
+		return
+	}
+	AuditActor(c, user.ID, user.Email)
+	// The code is throttled on its own: a right one is the way in for the
+	// owner of an account locked out by password guessing
+	if throttledMFA(c, uid) {
+		return
+	}
+	st, err := service.mfa.Get(ctx, uid)
+	if err != nil {
+		log.Printf("[Auth] 2FA state lookup error: %v", err)
+		c.JSON(500, gin.H{"error": "internal error"})
+		return
+	}
+
+	ok, err := service.checkSecondFactor(ctx, uid, st, req.Code)
+	if err != nil {
+		log.Printf("[Auth] 2FA verification error: %v", err)
+		c.JSON(500, gin.H{"error": "internal error"})
+		return
+	}
+	if !ok {
+		globalAuthMetrics.loginFailures.Add(1)
+		rateLimiter.FailMFA(ctx, c.ClientIP(), uid)
+		c.JSON(401, gin.H{"error": "invalid code", "code": ErrCodeInvalidCredentials})
+		return
+	}
+	rateLimiter.ResetMFA(ctx, uid)
+
+	// A challenge completes one login only, on any instance
+	first, err := service.tokens.Consume(ctx, claims.ID, claims.ExpiresAt.Time)
+	if err != nil {
+		log.Printf("[Auth] 2FA challenge revocation error: %v", err)
+		c.JSON(500, gin.H{"error": "internal error"})
+		return
+	}
+	revokedTokens.Revoke(claims.ID, claims.ExpiresAt.Time)
+	if !first {
+		c.JSON(401, gin.H{"error": "invalid or expired challenge", "code": ErrCodeTokenInvalid})
+		return
+	}
+	rateLimiter.Reset(ctx, user.Email)
+	service.completeLogin(c, user)
+}
+
+func MFAStatusHandler(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	service := GetAuthService()
+	ctx := c.Request.Context()
+
+	st, err := service.mfa.Get(ctx, uid)
+	if err != nil {
+		log.Printf("[Auth] 2FA state lookup error: %v", err)
+		c.JSON(500, gin.H{"error": "failed to fetch 2FA status"})
+		return
+	}
+	left, err := service.mfa.RecoveryCodesLeft(ctx, uid)
+	if err != nil {
+		log.Printf("[Auth] Recovery code count error: %v", err)
+		c.JSON(500, gin.H{"error": "failed to fetch 2FA status"})
+		return
+	}
+	required, err := service.mfaRequired(ctx, c.GetString("role"))
+	if err != nil {
+		log.Printf("[Auth] 2FA policy lookup error: %v", err)
+		c.JSON(500, gin.H{"error": "failed to fetch 2FA status"})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"enabled":             st.Enabled,
+		"required":            required,
+		"recovery_codes_left": left,
+	})
+}
+
+// EnrollMFAHandler creates a new secret; it is used only once confirmed.
+func EnrollMFAHandler(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	service := GetAuthService()
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to generate secret"})
+		return
+	}
+	err = service.mfa.SetPendingSecret(c.Request.Context(), uid, secret)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(409, gin.H{"error": "2FA is already enabled"})
+		return
+	}
+	if err != nil {
+		log.Printf("[Auth] 2FA enrolment error: %v", err)
+		c.JSON(500, gin.H{"error": "failed to start enrolment"})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"secret":      secret,
+		"otpauth_uri": totpURI(secret, c.GetString("username")),
+	})
+}
+
+// ConfirmMFAHandler enables 2FA with a code from the new secret and returns
+// the recovery codes, which are never shown again.
+func ConfirmMFAHandler(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "invalid request"})
+		return
+	}
+	service := GetAuthService()
+	ctx := c.Request.Context()
+
+	st, err := service.mfa.Get(ctx, uid)
+	if err != nil {
+		log.Printf("[Auth] 2FA state lookup error: %v", err)
+		c.JSON(500, gin.H{"error": "failed to confirm 2FA"})
+		return
+	}
+	if st.Enabled {
+		c.JSON(409, gin.H{"error": "2FA is already enabled"})
+		return
+	}
+	if st.Secret == "" {
+		c.JSON(409, gin.H{"error": "no enrolment in progress"})
+		return
+	}
+	step, valid := verifyTOTP(st.Secret, req.Code, time.Now())
+	if !valid {
+		c.JSON(400, gin.H{"error": "invalid code"})
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to generate recovery codes"})
+		return
+	}
+	if err := service.mfa.Enable(ctx, uid, step, hashes); err != nil {
+		log.Printf("[Auth] 2FA enable error: %v", err)
+		c.JSON(500, gin.H{"error": "failed to confirm 2FA"})
+		return
+	}
+
+	log.Printf("[Auth] 2FA enabled for user %d", uid)
+	c.JSON(200, gin.H{"status": "enabled", "recovery_codes": codes})
+}
+
+// DisableMFAHandler turns 2FA off after checking a code, unless the policy
+// requires it for the caller's role.
+func DisableMFAHandler(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "invalid request"})
+		return
+	}
+	service := GetAuthService()
+	ctx := c.Request.Context()
+
+	required, err := service.mfaRequired(ctx, c.GetString("role"))
+	if err != nil {
+		log.Printf("[Auth] 2FA policy lookup error: %v", err)
+		c.JSON(500, gin.H{"error": "failed to disable 2FA"})
+		return
+	}
+	if required {
+		c.JSON(409, gin.H{"error": "2FA is required for your role"})
+		return
+	}
+	if !service.verifyCode(c, uid, req.Code) {
+		return
+	}
+
+	if err := service.mfa.Disable(ctx, uid); err != nil {
+		log.Printf("[Auth] 2FA disable error: %v", err)
+		c.JSON(500, gin.H{"error": "failed to disable 2FA"})
+		return
+	}
+	log.Printf("[Auth] 2FA disabled for user %d", uid)
+	c.JSON(200, gin.H{"status": "disabled"})
+}
+
+// RegenerateRecoveryCodesHandler replaces all recovery codes.
+func RegenerateRecoveryCodesHandler(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "invalid request"})
+		return
+	}
+	service := GetAuthService()
+	if !service.verifyCode(c, uid, req.Code) {
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to generate recovery codes"})
+		return
+	}
+	if err := service.mfa.ReplaceRecoveryCodes(c.Request.Context(), uid, hashes); err != nil {
+		log.Printf("[Auth] Recovery code error: %v", err)
+		c.JSON(500, gin.H{"error": "failed to generate recovery codes"})
+		return
+	}
+	c.JSON(200, gin.H{"recovery_codes": codes})
+}
+
+// verifyCode checks a second factor of the caller and writes the error
+// response when it does not pass. Wrong codes count towards the caller's
+// 2FA throttle.
+func (s *AuthService) verifyCode(c *gin.Context, uid int, code string) bool {
+	if throttledMFA(c, uid) {
+		return false
+	}
+	ctx := c.Request.Context()
+	st, err := s.mfa.Get(ctx, uid)
+	if err != nil {
+		log.Printf("[Auth] 2FA state lookup error: %v", err)
+		c.JSON(500, gin.H{"error": "internal error"})
+		return false
+	}
+	if !st.Enabled {
+		c.JSON(409, gin.H{"error": "2FA is not enabled"})
+		return false
+	}
+	ok, err := s.checkSecondFactor(ctx, uid, st, code)
+	if err != nil {
+		log.Printf("[Auth] 2FA verification error: %v", err)
+		c.JSON(500, gin.H{"error": "internal error"})
+		return false
+	}
+	if !ok {
+		rateLimiter.FailMFA(ctx, c.ClientIP(), uid)
+		c.JSON(400, gin.H{"error": "invalid code"})
+		return false
+	}
+	rateLimiter.ResetMFA(ctx, uid)
+	return true
+}
+
+func GetMFAPolicyHandler(c *gin.Context) {
+	roles, err := GetAuthService().mfa.RequiredRoles(c.Request.Context())
+	if err != nil {
+		log.Printf("[Auth] 2FA policy lookup error: %v", err)
+		c.JSON(500, gin.H{"error": "failed to fetch 2FA policy"})
+		return
+	}
+	if roles == nil {
+		roles = []string{}
+	}
+	c.JSON(200, gin.H{"required_roles": roles})
+}
+
+// SetMFAPolicyHandler sets the platform roles that must use 2FA. Members of
+// those roles without 2FA can only enrol until they have done so.
+func SetMFAPolicyHandler(c *gin.Context) {
+	var req struct {
+		RequiredRoles []string `json:"required_roles"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "invalid request"})
+		return
+	}
+	if req.RequiredRoles == nil {
+		req.RequiredRoles = []string{}
+	}
+	for _, role := range req.RequiredRoles {
+		if role != "admin" && role != "user" {
+			c.JSON(400, gin.H{"error": "unknown role", "role": role})
+			return
+		}
+	}
+
+	if err := GetAuthService().mfa.SetRequiredRoles(c.Request.Context(), req.RequiredRoles); err != nil {
+		log.Printf("[Auth] 2FA policy update error: %v", err)
+		c.JSON(500, gin.H{"error": "failed to update 2FA policy"})
+		return
+	}
+	log.Printf("[Auth] 2FA required for roles %v", req.RequiredRoles)
+	c.JSON(200, gin.H{"required_roles": req.RequiredRoles})
+}
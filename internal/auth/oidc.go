@@ -0,0 +1,492 @@
+package auth
+
+import (
+	"aexon/internal/db"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zitadel/oidc/v3/pkg/client/rp"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+)
+
+// ============================================================================
+// OIDC SINGLE SIGN-ON
+// ============================================================================
+
+// oidcLoginTimeout bounds the time a user may spend at the identity
+// provider between /auth/oidc/login and the callback.
+const oidcLoginTimeout = 10 * time.Minute
+
+// oidcStateCookie binds a pending login to the browser that started it, so
+// that a callback URL planted on someone else logs nobody in.
+const oidcStateCookie = "aexon_oidc_state"
+
+// OIDCConfig configures login through an OpenID Connect provider. Accounts
+// are matched by the provider's subject; groups found in GroupsClaim decide
+// the platform role and project memberships on every login.
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string // This service's /auth/oidc/callback as registered at the provider
+	Scopes       []string
+
+	GroupsClaim     string
+	AdminGroups     []string             // Members get the admin platform role; others are demoted to user
+	ProjectGroups   []OIDCProjectMapping // Memberships granted to members of a group
+	AutoProvision   bool                 // Create accounts on first login
+	SuccessRedirect string               // Frontend URL receiving the tokens in its fragment; JSON when empty
+}
+
+// OIDCProjectMapping grants members of Group the Role in ProjectID.
+type OIDCProjectMapping struct {
+	Group     string
+	ProjectID int
+	Role      string
+}
+
+// OIDCConfigFromEnv reads the OIDC_* variables. SSO is disabled (nil) unless
+// an issuer is set.
+func OIDCConfigFromEnv() *OIDCConfig {
+	issuer := strings.TrimSuffix(getEnv("OIDC_ISSUER", ""), "/")
+	if issuer == "" {
+		return nil
+	}
+
+	cfg := &OIDCConfig{
+		Issuer:          issuer,
+		ClientID:        getEnv("OIDC_CLIENT_ID", ""),
+		ClientSecret:    getEnv("OIDC_CLIENT_SECRET", ""),
+		RedirectURL:     getEnv("OIDC_REDIRECT_URL", ""),
+		Scopes:          splitList(getEnv("OIDC_SCOPES", "openid email profile"), " "),
+		GroupsClaim:     getEnv("OIDC_GROUPS_CLAIM", "groups"),
+		AdminGroups:     splitList(getEnv("OIDC_ADMIN_GROUPS", ""), ","),
+		AutoProvision:   getEnv("OIDC_AUTO_PROVISION", "true") == "true",
+		SuccessRedirect: getEnv("OIDC_SUCCESS_URL", ""),
+	}
+	mappings, err := parseProjectGroups(getEnv("OIDC_PROJECT_GROUPS", ""))
+	if err != nil {
+		log.Printf("[Auth] Ignoring OIDC_PROJECT_GROUPS: %v", err)
+	}
+	cfg.ProjectGroups = mappings
+
+	if cfg.ClientID == "" || cfg.RedirectURL == "" {
+		log.Println("[Auth] OIDC_ISSUER is set without OIDC_CLIENT_ID and OIDC_REDIRECT_URL; SSO disabled")
+		return nil
+	}
+	return cfg
+}
+
+func splitList(s, sep string) []string {
+	var out []string
+	for _, v := range strings.Split(s, sep) {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// parseProjectGroups reads "group=projectID:role" pairs separated by commas,
+// e.g. "platform-team=12:admin,support=12:viewer".
+func parseProjectGroups(s string) ([]OIDCProjectMapping, error) {
+	var out []OIDCProjectMapping
+	for _, entry := range splitList(s, ",") {
+		group, target, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q: expected group=project:role", entry)
+		}
+		project, role, ok := strings.Cut(target, ":")
+		id, err := strconv.Atoi(project)
+		if !ok || err != nil || id <= 0 {
+			return nil, fmt.Errorf("%q: expected group=project:role", entry)
+		}
+		if !db.ValidProjectRole(role) {
+			return nil, fmt.Errorf("%q: %w", entry, db.ErrInvalidProjectRole)
+		}
+		out = append(out, OIDCProjectMapping{Group: strings.TrimSpace(group), ProjectID: id, Role: role})
+	}
+	return out, nil
+}
+
+// oidcLogin is what the callback needs to finish a login started here.
+type oidcLogin struct {
+	verifier  string // PKCE code verifier
+	nonce     string
+	expiresAt time.Time
+}
+
+// oidcProvider is the relying party of one identity provider. Discovery
+// happens on first use so that an unreachable provider does not prevent
+// startup. Pending logins are kept in memory.
+type oidcProvider struct {
+	config *OIDCConfig
+
+	mu    sync.Mutex
+	party rp.RelyingParty
+
+	loginsMu sync.Mutex
+	logins   map[string]oidcLogin // state -> pending login
+}
+
+func newOIDCProvider(cfg *OIDCConfig) *oidcProvider {
+	return &oidcProvider{config: cfg, logins: make(map[string]oidcLogin)}
+}
+
+type oidcNonceKey struct{}
+
+func (p *oidcProvider) relyingParty(ctx context.Context) (rp.RelyingParty, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.party != nil {
+		return p.party, nil
+	}
+
+	party, err := rp.NewRelyingPartyOIDC(ctx, p.config.Issuer, p.config.ClientID, p.config.ClientSecret,
+		p.config.RedirectURL, p.config.Scopes,
+		rp.WithSigningAlgsFromDiscovery(),
+		rp.WithVerifierOpts(rp.WithNonce(func(ctx context.Context) string {
+			nonce, _ := ctx.Value(oidcNonceKey{}).(string)
+			return nonce
+		})),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	p.party = party
+	return party, nil
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// authURL starts a login and returns the provider URL to send the user to,
+// with the state the callback must carry.
+func (p *oidcProvider) authURL(ctx context.Context) (string, string, error) {
+	party, err := p.relyingParty(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	var login oidcLogin
+	state, err := randomToken()
+	if err == nil {
+		login.verifier, err = randomToken()
+	}
+	if err == nil {
+		login.nonce, err = randomToken()
+	}
+	if err != nil {
+		return "", "", err
+	}
+	login.expiresAt = time.Now().Add(oidcLoginTimeout)
+
+	p.loginsMu.Lock()
+	now := time.Now()
+	for s, l := range p.logins {
+		if now.After(l.expiresAt) {
+			delete(p.logins, s)
+		}
+	}
+	p.logins[state] = login
+	p.loginsMu.Unlock()
+
+	return rp.AuthURL(state, party,
+		rp.WithCodeChallenge(oidc.NewSHACodeChallenge(login.verifier)),
+		rp.AuthURLOpt(rp.WithURLParam("nonce", login.nonce)),
+	), state, nil
+}
+
+var errOIDCState = errors.New("unknown or expired login state")
+
+// exchange finishes the login of state: the code is redeemed with the PKCE
+// verifier and the ID token must carry the nonce sent with the request.
+// Each state can be used once.
+func (p *oidcProvider) exchange(ctx context.Context, state, code string) (*oidc.IDTokenClaims, error) {
+	p.loginsMu.Lock()
+	login, ok := p.logins[state]
+	delete(p.logins, state)
+	p.loginsMu.Unlock()
+	if !ok || time.Now().After(login.expiresAt) {
+		return nil, errOIDCState
+	}
+
+	party, err := p.relyingParty(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := rp.CodeExchange[*oidc.IDTokenClaims](
+		context.WithValue(ctx, oidcNonceKey{}, login.nonce), code, party,
+		rp.WithCodeVerifier(login.verifier),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return tokens.IDTokenClaims, nil
+}
+
+// claimGroups returns the values of the groups claim, which providers send
+// either as a list or as a single string.
+func (p *oidcProvider) claimGroups(claims *oidc.IDTokenClaims) []string {
+	switch v := claims.Claims[p.config.GroupsClaim].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		groups := make([]string, 0, len(v))
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+		return groups
+	}
+	return nil
+}
+
+// platformRole maps the groups to a platform role. It reports false when
+// no admin groups are configured, leaving roles to be managed locally.
+func (p *oidcProvider) platformRole(groups []string) (string, bool) {
+	if len(p.config.AdminGroups) == 0 {
+		return "", false
+	}
+	for _, g := range groups {
+		for _, admin := range p.config.AdminGroups {
+			if g == admin {
+				return "admin", true
+			}
+		}
+	}
+	return "user", true
+}
+
+// projectGrants maps the groups to project memberships, keeping the highest
+// role per project.
+func (p *oidcProvider) projectGrants(groups []string) map[int]string {
+	grants := make(map[int]string)
+	for _, m := range p.config.ProjectGroups {
+		for _, g := range groups {
+			if g == m.Group && !db.ProjectRoleAtLeast(grants[m.ProjectID], m.Role) {
+				grants[m.ProjectID] = m.Role
+			}
+		}
+	}
+	return grants
+}
+
+var (
+	errOIDCNoEmail    = errors.New("identity provider did not return an email")
+	errOIDCNoAccount  = errors.New("no account is linked to this identity")
+	errOIDCEmailTaken = errors.New("email already registered; it must be verified by the identity provider to be linked")
+	errOIDCLinkDenied = errors.New("email belongs to an account with 2FA or admin rights, which is not linked to single sign-on automatically")
+)
+
+// resolveUser finds, links or provisions the account of the identity and
+// applies the role and project mappings.
+func (s *AuthService) resolveUser(ctx context.Context, p *oidcProvider, claims *oidc.IDTokenClaims) (*db.User, error) {
+	groups := p.claimGroups(claims)
+	role, syncRole := p.platformRole(groups)
+
+	user, err := s.identities.Login(ctx, claims.Issuer, claims.Subject)
+	if errors.Is(err, sql.ErrNoRows) {
+		user, err = s.linkOrProvision(ctx, p, claims, role)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if syncRole && user.Role != role {
+		if err := s.repo.SetRole(ctx, user.ID, role); err != nil {
+			return nil, err
+		}
+		log.Printf("[Auth] SSO changed role of user %d from %s to %s", user.ID, user.Role, role)
+		user.Role = role
+	}
+	for projectID, projectRole := range p.projectGrants(groups) {
+		// A mapping to a deleted project must not lock everyone out
+		if err := s.projects.GrantMember(ctx, projectID, user.ID, projectRole); err != nil {
+			log.Printf("[Auth] SSO membership of user %d in project %d failed: %v", user.ID, projectID, err)
+		}
+	}
+	return user, nil
+}
+
+func (s *AuthService) linkOrProvision(ctx context.Context, p *oidcProvider, claims *oidc.IDTokenClaims, role string) (*db.User, error) {
+	email := strings.ToLower(strings.TrimSpace(claims.Email))
+	if email == "" {
+		return nil, errOIDCNoEmail
+	}
+
+	existing, err := s.repo.GetByEmail(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		// Unverified addresses could be claimed by anyone at the provider
+		if !bool(claims.EmailVerified) {
+			return nil, errOIDCEmailTaken
+		}
+		// SSO logins skip local 2FA, so linking such an account would let
+		// the provider stand in for factors it never checked
+		if existing.Role == "admin" {
+			return nil, errOIDCLinkDenied
+		}
+		st, err := s.mfa.Get(ctx, existing.ID)
+		if err != nil {
+			return nil, err
+		}
+		if st.Enabled {
+			return nil, errOIDCLinkDenied
+		}
+		if err := s.identities.Link(ctx, existing.ID, claims.Issuer, claims.Subject); err != nil {
+			return nil, err
+		}
+		log.Printf("[Auth] SSO identity %s linked to user %d", claims.Subject, existing.ID)
+		return existing, nil
+	}
+
+	if !p.config.AutoProvision {
+		return nil, errOIDCNoAccount
+	}
+	if role == "" {
+		role = "user"
+	}
+	// No password: the account can only sign in through the provider
+	user := &db.User{Email: email, Role: role}
+	if err := s.identities.Provision(ctx, user, claims.Issuer, claims.Subject); err != nil {
+		return nil, err
+	}
+	log.Printf("[Auth] SSO provisioned user %d (%s)", user.ID, email)
+	return user, nil
+}
+
+// ============================================================================
+// OIDC HANDLERS
+// ============================================================================
+
+// OIDCLoginHandler redirects to the identity provider.
+func OIDCLoginHandler(c *gin.Context) {
+	p := GetAuthService().oidc
+	if p == nil {
+		c.JSON(404, gin.H{"error": "single sign-on is not configured"})
+		return
+	}
+
+	target, state, err := p.authURL(c.Request.Context())
+	if err != nil {
+		log.Printf("[Auth] OIDC login error: %v", err)
+		c.JSON(502, gin.H{"error": "identity provider unavailable"})
+		return
+	}
+	p.setStateCookie(c, state, int(oidcLoginTimeout/time.Second))
+	c.Redirect(302, target)
+}
+
+// setStateCookie keeps state in the browser for the callback next to the
+// login route; a negative maxAge removes it. Lax lets the cookie follow
+// the provider's top-level redirect back.
+func (p *oidcProvider) setStateCookie(c *gin.Context, state string, maxAge int) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, state, maxAge, path.Dir(c.Request.URL.Path), "",
+		strings.HasPrefix(p.config.RedirectURL, "https://"), true)
+}
+
+// stateMatches reports whether the callback comes from the browser that
+// started the login, and removes the cookie.
+func (p *oidcProvider) stateMatches(c *gin.Context) bool {
+	cookie, err := c.Cookie(oidcStateCookie)
+	p.setStateCookie(c, "", -1)
+	state := c.Query("state")
+	return err == nil && state != "" && subtle.ConstantTimeCompare([]byte(cookie), []byte(state)) == 1
+}
+
+// OIDCCallbackHandler is where the identity provider sends the user back.
+// SSO logins skip local 2FA; the provider is responsible for the factors.
+func OIDCCallbackHandler(c *gin.Context) {
+	service := GetAuthService()
+	p := service.oidc
+	if p == nil {
+		c.JSON(404, gin.H{"error": "single sign-on is not configured"})
+		return
+	}
+	globalAuthMetrics.loginAttempts.Add(1)
+	AuditAction(c, "auth.login.oidc")
+
+	if e := c.Query("error"); e != "" {
+		globalAuthMetrics.loginFailures.Add(1)
+		c.JSON(401, gin.H{"error": "login rejected by identity provider", "reason": e})
+		return
+	}
+
+	if !p.stateMatches(c) {
+		globalAuthMetrics.loginFailures.Add(1)
+		c.JSON(401, gin.H{"error": "login was not started by this browser", "code": ErrCodeInvalidCredentials})
+		return
+	}
+
+	ctx := c.Request.Context()
+	claims, err := p.exchange(ctx, c.Query("state"), c.Query("code"))
+	if err != nil {
+		globalAuthMetrics.loginFailures.Add(1)
+		log.Printf("[Auth] OIDC callback error: %v", err)
+		c.JSON(401, gin.H{"error": "single sign-on failed", "code": ErrCodeInvalidCredentials})
+		return
+	}
+
+	user, err := service.resolveUser(ctx, p, claims)
+	switch {
+	case errors.Is(err, errOIDCNoEmail), errors.Is(err, errOIDCNoAccount):
+		globalAuthMetrics.loginFailures.Add(1)
+		c.JSON(403, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, errOIDCEmailTaken), errors.Is(err, errOIDCLinkDenied):
+		globalAuthMetrics.loginFailures.Add(1)
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		log.Printf("[Auth] OIDC user resolution error: %v", err)
+		c.JSON(500, gin.H{"error": "internal error"})
+		return
+	}
+	AuditActor(c, user.ID, user.Email)
+
+	if !checkActive(c, user) {
+		return
+	}
+	if p.config.SuccessRedirect == "" {
+		service.issueSession(c, user)
+		return
+	}
+
+	session, err := service.newSession(ctx, user)
+	if err != nil {
+		log.Printf("[Auth] OIDC session error: %v", err)
+		c.JSON(500, gin.H{"error": "failed to generate token"})
+		return
+	}
+	// The fragment never reaches servers or logs on the way to the frontend
+	fragment := url.Values{}
+	fragment.Set("access_token", session.AccessToken)
+	fragment.Set("refresh_token", session.RefreshToken)
+	fragment.Set("token_type", "Bearer")
+	fragment.Set("expires_in", strconv.Itoa(session.ExpiresIn))
+	c.Redirect(302, p.config.SuccessRedirect+"#"+fragment.Encode())
+}
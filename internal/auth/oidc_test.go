@@ -0,0 +1,252 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// mockIDP is a minimal OpenID provider: discovery, JWKS and a token
+// endpoint that checks the PKCE verifier of the one code it issued.
+type mockIDP struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu        sync.Mutex
+	challenge string // S256 challenge sent with the authorization request
+	nonce     string // Nonce to put into the ID token
+}
+
+func newMockIDP(t *testing.T) *mockIDP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIDP{key: key}
+	mux := http.NewServeMux()
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                idp.URL,
+			"authorization_endpoint":                idp.URL + "/authorize",
+			"token_endpoint":                        idp.URL + "/token",
+			"jwks_uri":                              idp.URL + "/keys",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+			"code_challenge_methods_supported":      []string{"S256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if r.PostForm.Get("code") != "good-code" || base64.RawURLEncoding.EncodeToString(sum[:]) != idp.challenge {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		now := time.Now()
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss":            idp.URL,
+			"sub":            "alice-sub",
+			"aud":            "aexon",
+			"exp":            now.Add(time.Minute).Unix(),
+			"iat":            now.Unix(),
+			"nonce":          idp.nonce,
+			"email":          "alice@corp.example",
+			"email_verified": true,
+			"groups":         []string{"ops", "staff"},
+		})
+		token.Header["kid"] = "test"
+		signed, err := token.SignedString(key)
+		if err != nil {
+			w.WriteHeader(500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "opaque",
+			"token_type":   "Bearer",
+			"expires_in":   60,
+			"id_token":     signed,
+		})
+	})
+	return idp
+}
+
+// authorize plays the user at the provider: it records what the
+// authorization request carried and returns its state. A non-empty nonce
+// replaces the requested one in the ID token.
+func (idp *mockIDP) authorize(t *testing.T, authURL string, nonce string) (state string) {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Fatalf("authorization request without PKCE: %s", authURL)
+	}
+	if q.Get("nonce") == "" {
+		t.Fatalf("authorization request without nonce: %s", authURL)
+	}
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.challenge = q.Get("code_challenge")
+	idp.nonce = q.Get("nonce")
+	if nonce != "" {
+		idp.nonce = nonce
+	}
+	return q.Get("state")
+}
+
+func TestOIDCExchange(t *testing.T) {
+	idp := newMockIDP(t)
+	p := newOIDCProvider(&OIDCConfig{
+		Issuer:      idp.URL,
+		ClientID:    "aexon",
+		RedirectURL: "http://aexon.test/api/v1/auth/oidc/callback",
+		Scopes:      []string{"openid", "email"},
+		GroupsClaim: "groups",
+	})
+	ctx := context.Background()
+
+	authURL, _, err := p.authURL(ctx)
+	if err != nil {
+		t.Fatalf("authURL: %v", err)
+	}
+	state := idp.authorize(t, authURL, "")
+	claims, err := p.exchange(ctx, state, "good-code")
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	if claims.Subject != "alice-sub" || claims.Email != "alice@corp.example" || !bool(claims.EmailVerified) {
+		t.Errorf("unexpected claims: %+v", claims)
+	}
+	if got := p.claimGroups(claims); !reflect.DeepEqual(got, []string{"ops", "staff"}) {
+		t.Errorf("groups = %v", got)
+	}
+
+	if _, err := p.exchange(ctx, state, "good-code"); err != errOIDCState {
+		t.Errorf("state reused: %v", err)
+	}
+
+	authURL, _, _ = p.authURL(ctx)
+	state = idp.authorize(t, authURL, "replayed-nonce")
+	if _, err := p.exchange(ctx, state, "good-code"); err == nil {
+		t.Error("ID token with a foreign nonce accepted")
+	}
+
+	// A code bound to another login's PKCE challenge is not redeemed
+	authURL, _, _ = p.authURL(ctx)
+	state = idp.authorize(t, authURL, "")
+	idp.mu.Lock()
+	idp.challenge = "challenge-of-another-login"
+	idp.mu.Unlock()
+	if _, err := p.exchange(ctx, state, "good-code"); err == nil {
+		t.Error("code redeemed without a matching PKCE verifier")
+	}
+}
+
+func TestOIDCStateCookie(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	idp := newMockIDP(t)
+	service := &AuthService{config: &Config{}, oidc: newOIDCProvider(&OIDCConfig{
+		Issuer:      idp.URL,
+		ClientID:    "aexon",
+		RedirectURL: "https://aexon.test/api/v1/auth/oidc/callback",
+		Scopes:      []string{"openid", "email"},
+	})}
+	prev := globalAuthService
+	globalAuthService = service
+	t.Cleanup(func() { globalAuthService = prev })
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/api/v1/auth/oidc/login", nil)
+	OIDCLoginHandler(c)
+	if w.Code != 302 {
+		t.Fatalf("login: %d", w.Code)
+	}
+	state := idp.authorize(t, w.Header().Get("Location"), "")
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcStateCookie || cookies[0].Value != state {
+		t.Fatalf("login cookies = %+v", cookies)
+	}
+	if ck := cookies[0]; !ck.HttpOnly || !ck.Secure || ck.SameSite != http.SameSiteLaxMode || ck.Path != "/api/v1/auth/oidc" {
+		t.Errorf("state cookie = %+v", ck)
+	}
+
+	// A callback URL planted in another browser carries no or another state
+	for name, cookie := range map[string]string{"no cookie": "", "other login": "state-of-another-login"} {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("GET", "/api/v1/auth/oidc/callback?code=good-code&state="+url.QueryEscape(state), nil)
+		if cookie != "" {
+			c.Request.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: cookie})
+		}
+		OIDCCallbackHandler(c)
+		if w.Code != 401 {
+			t.Errorf("%s: callback %d, want 401", name, w.Code)
+		}
+	}
+}
+
+func TestOIDCMappings(t *testing.T) {
+	mappings, err := parseProjectGroups("ops=12:operator, ops-leads=12:admin,staff=7:viewer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []string{"ops", "ops=x:viewer", "ops=12", "ops=12:root"} {
+		if _, err := parseProjectGroups(bad); err == nil {
+			t.Errorf("parseProjectGroups(%q) accepted", bad)
+		}
+	}
+
+	p := newOIDCProvider(&OIDCConfig{AdminGroups: []string{"platform"}, ProjectGroups: mappings})
+	if role, ok := p.platformRole([]string{"ops", "platform"}); !ok || role != "admin" {
+		t.Errorf("platformRole = %q, %v, want admin", role, ok)
+	}
+	if role, ok := p.platformRole([]string{"ops"}); !ok || role != "user" {
+		t.Errorf("platformRole = %q, %v, want user", role, ok)
+	}
+
+	grants := p.projectGrants([]string{"ops-leads", "ops", "staff"})
+	if want := map[int]string{12: "admin", 7: "viewer"}; !reflect.DeepEqual(grants, want) {
+		t.Errorf("projectGrants = %v, want %v", grants, want)
+	}
+
+	unmapped := newOIDCProvider(&OIDCConfig{})
+	if _, ok := unmapped.platformRole([]string{"platform"}); ok {
+		t.Error("roles must stay local without admin groups")
+	}
+}
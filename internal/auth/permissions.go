@@ -0,0 +1,366 @@
+package auth
+
+import (
+	"aexon/internal/db"
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// PERMISSION CATALOG
+// ============================================================================
+
+// Permissions are "<resource>:<action>". Roles are granted patterns in which
+// "*" stands for a whole segment ("instances:*") or for everything ("*").
+const (
+	PermInstancesRead    = "instances:read"
+	PermInstancesCreate  = "instances:create"
+	PermInstancesDelete  = "instances:delete"
+	PermInstancesOperate = "instances:operate"
+	PermInstancesResize  = "instances:resize"
+
+	PermSnapshotsRead   = "snapshots:read"
+	PermSnapshotsCreate = "snapshots:create"
+	PermSnapshotsDelete = "snapshots:delete"
+	PermBackupsManage   = "backups:manage"
+	PermBackupsRestore  = "backups:restore"
+
+	PermFilesRead  = "files:read"
+	PermFilesWrite = "files:write"
+
+	PermISOsRead        = "isos:read"
+	PermISOsManage      = "isos:manage"
+	PermJobsRead        = "jobs:read"
+	PermJobsCancel      = "jobs:cancel"
+	PermWorkflowsCreate = "workflows:create"
+	PermTemplatesRead   = "templates:read"
+
+	PermNetworksRead         = "networks:read"
+	PermNetworksManage       = "networks:manage"
+	PermSecurityGroupsRead   = "security_groups:read"
+	PermSecurityGroupsManage = "security_groups:manage"
+	PermSecurityGroupsAttach = "security_groups:attach"
+	PermFloatingIPsRead      = "floating_ips:read"
+	PermFloatingIPsManage    = "floating_ips:manage"
+	PermFloatingIPsAttach    = "floating_ips:attach"
+	PermTrafficRead          = "traffic:read"
+	PermTrafficManage        = "traffic:manage"
+
+	PermProjectsList    = "projects:list"
+	PermProjectsCreate  = "projects:create"
+	PermProjectsRead    = "projects:read"
+	PermProjectsUpdate  = "projects:update"
+	PermProjectsDelete  = "projects:delete"
+	PermProjectsLeave   = "projects:leave"
+	PermMembersRead     = "members:read"
+	PermMembersManage   = "members:manage"
+	PermInvitationsJoin = "invitations:accept"
+	PermSessionsRevoke  = "sessions:revoke"
+	PermAPITokensManage = "api_tokens:manage"
+	PermMFAManage       = "mfa:manage"
+	PermPasswordChange  = "password:change"
+
+	PermClusterRead = "cluster:read"
+	PermSystemRead  = "system:read"
+	PermRolesManage = "roles:manage"
+	PermMFAPolicy   = "mfa_policy:manage"
+	PermUsersRead   = "users:read"
+	PermUsersManage = "users:manage"
+	PermSigningKeys = "signing_keys:manage"
+	PermAuditRead   = "audit:read"
+
+	PermQuotasRead     = "quotas:read"
+	PermQuotasManage   = "quotas:manage"
+	PermPlansRead      = "plans:read"
+	PermPlansManage    = "plans:manage"
+	PermBrandingManage = "branding:manage"
+	PermBillingRead    = "billing:read"
+	PermBillingManage  = "billing:manage"
+)
+
+// PermissionInfo describes one entry of the catalog.
+type PermissionInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// Catalog lists every permission a route can require.
+var Catalog = []PermissionInfo{
+	{PermInstancesRead, "View instances, their metrics and logs"},
+	{PermInstancesCreate, "Create instances"},
+	{PermInstancesDelete, "Delete instances"},
+	{PermInstancesOperate, "Start, stop and restart instances"},
+	{PermInstancesResize, "Change instance resource limits"},
+	{PermSnapshotsRead, "List snapshots"},
+	{PermSnapshotsCreate, "Take snapshots"},
+	{PermSnapshotsDelete, "Delete snapshots"},
+	{PermBackupsManage, "Configure scheduled backups"},
+	{PermBackupsRestore, "Restore an instance from a snapshot"},
+	{PermFilesRead, "Browse and download instance files"},
+	{PermFilesWrite, "Upload and delete instance files"},
+	{PermISOsRead, "List ISO images"},
+	{PermISOsManage, "Upload and delete ISO images"},
+	{PermJobsRead, "View jobs"},
+	{PermJobsCancel, "Cancel pending and running jobs"},
+	{PermWorkflowsCreate, "Queue workflows of jobs on instances"},
+	{PermTemplatesRead, "List instance templates"},
+	{PermNetworksRead, "View networks"},
+	{PermNetworksManage, "Create and delete networks"},
+	{PermSecurityGroupsRead, "View security groups and instance firewalls"},
+	{PermSecurityGroupsManage, "Create, edit and delete security groups"},
+	{PermSecurityGroupsAttach, "Attach security groups to instances"},
+	{PermFloatingIPsRead, "View floating IPs"},
+	{PermFloatingIPsManage, "Allocate and release floating IPs"},
+	{PermFloatingIPsAttach, "Attach floating IPs to instances"},
+	{PermTrafficRead, "View traffic accounting"},
+	{PermTrafficManage, "Set traffic quotas"},
+	{PermProjectsList, "List own projects"},
+	{PermProjectsCreate, "Create projects"},
+	{PermProjectsRead, "View a project"},
+	{PermProjectsUpdate, "Rename a project"},
+	{PermProjectsDelete, "Delete a project"},
+	{PermProjectsLeave, "Leave a project"},
+	{PermMembersRead, "List project members"},
+	{PermMembersManage, "Manage project members and invitations"},
+	{PermInvitationsJoin, "Accept project invitations"},
+	{PermSessionsRevoke, "Log out of all sessions"},
+	{PermAPITokensManage, "Create, list and revoke own API tokens"},
+	{PermMFAManage, "Enrol in and manage own two-factor authentication"},
+	{PermPasswordChange, "Change own password"},
+	{PermClusterRead, "View hypervisor cluster members"},
+	{PermSystemRead, "View control plane metrics"},
+	{PermRolesManage, "Edit role permissions"},
+	{PermMFAPolicy, "Require two-factor authentication for platform roles"},
+	{PermUsersRead, "List user accounts"},
+	{PermUsersManage, "Create, edit, disable and delete user accounts and reset passwords"},
+	{PermSigningKeys, "View and rotate the token signing keys"},
+	{PermAuditRead, "Search the audit log and verify its integrity"},
+	{PermQuotasRead, "View own and the current project's quota usage"},
+	{PermQuotasManage, "Set user and project resource quotas"},
+	{PermPlansRead, "List plans and view the plan in effect"},
+	{PermPlansManage, "Define plans and assign them to users and projects"},
+	{PermBrandingManage, "Customise branding, where the plan includes it"},
+	{PermBillingRead, "View own usage and invoices"},
+	{PermBillingManage, "Set price sheets and view everyone's usage and invoices"},
+}
+
+// MatchPermission reports whether the granted pattern covers perm.
+func MatchPermission(pattern, perm string) bool {
+	if pattern == "*" {
+		return true
+	}
+	want, have := strings.Split(pattern, ":"), strings.Split(perm, ":")
+	if len(want) != len(have) {
+		return false
+	}
+	for i := range want {
+		if want[i] != "*" && want[i] != have[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// HasPermission reports whether any of the granted patterns covers perm.
+func HasPermission(granted []string, perm string) bool {
+	for _, p := range granted {
+		if MatchPermission(p, perm) {
+			return true
+		}
+	}
+	return false
+}
+
+// validPattern accepts patterns that cover at least one catalog entry.
+func validPattern(pattern string) bool {
+	for _, p := range Catalog {
+		if MatchPermission(pattern, p.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// ============================================================================
+// DIRECTORY
+// ============================================================================
+
+// Directory answers the membership and permission lookups of the
+// middleware. The default one reads the database.
+type Directory interface {
+	DefaultProject(ctx context.Context, userID int) (projectID int, role string, err error)
+	ProjectRole(ctx context.Context, projectID, userID int) (string, error)
+	RolePermissions(ctx context.Context) (map[string][]string, error)
+}
+
+const rolePermissionsTTL = 30 * time.Second
+
+type dbDirectory struct {
+	mu       sync.Mutex
+	roles    map[string][]string
+	loadedAt time.Time
+}
+
+var directory Directory = &dbDirectory{}
+
+// SetDirectory replaces the directory and returns a function restoring the
+// previous one.
+func SetDirectory(d Directory) func() {
+	prev := directory
+	directory = d
+	return func() { directory = prev }
+}
+
+func (d *dbDirectory) DefaultProject(ctx context.Context, userID int) (int, string, error) {
+	return db.NewProjectRepository(db.GetService()).DefaultFor(ctx, userID)
+}
+
+func (d *dbDirectory) ProjectRole(ctx context.Context, projectID, userID int) (string, error) {
+	return db.NewProjectRepository(db.GetService()).MemberRole(ctx, projectID, userID)
+}
+
+// RolePermissions caches the role table briefly; edits through the API
+// invalidate it immediately.
+func (d *dbDirectory) RolePermissions(ctx context.Context) (map[string][]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.roles != nil && time.Since(d.loadedAt) < rolePermissionsTTL {
+		return d.roles, nil
+	}
+	roles, err := db.NewRolePermissionRepository(db.GetService()).List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d.roles, d.loadedAt = roles, time.Now()
+	return roles, nil
+}
+
+func (d *dbDirectory) invalidate() {
+	d.mu.Lock()
+	d.roles = nil
+	d.mu.Unlock()
+}
+
+// grantedPermissions unions the patterns of the platform role and of the
+// role in the current project.
+func grantedPermissions(ctx context.Context, platformRole, projectRole string) ([]string, error) {
+	roles, err := directory.RolePermissions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	granted := append([]string{}, roles[db.PlatformRole(platformRole)]...)
+	if projectRole != "" {
+		granted = append(granted, roles[projectRole]...)
+	}
+	return granted, nil
+}
+
+// setScope stores the scope and the permissions it grants on the request.
+func setScope(c *gin.Context, scope db.Scope) error {
+	granted, err := grantedPermissions(c.Request.Context(), c.GetString("role"), scope.Role)
+	if err != nil {
+		return err
+	}
+	c.Set("project_id", scope.ProjectID)
+	c.Set("project_role", scope.Role)
+	c.Set("permissions", granted)
+	c.Request = c.Request.WithContext(db.WithScope(c.Request.Context(), scope))
+	return nil
+}
+
+// ScopeToProject moves the request into the project named by the path
+// parameter, so that project routes are authorized against the caller's
+// role in that project rather than in the selected one.
+func ScopeToProject(param string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scope, _ := db.ScopeFrom(c.Request.Context())
+		pid, err := strconv.Atoi(c.Param(param))
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": "Invalid project ID"})
+			return
+		}
+
+		role, err := directory.ProjectRole(c.Request.Context(), pid, scope.UserID)
+		switch {
+		case errors.Is(err, sql.ErrNoRows) && scope.Admin:
+			role = db.ProjectRoleOwner
+		case errors.Is(err, sql.ErrNoRows):
+			c.AbortWithStatusJSON(404, gin.H{"error": "Project not found"})
+			return
+		case err != nil:
+			log.Printf("[Auth] Project lookup failed: %v", err)
+			c.AbortWithStatusJSON(500, gin.H{"error": "internal error"})
+			return
+		}
+
+		scope.ProjectID, scope.Role = pid, role
+		if err := setScope(c, scope); err != nil {
+			log.Printf("[Auth] Permission lookup failed: %v", err)
+			c.AbortWithStatusJSON(500, gin.H{"error": "internal error"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// ============================================================================
+// ROLE HANDLERS
+// ============================================================================
+
+func ListRolesHandler(c *gin.Context) {
+	roles, err := db.NewRolePermissionRepository(db.GetService()).List(c.Request.Context())
+	if err != nil {
+		log.Printf("[Auth] List roles error: %v", err)
+		c.JSON(500, gin.H{"error": "failed to fetch roles"})
+		return
+	}
+	c.JSON(200, gin.H{
+		"roles":       roles,
+		"permissions": Catalog,
+	})
+}
+
+func SetRolePermissionsHandler(c *gin.Context) {
+	var req struct {
+		Permissions []string `json:"permissions"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "invalid request"})
+		return
+	}
+
+	role := c.Param("role")
+	if !db.ValidPermissionRole(role) {
+		c.JSON(400, gin.H{"error": "unknown role", "role": role})
+		return
+	}
+	for _, p := range req.Permissions {
+		if !validPattern(p) {
+			c.JSON(400, gin.H{"error": "unknown permission", "permission": p})
+			return
+		}
+	}
+	sort.Strings(req.Permissions)
+
+	if err := db.NewRolePermissionRepository(db.GetService()).Set(c.Request.Context(), role, req.Permissions); err != nil {
+		log.Printf("[Auth] Set role permissions error: %v", err)
+		c.JSON(500, gin.H{"error": "failed to update role"})
+		return
+	}
+	if d, ok := directory.(*dbDirectory); ok {
+		d.invalidate()
+	}
+	log.Printf("[Auth] Permissions of role %s set to %v", role, req.Permissions)
+
+	c.JSON(200, gin.H{"role": role, "permissions": req.Permissions})
+}
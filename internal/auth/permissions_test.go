@@ -0,0 +1,39 @@
+package auth
+
+import "testing"
+
+func TestMatchPermission(t *testing.T) {
+	cases := []struct {
+		pattern, perm string
+		want          bool
+	}{
+		{"*", PermInstancesCreate, true},
+		{"*", PermRolesManage, true},
+		{"instances:*", PermInstancesCreate, true},
+		{"instances:*", PermSnapshotsCreate, false},
+		{"*:read", PermNetworksRead, true},
+		{"*:read", PermNetworksManage, false},
+		{PermInstancesRead, PermInstancesRead, true},
+		{PermInstancesRead, PermInstancesDelete, false},
+		{"instances", PermInstancesRead, false},
+		{"instances:read:extra", PermInstancesRead, false},
+	}
+	for _, tc := range cases {
+		if got := MatchPermission(tc.pattern, tc.perm); got != tc.want {
+			t.Errorf("MatchPermission(%q, %q) = %v, want %v", tc.pattern, tc.perm, got, tc.want)
+		}
+	}
+}
+
+func TestValidPattern(t *testing.T) {
+	for _, p := range Catalog {
+		if !validPattern(p.Name) {
+			t.Errorf("catalog entry %q rejected", p.Name)
+		}
+	}
+	for _, p := range []string{"instance:read", "instances:launch", "payroll:*"} {
+		if validPattern(p) {
+			t.Errorf("pattern %q accepted", p)
+		}
+	}
+}
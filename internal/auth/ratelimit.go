@@ -0,0 +1,349 @@
+package auth
+
+import (
+	"aexon/internal/db"
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// RATE LIMITING
+// ============================================================================
+
+// Failed logins are counted per client IP and per account, so that neither
+// one address trying many accounts nor many addresses trying one account
+// get far. A key reaching its limit is locked out; each further lockout
+// lasts twice as long, and a key left alone for MaxLockoutDuration starts
+// over. Accounts are locked out for MaxAccountLockout at most: anyone
+// knowing an email can cause those lockouts, and the IP limit is what stops
+// a single address from guessing on. Wrong second-factor codes are counted
+// per user as well, so that a stolen password is no head start for guessing
+// codes.
+
+// throttleStore keeps the login throttles by key.
+type throttleStore interface {
+	Get(ctx context.Context, key string) (db.LoginThrottle, error)
+	Update(ctx context.Context, key string, fn func(*db.LoginThrottle)) (db.LoginThrottle, error)
+	Delete(ctx context.Context, key string) error
+	Purge(ctx context.Context, before time.Time) error
+}
+
+// memoryThrottleStore keeps the throttles of this process only.
+type memoryThrottleStore struct {
+	throttles map[string]db.LoginThrottle
+	mu        sync.Mutex
+}
+
+func newMemoryThrottleStore() *memoryThrottleStore {
+	return &memoryThrottleStore{throttles: make(map[string]db.LoginThrottle)}
+}
+
+func (s *memoryThrottleStore) Get(ctx context.Context, key string) (db.LoginThrottle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.throttles[key]
+	if !ok {
+		t.Key = key
+	}
+	return t, nil
+}
+
+func (s *memoryThrottleStore) Update(ctx context.Context, key string, fn func(*db.LoginThrottle)) (db.LoginThrottle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.throttles[key]
+	if !ok {
+		t.Key = key
+	}
+	fn(&t)
+	s.throttles[key] = t
+	return t, nil
+}
+
+func (s *memoryThrottleStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.throttles, key)
+	return nil
+}
+
+func (s *memoryThrottleStore) Purge(ctx context.Context, before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, t := range s.throttles {
+		if t.UpdatedAt.Before(before) && t.LockedUntil.Before(before) {
+			delete(s.throttles, key)
+		}
+	}
+	return nil
+}
+
+type RateLimiter struct {
+	config *Config
+	store  throttleStore
+	now    func() time.Time
+}
+
+var rateLimiter = &RateLimiter{
+	store: newMemoryThrottleStore(),
+	now:   time.Now,
+}
+
+// SetConfig applies cfg, moving the throttles to Postgres when it asks
+// for persistence.
+func (r *RateLimiter) SetConfig(cfg *Config) {
+	r.config = cfg
+	if cfg.PersistRateLimit {
+		r.store = db.NewLoginThrottleRepository(db.GetService())
+	}
+}
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+func accountThrottleKey(account string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(account))
+}
+
+func mfaThrottleKey(userID int) string {
+	return "mfa:" + strconv.Itoa(userID)
+}
+
+// throttleLimit is how a throttle key is limited.
+type throttleLimit struct {
+	attempts   int           // Failures within RateLimitWindow that lock the key out
+	maxLockout time.Duration // Longest lockout of the key
+}
+
+// keys returns the throttle keys of an attempt with their limits; an empty
+// account, or a limit of 0, is not throttled.
+func (r *RateLimiter) keys(ip, account string) map[string]throttleLimit {
+	keys := make(map[string]throttleLimit, 2)
+	if r.config.MaxLoginAttempts > 0 {
+		keys[ipThrottleKey(ip)] = throttleLimit{r.config.MaxLoginAttempts, r.config.MaxLockoutDuration}
+	}
+	if account != "" && r.config.MaxAccountAttempts > 0 {
+		max := r.config.MaxAccountLockout
+		if max <= 0 {
+			max = r.config.MaxLockoutDuration
+		}
+		keys[accountThrottleKey(account)] = throttleLimit{r.config.MaxAccountAttempts, max}
+	}
+	return keys
+}
+
+// mfaKeys returns the throttle keys of a second-factor code of the user.
+func (r *RateLimiter) mfaKeys(ip string, userID int) map[string]throttleLimit {
+	keys := r.keys(ip, "")
+	if r.config.MaxMFAAttempts > 0 {
+		keys[mfaThrottleKey(userID)] = throttleLimit{r.config.MaxMFAAttempts, r.config.MaxLockoutDuration}
+	}
+	return keys
+}
+
+// Check returns how long the client IP or the account is still locked out,
+// 0 when attempts are allowed.
+func (r *RateLimiter) Check(ctx context.Context, ip, account string) (time.Duration, error) {
+	if r.config == nil || !r.config.EnableRateLimit {
+		return 0, nil
+	}
+	return r.check(ctx, r.keys(ip, account))
+}
+
+// CheckMFA returns how long the client IP or the user's second factor is
+// still locked out, 0 when codes are accepted.
+func (r *RateLimiter) CheckMFA(ctx context.Context, ip string, userID int) (time.Duration, error) {
+	if r.config == nil || !r.config.EnableRateLimit {
+		return 0, nil
+	}
+	return r.check(ctx, r.mfaKeys(ip, userID))
+}
+
+func (r *RateLimiter) check(ctx context.Context, keys map[string]throttleLimit) (time.Duration, error) {
+	var wait time.Duration
+	now := r.now()
+	for key := range keys {
+		t, err := r.store.Get(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		if left := t.LockedUntil.Sub(now); left > wait {
+			wait = left
+		}
+	}
+	return wait, nil
+}
+
+// lockout returns how long the given lockout of a key lasts.
+func (r *RateLimiter) lockout(strikes int, max time.Duration) time.Duration {
+	d := r.config.LockoutDuration
+	for i := 1; i < strikes && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// Fail counts a failed attempt against the client IP and the account,
+// locking out those reaching their limit. Lockouts are recorded in the
+// audit log.
+func (r *RateLimiter) Fail(ctx context.Context, ip, account string) {
+	if r.config == nil || !r.config.EnableRateLimit {
+		return
+	}
+	r.fail(ctx, ip, r.keys(ip, account))
+}
+
+// FailMFA counts a wrong second-factor code against the client IP and the
+// user.
+func (r *RateLimiter) FailMFA(ctx context.Context, ip string, userID int) {
+	if r.config == nil || !r.config.EnableRateLimit {
+		return
+	}
+	r.fail(ctx, ip, r.mfaKeys(ip, userID))
+}
+
+func (r *RateLimiter) fail(ctx context.Context, ip string, keys map[string]throttleLimit) {
+	now := r.now()
+	for key, limit := range keys {
+		locked := false
+		t, err := r.store.Update(ctx, key, func(t *db.LoginThrottle) {
+			if now.Sub(t.UpdatedAt) > r.config.MaxLockoutDuration {
+				t.Strikes = 0
+			}
+			if now.Sub(t.WindowStart) >= r.config.RateLimitWindow {
+				t.Failures, t.WindowStart = 0, now
+			}
+			t.Failures++
+			t.UpdatedAt = now
+			if t.Failures >= limit.attempts {
+				t.Strikes++
+				t.Failures, t.WindowStart = 0, now
+				t.LockedUntil = now.Add(r.lockout(t.Strikes, limit.maxLockout))
+				locked = true
+			}
+		})
+		if err != nil {
+			log.Printf("[Auth] Recording failed login for %s failed: %v", key, err)
+			continue
+		}
+		if locked {
+			r.recordLockout(ctx, ip, t)
+		}
+	}
+}
+
+func (r *RateLimiter) recordLockout(ctx context.Context, ip string, t db.LoginThrottle) {
+	globalAuthMetrics.lockouts.Add(1)
+	log.Printf("[Auth] %s locked out until %s (lockout %d)", t.Key, t.LockedUntil.Format(time.RFC3339), t.Strikes)
+
+	scope, _, _ := strings.Cut(t.Key, ":")
+	request, _ := json.Marshal(map[string]interface{}{
+		"scope":        scope,
+		"lockout":      t.Strikes,
+		"locked_until": t.LockedUntil.UTC().Format(time.RFC3339),
+	})
+	RecordAuditEvent(ctx, &db.AuditEvent{
+		SourceIP: ip,
+		Action:   "auth.lockout",
+		Target:   t.Key,
+		Request:  request,
+		Outcome:  db.AuditDenied,
+	})
+}
+
+// Reset forgets the failures of the account after a successful attempt.
+// Those of the client IP expire with the window instead, or an attacker
+// could clear them by logging in to an account of their own.
+func (r *RateLimiter) Reset(ctx context.Context, account string) {
+	if r.config == nil || !r.config.EnableRateLimit || account == "" {
+		return
+	}
+	if err := r.store.Delete(ctx, accountThrottleKey(account)); err != nil {
+		log.Printf("[Auth] Resetting login throttle of %s failed: %v", account, err)
+	}
+}
+
+// ResetMFA forgets the wrong codes of the user after a right one.
+func (r *RateLimiter) ResetMFA(ctx context.Context, userID int) {
+	if r.config == nil || !r.config.EnableRateLimit {
+		return
+	}
+	if err := r.store.Delete(ctx, mfaThrottleKey(userID)); err != nil {
+		log.Printf("[Auth] Resetting 2FA throttle of user %d failed: %v", userID, err)
+	}
+}
+
+func (r *RateLimiter) Cleanup(ctx context.Context) error {
+	if r.config == nil {
+		return nil
+	}
+	return r.store.Purge(ctx, r.now().Add(-r.config.MaxLockoutDuration))
+}
+
+func StartRateLimitCleanup(ctx context.Context) {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := rateLimiter.Cleanup(ctx); err != nil {
+				log.Printf("[Auth] Purging login throttles failed: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// throttled answers 429 when the client IP or the account is locked out;
+// an empty account only checks the IP.
+func throttled(c *gin.Context, account string) bool {
+	wait, err := rateLimiter.Check(c.Request.Context(), c.ClientIP(), account)
+	return tooManyAttempts(c, wait, err)
+}
+
+// throttledMFA answers 429 when the client IP or the user's second factor
+// is locked out.
+func throttledMFA(c *gin.Context, userID int) bool {
+	wait, err := rateLimiter.CheckMFA(c.Request.Context(), c.ClientIP(), userID)
+	return tooManyAttempts(c, wait, err)
+}
+
+func tooManyAttempts(c *gin.Context, wait time.Duration, err error) bool {
+	if err != nil {
+		log.Printf("[Auth] Login throttle lookup error: %v", err)
+		c.JSON(500, gin.H{"error": "internal error"})
+		return true
+	}
+	if wait <= 0 {
+		return false
+	}
+
+	globalAuthMetrics.rateLimitHits.Add(1)
+	retry := int((wait + time.Second - 1) / time.Second)
+	c.Header("Retry-After", strconv.Itoa(retry))
+	c.JSON(429, gin.H{
+		"error":       "too many attempts",
+		"code":        ErrCodeRateLimitExceeded,
+		"retry_after": retry,
+	})
+	return true
+}
+
+// TrustedProxies returns the proxies whose forwarding headers may name the
+// client, for the router to trust.
+func (s *AuthService) TrustedProxies() []string {
+	return s.config.TrustedProxies
+}
@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"aexon/internal/db"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterLockout(t *testing.T) {
+	rec := &recordingAuditLog{}
+	t.Cleanup(SetAuditLog(rec))
+
+	now := time.Unix(1700000000, 0)
+	r := &RateLimiter{
+		config: &Config{
+			EnableRateLimit:    true,
+			MaxLoginAttempts:   3,
+			MaxAccountAttempts: 5,
+			RateLimitWindow:    15 * time.Minute,
+			LockoutDuration:    time.Minute,
+			MaxLockoutDuration: 3 * time.Minute,
+			MaxAccountLockout:  time.Minute,
+		},
+		store: newMemoryThrottleStore(),
+		now:   func() time.Time { return now },
+	}
+	ctx := context.Background()
+	wait := func(ip, account string) time.Duration {
+		t.Helper()
+		d, err := r.Check(ctx, ip, account)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	// One address trying many accounts is stopped by the IP limit
+	for i := 0; i < 3; i++ {
+		r.Fail(ctx, "10.0.0.1", "")
+	}
+	if d := wait("10.0.0.1", "bob@example.com"); d != time.Minute {
+		t.Errorf("IP after 3 failures: wait %v, want 1m", d)
+	}
+	if d := wait("10.0.0.2", ""); d != 0 {
+		t.Errorf("other IP: wait %v", d)
+	}
+
+	// Many addresses trying one account are stopped by the account limit
+	for i := 0; i < 5; i++ {
+		r.Fail(ctx, fmt.Sprintf("192.0.2.%d", i+1), "Alice@Example.com")
+	}
+	if d := wait("198.51.100.7", "alice@example.com"); d != time.Minute {
+		t.Errorf("account after 5 failures from 5 IPs: wait %v, want 1m", d)
+	}
+
+	// Each further lockout lasts twice as long, up to the maximum
+	for _, want := range []time.Duration{2 * time.Minute, 3 * time.Minute} {
+		now = now.Add(want) // Just past the previous lockout
+		for i := 0; i < 3; i++ {
+			r.Fail(ctx, "10.0.0.1", "")
+		}
+		if d := wait("10.0.0.1", ""); d != want {
+			t.Errorf("next lockout: wait %v, want %v", d, want)
+		}
+	}
+
+	// Accounts, which anyone can lock out, stay at their shorter maximum
+	for i := 0; i < 5; i++ {
+		r.Fail(ctx, fmt.Sprintf("192.0.2.%d", i+1), "alice@example.com")
+	}
+	if d := wait("198.51.100.7", "alice@example.com"); d != time.Minute {
+		t.Errorf("second account lockout: wait %v, want 1m", d)
+	}
+
+	// Success clears the account, not the IP
+	r.Reset(ctx, "alice@example.com")
+	if d := wait("198.51.100.7", "alice@example.com"); d != 0 {
+		t.Errorf("account after reset: wait %v", d)
+	}
+
+	// Left alone long enough, a key starts over
+	now = now.Add(4 * time.Minute)
+	for i := 0; i < 3; i++ {
+		r.Fail(ctx, "10.0.0.1", "")
+	}
+	if d := wait("10.0.0.1", ""); d != time.Minute {
+		t.Errorf("lockout after a quiet period: wait %v, want 1m", d)
+	}
+
+	if len(rec.events) != 6 {
+		t.Fatalf("recorded %d lockout events, want 6", len(rec.events))
+	}
+	e := rec.events[1]
+	if e.Action != "auth.lockout" || e.Target != "account:alice@example.com" || e.Outcome != db.AuditDenied || e.Actor != "system" {
+		t.Errorf("account lockout event = %+v", e)
+	}
+}
+
+func TestRateLimiterMFA(t *testing.T) {
+	t.Cleanup(SetAuditLog(&recordingAuditLog{}))
+
+	now := time.Unix(1700000000, 0)
+	r := &RateLimiter{
+		config: &Config{
+			EnableRateLimit:    true,
+			MaxLoginAttempts:   10,
+			MaxMFAAttempts:     3,
+			RateLimitWindow:    15 * time.Minute,
+			LockoutDuration:    time.Minute,
+			MaxLockoutDuration: 3 * time.Minute,
+		},
+		store: newMemoryThrottleStore(),
+		now:   func() time.Time { return now },
+	}
+	ctx := context.Background()
+	wait := func(ip string, uid int) time.Duration {
+		t.Helper()
+		d, err := r.CheckMFA(ctx, ip, uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	// Guessing codes from many addresses locks out the user's second factor
+	for i := 0; i < 3; i++ {
+		r.FailMFA(ctx, fmt.Sprintf("192.0.2.%d", i+1), 7)
+	}
+	if d := wait("198.51.100.7", 7); d != time.Minute {
+		t.Errorf("user after 3 wrong codes: wait %v, want 1m", d)
+	}
+	if d := wait("198.51.100.7", 8); d != 0 {
+		t.Errorf("other user: wait %v", d)
+	}
+	if d, _ := r.Check(ctx, "198.51.100.7", "alice@example.com"); d != 0 {
+		t.Errorf("password logins throttled by wrong codes: wait %v", d)
+	}
+
+	r.ResetMFA(ctx, 7)
+	if d := wait("198.51.100.7", 7); d != 0 {
+		t.Errorf("user after reset: wait %v", d)
+	}
+}
@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"aexon/internal/db"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// FIRST-RUN SETUP
+// ============================================================================
+
+const (
+	signingKeySecret   = "jwt_signing_key"
+	signingKeyBytes    = 64
+	setupTokenBytes    = 24
+	minSetupTokenChars = 16
+)
+
+// ProductionMode reports whether AXION_ENV declares a production deployment,
+// in which the control plane refuses to start with insecure defaults.
+func ProductionMode() bool {
+	return strings.EqualFold(os.Getenv("AXION_ENV"), "production")
+}
+
+// loadSigningKey uses the key generated on the first start of any instance
+// sharing the database, generating it if this is that start.
+func (s *AuthService) loadSigningKey(ctx context.Context) error {
+	fresh := make([]byte, signingKeyBytes)
+	if _, err := rand.Read(fresh); err != nil {
+		return err
+	}
+	key, err := s.secrets.GetOrCreate(ctx, signingKeySecret, fresh)
+	if err != nil {
+		return err
+	}
+	if len(key) < minSecretLength {
+		return errors.New("stored signing key is too short")
+	}
+	s.config.SecretKey = key
+	log.Println("[Auth] Using the generated JWT signing key (set JWT_SECRET to override)")
+	return nil
+}
+
+// setupState guards the creation of the first administrator. While no user
+// exists, a one-time token known only to whoever reads the logs (or set
+// AXION_SETUP_TOKEN) is required to claim the installation.
+type setupState struct {
+	mu        sync.Mutex
+	active    bool
+	tokenHash [sha256.Size]byte
+}
+
+// StartSetup enters setup mode when the database has no users yet. A setup
+// token is taken from AXION_SETUP_TOKEN or generated and printed to stdout.
+func (s *AuthService) StartSetup(ctx context.Context) error {
+	count, err := s.repo.Count(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to check user count: %w", err)
+	}
+	if count > 0 {
+		return nil // Already initialized
+	}
+
+	token := os.Getenv("AXION_SETUP_TOKEN")
+	if token == "" {
+		b := make([]byte, setupTokenBytes)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		token = hex.EncodeToString(b)
+		// Deliberately not logged: log shippers should not see it
+		fmt.Printf("\n  First-run setup: create the administrator with POST /api/v1/setup\n  Setup token: %s\n\n", token)
+	}
+
+	s.setup.mu.Lock()
+	s.setup.active = true
+	s.setup.tokenHash = sha256.Sum256([]byte(token))
+	s.setup.mu.Unlock()
+
+	log.Println("[Auth] No users yet: setup mode enabled")
+	return nil
+}
+
+// InsecureDefaults lists the settings that must not be used in production.
+func (s *AuthService) InsecureDefaults(ctx context.Context) ([]string, error) {
+	var problems []string
+	if secret := getSecret(); secret != "" && len(secret) < minSecretLength {
+		problems = append(problems, fmt.Sprintf("JWT_SECRET is shorter than %d characters", minSecretLength))
+	}
+	if token := os.Getenv("AXION_SETUP_TOKEN"); token != "" && len(token) < minSetupTokenChars {
+		problems = append(problems, fmt.Sprintf("AXION_SETUP_TOKEN is shorter than %d characters", minSetupTokenChars))
+	}
+	if !s.config.RequireStrongPass {
+		problems = append(problems, "REQUIRE_STRONG_PASSWORD is disabled")
+	}
+
+	// Seeded by earlier versions
+	legacy, err := s.repo.GetByEmail(ctx, "admin@admin")
+	if err != nil {
+		return nil, err
+	}
+	if legacy != nil && CheckPasswordHash("admin", legacy.PasswordHash) {
+		problems = append(problems, "the account admin@admin still has the default password")
+	}
+	return problems, nil
+}
+
+// ============================================================================
+// SETUP HANDLERS
+// ============================================================================
+
+func SetupStatusHandler(c *gin.Context) {
+	setup := &GetAuthService().setup
+	setup.mu.Lock()
+	active := setup.active
+	setup.mu.Unlock()
+	c.JSON(200, gin.H{"setup_required": active})
+}
+
+// SetupHandler creates the first administrator and logs them in.
+func SetupHandler(c *gin.Context) {
+	service := GetAuthService()
+
+	if throttled(c, "") {
+		return
+	}
+
+	var req struct {
+		SetupToken string `json:"setup_token" binding:"required"`
+		Email      string `json:"email" binding:"required"`
+		Password   string `json:"password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "invalid request"})
+		return
+	}
+
+	setup := &service.setup
+	setup.mu.Lock()
+	defer setup.mu.Unlock()
+	if !setup.active {
+		c.JSON(409, gin.H{"error": "setup already completed"})
+		return
+	}
+	sum := sha256.Sum256([]byte(req.SetupToken))
+	if subtle.ConstantTimeCompare(sum[:], setup.tokenHash[:]) != 1 {
+		rateLimiter.Fail(c.Request.Context(), c.ClientIP(), "")
+		c.JSON(401, gin.H{"error": "invalid setup token", "code": ErrCodeInvalidCredentials})
+		return
+	}
+
+	email, ok := normalizeEmail(req.Email)
+	if !ok {
+		c.JSON(400, gin.H{"error": "invalid email"})
+		return
+	}
+	if err := ValidatePasswordStrength(req.Password); err != nil {
+		c.JSON(400, gin.H{"error": err.Error(), "code": ErrCodePasswordTooWeak})
+		return
+	}
+	hash, err := HashPassword(req.Password)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "internal error"})
+		return
+	}
+
+	admin := &db.User{Email: email, PasswordHash: hash}
+	err = service.repo.CreateFirstAdmin(c.Request.Context(), admin)
+	if errors.Is(err, db.ErrAlreadySetUp) {
+		// Another instance sharing the database was set up first
+		setup.active = false
+		c.JSON(409, gin.H{"error": "setup already completed"})
+		return
+	}
+	if err != nil {
+		log.Printf("[Auth] Setup error: %v", err)
+		c.JSON(500, gin.H{"error": "failed to create administrator"})
+		return
+	}
+
+	setup.active = false
+	AuditActor(c, admin.ID, admin.Email)
+	log.Printf("[Auth] Setup completed: administrator %s created", admin.Email)
+	service.issueSession(c, admin)
+}
@@ -0,0 +1,330 @@
+package auth
+
+import (
+	"aexon/internal/db"
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// USER MANAGEMENT
+// ============================================================================
+
+const (
+	defaultUserPageSize = 50
+	maxUserPageSize     = 200
+)
+
+func userIDParam(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "invalid user id"})
+		return 0, false
+	}
+	return id, true
+}
+
+func normalizeEmail(email string) (string, bool) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	return email, strings.Contains(email, "@")
+}
+
+func writeUserError(c *gin.Context, err error, action string) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(404, gin.H{"error": "user not found"})
+	case errors.Is(err, db.ErrEmailTaken), errors.Is(err, db.ErrLastAdmin),
+		errors.Is(err, db.ErrLastOwner), errors.Is(err, db.ErrUserHasResources):
+		c.JSON(409, gin.H{"error": err.Error()})
+	case errors.Is(err, db.ErrInvalidUserRole), errors.Is(err, db.ErrInvalidUserStatus):
+		c.JSON(400, gin.H{"error": err.Error()})
+	default:
+		log.Printf("[Auth] %s error: %v", action, err)
+		c.JSON(500, gin.H{"error": "failed to " + strings.ToLower(action)})
+	}
+}
+
+func ListUsersHandler(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultUserPageSize)))
+	if err != nil || limit < 1 || limit > maxUserPageSize {
+		c.JSON(400, gin.H{"error": "limit must be between 1 and 200"})
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(400, gin.H{"error": "invalid offset"})
+		return
+	}
+
+	users, total, err := GetAuthService().repo.List(c.Request.Context(), db.UserFilter{
+		Status: c.Query("status"),
+		Role:   c.Query("role"),
+		Query:  c.Query("q"),
+		Limit:  limit,
+		Offset: offset,
+	})
+	if err != nil {
+		writeUserError(c, err, "List users")
+		return
+	}
+	if users == nil {
+		users = []db.User{}
+	}
+	c.JSON(200, gin.H{"users": users, "total": total})
+}
+
+func GetUserHandler(c *gin.Context) {
+	id, ok := userIDParam(c)
+	if !ok {
+		return
+	}
+	user, err := GetAuthService().repo.GetByID(c.Request.Context(), id)
+	if err == nil && user == nil {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		writeUserError(c, err, "Get user")
+		return
+	}
+	c.JSON(200, user)
+}
+
+func CreateUserHandler(c *gin.Context) {
+	var req struct {
+		Email                 string `json:"email" binding:"required"`
+		Password              string `json:"password" binding:"required"`
+		Role                  string `json:"role"`
+		PasswordResetRequired bool   `json:"password_reset_required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "invalid request"})
+		return
+	}
+
+	email, ok := normalizeEmail(req.Email)
+	if !ok {
+		c.JSON(400, gin.H{"error": "invalid email"})
+		return
+	}
+	if req.Role == "" {
+		req.Role = "user"
+	}
+	if !db.ValidUserRole(req.Role) {
+		c.JSON(400, gin.H{"error": db.ErrInvalidUserRole.Error()})
+		return
+	}
+	if err := ValidatePasswordStrength(req.Password); err != nil {
+		c.JSON(400, gin.H{"error": err.Error(), "code": ErrCodePasswordTooWeak})
+		return
+	}
+	hash, err := HashPassword(req.Password)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "internal error"})
+		return
+	}
+
+	user := &db.User{
+		Email:                 email,
+		PasswordHash:          hash,
+		Role:                  req.Role,
+		PasswordResetRequired: req.PasswordResetRequired,
+	}
+	if err := GetAuthService().repo.Create(c.Request.Context(), user); err != nil {
+		writeUserError(c, err, "Create user")
+		return
+	}
+
+	AuditTarget(c, "/users/"+strconv.Itoa(user.ID))
+	log.Printf("[Auth] User %d (%s) created by user %s", user.ID, user.Email, c.GetString("user_id"))
+	c.JSON(201, user)
+}
+
+// UpdateUserHandler changes the email, platform role or status of a user.
+// Role and status changes end the user's sessions so they apply at once.
+func UpdateUserHandler(c *gin.Context) {
+	id, ok := userIDParam(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Email  *string `json:"email"`
+		Role   *string `json:"role"`
+		Status *string `json:"status"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "invalid request"})
+		return
+	}
+	if req.Email != nil {
+		email, ok := normalizeEmail(*req.Email)
+		if !ok {
+			c.JSON(400, gin.H{"error": "invalid email"})
+			return
+		}
+		req.Email = &email
+	}
+	if (req.Role != nil || req.Status != nil) && c.GetString("user_id") == strconv.Itoa(id) {
+		c.JSON(400, gin.H{"error": "cannot change own role or status"})
+		return
+	}
+
+	service := GetAuthService()
+	ctx := c.Request.Context()
+	user, err := service.repo.Update(ctx, id, db.UserUpdate{Email: req.Email, Role: req.Role, Status: req.Status})
+	if err != nil {
+		writeUserError(c, err, "Update user")
+		return
+	}
+
+	if req.Role != nil || req.Status != nil {
+		if err := service.RevokeSessions(ctx, id); err != nil {
+			log.Printf("[Auth] Revoke sessions of user %d error: %v", id, err)
+		}
+	}
+	log.Printf("[Auth] User %d updated by user %s (role=%s, status=%s)", id, c.GetString("user_id"), user.Role, user.Status)
+	c.JSON(200, user)
+}
+
+func DeleteUserHandler(c *gin.Context) {
+	id, ok := userIDParam(c)
+	if !ok {
+		return
+	}
+	if c.GetString("user_id") == strconv.Itoa(id) {
+		c.JSON(400, gin.H{"error": "cannot delete own account"})
+		return
+	}
+
+	if err := GetAuthService().repo.Delete(c.Request.Context(), id); err != nil {
+		writeUserError(c, err, "Delete user")
+		return
+	}
+	// The cutoff stored with the user is gone; the in-memory one outlives it
+	revokedTokens.RevokeSessions(strconv.Itoa(id), time.Now())
+
+	log.Printf("[Auth] User %d deleted by user %s", id, c.GetString("user_id"))
+	c.JSON(200, gin.H{"status": "deleted"})
+}
+
+// ResetUserPasswordHandler makes the user choose a new password at the next
+// login, optionally replacing the current one with a temporary password.
+func ResetUserPasswordHandler(c *gin.Context) {
+	id, ok := userIDParam(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Password string `json:"password"` // Temporary password; keeps the current one when empty
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": "invalid request"})
+			return
+		}
+	}
+
+	service := GetAuthService()
+	ctx := c.Request.Context()
+	var err error
+	if req.Password != "" {
+		if err := ValidatePasswordStrength(req.Password); err != nil {
+			c.JSON(400, gin.H{"error": err.Error(), "code": ErrCodePasswordTooWeak})
+			return
+		}
+		hash, hashErr := HashPassword(req.Password)
+		if hashErr != nil {
+			c.JSON(500, gin.H{"error": "internal error"})
+			return
+		}
+		err = service.repo.SetPassword(ctx, id, hash, true)
+	} else {
+		err = service.repo.RequirePasswordReset(ctx, id)
+	}
+	if err != nil {
+		writeUserError(c, err, "Reset password")
+		return
+	}
+
+	if err := service.RevokeSessions(ctx, id); err != nil {
+		log.Printf("[Auth] Revoke sessions of user %d error: %v", id, err)
+	}
+	// An administrator's reset is the way back in for a locked-out account
+	if user, err := service.repo.GetByID(ctx, id); err == nil && user != nil {
+		rateLimiter.Reset(ctx, user.Email)
+	}
+	log.Printf("[Auth] Password reset of user %d required by user %s", id, c.GetString("user_id"))
+	c.JSON(200, gin.H{"status": "password reset required"})
+}
+
+// ChangePasswordHandler lets users replace their own password, which also
+// satisfies a reset demanded by an administrator. All sessions end, so the
+// user logs in again with the new password.
+func ChangePasswordHandler(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		CurrentPassword string `json:"current_password" binding:"required"`
+		NewPassword     string `json:"new_password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "invalid request"})
+		return
+	}
+
+	service := GetAuthService()
+	ctx := c.Request.Context()
+	user, err := service.repo.GetByID(ctx, uid)
+	if err != nil {
+		log.Printf("[Auth] Change password lookup error: %v", err)
+		c.JSON(500, gin.H{"error": "internal error"})
+		return
+	}
+	if user == nil {
+		c.JSON(401, gin.H{"error": "current password is incorrect", "code": ErrCodeInvalidCredentials})
+		return
+	}
+	if throttled(c, user.Email) {
+		return
+	}
+	if !CheckPasswordHash(req.CurrentPassword, user.PasswordHash) {
+		rateLimiter.Fail(ctx, c.ClientIP(), user.Email)
+		c.JSON(401, gin.H{"error": "current password is incorrect", "code": ErrCodeInvalidCredentials})
+		return
+	}
+	if err := ValidatePasswordStrength(req.NewPassword); err != nil {
+		c.JSON(400, gin.H{"error": err.Error(), "code": ErrCodePasswordTooWeak})
+		return
+	}
+	if req.NewPassword == req.CurrentPassword {
+		c.JSON(400, gin.H{"error": "new password must differ from the current one"})
+		return
+	}
+
+	hash, err := HashPassword(req.NewPassword)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "internal error"})
+		return
+	}
+	if err := service.repo.SetPassword(ctx, uid, hash, false); err != nil {
+		writeUserError(c, err, "Change password")
+		return
+	}
+	rateLimiter.Reset(ctx, user.Email)
+
+	if err := service.RevokeSessions(ctx, uid); err != nil {
+		log.Printf("[Auth] Revoke sessions of user %d error: %v", uid, err)
+	}
+	log.Printf("[Auth] User %d changed their password", uid)
+	c.JSON(200, gin.H{"status": "password changed"})
+}
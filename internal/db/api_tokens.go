@@ -0,0 +1,157 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// APIToken is a long-lived credential acting as its user, limited to a
+// permission subset and optionally to source networks.
+type APIToken struct {
+	ID           string     `json:"id"`
+	UserID       int        `json:"user_id"`
+	Name         string     `json:"name"`
+	Prefix       string     `json:"prefix"`
+	Permissions  []string   `json:"permissions"`
+	AllowedCIDRs []string   `json:"allowed_cidrs"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt   *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP   *string    `json:"last_used_ip,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+
+	// Resolved on authentication
+	UserEmail string `json:"-"`
+	UserRole  string `json:"-"`
+}
+
+// APITokenRepository persists API tokens.
+type APITokenRepository struct {
+	db *Service
+}
+
+func NewAPITokenRepository(db *Service) *APITokenRepository {
+	return &APITokenRepository{db: db}
+}
+
+const apiTokenColumns = `t.id, t.user_id, t.name, t.prefix, t.permissions, t.allowed_cidrs,
+	t.expires_at, t.last_used_at, t.last_used_ip, t.created_at`
+
+func scanAPIToken(row interface{ Scan(...interface{}) error }, t *APIToken, extra ...interface{}) error {
+	var perms, cidrs []byte
+	var expiresAt, lastUsedAt sql.NullTime
+	var lastUsedIP sql.NullString
+	dest := append([]interface{}{&t.ID, &t.UserID, &t.Name, &t.Prefix, &perms, &cidrs,
+		&expiresAt, &lastUsedAt, &lastUsedIP, &t.CreatedAt}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(perms, &t.Permissions); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(cidrs, &t.AllowedCIDRs); err != nil {
+		return err
+	}
+	if expiresAt.Valid {
+		t.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		t.LastUsedAt = &lastUsedAt.Time
+	}
+	if lastUsedIP.Valid {
+		t.LastUsedIP = &lastUsedIP.String
+	}
+	return nil
+}
+
+// Create stores a token by the SHA-256 of its secret.
+func (r *APITokenRepository) Create(ctx context.Context, t *APIToken, tokenHash string) error {
+	perms, err := json.Marshal(t.Permissions)
+	if err != nil {
+		return err
+	}
+	cidrs, err := json.Marshal(t.AllowedCIDRs)
+	if err != nil {
+		return err
+	}
+	var expiresAt interface{}
+	if t.ExpiresAt != nil {
+		expiresAt = t.ExpiresAt.UTC()
+	}
+
+	return r.db.QueryRowContext(ctx, `
+		INSERT INTO api_tokens (user_id, name, prefix, token_hash, permissions, allowed_cidrs, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at
+	`, t.UserID, t.Name, t.Prefix, tokenHash, perms, cidrs, expiresAt).Scan(&t.ID, &t.CreatedAt)
+}
+
+// ListForUser returns the user's tokens that are not revoked.
+func (r *APITokenRepository) ListForUser(ctx context.Context, userID int) ([]APIToken, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT `+apiTokenColumns+`
+		FROM api_tokens t
+		WHERE t.user_id = $1 AND t.revoked_at IS NULL
+		ORDER BY t.created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		var t APIToken
+		if err := scanAPIToken(rows, &t); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// Revoke revokes one of the user's tokens. Tokens of other users are
+// reported as sql.ErrNoRows.
+func (r *APITokenRepository) Revoke(ctx context.Context, userID int, id string) error {
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE api_tokens SET revoked_at = NOW()
+		WHERE id::text = $1 AND user_id = $2 AND revoked_at IS NULL
+	`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Authenticate returns the live (not revoked, not expired) token with the
+// given hash, together with its user, who must be active.
+func (r *APITokenRepository) Authenticate(ctx context.Context, tokenHash string) (*APIToken, error) {
+	var t APIToken
+	row := r.db.QueryRowContext(ctx, `
+		SELECT `+apiTokenColumns+`, u.email, u.role
+		FROM api_tokens t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = $1
+		  AND t.revoked_at IS NULL
+		  AND (t.expires_at IS NULL OR t.expires_at > NOW())
+		  AND u.status = $2
+	`, tokenHash, UserStatusActive)
+	if err := scanAPIToken(row, &t, &t.UserEmail, &t.UserRole); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// Touch records a use of the token. Writes are coalesced to one a minute.
+func (r *APITokenRepository) Touch(ctx context.Context, id, ip string) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE api_tokens SET last_used_at = NOW(), last_used_ip = $2
+		WHERE id = $1
+		  AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute' OR last_used_ip <> $2)
+	`, id, ip)
+	return err
+}
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAPITokenLifecycle(t *testing.T) {
+	svc := testService(t)
+	alice, bob := testUser(t, svc, "user"), testUser(t, svc, "user")
+	repo := NewAPITokenRepository(svc)
+	ctx := context.Background()
+
+	hash := fmt.Sprintf("%064d", alice.ID)
+	tok := &APIToken{UserID: alice.ID, Name: "ci", Prefix: "axk_test", Permissions: []string{"instances:read"}}
+	if err := repo.Create(ctx, tok, hash); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	got, err := repo.Authenticate(ctx, hash)
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	if got.UserID != alice.ID || got.UserEmail != alice.Email || len(got.Permissions) != 1 {
+		t.Errorf("authenticated %+v", got)
+	}
+	if err := repo.Touch(ctx, got.ID, "192.0.2.1"); err != nil {
+		t.Fatalf("touch: %v", err)
+	}
+	listed, err := repo.ListForUser(ctx, alice.ID)
+	if err != nil || len(listed) != 1 || listed[0].LastUsedIP == nil {
+		t.Fatalf("list: %v, %+v", err, listed)
+	}
+
+	if err := repo.Revoke(ctx, bob.ID, tok.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("other users must not revoke the token: %v", err)
+	}
+	if err := repo.Revoke(ctx, alice.ID, tok.ID); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if _, err := repo.Authenticate(ctx, hash); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("revoked tokens must not authenticate: %v", err)
+	}
+
+	past := time.Now().Add(-time.Minute)
+	expired := &APIToken{UserID: alice.ID, Name: "old", Prefix: "axk_old", Permissions: []string{"*"}, ExpiresAt: &past}
+	if err := repo.Create(ctx, expired, fmt.Sprintf("%064d", -alice.ID)); err != nil {
+		t.Fatalf("create expired: %v", err)
+	}
+	if _, err := repo.Authenticate(ctx, fmt.Sprintf("%064d", -alice.ID)); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expired tokens must not authenticate: %v", err)
+	}
+}
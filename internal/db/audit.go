@@ -0,0 +1,271 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Audit event outcomes.
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+	AuditDenied  = "denied" // Rejected by authentication or authorization
+)
+
+// auditGenesis is the predecessor hash of the first event.
+var auditGenesis = strings.Repeat("0", sha256.Size*2)
+
+// AuditEvent records who did what to which resource, and how it ended.
+type AuditEvent struct {
+	ID         int64           `json:"id"`
+	CreatedAt  time.Time       `json:"created_at"`
+	ActorID    *int            `json:"actor_id,omitempty"`
+	Actor      string          `json:"actor"` // Email at the time, or "anonymous" / "system"
+	SourceIP   string          `json:"source_ip,omitempty"`
+	Action     string          `json:"action"`
+	Target     string          `json:"target,omitempty"`
+	ProjectID  *int            `json:"project_id,omitempty"`
+	Request    json.RawMessage `json:"request"`
+	Outcome    string          `json:"outcome"`
+	StatusCode int             `json:"status_code,omitempty"`
+	PrevHash   string          `json:"prev_hash"`
+	Hash       string          `json:"hash"`
+}
+
+// AuditFilter narrows List; zero fields match everything.
+type AuditFilter struct {
+	ActorID   int
+	Action    string // Exact, or a prefix ending in "*" ("instance.*")
+	Target    string
+	Outcome   string
+	ProjectID int
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+	Offset    int
+}
+
+// AuditVerification is the result of walking the hash chain.
+type AuditVerification struct {
+	Checked  int    `json:"checked"`
+	Valid    bool   `json:"valid"`
+	BrokenAt *int64 `json:"broken_at,omitempty"` // First event whose hash or link does not match
+}
+
+type AuditRepository struct {
+	db *Service
+}
+
+func NewAuditRepository(db *Service) *AuditRepository {
+	return &AuditRepository{db: db}
+}
+
+// canonicalJSON re-encodes raw with sorted keys and no insignificant
+// whitespace, which is also what it becomes after a round trip through
+// JSONB, so hashes computed before the insert can be checked later.
+func canonicalJSON(raw json.RawMessage) (json.RawMessage, error) {
+	if len(raw) == 0 {
+		return json.RawMessage("{}"), nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// auditHash chains e to its predecessor.
+func auditHash(prev string, e *AuditEvent) (string, error) {
+	fields, err := json.Marshal([]interface{}{
+		e.CreatedAt.UTC().Format(time.RFC3339Nano),
+		e.ActorID, e.Actor, e.SourceIP,
+		e.Action, e.Target, e.ProjectID,
+		e.Request, e.Outcome, e.StatusCode,
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(append([]byte(prev), fields...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Append adds e at the end of the chain. Appends are serialised so that
+// every event links to the one stored before it.
+func (r *AuditRepository) Append(ctx context.Context, e *AuditEvent) error {
+	request, err := canonicalJSON(e.Request)
+	if err != nil {
+		return fmt.Errorf("audit request summary: %w", err)
+	}
+	e.Request = request
+	// Stored without a zone and at microsecond precision
+	e.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `LOCK TABLE audit_events IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+		return err
+	}
+	err = tx.QueryRowContext(ctx, `SELECT hash FROM audit_events ORDER BY id DESC LIMIT 1`).Scan(&e.PrevHash)
+	if err == sql.ErrNoRows {
+		e.PrevHash, err = auditGenesis, nil
+	}
+	if err != nil {
+		return err
+	}
+	if e.Hash, err = auditHash(e.PrevHash, e); err != nil {
+		return err
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO audit_events (
+			created_at, actor_id, actor, source_ip, action, target,
+			project_id, request, outcome, status_code, prev_hash, hash
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING id
+	`, e.CreatedAt, e.ActorID, e.Actor, e.SourceIP, e.Action, e.Target,
+		e.ProjectID, string(e.Request), e.Outcome, e.StatusCode, e.PrevHash, e.Hash,
+	).Scan(&e.ID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const auditColumns = `id, created_at, actor_id, actor, source_ip, action, target,
+	project_id, request::text, outcome, status_code, prev_hash, hash`
+
+func scanAuditEvent(row interface{ Scan(...interface{}) error }, e *AuditEvent) error {
+	var actorID, projectID sql.NullInt64
+	var request string
+	if err := row.Scan(&e.ID, &e.CreatedAt, &actorID, &e.Actor, &e.SourceIP, &e.Action, &e.Target,
+		&projectID, &request, &e.Outcome, &e.StatusCode, &e.PrevHash, &e.Hash); err != nil {
+		return err
+	}
+	e.ActorID, e.ProjectID = nil, nil
+	if actorID.Valid {
+		id := int(actorID.Int64)
+		e.ActorID = &id
+	}
+	if projectID.Valid {
+		id := int(projectID.Int64)
+		e.ProjectID = &id
+	}
+	e.Request = json.RawMessage(request)
+	return nil
+}
+
+// List returns matching events, newest first, and how many match in total.
+// Tenants only see the events of the project they act in.
+func (r *AuditRepository) List(ctx context.Context, f AuditFilter) ([]AuditEvent, int, error) {
+	where := []string{"TRUE"}
+	var args []interface{}
+	if f.ActorID > 0 {
+		args = append(args, f.ActorID)
+		where = append(where, fmt.Sprintf("actor_id = $%d", len(args)))
+	}
+	if prefix, ok := strings.CutSuffix(f.Action, "*"); ok {
+		args = append(args, prefix)
+		where = append(where, fmt.Sprintf("starts_with(action, $%d)", len(args)))
+	} else if f.Action != "" {
+		args = append(args, f.Action)
+		where = append(where, fmt.Sprintf("action = $%d", len(args)))
+	}
+	if f.Target != "" {
+		args = append(args, f.Target)
+		where = append(where, fmt.Sprintf("target = $%d", len(args)))
+	}
+	if f.Outcome != "" {
+		args = append(args, f.Outcome)
+		where = append(where, fmt.Sprintf("outcome = $%d", len(args)))
+	}
+	if f.ProjectID > 0 {
+		args = append(args, f.ProjectID)
+		where = append(where, fmt.Sprintf("project_id = $%d", len(args)))
+	}
+	if !f.Since.IsZero() {
+		args = append(args, f.Since.UTC())
+		where = append(where, fmt.Sprintf("created_at >= $%d", len(args)))
+	}
+	if !f.Until.IsZero() {
+		args = append(args, f.Until.UTC())
+		where = append(where, fmt.Sprintf("created_at < $%d", len(args)))
+	}
+	tenant, args := projectFilter(ctx, "project_id", args)
+	cond := strings.Join(where, " AND ") + tenant
+
+	var total int
+	if err := r.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM audit_events WHERE `+cond, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `SELECT ` + auditColumns + ` FROM audit_events WHERE ` + cond + ` ORDER BY id DESC`
+	if f.Limit > 0 {
+		args = append(args, f.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	if f.Offset > 0 {
+		args = append(args, f.Offset)
+		query += fmt.Sprintf(" OFFSET $%d", len(args))
+	}
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+	for rows.Next() {
+		var e AuditEvent
+		if err := scanAuditEvent(rows, &e); err != nil {
+			return nil, 0, err
+		}
+		events = append(events, e)
+	}
+	return events, total, rows.Err()
+}
+
+// Verify walks the whole chain, recomputing every hash.
+func (r *AuditRepository) Verify(ctx context.Context) (*AuditVerification, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT `+auditColumns+` FROM audit_events ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := &AuditVerification{Valid: true}
+	prev := auditGenesis
+	for rows.Next() {
+		var e AuditEvent
+		if err := scanAuditEvent(rows, &e); err != nil {
+			return nil, err
+		}
+		result.Checked++
+		if e.Request, err = canonicalJSON(e.Request); err != nil {
+			return nil, err
+		}
+		want, err := auditHash(prev, &e)
+		if err != nil {
+			return nil, err
+		}
+		if e.PrevHash != prev || e.Hash != want {
+			result.Valid = false
+			result.BrokenAt = &e.ID
+			return result, nil
+		}
+		prev = e.Hash
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,66 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestAuditHash(t *testing.T) {
+	// The hash must survive the round trip through JSONB, which reorders
+	// keys and drops whitespace
+	sent, err := canonicalJSON(json.RawMessage(`{"b": 1.50, "a": ["<x>", {"d": 2, "c": null}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := canonicalJSON(json.RawMessage(`{"a": ["<x>", {"c": null, "d": 2}], "b": 1.50}`))
+	if string(sent) != string(stored) {
+		t.Fatalf("canonical forms differ: %s vs %s", sent, stored)
+	}
+
+	e := &AuditEvent{Actor: "a@example.com", Action: "instance.delete", Request: sent, Outcome: AuditSuccess}
+	h1, _ := auditHash(auditGenesis, e)
+	h2, _ := auditHash(h1, e)
+	if h1 == h2 {
+		t.Error("hash ignores the predecessor")
+	}
+	e.Target = "/instances/web"
+	if h3, _ := auditHash(auditGenesis, e); h3 == h1 {
+		t.Error("hash ignores the target")
+	}
+}
+
+func TestAuditChain(t *testing.T) {
+	svc := testService(t)
+	repo := NewAuditRepository(svc)
+	ctx := context.Background()
+	alice := testUser(t, svc, "user")
+
+	for _, action := range []string{"instance.create", "instance.delete"} {
+		e := &AuditEvent{
+			ActorID:   &alice.ID,
+			Actor:     alice.Email,
+			Action:    action,
+			Target:    "/instances/audit-test",
+			Request:   json.RawMessage(`{"path": "/api/v1/instances", "body": {"name": "audit-test", "cpu": 2}}`),
+			Outcome:   AuditSuccess,
+			ProjectID: &alice.ID,
+		}
+		if err := repo.Append(ctx, e); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+
+	events, total, err := repo.List(ctx, AuditFilter{ActorID: alice.ID, Action: "instance.*"})
+	if err != nil || total != 2 || events[0].Action != "instance.delete" || events[0].PrevHash != events[1].Hash {
+		t.Fatalf("List = %+v, %d, %v", events, total, err)
+	}
+
+	if _, err := svc.ExecContext(ctx, `UPDATE audit_events SET outcome = 'failure' WHERE id = $1`, events[0].ID); err == nil {
+		t.Error("audit events can be updated")
+	}
+	result, err := repo.Verify(ctx)
+	if err != nil || !result.Valid || result.Checked < 2 {
+		t.Errorf("Verify = %+v, %v", result, err)
+	}
+}
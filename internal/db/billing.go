@@ -0,0 +1,186 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// ============================================================================
+// PRICE SHEETS & INVOICES
+// ============================================================================
+
+// PriceSheet prices the usage of a plan's users and projects.
+type PriceSheet struct {
+	PlanID       int       `json:"plan_id"`
+	Currency     string    `json:"currency"` // ISO 4217
+	VCPUHour     float64   `json:"vcpu_hour"`
+	MemoryGBHour float64   `json:"memory_gb_hour"`
+	DiskGBHour   float64   `json:"disk_gb_hour"`
+	TrafficGB    float64   `json:"traffic_gb"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// InvoiceLine is the charge for one resource.
+type InvoiceLine struct {
+	Resource  string  `json:"resource"`
+	Quantity  float64 `json:"quantity"`
+	Unit      string  `json:"unit"`
+	UnitPrice float64 `json:"unit_price"`
+	Amount    float64 `json:"amount"`
+}
+
+// Invoice prices the usage of one user or project in a month.
+type Invoice struct {
+	Scope       string        `json:"scope"`
+	ScopeID     int           `json:"scope_id"`
+	PeriodStart time.Time     `json:"period_start"`
+	PeriodEnd   time.Time     `json:"period_end"`
+	Plan        string        `json:"plan,omitempty"`
+	Currency    string        `json:"currency,omitempty"`
+	Lines       []InvoiceLine `json:"lines"`
+	Total       float64       `json:"total"`
+}
+
+// roundCents rounds an amount to two decimals.
+func roundCents(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// BuildInvoice prices a usage summary of the month starting at period. A
+// nil sheet yields quantities only.
+func BuildInvoice(s UsageSummary, period time.Time, plan *Plan, sheet *PriceSheet) Invoice {
+	from := TrafficPeriod(period)
+	inv := Invoice{Scope: s.Scope, ScopeID: s.ScopeID, PeriodStart: from, PeriodEnd: from.AddDate(0, 1, 0)}
+	if plan != nil {
+		inv.Plan = plan.Name
+	}
+	var prices PriceSheet
+	if sheet != nil {
+		prices = *sheet
+		inv.Currency = sheet.Currency
+	}
+
+	lines := []InvoiceLine{
+		{Resource: "vcpu", Quantity: s.VCPUHours, Unit: "vCPU-hour", UnitPrice: prices.VCPUHour},
+		{Resource: "memory", Quantity: s.MemoryGBHours, Unit: "GB-hour", UnitPrice: prices.MemoryGBHour},
+		{Resource: "disk", Quantity: s.DiskGBHours, Unit: "GB-hour", UnitPrice: prices.DiskGBHour},
+		{Resource: "traffic", Quantity: s.TrafficGB, Unit: "GB", UnitPrice: prices.TrafficGB},
+	}
+	for i := range lines {
+		lines[i].Quantity = math.Round(lines[i].Quantity*1000) / 1000
+		lines[i].Amount = roundCents(lines[i].Quantity * lines[i].UnitPrice)
+		inv.Total += lines[i].Amount
+	}
+	inv.Lines = lines
+	inv.Total = roundCents(inv.Total)
+	return inv
+}
+
+type PriceSheetRepository struct {
+	db *Service
+}
+
+func NewPriceSheetRepository(db *Service) *PriceSheetRepository {
+	return &PriceSheetRepository{db: db}
+}
+
+const priceSheetColumns = `plan_id, currency, vcpu_hour, memory_gb_hour, disk_gb_hour, traffic_gb, updated_at`
+
+func scanPriceSheet(row interface{ Scan(...interface{}) error }) (*PriceSheet, error) {
+	var p PriceSheet
+	if err := row.Scan(&p.PlanID, &p.Currency, &p.VCPUHour, &p.MemoryGBHour,
+		&p.DiskGBHour, &p.TrafficGB, &p.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (r *PriceSheetRepository) List(ctx context.Context) ([]PriceSheet, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT `+priceSheetColumns+` FROM price_sheets ORDER BY plan_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sheets := []PriceSheet{}
+	for rows.Next() {
+		p, err := scanPriceSheet(rows)
+		if err != nil {
+			return nil, err
+		}
+		sheets = append(sheets, *p)
+	}
+	return sheets, rows.Err()
+}
+
+// Get returns the price sheet of a plan, or nil when it has none.
+func (r *PriceSheetRepository) Get(ctx context.Context, planID int) (*PriceSheet, error) {
+	p, err := scanPriceSheet(r.db.QueryRowContext(ctx,
+		`SELECT `+priceSheetColumns+` FROM price_sheets WHERE plan_id = $1`, planID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return p, err
+}
+
+// Set replaces the price sheet of a plan.
+func (r *PriceSheetRepository) Set(ctx context.Context, p *PriceSheet) error {
+	saved, err := scanPriceSheet(r.db.QueryRowContext(ctx, `
+		INSERT INTO price_sheets (plan_id, currency, vcpu_hour, memory_gb_hour, disk_gb_hour, traffic_gb)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (plan_id) DO UPDATE SET
+			currency = EXCLUDED.currency, vcpu_hour = EXCLUDED.vcpu_hour,
+			memory_gb_hour = EXCLUDED.memory_gb_hour, disk_gb_hour = EXCLUDED.disk_gb_hour,
+			traffic_gb = EXCLUDED.traffic_gb, updated_at = NOW()
+		RETURNING `+priceSheetColumns,
+		p.PlanID, p.Currency, p.VCPUHour, p.MemoryGBHour, p.DiskGBHour, p.TrafficGB))
+	if err != nil {
+		return err
+	}
+	*p = *saved
+	return nil
+}
+
+func (r *PriceSheetRepository) Delete(ctx context.Context, planID int) error {
+	result, err := r.db.ExecContext(ctx, `DELETE FROM price_sheets WHERE plan_id = $1`, planID)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return fmt.Errorf("price sheet not found: %d: %w", planID, sql.ErrNoRows)
+	}
+	return nil
+}
+
+// Invoices prices the usage of the month starting at period, grouped by
+// user or project, with the sheet of each one's current plan.
+func (r *PriceSheetRepository) Invoices(ctx context.Context, period time.Time, groupBy string, now time.Time) ([]Invoice, error) {
+	summaries, err := NewUsageRepository(r.db).Summarize(ctx, period, groupBy, now)
+	if err != nil {
+		return nil, err
+	}
+
+	invoices := make([]Invoice, 0, len(summaries))
+	for _, s := range summaries {
+		var plan *Plan
+		var sheet *PriceSheet
+		if s.ScopeID > 0 {
+			if plan, err = planOf(ctx, r.db, groupBy, s.ScopeID); err != nil {
+				return nil, err
+			}
+		}
+		if plan != nil {
+			if sheet, err = r.Get(ctx, plan.ID); err != nil {
+				return nil, err
+			}
+		}
+		invoices = append(invoices, BuildInvoice(s, period, plan, sheet))
+	}
+	return invoices, nil
+}
@@ -46,6 +46,10 @@ func (e *DBError) Error() string {
 	return fmt.Sprintf("[%d] %s", e.Code, e.Message)
 }
 
+func (e *DBError) Unwrap() error {
+	return e.Err
+}
+
 func NewDBError(code DBErrorCode, msg string, err error) *DBError {
 	return &DBError{
 		Code:      code,
@@ -0,0 +1,265 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ============================================================================
+// FLOATING IPS
+// ============================================================================
+
+var (
+	ErrNoPublicIP            = errors.New("no public IP addresses available")
+	ErrNotPublicNetwork      = errors.New("network is not public")
+	ErrInstanceHasFloatingIP = errors.New("instance already has a floating IP")
+)
+
+type FloatingIP struct {
+	ID           string     `json:"id"`
+	IP           string     `json:"ip"`
+	NetworkID    string     `json:"network_id"`
+	InstanceName *string    `json:"instance_name"`
+	PrivateIP    *string    `json:"private_ip,omitempty"` // Current lease of the instance, if it exists
+	Description  string     `json:"description"`
+	CreatedAt    time.Time  `json:"created_at"`
+	AttachedAt   *time.Time `json:"attached_at"`
+	ProjectID    *int       `json:"project_id,omitempty"`
+}
+
+// IsUniqueViolation reports whether err is a Postgres unique_violation.
+func IsUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+type FloatingIPRepository struct {
+	db *Service
+}
+
+func NewFloatingIPRepository(db *Service) *FloatingIPRepository {
+	return &FloatingIPRepository{db: db}
+}
+
+const floatingIPSelect = `
+	SELECT f.id, f.ip, f.network_id, f.instance_name, l.ip, COALESCE(f.description, ''),
+	       f.created_at, f.attached_at, f.project_id
+	FROM floating_ips f
+	LEFT JOIN ip_leases l ON l.instance_name = f.instance_name
+`
+
+func scanFloatingIP(row interface{ Scan(...interface{}) error }) (*FloatingIP, error) {
+	var f FloatingIP
+	var instance, private sql.NullString
+	var attachedAt sql.NullTime
+	var projectID sql.NullInt64
+	if err := row.Scan(&f.ID, &f.IP, &f.NetworkID, &instance, &private, &f.Description,
+		&f.CreatedAt, &attachedAt, &projectID); err != nil {
+		return nil, err
+	}
+	f.ProjectID = nullIntPtr(projectID)
+	if instance.Valid {
+		f.InstanceName = &instance.String
+	}
+	if private.Valid {
+		f.PrivateIP = &private.String
+	}
+	if attachedAt.Valid {
+		f.AttachedAt = &attachedAt.Time
+	}
+	return &f, nil
+}
+
+func (r *FloatingIPRepository) List(ctx context.Context) ([]FloatingIP, error) {
+	filter, args := projectFilter(ctx, "f.project_id", nil)
+	rows, err := r.db.QueryContext(ctx, floatingIPSelect+` WHERE TRUE`+filter+` ORDER BY f.created_at`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fips := []FloatingIP{}
+	for rows.Next() {
+		f, err := scanFloatingIP(rows)
+		if err != nil {
+			return nil, err
+		}
+		fips = append(fips, *f)
+	}
+	return fips, rows.Err()
+}
+
+func (r *FloatingIPRepository) Get(ctx context.Context, id string) (*FloatingIP, error) {
+	filter, args := projectFilter(ctx, "f.project_id", []interface{}{id})
+	return scanFloatingIP(r.db.QueryRowContext(ctx, floatingIPSelect+` WHERE f.id = $1`+filter, args...))
+}
+
+// Allocate reserves the first free address of a public network. With an
+// empty networkID every public network is tried in creation order.
+func (r *FloatingIPRepository) Allocate(ctx context.Context, networkID, description string) (*FloatingIP, error) {
+	var candidates []Network
+	if networkID != "" {
+		n, err := r.db.GetNetwork(ctx, networkID)
+		if err != nil {
+			return nil, err
+		}
+		if !n.IsPublic {
+			return nil, ErrNotPublicNetwork
+		}
+		candidates = []Network{*n}
+	} else {
+		nets, err := r.db.getAvailableNetworks(ctx, true)
+		if err != nil {
+			return nil, err
+		}
+		candidates = nets
+	}
+
+	for _, n := range candidates {
+		fip, err := r.allocateIn(ctx, n, description)
+		if err == nil {
+			log.Printf("[IPAM] Allocated floating IP %s from %s", fip.IP, n.Name)
+			return fip, nil
+		}
+		if !errors.Is(err, ErrNoPublicIP) {
+			return nil, err
+		}
+	}
+	return nil, ErrNoPublicIP
+}
+
+func (r *FloatingIPRepository) allocateIn(ctx context.Context, n Network, description string) (*FloatingIP, error) {
+	start, end, err := CidrToRange(n.CIDR)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Serialise allocators of the same pool
+	if _, err := tx.ExecContext(ctx, `SELECT id FROM networks WHERE id = $1 FOR UPDATE`, n.ID); err != nil {
+		return nil, err
+	}
+	owner, project := ownerFor(ctx, nil), projectFor(ctx, nil)
+	if err := checkQuota(ctx, tx, owner, project, Resources{PublicIPs: 1}); err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT ip FROM ip_leases WHERE network_id = $1 AND instance_name IS NOT NULL
+		UNION
+		SELECT ip FROM floating_ips WHERE network_id = $1
+	`, n.ID)
+	if err != nil {
+		return nil, err
+	}
+	used := map[string]bool{n.Gateway: true}
+	for rows.Next() {
+		var ip string
+		if err := rows.Scan(&ip); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		used[ip] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Skip the network address; end is the broadcast address
+	for i := start + 1; i < end; i++ {
+		ip := IntToIP(i)
+		if used[ip] {
+			continue
+		}
+		fip := &FloatingIP{IP: ip, NetworkID: n.ID, Description: description, ProjectID: project}
+		err := tx.QueryRowContext(ctx, `
+			INSERT INTO floating_ips (ip, network_id, description, owner_id, project_id)
+			VALUES ($1, $2, $3, $4, $5)
+			RETURNING id, created_at
+		`, ip, n.ID, description, owner, fip.ProjectID).Scan(&fip.ID, &fip.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return fip, nil
+	}
+	return nil, ErrNoPublicIP
+}
+
+// Release returns the address to its pool; an attached address simply
+// stops being NATed on the next sync.
+func (r *FloatingIPRepository) Release(ctx context.Context, id string) error {
+	filter, args := projectFilter(ctx, "project_id", []interface{}{id})
+	res, err := r.db.ExecContext(ctx, `DELETE FROM floating_ips WHERE id = $1`+filter, args...)
+	if err != nil {
+		return err
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Attach binds the address to an instance name, moving it away from any
+// previous instance.
+func (r *FloatingIPRepository) Attach(ctx context.Context, id, instanceName string) error {
+	filter, args := projectFilter(ctx, "project_id", []interface{}{instanceName, id})
+	res, err := r.db.ExecContext(ctx,
+		`UPDATE floating_ips SET instance_name = $1, attached_at = NOW() WHERE id = $2`+filter, args...)
+	if err != nil {
+		if IsUniqueViolation(err) {
+			return ErrInstanceHasFloatingIP
+		}
+		return err
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (r *FloatingIPRepository) Detach(ctx context.Context, id string) error {
+	filter, args := projectFilter(ctx, "project_id", []interface{}{id})
+	res, err := r.db.ExecContext(ctx,
+		`UPDATE floating_ips SET instance_name = NULL, attached_at = NULL WHERE id = $1`+filter, args...)
+	if err != nil {
+		return err
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListBindings returns every attached floating IP whose instance currently
+// holds a lease; detached or orphaned bindings are left out.
+func (r *FloatingIPRepository) ListBindings(ctx context.Context) ([]FloatingIP, error) {
+	rows, err := r.db.QueryContext(ctx, floatingIPSelect+` WHERE f.instance_name IS NOT NULL AND l.ip IS NOT NULL ORDER BY f.ip`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var fips []FloatingIP
+	for rows.Next() {
+		f, err := scanFloatingIP(rows)
+		if err != nil {
+			return nil, err
+		}
+		fips = append(fips, *f)
+	}
+	return fips, rows.Err()
+}
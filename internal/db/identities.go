@@ -0,0 +1,62 @@
+package db
+
+import "context"
+
+// IdentityRepository links accounts to identity provider subjects for
+// single sign-on.
+type IdentityRepository struct {
+	db *Service
+}
+
+func NewIdentityRepository(db *Service) *IdentityRepository {
+	return &IdentityRepository{db: db}
+}
+
+// Login returns the user linked to the subject and records the login. It
+// fails with sql.ErrNoRows when the subject is not linked.
+func (r *IdentityRepository) Login(ctx context.Context, issuer, subject string) (*User, error) {
+	var u User
+	row := r.db.QueryRowContext(ctx, `
+		WITH identity AS (
+			UPDATE user_identities SET last_login_at = NOW()
+			WHERE issuer = $1 AND subject = $2
+			RETURNING user_id
+		)
+		SELECT `+userColumns+`
+		FROM users u JOIN identity i ON i.user_id = u.id
+	`, issuer, subject)
+	if err := scanUser(row, &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// Link attaches the subject to an existing account.
+func (r *IdentityRepository) Link(ctx context.Context, userID int, issuer, subject string) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO user_identities (issuer, subject, user_id, last_login_at)
+		VALUES ($1, $2, $3, NOW())
+	`, issuer, subject, userID)
+	return err
+}
+
+// Provision creates an account for the subject, with its personal project,
+// and links it in one transaction.
+func (r *IdentityRepository) Provision(ctx context.Context, user *User, issuer, subject string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertUser(ctx, tx, user); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO user_identities (issuer, subject, user_id, last_login_at)
+		VALUES ($1, $2, $3, NOW())
+	`, issuer, subject, user.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
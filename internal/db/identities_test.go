@@ -0,0 +1,54 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestIdentityProvisioning(t *testing.T) {
+	svc := testService(t)
+	repo := NewIdentityRepository(svc)
+	projects := NewProjectRepository(svc)
+	ctx := context.Background()
+	issuer, subject := "https://idp.test.local", fmt.Sprintf("sub-%d", time.Now().UnixNano())
+
+	if _, err := repo.Login(ctx, issuer, subject); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("unlinked subject: %v", err)
+	}
+
+	u := &User{Email: subject + "@test.local", Role: "user"}
+	if err := repo.Provision(ctx, u, issuer, subject); err != nil {
+		t.Fatalf("provision: %v", err)
+	}
+	t.Cleanup(func() {
+		svc.ExecContext(ctx, `DELETE FROM projects WHERE created_by = $1`, u.ID)
+		svc.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, u.ID)
+	})
+	if _, _, err := projects.DefaultFor(ctx, u.ID); err != nil {
+		t.Errorf("provisioned user has no personal project: %v", err)
+	}
+
+	got, err := repo.Login(ctx, issuer, subject)
+	if err != nil || got.ID != u.ID {
+		t.Fatalf("Login = %+v, %v, want user %d", got, err, u.ID)
+	}
+	if _, err := repo.Login(ctx, "https://other.test.local", subject); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("subjects are scoped to their issuer: %v", err)
+	}
+
+	// Platform-managed memberships only ever raise the role
+	owner := testUser(t, svc, "user")
+	if err := projects.GrantMember(ctx, owner.ProjectID, u.ID, ProjectRoleOperator); err != nil {
+		t.Fatalf("grant: %v", err)
+	}
+	if err := projects.GrantMember(ctx, owner.ProjectID, u.ID, ProjectRoleViewer); err != nil {
+		t.Fatalf("grant: %v", err)
+	}
+	if role, _ := projects.MemberRole(ctx, owner.ProjectID, u.ID); role != ProjectRoleOperator {
+		t.Errorf("role = %q, want %q", role, ProjectRoleOperator)
+	}
+}
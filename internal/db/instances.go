@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"strconv"
 
 	"aexon/internal/types"
 )
@@ -27,6 +28,8 @@ func NewInstanceRepository(db *Service) *InstanceRepository {
 // CRUD OPERATIONS
 // ============================================================================
 
+// Create inserts an instance, refusing it when its size would exceed the
+// quota of its owner or project.
 func (r *InstanceRepository) Create(ctx context.Context, instance *types.Instance) error {
 	limitsJSON, err := json.Marshal(instance.Limits)
 	if err != nil {
@@ -36,11 +39,26 @@ func (r *InstanceRepository) Create(ctx context.Context, instance *types.Instanc
 	query := `
 		INSERT INTO instances (
 			name, image, limits, user_data, type,
-			backup_schedule, backup_retention, backup_enabled
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			backup_schedule, backup_retention, backup_enabled, owner_id, project_id,
+			vcpu, memory_mib, disk_gb
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
 	`
 
-	_, err = r.db.ExecContext(ctx, query,
+	instance.OwnerID = ownerFor(ctx, instance.OwnerID)
+	instance.ProjectID = projectFor(ctx, instance.ProjectID)
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	requested := Resources{Instances: 1, VCPU: instance.VCPU, MemoryMiB: instance.MemoryMiB, DiskGB: instance.DiskGB}
+	if err := checkQuota(ctx, tx, instance.OwnerID, instance.ProjectID, requested); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, query,
 		instance.Name,
 		instance.Image,
 		string(limitsJSON),
@@ -49,25 +67,35 @@ func (r *InstanceRepository) Create(ctx context.Context, instance *types.Instanc
 		instance.BackupSchedule,
 		instance.BackupRetention,
 		instance.BackupEnabled,
+		instance.OwnerID,
+		instance.ProjectID,
+		instance.VCPU,
+		instance.MemoryMiB,
+		instance.DiskGB,
 	)
+	if err != nil {
+		return err
+	}
 
-	return err
+	return tx.Commit()
 }
 
 func (r *InstanceRepository) Get(ctx context.Context, name string) (*types.Instance, error) {
+	filter, args := projectFilter(ctx, "i.project_id", []interface{}{name})
 	query := `
 		SELECT i.name, i.image, i.limits, i.user_data, i.type,
 		       i.backup_schedule, i.backup_retention, i.backup_enabled,
-		       COALESCE(l.ip, '') as ip_address
+		       COALESCE(l.ip, '') as ip_address, i.owner_id, i.project_id,
+		       i.vcpu, i.memory_mib, i.disk_gb
 		FROM instances i
 		LEFT JOIN ip_leases l ON l.instance_name = i.name
-		WHERE i.name = $1
-	`
+		WHERE i.name = $1` + filter
 
-	row := r.db.QueryRowContext(ctx, query, name)
+	row := r.db.QueryRowContext(ctx, query, args...)
 
 	var instance types.Instance
 	var limitsJSON string
+	var ownerID, projectID sql.NullInt64
 
 	err := row.Scan(
 		&instance.Name,
@@ -79,14 +107,22 @@ func (r *InstanceRepository) Get(ctx context.Context, name string) (*types.Insta
 		&instance.BackupRetention,
 		&instance.BackupEnabled,
 		&instance.IpAddress, // Fetch IP
+		&ownerID,
+		&projectID,
+		&instance.VCPU,
+		&instance.MemoryMiB,
+		&instance.DiskGB,
 	)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("instance not found: %s", name)
+			// Other tenants' instances are reported as missing, not forbidden
+			return nil, fmt.Errorf("instance not found: %s: %w", name, err)
 		}
 		return nil, err
 	}
+	instance.OwnerID = nullIntPtr(ownerID)
+	instance.ProjectID = nullIntPtr(projectID)
 
 	if err := json.Unmarshal([]byte(limitsJSON), &instance.Limits); err != nil {
 		return nil, fmt.Errorf("unmarshal limits: %w", err)
@@ -104,16 +140,18 @@ func (r *InstanceRepository) Get(ctx context.Context, name string) (*types.Insta
 }
 
 func (r *InstanceRepository) List(ctx context.Context) ([]types.Instance, error) {
+	filter, args := projectFilter(ctx, "i.project_id", nil)
 	query := `
 		SELECT i.name, i.image, i.limits, i.user_data, i.type,
 		       i.backup_schedule, i.backup_retention, i.backup_enabled,
-		       COALESCE(l.ip, '') as ip_address
+		       COALESCE(l.ip, '') as ip_address, i.owner_id, i.project_id,
+		       i.vcpu, i.memory_mib, i.disk_gb
 		FROM instances i
 		LEFT JOIN ip_leases l ON l.instance_name = i.name
-		ORDER BY i.name
-	`
+		WHERE TRUE` + filter + `
+		ORDER BY i.name`
 
-	rows, err := r.db.QueryContext(ctx, query)
+	rows, err := r.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -124,6 +162,7 @@ func (r *InstanceRepository) List(ctx context.Context) ([]types.Instance, error)
 	for rows.Next() {
 		var instance types.Instance
 		var limitsJSON string
+		var ownerID, projectID sql.NullInt64
 
 		err := rows.Scan(
 			&instance.Name,
@@ -135,11 +174,18 @@ func (r *InstanceRepository) List(ctx context.Context) ([]types.Instance, error)
 			&instance.BackupRetention,
 			&instance.BackupEnabled,
 			&instance.IpAddress,
+			&ownerID,
+			&projectID,
+			&instance.VCPU,
+			&instance.MemoryMiB,
+			&instance.DiskGB,
 		)
 
 		if err != nil {
 			return nil, err
 		}
+		instance.OwnerID = nullIntPtr(ownerID)
+		instance.ProjectID = nullIntPtr(projectID)
 
 		if err := json.Unmarshal([]byte(limitsJSON), &instance.Limits); err != nil {
 			log.Printf("[Instances] Failed to unmarshal limits for %s: %v", instance.Name, err)
@@ -175,10 +221,9 @@ func (r *InstanceRepository) Update(ctx context.Context, instance *types.Instanc
 		    backup_schedule = $6,
 		    backup_retention = $7,
 		    backup_enabled = $8
-		WHERE name = $1
-	`
+		WHERE name = $1`
 
-	result, err := r.db.ExecContext(ctx, query,
+	filter, args := projectFilter(ctx, "project_id", []interface{}{
 		instance.Name,
 		instance.Image,
 		string(limitsJSON),
@@ -187,7 +232,8 @@ func (r *InstanceRepository) Update(ctx context.Context, instance *types.Instanc
 		instance.BackupSchedule,
 		instance.BackupRetention,
 		instance.BackupEnabled,
-	)
+	})
+	result, err := r.db.ExecContext(ctx, query+filter, args...)
 
 	if err != nil {
 		return err
@@ -199,16 +245,17 @@ func (r *InstanceRepository) Update(ctx context.Context, instance *types.Instanc
 	}
 
 	if rows == 0 {
-		return fmt.Errorf("instance not found: %s", instance.Name)
+		return fmt.Errorf("instance not found: %s: %w", instance.Name, sql.ErrNoRows)
 	}
 
 	return nil
 }
 
 func (r *InstanceRepository) Delete(ctx context.Context, name string) error {
-	query := `DELETE FROM instances WHERE name = $1`
+	filter, args := projectFilter(ctx, "project_id", []interface{}{name})
+	query := `DELETE FROM instances WHERE name = $1` + filter
 
-	result, err := r.db.ExecContext(ctx, query, name)
+	result, err := r.db.ExecContext(ctx, query, args...)
 	if err != nil {
 		return err
 	}
@@ -219,7 +266,7 @@ func (r *InstanceRepository) Delete(ctx context.Context, name string) error {
 	}
 
 	if rows == 0 {
-		return fmt.Errorf("instance not found: %s", name)
+		return fmt.Errorf("instance not found: %s: %w", name, sql.ErrNoRows)
 	}
 
 	return nil
@@ -235,10 +282,10 @@ func (r *InstanceRepository) UpdateBackupConfig(ctx context.Context, name string
 		SET backup_enabled = $1,
 		    backup_schedule = $2,
 		    backup_retention = $3
-		WHERE name = $4
-	`
+		WHERE name = $4`
 
-	result, err := r.db.ExecContext(ctx, query, enabled, schedule, retention, name)
+	filter, args := projectFilter(ctx, "project_id", []interface{}{enabled, schedule, retention, name})
+	result, err := r.db.ExecContext(ctx, query+filter, args...)
 	if err != nil {
 		return err
 	}
@@ -249,7 +296,7 @@ func (r *InstanceRepository) UpdateBackupConfig(ctx context.Context, name string
 	}
 
 	if rows == 0 {
-		return fmt.Errorf("instance not found: %s", name)
+		return fmt.Errorf("instance not found: %s: %w", name, sql.ErrNoRows)
 	}
 
 	return nil
@@ -306,9 +353,10 @@ func (r *InstanceRepository) UpdateLimits(ctx context.Context, name string, limi
 		return fmt.Errorf("marshal limits: %w", err)
 	}
 
-	query := `UPDATE instances SET limits = $1 WHERE name = $2`
+	filter, args := projectFilter(ctx, "project_id", []interface{}{string(limitsJSON), name})
+	query := `UPDATE instances SET limits = $1 WHERE name = $2` + filter
 
-	result, err := r.db.ExecContext(ctx, query, string(limitsJSON), name)
+	result, err := r.db.ExecContext(ctx, query, args...)
 	if err != nil {
 		return err
 	}
@@ -319,12 +367,75 @@ func (r *InstanceRepository) UpdateLimits(ctx context.Context, name string, limi
 	}
 
 	if rows == 0 {
-		return fmt.Errorf("instance not found: %s", name)
+		return fmt.Errorf("instance not found: %s: %w", name, sql.ErrNoRows)
 	}
 
 	return nil
 }
 
+// Resize changes the vCPUs and memory of an instance, leaving a zero value
+// unchanged, and records them in its limits. Growth is checked against the
+// quotas of the instance's owner and project.
+func (r *InstanceRepository) Resize(ctx context.Context, name string, vcpu, memoryMiB int) (*types.Instance, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	filter, args := projectFilter(ctx, "project_id", []interface{}{name})
+	var instance types.Instance
+	var limitsJSON string
+	var ownerID, projectID sql.NullInt64
+	err = tx.QueryRowContext(ctx, `
+		SELECT name, limits, owner_id, project_id, vcpu, memory_mib, disk_gb
+		FROM instances WHERE name = $1`+filter+` FOR UPDATE
+	`, args...).Scan(&instance.Name, &limitsJSON, &ownerID, &projectID,
+		&instance.VCPU, &instance.MemoryMiB, &instance.DiskGB)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("instance not found: %s: %w", name, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	instance.OwnerID = nullIntPtr(ownerID)
+	instance.ProjectID = nullIntPtr(projectID)
+	if err := json.Unmarshal([]byte(limitsJSON), &instance.Limits); err != nil || instance.Limits == nil {
+		instance.Limits = make(map[string]string)
+	}
+
+	delta := Resources{}
+	if vcpu > 0 {
+		delta.VCPU = vcpu - instance.VCPU
+		instance.VCPU = vcpu
+		instance.Limits["limits.cpu"] = strconv.Itoa(vcpu)
+	}
+	if memoryMiB > 0 {
+		delta.MemoryMiB = memoryMiB - instance.MemoryMiB
+		instance.MemoryMiB = memoryMiB
+		instance.Limits["limits.memory"] = fmt.Sprintf("%dMB", memoryMiB)
+	}
+	if err := checkQuota(ctx, tx, instance.OwnerID, instance.ProjectID, delta); err != nil {
+		return nil, err
+	}
+
+	updated, err := json.Marshal(instance.Limits)
+	if err != nil {
+		return nil, fmt.Errorf("marshal limits: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE instances SET vcpu = $2, memory_mib = $3, limits = $4, updated_at = NOW()
+		WHERE name = $1
+	`, name, instance.VCPU, instance.MemoryMiB, string(updated))
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &instance, nil
+}
+
 // ============================================================================
 // BATCH OPERATIONS
 // ============================================================================
@@ -383,10 +494,9 @@ func (r *InstanceRepository) DeleteBatch(ctx context.Context, names []string) er
 	}
 	defer tx.Rollback()
 
-	query := `DELETE FROM instances WHERE name = $1`
-
 	for _, name := range names {
-		_, err := tx.ExecContext(ctx, query, name)
+		filter, args := projectFilter(ctx, "project_id", []interface{}{name})
+		_, err := tx.ExecContext(ctx, `DELETE FROM instances WHERE name = $1`+filter, args...)
 		if err != nil {
 			return err
 		}
@@ -400,18 +510,20 @@ func (r *InstanceRepository) DeleteBatch(ctx context.Context, names []string) er
 // ============================================================================
 
 func (r *InstanceRepository) Exists(ctx context.Context, name string) (bool, error) {
-	query := `SELECT EXISTS(SELECT 1 FROM instances WHERE name = $1)`
+	filter, args := projectFilter(ctx, "project_id", []interface{}{name})
+	query := `SELECT EXISTS(SELECT 1 FROM instances WHERE name = $1` + filter + `)`
 
 	var exists bool
-	err := r.db.QueryRowContext(ctx, query, name).Scan(&exists)
+	err := r.db.QueryRowContext(ctx, query, args...).Scan(&exists)
 	return exists, err
 }
 
 func (r *InstanceRepository) Count(ctx context.Context) (int, error) {
-	query := `SELECT COUNT(*) FROM instances`
+	filter, args := projectFilter(ctx, "project_id", nil)
+	query := `SELECT COUNT(*) FROM instances WHERE TRUE` + filter
 
 	var count int
-	err := r.db.QueryRowContext(ctx, query).Scan(&count)
+	err := r.db.QueryRowContext(ctx, query, args...).Scan(&count)
 	return count, err
 }
 
@@ -420,11 +532,10 @@ func (r *InstanceRepository) ListByType(ctx context.Context, instanceType string
 		SELECT name, image, limits, user_data, type,
 		       backup_schedule, backup_retention, backup_enabled
 		FROM instances
-		WHERE type = $1
-		ORDER BY name
-	`
+		WHERE type = $1`
 
-	rows, err := r.db.QueryContext(ctx, query, instanceType)
+	filter, args := projectFilter(ctx, "project_id", []interface{}{instanceType})
+	rows, err := r.db.QueryContext(ctx, query+filter+` ORDER BY name`, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -471,11 +582,10 @@ func (r *InstanceRepository) ListWithBackupEnabled(ctx context.Context) ([]types
 		SELECT name, image, limits, user_data, type,
 		       backup_schedule, backup_retention, backup_enabled
 		FROM instances
-		WHERE backup_enabled = true
-		ORDER BY name
-	`
+		WHERE backup_enabled = true`
 
-	rows, err := r.db.QueryContext(ctx, query)
+	filter, args := projectFilter(ctx, "project_id", nil)
+	rows, err := r.db.QueryContext(ctx, query+filter+` ORDER BY name`, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -517,6 +627,14 @@ func (r *InstanceRepository) ListWithBackupEnabled(ctx context.Context) ([]types
 	return instances, rows.Err()
 }
 
+func nullIntPtr(v sql.NullInt64) *int {
+	if !v.Valid {
+		return nil
+	}
+	i := int(v.Int64)
+	return &i
+}
+
 // ============================================================================
 // COMPATIBILITY FUNCTIONS (for existing code)
 // ============================================================================
@@ -18,24 +18,40 @@ type Network struct {
 	DNS1      string    `json:"dns1"`
 	VlanID    int       `json:"vlan_id"`
 	IsPublic  bool      `json:"is_public"`
+	OwnerID   *int      `json:"owner_id,omitempty"`   // User who created the pool
+	ProjectID *int      `json:"project_id,omitempty"` // nil = shared pool
 	CreatedAt time.Time `json:"created_at"`
 }
 
 // AllocateIP finds a free IP across available networks using a "Smart Pool" strategy.
 // It supports both pre-populated (legacy) and sparse (new) allocation models.
+// Private pools are tried first, then public ones if the caller's plan
+// includes them; pools outside the plan are skipped.
 func (s *Service) AllocateIP(ctx context.Context, instanceName string) (string, error) {
-	// 1. Determine Plan Type (Placeholder for now, default to Free/Private)
-	// In the future, we can check user quota/plan here.
-	isPro := false
+	// 1. Determine the plan of the caller
+	plan, err := NewPlanRepository(s).Effective(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve plan: %w", err)
+	}
 
 	// 2. Fetch candidate networks
-	networks, err := s.getAvailableNetworks(ctx, isPro)
+	networks, err := s.getAvailableNetworks(ctx, false)
 	if err != nil {
 		return "", fmt.Errorf("failed to fetch networks: %w", err)
 	}
+	if plan == nil || plan.PublicNetworks {
+		public, err := s.getAvailableNetworks(ctx, true)
+		if err != nil {
+			return "", fmt.Errorf("failed to fetch networks: %w", err)
+		}
+		networks = append(networks, public...)
+	}
 
 	// 3. Try allocation in each network
 	for _, net := range networks {
+		if plan.AllowsNetwork(net) != nil {
+			continue
+		}
 		ip, err := s.tryAllocateInNetwork(ctx, net, instanceName)
 		if err == nil {
 			log.Printf("[IPAM] Allocated %s from network %s (%s)", ip, net.Name, net.CIDR)
@@ -48,15 +64,25 @@ func (s *Service) AllocateIP(ctx context.Context, instanceName string) (string,
 	return "", fmt.Errorf("no IP addresses available in any pool")
 }
 
-// AllocateInNetwork allocates an IP in a specific network pool.
+// AllocateInNetwork allocates an IP in a specific network pool, which the
+// caller's plan must include.
 func (s *Service) AllocateInNetwork(ctx context.Context, networkID string, instanceName string) (string, error) {
 	var net Network
-	query := `SELECT id, name, cidr, gateway, dns1, vlan_id, is_public FROM networks WHERE id = $1`
-	err := s.QueryRowContext(ctx, query, networkID).Scan(&net.ID, &net.Name, &net.CIDR, &net.Gateway, &net.DNS1, &net.VlanID, &net.IsPublic)
+	filter, args := sharedFilter(ctx, "project_id", []interface{}{networkID})
+	query := `SELECT id, name, cidr, gateway, dns1, vlan_id, is_public FROM networks WHERE id = $1` + filter
+	err := s.QueryRowContext(ctx, query, args...).Scan(&net.ID, &net.Name, &net.CIDR, &net.Gateway, &net.DNS1, &net.VlanID, &net.IsPublic)
 	if err != nil {
 		return "", fmt.Errorf("network not found: %w", err)
 	}
 
+	plan, err := NewPlanRepository(s).Effective(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve plan: %w", err)
+	}
+	if err := plan.AllowsNetwork(net); err != nil {
+		return "", err
+	}
+
 	ip, err := s.tryAllocateInNetwork(ctx, net, instanceName)
 	if err != nil {
 		return "", fmt.Errorf("allocation failed in pool %s: %w", net.Name, err)
@@ -64,13 +90,11 @@ func (s *Service) AllocateInNetwork(ctx context.Context, networkID string, insta
 	return ip, nil
 }
 
-func (s *Service) getAvailableNetworks(ctx context.Context, isPro bool) ([]Network, error) {
-	query := `SELECT id, name, cidr, gateway, dns1, vlan_id, is_public FROM networks WHERE is_public = $1 ORDER BY created_at ASC`
-
-	// Free plan gets Private (is_public=false). Pro logic handles both later.
-	// For now, simple bool.
+func (s *Service) getAvailableNetworks(ctx context.Context, public bool) ([]Network, error) {
+	filter, args := sharedFilter(ctx, "project_id", []interface{}{public})
+	query := `SELECT id, name, cidr, gateway, dns1, vlan_id, is_public FROM networks WHERE is_public = $1` + filter + ` ORDER BY created_at ASC`
 
-	rows, err := s.QueryContext(ctx, query, isPro)
+	rows, err := s.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -96,8 +120,9 @@ type NetworkStats struct {
 
 func (s *Service) GetNetworksWithStats(ctx context.Context) ([]NetworkStats, error) {
 	// Fetch all networks
-	query := `SELECT id, name, cidr, gateway, dns1, vlan_id, is_public, created_at FROM networks ORDER BY created_at ASC`
-	rows, err := s.QueryContext(ctx, query)
+	filter, args := sharedFilter(ctx, "project_id", nil)
+	query := `SELECT ` + networkColumns + ` FROM networks WHERE TRUE` + filter + ` ORDER BY created_at ASC`
+	rows, err := s.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -106,7 +131,7 @@ func (s *Service) GetNetworksWithStats(ctx context.Context) ([]NetworkStats, err
 	var stats []NetworkStats
 	for rows.Next() {
 		var n NetworkStats
-		if err := rows.Scan(&n.ID, &n.Name, &n.CIDR, &n.Gateway, &n.DNS1, &n.VlanID, &n.IsPublic, &n.CreatedAt); err != nil {
+		if err := scanNetwork(rows, &n.Network); err != nil {
 			return nil, err
 		}
 
@@ -134,10 +159,117 @@ func (s *Service) GetNetworksWithStats(ctx context.Context) ([]NetworkStats, err
 	return stats, nil
 }
 
-func (s *Service) CreateNetwork(ctx context.Context, n Network) error {
-	query := `INSERT INTO networks (name, cidr, gateway, is_public) VALUES ($1, $2, $3, $4)`
-	_, err := s.ExecContext(ctx, query, n.Name, n.CIDR, n.Gateway, n.IsPublic)
-	return err
+// CreateNetwork stores a new pool. Pools created by a tenant are private to
+// its project; pools created by admins are shared unless a project is given.
+func (s *Service) CreateNetwork(ctx context.Context, n Network) (*Network, error) {
+	if pid, ok := tenantOf(ctx); ok {
+		n.ProjectID = &pid
+	}
+	n.OwnerID = ownerFor(ctx, n.OwnerID)
+	query := `
+		INSERT INTO networks (name, cidr, gateway, dns1, vlan_id, is_public, owner_id, project_id)
+		VALUES ($1, $2, $3, COALESCE(NULLIF($4, ''), '1.1.1.1'), $5, $6, $7, $8)
+		RETURNING id, dns1, created_at
+	`
+	err := s.QueryRowContext(ctx, query, n.Name, n.CIDR, n.Gateway, n.DNS1, n.VlanID, n.IsPublic, n.OwnerID, n.ProjectID).
+		Scan(&n.ID, &n.DNS1, &n.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+const networkColumns = `id, name, cidr, gateway, dns1, vlan_id, is_public, owner_id, project_id, created_at`
+
+func scanNetwork(row interface{ Scan(...interface{}) error }, n *Network) error {
+	var ownerID, projectID sql.NullInt64
+	if err := row.Scan(&n.ID, &n.Name, &n.CIDR, &n.Gateway, &n.DNS1, &n.VlanID, &n.IsPublic, &ownerID, &projectID, &n.CreatedAt); err != nil {
+		return err
+	}
+	n.OwnerID = nullIntPtr(ownerID)
+	n.ProjectID = nullIntPtr(projectID)
+	return nil
+}
+
+// ListNetworks returns every network pool visible to the caller, without
+// usage stats.
+func (s *Service) ListNetworks(ctx context.Context) ([]Network, error) {
+	filter, args := sharedFilter(ctx, "project_id", nil)
+	query := `SELECT ` + networkColumns + ` FROM networks WHERE TRUE` + filter + ` ORDER BY created_at ASC`
+	rows, err := s.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var networks []Network
+	for rows.Next() {
+		var n Network
+		if err := scanNetwork(rows, &n); err != nil {
+			return nil, err
+		}
+		networks = append(networks, n)
+	}
+	return networks, rows.Err()
+}
+
+// GetNetwork fetches a single network pool by ID.
+func (s *Service) GetNetwork(ctx context.Context, id string) (*Network, error) {
+	filter, args := sharedFilter(ctx, "project_id", []interface{}{id})
+	query := `SELECT ` + networkColumns + ` FROM networks WHERE id = $1` + filter
+	var n Network
+	if err := scanNetwork(s.QueryRowContext(ctx, query, args...), &n); err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// GetLeaseNetwork returns the network the lease of ip belongs to.
+func (s *Service) GetLeaseNetwork(ctx context.Context, ip string) (*Network, error) {
+	query := `
+		SELECT n.id, n.name, n.cidr, n.gateway, n.dns1, n.vlan_id, n.is_public, n.created_at
+		FROM ip_leases l
+		JOIN networks n ON n.id = l.network_id
+		WHERE l.ip = $1
+	`
+	var n Network
+	err := s.QueryRowContext(ctx, query, ip).Scan(&n.ID, &n.Name, &n.CIDR, &n.Gateway, &n.DNS1, &n.VlanID, &n.IsPublic, &n.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// NetworkAttachment links an instance to the network of its lease.
+type NetworkAttachment struct {
+	InstanceName string `json:"instance_name"`
+	NetworkID    string `json:"network_id"`
+	IP           string `json:"ip"`
+}
+
+// ListNetworkAttachments returns every allocated lease with its network.
+func (s *Service) ListNetworkAttachments(ctx context.Context) ([]NetworkAttachment, error) {
+	query := `
+		SELECT instance_name, network_id, ip
+		FROM ip_leases
+		WHERE instance_name IS NOT NULL AND network_id IS NOT NULL
+		ORDER BY instance_name
+	`
+	rows, err := s.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []NetworkAttachment
+	for rows.Next() {
+		var a NetworkAttachment
+		if err := rows.Scan(&a.InstanceName, &a.NetworkID, &a.IP); err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
 }
 
 func (s *Service) tryAllocateInNetwork(ctx context.Context, netDef Network, instanceName string) (string, error) {
@@ -153,8 +285,13 @@ func (s *Service) tryAllocateInNetwork(ctx context.Context, netDef Network, inst
 	// Start searching from Start + 2 (Skipping Network .0 and Gateway .1)
 	currentIP := startIP + 2
 
-	// 2. Fetch ALL used IPs in this network (ignoring placeholders)
-	query := `SELECT ip FROM ip_leases WHERE network_id = $1 AND instance_name IS NOT NULL`
+	// 2. Fetch ALL used IPs in this network (ignoring placeholders).
+	// Floating IPs live in public pools too and must never be leased.
+	query := `
+		SELECT ip FROM ip_leases WHERE network_id = $1 AND instance_name IS NOT NULL
+		UNION
+		SELECT ip FROM floating_ips WHERE network_id = $1
+	`
 	rows, err := s.QueryContext(ctx, query, netDef.ID)
 	if err != nil {
 		return "", err
@@ -251,6 +388,20 @@ func (s *Service) ReleaseIP(ctx context.Context, instanceName string) error {
 	return nil
 }
 
+// ReleaseLease frees ip if it is still leased to instanceName. Unlike
+// ReleaseIP it leaves alone any other lease held under the same name.
+func (s *Service) ReleaseLease(ctx context.Context, ip, instanceName string) error {
+	_, err := s.ExecContext(ctx, `
+		UPDATE ip_leases
+		SET instance_name = NULL, allocated_at = NULL
+		WHERE ip = $1 AND instance_name = $2
+	`, ip, instanceName)
+	if err != nil {
+		return fmt.Errorf("failed to release IP %s of instance %s: %w", ip, instanceName, err)
+	}
+	return nil
+}
+
 // GetInstanceIP retrieves the IP assigned to an instance.
 func (s *Service) GetInstanceIP(ctx context.Context, instanceName string) (string, error) {
 	query := `SELECT ip FROM ip_leases WHERE instance_name = $1`
@@ -285,15 +436,13 @@ type NetworkDetails struct {
 // GetNetworkDetails fetches a specific network with its usage stats and full lease list.
 func (s *Service) GetNetworkDetails(ctx context.Context, id string) (*NetworkDetails, error) {
 	// 1. Fetch Network
-	query := `SELECT id, name, cidr, gateway, dns1, vlan_id, is_public, created_at FROM networks WHERE id = $1`
-	var n Network
-	err := s.QueryRowContext(ctx, query, id).Scan(&n.ID, &n.Name, &n.CIDR, &n.Gateway, &n.DNS1, &n.VlanID, &n.IsPublic, &n.CreatedAt)
+	n, err := s.GetNetwork(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 
 	details := &NetworkDetails{
-		Network: n,
+		Network: *n,
 		Leases:  []IpLease{},
 	}
 
@@ -307,18 +456,29 @@ func (s *Service) GetNetworkDetails(ctx context.Context, id string) (*NetworkDet
 			details.Stats.TotalIPs -= 3
 		}
 	}
-	details.Stats.Network = n // Copy base info
+	details.Stats.Network = *n // Copy base info
+
+	usedCount := 0
+	countQuery := `SELECT COUNT(*) FROM ip_leases WHERE network_id = $1 AND instance_name IS NOT NULL`
+	if err := s.QueryRowContext(ctx, countQuery, id).Scan(&usedCount); err != nil {
+		return nil, err
+	}
 
 	// 3. Fetch Leases
-	// We want ALL leases for this network
-	leasesQuery := `SELECT ip, instance_name, allocated_at FROM ip_leases WHERE network_id = $1 ORDER BY ip`
-	rows, err := s.QueryContext(ctx, leasesQuery, id)
+	// Tenants only see their own project's instances in a shared pool
+	filter, args := projectFilter(ctx, "i.project_id", []interface{}{id})
+	if filter != "" {
+		filter = " AND (l.instance_name IS NULL OR (TRUE" + filter + "))"
+	}
+	leasesQuery := `SELECT l.ip, l.instance_name, l.allocated_at FROM ip_leases l
+		LEFT JOIN instances i ON i.name = l.instance_name
+		WHERE l.network_id = $1` + filter + ` ORDER BY l.ip`
+	rows, err := s.QueryContext(ctx, leasesQuery, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	usedCount := 0
 	for rows.Next() {
 		var l IpLease
 		var instName sql.NullString
@@ -331,7 +491,6 @@ func (s *Service) GetNetworkDetails(ctx context.Context, id string) (*NetworkDet
 		if instName.Valid {
 			l.InstanceName = &instName.String
 			l.Status = "allocated"
-			usedCount++
 		} else {
 			l.Status = "reserved" // Pre-allocated but not assigned to VM
 		}
@@ -353,15 +512,29 @@ func (s *Service) GetNetworkDetails(ctx context.Context, id string) (*NetworkDet
 
 // DeleteNetwork removes a network pool. Fails if there are active allocations.
 func (s *Service) DeleteNetwork(ctx context.Context, id string) error {
+	n, err := s.GetNetwork(ctx, id)
+	if err != nil {
+		return err
+	}
+	if _, restricted := tenantOf(ctx); restricted && n.ProjectID == nil {
+		return ErrSharedResource
+	}
+
 	// Check for active allocations
 	var count int
-	err := s.QueryRowContext(ctx, "SELECT COUNT(*) FROM ip_leases WHERE network_id = $1 AND instance_name IS NOT NULL", id).Scan(&count)
+	err = s.QueryRowContext(ctx, "SELECT COUNT(*) FROM ip_leases WHERE network_id = $1 AND instance_name IS NOT NULL", id).Scan(&count)
 	if err != nil {
 		return err
 	}
 	if count > 0 {
 		return fmt.Errorf("network has %d active IP allocations", count)
 	}
+	if err := s.QueryRowContext(ctx, "SELECT COUNT(*) FROM floating_ips WHERE network_id = $1", id).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("network has %d floating IPs", count)
+	}
 
 	// Delete leases first (if cascading isn't set up or to be safe)
 	// Actually schema migration 8 didn't specify ON DELETE CASCADE explicitly for the foreign key,
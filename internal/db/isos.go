@@ -0,0 +1,107 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// ============================================================================
+// ISO OWNERSHIP
+// ============================================================================
+
+// ISO images are files in the storage directory; this table only records
+// which project owns the ones uploaded by tenants. Files without a row (or
+// without a project) belong to the shared library managed by admins.
+type ISO struct {
+	Name      string    `json:"name"`
+	OwnerID   *int      `json:"owner_id,omitempty"`
+	ProjectID *int      `json:"project_id,omitempty"`
+	SizeBytes int64     `json:"size_bytes"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ISORepository struct {
+	db *Service
+}
+
+func NewISORepository(db *Service) *ISORepository {
+	return &ISORepository{db: db}
+}
+
+// Register records an uploaded image as owned by the caller's project.
+// Images uploaded by admins stay in the shared library.
+func (r *ISORepository) Register(ctx context.Context, name string, size int64) (*ISO, error) {
+	iso := &ISO{Name: name, OwnerID: ownerFor(ctx, nil), SizeBytes: size}
+	if pid, restricted := tenantOf(ctx); restricted {
+		iso.ProjectID = &pid
+	}
+	err := r.db.QueryRowContext(ctx, `
+		INSERT INTO isos (name, owner_id, project_id, size_bytes)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (name) DO UPDATE SET size_bytes = EXCLUDED.size_bytes
+		RETURNING created_at
+	`, name, iso.OwnerID, iso.ProjectID, size).Scan(&iso.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return iso, nil
+}
+
+// Visible filters the names found on disk down to those the caller may see:
+// the shared library plus its project's uploads.
+func (r *ISORepository) Visible(ctx context.Context, names []string) ([]string, error) {
+	pid, restricted := tenantOf(ctx)
+	if !restricted {
+		return names, nil
+	}
+
+	rows, err := r.db.QueryContext(ctx, `SELECT name FROM isos WHERE project_id <> $1`, pid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hidden := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		hidden[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	visible := make([]string, 0, len(names))
+	for _, name := range names {
+		if !hidden[name] {
+			visible = append(visible, name)
+		}
+	}
+	return visible, nil
+}
+
+// Delete drops the ownership record before the file is removed. Tenants may
+// only delete their project's uploads: another project's image is reported
+// as missing and the shared library is read-only.
+func (r *ISORepository) Delete(ctx context.Context, name string) error {
+	var projectID sql.NullInt64
+	err := r.db.QueryRowContext(ctx, `SELECT project_id FROM isos WHERE name = $1`, name).Scan(&projectID)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if pid, restricted := tenantOf(ctx); restricted {
+		switch {
+		case err == sql.ErrNoRows || !projectID.Valid:
+			return ErrSharedResource
+		case int(projectID.Int64) != pid:
+			return sql.ErrNoRows
+		}
+	}
+
+	_, err = r.db.ExecContext(ctx, `DELETE FROM isos WHERE name = $1`, name)
+	return err
+}
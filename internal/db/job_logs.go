@@ -0,0 +1,112 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"aexon/internal/types"
+)
+
+// ============================================================================
+// JOB PROGRESS & LOGS
+// ============================================================================
+
+// Levels of job log lines.
+const (
+	JobLogDebug = "debug"
+	JobLogInfo  = "info"
+	JobLogWarn  = "warn"
+	JobLogError = "error"
+)
+
+// JobLog is a line logged by a job while it ran.
+type JobLog struct {
+	ID        int64                  `json:"id"`
+	JobID     string                 `json:"job_id"`
+	Attempt   int                    `json:"attempt"`
+	Level     string                 `json:"level"`
+	Stage     string                 `json:"stage,omitempty"`
+	Message   string                 `json:"message"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+// SetProgress records how far the running attempt of a job got, in
+// percent, and the stage it is in.
+func (r *JobRepository) SetProgress(ctx context.Context, id string, progress int, stage string) error {
+	if progress < 0 || progress > 100 {
+		return fmt.Errorf("progress must be between 0 and 100, got %d", progress)
+	}
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE jobs SET progress = $1, stage = $2
+		WHERE id = $3 AND status = $4
+	`, progress, stage, id, types.JobInProgress)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return fmt.Errorf("%w: %s", ErrJobNotRunning, id)
+	}
+	return nil
+}
+
+// AppendLog records l for the current attempt of its job. Without a stage
+// of its own, l gets the one the job is in.
+func (r *JobRepository) AppendLog(ctx context.Context, l *JobLog) error {
+	switch l.Level {
+	case JobLogDebug, JobLogInfo, JobLogWarn, JobLogError:
+	default:
+		return fmt.Errorf("invalid log level %q", l.Level)
+	}
+	fields := []byte("{}")
+	if len(l.Fields) > 0 {
+		var err error
+		if fields, err = json.Marshal(l.Fields); err != nil {
+			return err
+		}
+	}
+
+	l.CreatedAt = time.Now().UTC()
+	return r.db.QueryRowContext(ctx, `
+		INSERT INTO job_logs (job_id, attempt, level, stage, message, fields, created_at)
+		SELECT id, attempt_count, $2, COALESCE(NULLIF($3, ''), stage), $4, $5, $6
+		FROM jobs WHERE id = $1
+		RETURNING id, attempt, stage
+	`, l.JobID, l.Level, l.Stage, l.Message, string(fields), l.CreatedAt).Scan(&l.ID, &l.Attempt, &l.Stage)
+}
+
+// Logs returns up to limit lines logged after the line with ID after by a
+// job, or by the steps of a workflow, oldest first, as seen by the
+// caller's scope.
+func (r *JobRepository) Logs(ctx context.Context, jobID string, after int64, limit int) ([]JobLog, error) {
+	filter, args := projectFilter(ctx, "j.project_id", []interface{}{jobID, after, limit})
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT l.id, l.job_id, l.attempt, l.level, l.stage, l.message, l.fields::text, l.created_at
+		FROM job_logs l JOIN jobs j ON j.id = l.job_id
+		WHERE (j.id = $1 OR j.parent_id = $1) AND l.id > $2`+filter+`
+		ORDER BY l.id
+		LIMIT $3
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	logs := []JobLog{}
+	for rows.Next() {
+		var l JobLog
+		var fields string
+		if err := rows.Scan(&l.ID, &l.JobID, &l.Attempt, &l.Level, &l.Stage, &l.Message, &fields, &l.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(fields), &l.Fields); err != nil {
+			return nil, fmt.Errorf("job log %d: invalid fields: %w", l.ID, err)
+		}
+		logs = append(logs, l)
+	}
+	return logs, rows.Err()
+}
@@ -0,0 +1,68 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"aexon/internal/types"
+)
+
+func TestJobLogs(t *testing.T) {
+	svc := testService(t)
+	alice, bob := testUser(t, svc, "user"), testUser(t, svc, "user")
+	repo := NewJobRepository(svc)
+	ctx := as(alice)
+
+	job := &Job{ID: fmt.Sprintf("logs-%d", time.Now().UnixNano()), Type: types.JobTypeCreateInstance, Target: "vm", Payload: "{}"}
+	if err := repo.Create(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { svc.ExecContext(ctx, `DELETE FROM jobs WHERE id = $1`, job.ID) })
+
+	// Progress is only recorded while the job runs
+	if err := repo.SetProgress(ctx, job.ID, 40, "cloning image"); !errors.Is(err, ErrJobNotRunning) {
+		t.Errorf("progress of a pending job: %v", err)
+	}
+	if _, err := svc.ExecContext(ctx, `UPDATE jobs SET status = $1, attempt_count = 1 WHERE id = $2`, types.JobInProgress, job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SetProgress(ctx, job.ID, 101, "cloning image"); err == nil {
+		t.Error("accepted progress above 100")
+	}
+	if err := repo.SetProgress(ctx, job.ID, 40, "cloning image"); err != nil {
+		t.Fatal(err)
+	}
+
+	first := &JobLog{JobID: job.ID, Level: JobLogInfo, Message: "cloning", Fields: map[string]interface{}{"image": "debian/12"}}
+	second := &JobLog{JobID: job.ID, Level: JobLogWarn, Stage: "resizing", Message: "slow disk"}
+	for _, l := range []*JobLog{first, second} {
+		if err := repo.AppendLog(ctx, l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if first.Stage != "cloning image" || first.Attempt != 1 || second.Stage != "resizing" {
+		t.Errorf("logged %+v, %+v", first, second)
+	}
+	if err := repo.AppendLog(ctx, &JobLog{JobID: job.ID, Level: "loud", Message: "x"}); err == nil {
+		t.Error("accepted an invalid level")
+	}
+
+	logs, err := repo.Logs(ctx, job.ID, 0, 10)
+	if err != nil || len(logs) != 2 || logs[0].ID != first.ID || logs[0].Fields["image"] != "debian/12" {
+		t.Fatalf("Logs() = %+v, %v", logs, err)
+	}
+	if logs, err := repo.Logs(ctx, job.ID, first.ID, 10); err != nil || len(logs) != 1 || logs[0].ID != second.ID {
+		t.Errorf("Logs(after first) = %+v, %v", logs, err)
+	}
+	if logs, err := repo.Logs(as(bob), job.ID, 0, 10); err != nil || len(logs) != 0 {
+		t.Errorf("bob read alice's job logs: %+v, %v", logs, err)
+	}
+
+	got, err := repo.Get(ctx, job.ID)
+	if err != nil || got.Progress != 40 || got.Stage != "cloning image" ||
+		got.ProjectID == nil || *got.ProjectID != alice.ProjectID || got.OwnerID == nil || *got.OwnerID != alice.ID {
+		t.Errorf("job = %+v, %v", got, err)
+	}
+}
@@ -0,0 +1,322 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"aexon/internal/types"
+
+	"github.com/lib/pq"
+)
+
+// ============================================================================
+// JOB QUEUE
+// ============================================================================
+
+// Channels NOTIFYed with the ID of every job queued or requeued as pending
+// (see migration 30), and of every job canceled (migration 31).
+const (
+	JobsChannel         = "jobs_ready"
+	JobsCanceledChannel = "jobs_canceled"
+)
+
+// JobLease is how long a claim on a job holds without being renewed by
+// Heartbeat. Jobs whose process died keep their lease until it runs out,
+// then RecoverStuckJobs requeues them.
+const JobLease = time.Minute
+
+// leaseExpiry is the end of a lease taken now. Leases are kept on the
+// database clock, which all processes sharing the queue agree on.
+var leaseExpiry = fmt.Sprintf("(now() AT TIME ZONE 'UTC') + interval '%d seconds'", int(JobLease/time.Second))
+
+// leaseExpired matches running jobs whose lease ran out; those started by
+// a process predating leases have none.
+const leaseExpired = `(lease_until IS NULL OR lease_until < (now() AT TIME ZONE 'UTC'))`
+
+// jobRunnable restricts jobs j to those a worker can run: not workflows,
+// whose steps run instead, and with every job they depend on completed.
+const jobRunnable = `j.type <> 'workflow' AND NOT EXISTS (
+			SELECT 1 FROM job_dependencies d JOIN jobs dep ON dep.id = d.depends_on
+			WHERE d.job_id = j.id AND dep.status <> 'COMPLETED'
+		)`
+
+// jobLocks names the part of its target that a job type changes; types not
+// listed lock the whole instance. Two jobs on the same target conflict when
+// either locks the whole instance or both lock the same part, so e.g. a
+// delete waits for a running snapshot, while a port forward does not.
+var jobLocks = map[types.JobType]string{
+	types.JobTypeCreateSnapshot: "snapshots",
+	types.JobTypeDeleteSnapshot: "snapshots",
+	types.JobTypeAddPort:        "ports",
+	types.JobTypeRemovePort:     "ports",
+}
+
+// jobConflict matches the running jobs o that job j must wait for. A job
+// whose lease ran out is left to RecoverStuckJobs, not waited for.
+var jobConflict = func() string {
+	lock := func(alias string) string {
+		names := make([]string, 0, len(jobLocks))
+		for t := range jobLocks {
+			names = append(names, string(t))
+		}
+		sort.Strings(names)
+		expr := "CASE " + alias + ".type"
+		for _, t := range names {
+			expr += fmt.Sprintf(" WHEN '%s' THEN '%s'", t, jobLocks[types.JobType(t)])
+		}
+		return expr + " ELSE '' END"
+	}
+	return `o.status = 'IN_PROGRESS' AND o.lease_until > (now() AT TIME ZONE 'UTC')
+			AND o.type <> 'workflow' AND j.type <> 'workflow'
+			AND o.target = j.target AND j.target <> '' AND o.id <> j.id
+			AND (` + lock("j") + ` = '' OR ` + lock("o") + ` IN ('', ` + lock("j") + `))`
+}()
+
+// JobLimits caps how many jobs run at once, across every process sharing
+// the queue. Zero means no limit.
+type JobLimits struct {
+	Running int                   // All types
+	PerType map[types.JobType]int // Types not listed are only capped by Running
+}
+
+// ParseJobTypeLimits reads "type=limit" pairs separated by commas, e.g.
+// "create_instance=2,delete_instance=1".
+func ParseJobTypeLimits(s string) (map[types.JobType]int, error) {
+	limits := make(map[types.JobType]int)
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		jobType, limit, ok := strings.Cut(entry, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(limit))
+		if !ok || err != nil || n < 0 || strings.TrimSpace(jobType) == "" {
+			return nil, fmt.Errorf("%q: expected type=limit", entry)
+		}
+		limits[types.JobType(strings.TrimSpace(jobType))] = n
+	}
+	return limits, nil
+}
+
+// querier is satisfied by both *Service and *Tx.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// claimable builds the conditions a pending job j must meet to be claimed
+// now under limits, numbering its arguments after the n already in use.
+// Full is set when the global limit is reached and nothing can be claimed.
+func claimable(ctx context.Context, q querier, limits JobLimits, n int) (cond string, args []interface{}, full bool, err error) {
+	cond = jobRunnable + ` AND NOT EXISTS (SELECT 1 FROM jobs o WHERE ` + jobConflict + `)`
+	if limits.Running <= 0 && len(limits.PerType) == 0 {
+		return cond, nil, false, nil
+	}
+
+	rows, err := q.QueryContext(ctx, `
+		SELECT type, COUNT(*) FROM jobs
+		WHERE status = $1 AND type <> $2 AND NOT `+leaseExpired+`
+		GROUP BY type
+	`, types.JobInProgress, types.JobTypeWorkflow)
+	if err != nil {
+		return "", nil, false, err
+	}
+	defer rows.Close()
+	total := 0
+	var capped []string
+	for rows.Next() {
+		var t types.JobType
+		var count int
+		if err := rows.Scan(&t, &count); err != nil {
+			return "", nil, false, err
+		}
+		total += count
+		if limit, ok := limits.PerType[t]; ok && count >= limit {
+			capped = append(capped, string(t))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", nil, false, err
+	}
+	// A limit of 0 keeps a type from running at all
+	for t, limit := range limits.PerType {
+		if limit == 0 {
+			capped = append(capped, string(t))
+		}
+	}
+
+	if limits.Running > 0 && total >= limits.Running {
+		return "", nil, true, nil
+	}
+	if len(capped) > 0 {
+		cond += fmt.Sprintf(` AND NOT (j.type = ANY($%d))`, n+1)
+		args = append(args, pq.Array(capped))
+	}
+	return cond, args, false, nil
+}
+
+// claimLock serializes claims, so that conflicts and limits are checked
+// against every job claimed before.
+const claimLock = "jobs:claim"
+
+// Claim takes the pending job that has been ready the longest and marks it
+// started, or returns nil when none is ready. Jobs that conflict with a
+// running job on their target (see jobLocks), or that would exceed limits,
+// wait. Rows locked by others, e.g. being canceled, are skipped rather
+// than waited on.
+func (r *JobRepository) Claim(ctx context.Context, limits JobLimits) (*Job, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, claimLock); err != nil {
+		return nil, err
+	}
+
+	cond, extra, full, err := claimable(ctx, tx, limits, 3)
+	if err != nil || full {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	job, err := scanJob(tx.QueryRowContext(ctx, `
+		UPDATE jobs
+		SET status = $1,
+		    started_at = $3,
+		    attempt_count = attempt_count + 1,
+		    progress = 0,
+		    stage = '',
+		    lease_until = `+leaseExpiry+`
+		WHERE id = (
+			SELECT j.id FROM jobs j
+			WHERE j.status = $2 AND j.run_after <= $3 AND `+cond+`
+			ORDER BY j.run_after, j.created_at
+			LIMIT 1
+			FOR UPDATE OF j SKIP LOCKED
+		)
+		RETURNING `+jobColumns,
+		append([]interface{}{types.JobInProgress, types.JobPending, now}, extra...)...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return job, tx.Commit()
+}
+
+// Heartbeat renews the lease of the given attempt of a running job. It
+// returns ErrJobNotRunning once the attempt is no longer running, because
+// the job was canceled or its lease ran out and it was requeued.
+func (r *JobRepository) Heartbeat(ctx context.Context, id string, attempt int) error {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE jobs SET lease_until = `+leaseExpiry+`
+		WHERE id = $1 AND attempt_count = $2 AND status = $3
+	`, id, attempt, types.JobInProgress)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return fmt.Errorf("%w: %s", ErrJobNotRunning, id)
+	}
+	return nil
+}
+
+// Retry records the failure of the given attempt of a running job and
+// requeues the job to run no earlier than at. It returns ErrJobNotRunning
+// once that attempt is no longer the one running.
+func (r *JobRepository) Retry(ctx context.Context, id string, attempt int, errorMsg string, at time.Time) error {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE jobs
+		SET status = $1,
+		    error = $2,
+		    run_after = $3
+		WHERE id = $4 AND status = $5 AND attempt_count = $6
+	`, types.JobPending, errorMsg, at.UTC(), id, types.JobInProgress, attempt)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return fmt.Errorf("%w: %s", ErrJobNotRunning, id)
+	}
+	return nil
+}
+
+// NextRunAfter returns when the earliest pending job that Claim could take
+// under limits becomes ready; ok is false when there is none. Jobs waiting
+// for a running one become claimable when it ends, not at a given time.
+func (r *JobRepository) NextRunAfter(ctx context.Context, limits JobLimits) (at time.Time, ok bool, err error) {
+	cond, extra, full, err := claimable(ctx, r.db, limits, 1)
+	if err != nil || full {
+		return time.Time{}, false, err
+	}
+	var next sql.NullTime
+	if err := r.db.QueryRowContext(ctx, `
+		SELECT MIN(j.run_after) FROM jobs j WHERE j.status = $1 AND `+cond,
+		append([]interface{}{types.JobPending}, extra...)...).Scan(&next); err != nil {
+		return time.Time{}, false, err
+	}
+	return next.Time, next.Valid, nil
+}
+
+// queuedBehind sets QueuedBehind on the pending jobs among jobs.
+func (r *JobRepository) queuedBehind(ctx context.Context, jobs []Job) error {
+	var ids []string
+	for _, job := range jobs {
+		if job.Status == types.JobPending {
+			ids = append(ids, job.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT j.id, o.id FROM jobs j JOIN jobs o ON `+jobConflict+`
+		WHERE j.id = ANY($1)
+		ORDER BY o.started_at, o.id
+	`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	behind := make(map[string][]string)
+	for rows.Next() {
+		var id, running string
+		if err := rows.Scan(&id, &running); err != nil {
+			return err
+		}
+		behind[id] = append(behind[id], running)
+	}
+	for i := range jobs {
+		jobs[i].QueuedBehind = behind[jobs[i].ID]
+	}
+	return rows.Err()
+}
+
+// ListenJobs opens a connection of its own, outside the pool, LISTENing on
+// JobsChannel and JobsCanceledChannel. It reconnects by itself; a nil
+// notification means notifications may have been missed while it was down.
+func (s *Service) ListenJobs() (*pq.Listener, error) {
+	l := pq.NewListener(s.config.DSN(), time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("[Jobs] Listener: %v", err)
+		}
+	})
+	for _, channel := range []string{JobsChannel, JobsCanceledChannel} {
+		if err := l.Listen(channel); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
@@ -0,0 +1,251 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"aexon/internal/types"
+)
+
+func TestJobQueueClaim(t *testing.T) {
+	svc := testService(t)
+	repo := NewJobRepository(svc)
+	ctx := context.Background()
+
+	// Ready long before anything else left in the table, so claimed first
+	job := &Job{
+		ID: fmt.Sprintf("queue-%d", time.Now().UnixNano()), Type: types.JobTypeCreateSnapshot, Target: "vm", Payload: "{}",
+		RunAfter: time.Date(1990, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	if err := repo.Create(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { svc.ExecContext(ctx, `DELETE FROM jobs WHERE id = $1`, job.ID) })
+
+	// A job locked by another worker is skipped, not waited on
+	tx, err := svc.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.ExecContext(ctx, `SELECT id FROM jobs WHERE id = $1 FOR UPDATE`, job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := repo.Claim(ctx, JobLimits{}); err != nil || (got != nil && got.ID == job.ID) {
+		t.Errorf("claimed a locked job: %+v, %v", got, err)
+	}
+	tx.Rollback()
+
+	got, err := repo.Claim(ctx, JobLimits{})
+	if err != nil || got == nil || got.ID != job.ID || got.Status != types.JobInProgress || got.AttemptCount != 1 {
+		t.Fatalf("Claim() = %+v, %v", got, err)
+	}
+
+	// A retry waits for its backoff before it can be claimed again
+	later := time.Now().Add(time.Hour)
+	if err := repo.Retry(ctx, job.ID, got.AttemptCount, "boom", later); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := repo.Claim(ctx, JobLimits{}); err != nil || (got != nil && got.ID == job.ID) {
+		t.Errorf("claimed a job before its retry: %+v, %v", got, err)
+	}
+	queued, err := repo.Get(ctx, job.ID)
+	if err != nil || queued.Status != types.JobPending || queued.Error == nil || queued.RunAfter.Sub(later.UTC()).Abs() > time.Second {
+		t.Errorf("retried job = %+v, %v", queued, err)
+	}
+	if next, ok, err := repo.NextRunAfter(ctx, JobLimits{}); err != nil || !ok || next.After(queued.RunAfter) {
+		t.Errorf("NextRunAfter() = %v, %v, %v", next, ok, err)
+	}
+}
+
+func TestJobLease(t *testing.T) {
+	svc := testService(t)
+	repo := NewJobRepository(svc)
+	ctx := context.Background()
+
+	job := &Job{
+		ID: fmt.Sprintf("lease-%d", time.Now().UnixNano()), Type: types.JobTypeCreateSnapshot, Target: "vm", Payload: "{}",
+		RunAfter: time.Date(1990, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	if err := repo.Create(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { svc.ExecContext(ctx, `DELETE FROM jobs WHERE id = $1`, job.ID) })
+
+	claimed, err := repo.Claim(ctx, JobLimits{})
+	if err != nil || claimed == nil || claimed.ID != job.ID {
+		t.Fatalf("Claim() = %+v, %v", claimed, err)
+	}
+	if err := repo.Heartbeat(ctx, job.ID, claimed.AttemptCount); err != nil {
+		t.Fatalf("heartbeat: %v", err)
+	}
+	if err := repo.Heartbeat(ctx, job.ID, claimed.AttemptCount+1); !errors.Is(err, ErrJobNotRunning) {
+		t.Errorf("heartbeat of another attempt: %v", err)
+	}
+
+	// A live lease is left alone, however long the job has been running
+	if _, err := svc.ExecContext(ctx, `UPDATE jobs SET started_at = started_at - interval '1 hour' WHERE id = $1`, job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.RecoverStuckJobs(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := repo.Get(ctx, job.ID); got.Status != types.JobInProgress {
+		t.Fatalf("job with a live lease recovered: %+v", got)
+	}
+
+	// Once the lease runs out the job is requeued, counting the attempt once
+	if _, err := svc.ExecContext(ctx, `UPDATE jobs SET lease_until = lease_until - interval '1 hour' WHERE id = $1`, job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := repo.RecoverStuckJobs(ctx); err != nil || n == 0 {
+		t.Fatalf("RecoverStuckJobs() = %d, %v", n, err)
+	}
+	if err := repo.Heartbeat(ctx, job.ID, claimed.AttemptCount); !errors.Is(err, ErrJobNotRunning) {
+		t.Errorf("heartbeat after recovery: %v", err)
+	}
+	again, err := repo.Claim(ctx, JobLimits{})
+	if err != nil || again == nil || again.ID != job.ID || again.AttemptCount != 2 {
+		t.Fatalf("claim after recovery = %+v, %v", again, err)
+	}
+
+	// The abandoned attempt cannot end the one now running
+	if err := repo.MarkCompleted(ctx, job.ID, claimed.AttemptCount); !errors.Is(err, ErrJobNotRunning) {
+		t.Errorf("completing the abandoned attempt: %v", err)
+	}
+	if err := repo.MarkFailed(ctx, job.ID, claimed.AttemptCount, "late", true); !errors.Is(err, ErrJobNotRunning) {
+		t.Errorf("failing the abandoned attempt: %v", err)
+	}
+	if err := repo.Retry(ctx, job.ID, claimed.AttemptCount, "late", time.Now()); !errors.Is(err, ErrJobNotRunning) {
+		t.Errorf("retrying the abandoned attempt: %v", err)
+	}
+	if err := repo.MarkCompleted(ctx, job.ID, again.AttemptCount); err != nil {
+		t.Errorf("completing the running attempt: %v", err)
+	}
+}
+
+func TestJobConflictExpiredLease(t *testing.T) {
+	svc := testService(t)
+	repo := NewJobRepository(svc)
+	ctx := context.Background()
+
+	target := fmt.Sprintf("vm-%d", time.Now().UnixNano())
+	running := &Job{ID: target + ".snapshot", Type: types.JobTypeCreateSnapshot, Target: target, Payload: "{}", RunAfter: time.Date(1990, 1, 1, 0, 0, 0, 0, time.UTC)}
+	waiting := &Job{ID: target + ".delete", Type: types.JobTypeDeleteInstance, Target: target, Payload: "{}", RunAfter: time.Date(1990, 1, 1, 0, 0, 1, 0, time.UTC)}
+	for _, job := range []*Job{running, waiting} {
+		if err := repo.Create(ctx, job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() { svc.ExecContext(ctx, `DELETE FROM jobs WHERE target = $1`, target) })
+
+	if claimed, err := repo.Claim(ctx, JobLimits{}); err != nil || claimed == nil || claimed.ID != running.ID {
+		t.Fatalf("Claim() = %+v, %v", claimed, err)
+	}
+	if claimed, _ := repo.Claim(ctx, JobLimits{Running: 1000}); claimed != nil && claimed.ID == waiting.ID {
+		t.Fatal("delete claimed while the snapshot holds its lease")
+	}
+
+	// A job that stopped renewing its lease no longer holds the target
+	if _, err := svc.ExecContext(ctx, `UPDATE jobs SET lease_until = lease_until - interval '1 hour' WHERE id = $1`, running.ID); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := repo.Claim(ctx, JobLimits{Running: 1000}); err != nil || claimed == nil || claimed.ID != waiting.ID {
+		t.Errorf("Claim() after the lease ran out = %+v, %v", claimed, err)
+	}
+}
+
+func TestJobCancel(t *testing.T) {
+	svc := testService(t)
+	alice, bob := testUser(t, svc, "user"), testUser(t, svc, "user")
+	repo := NewJobRepository(svc)
+
+	job := &Job{ID: fmt.Sprintf("cancel-%d", time.Now().UnixNano()), Type: types.JobTypeCreateSnapshot, Target: "vm", Payload: "{}"}
+	if err := repo.Create(as(alice), job); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.MarkCanceled(as(bob), job.ID, "nope"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("bob canceled alice's job: %v", err)
+	}
+	if err := repo.MarkCanceled(as(alice), job.ID, "no longer needed"); err != nil {
+		t.Fatalf("alice cannot cancel her job: %v", err)
+	}
+	got, err := repo.Get(as(alice), job.ID)
+	if err != nil || got.Status != types.JobCanceled || got.FinishedAt == nil {
+		t.Fatalf("canceled job = %+v, %v", got, err)
+	}
+	if err := repo.MarkCanceled(as(alice), job.ID, "again"); !errors.Is(err, ErrJobFinished) {
+		t.Errorf("canceling twice: %v", err)
+	}
+
+	// What the worker reports afterwards is discarded
+	if err := repo.MarkCompleted(context.Background(), job.ID, job.AttemptCount); !errors.Is(err, ErrJobNotRunning) {
+		t.Errorf("completing a canceled job: %v", err)
+	}
+}
+
+func TestParseJobTypeLimits(t *testing.T) {
+	got, err := ParseJobTypeLimits(" create_instance=2, delete_instance=0,")
+	if err != nil || len(got) != 2 || got[types.JobTypeCreateInstance] != 2 || got[types.JobTypeDeleteInstance] != 0 {
+		t.Errorf("ParseJobTypeLimits() = %v, %v", got, err)
+	}
+	for _, bad := range []string{"create_instance", "create_instance=-1", "=2", "create_instance=two"} {
+		if _, err := ParseJobTypeLimits(bad); err == nil {
+			t.Errorf("ParseJobTypeLimits(%q) accepted", bad)
+		}
+	}
+}
+
+func TestJobQueueConflicts(t *testing.T) {
+	svc := testService(t)
+	repo := NewJobRepository(svc)
+	ctx := context.Background()
+
+	target := fmt.Sprintf("vm-%d", time.Now().UnixNano())
+	queue := func(jobType types.JobType) *Job {
+		t.Helper()
+		job := &Job{
+			ID: fmt.Sprintf("%s-%s", target, jobType), Type: jobType, Target: target, Payload: "{}",
+			RunAfter: time.Date(1985, 1, 1, 0, 0, 0, 0, time.UTC),
+		}
+		if err := repo.Create(ctx, job); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { svc.ExecContext(ctx, `DELETE FROM jobs WHERE id = $1`, job.ID) })
+		return job
+	}
+	claim := func(limits JobLimits, want *Job) {
+		t.Helper()
+		got, err := repo.Claim(ctx, limits)
+		if want == nil && err == nil && (got == nil || got.Target != target) {
+			return
+		}
+		if err != nil || want == nil || got == nil || got.ID != want.ID {
+			t.Fatalf("Claim() = %+v, %v; want %v", got, err, want)
+		}
+	}
+
+	snapshot := queue(types.JobTypeCreateSnapshot)
+	claim(JobLimits{}, snapshot)
+
+	// The delete waits for the snapshot; a port forward does not
+	del, port := queue(types.JobTypeDeleteInstance), queue(types.JobTypeAddPort)
+	claim(JobLimits{Running: 1}, nil)
+	claim(JobLimits{}, port)
+	got, err := repo.Get(ctx, del.ID)
+	if err != nil || len(got.QueuedBehind) != 2 || got.QueuedBehind[0] != snapshot.ID || got.QueuedBehind[1] != port.ID {
+		t.Fatalf("queued delete = %+v, %v", got, err)
+	}
+
+	for _, job := range []*Job{snapshot, port} {
+		if err := repo.MarkCompleted(ctx, job.ID, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	claim(JobLimits{PerType: map[types.JobType]int{types.JobTypeDeleteInstance: 0}}, nil)
+	claim(JobLimits{}, del)
+}
@@ -4,8 +4,11 @@ package db
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
 	"time"
 
 	"aexon/internal/types"
@@ -27,8 +30,103 @@ type Job struct {
 	FinishedAt   *time.Time      `json:"finished_at,omitempty"`
 	AttemptCount int             `json:"attempt_count"`
 	RequestedBy  *string         `json:"requested_by,omitempty"`
+	OwnerID      *int            `json:"owner_id,omitempty"`
+	ProjectID    *int            `json:"project_id,omitempty"` // nil = admins only
+	RunAfter     time.Time       `json:"run_after"`
+	QueuedBehind []string        `json:"queued_behind,omitempty"` // Running jobs on the target it waits for
+	Progress     int             `json:"progress"`                // Percent, of the current attempt
+	Stage        string          `json:"stage,omitempty"`
+
+	// Workflow steps (see workflows.go)
+	ParentID    *string    `json:"parent_id,omitempty"`
+	Step        string     `json:"step,omitempty"`
+	DependsOn   []string   `json:"depends_on,omitempty"`
+	MaxAttempts int        `json:"max_attempts,omitempty"` // 0: types.MaxRetries
+	RetryDelay  int        `json:"retry_delay,omitempty"`  // Seconds; 0: types.BaseDelay
+	Rollback    *JobAction `json:"rollback,omitempty"`
+	Steps       []Job      `json:"steps,omitempty"` // Of a workflow
 }
 
+const jobColumns = `id, type, target, payload, status, error,
+		       created_at, started_at, finished_at,
+		       attempt_count, requested_by, run_after,
+		       parent_id, step, max_attempts, retry_delay, rollback,
+		       progress, stage, owner_id, project_id`
+
+func scanJob(row interface{ Scan(...interface{}) error }) (*Job, error) {
+	var job Job
+	var errStr sql.NullString
+	var reqByStr sql.NullString
+	var startedAt sql.NullTime
+	var finishedAt sql.NullTime
+	var parentID sql.NullString
+	var rollback sql.NullString
+	var ownerID, projectID sql.NullInt64
+
+	err := row.Scan(
+		&job.ID,
+		&job.Type,
+		&job.Target,
+		&job.Payload,
+		&job.Status,
+		&errStr,
+		&job.CreatedAt,
+		&startedAt,
+		&finishedAt,
+		&job.AttemptCount,
+		&reqByStr,
+		&job.RunAfter,
+		&parentID,
+		&job.Step,
+		&job.MaxAttempts,
+		&job.RetryDelay,
+		&rollback,
+		&job.Progress,
+		&job.Stage,
+		&ownerID,
+		&projectID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Handle nullable fields
+	if errStr.Valid {
+		s := errStr.String
+		job.Error = &s
+	}
+	if reqByStr.Valid {
+		s := reqByStr.String
+		job.RequestedBy = &s
+	}
+	if startedAt.Valid {
+		job.StartedAt = &startedAt.Time
+	}
+	if finishedAt.Valid {
+		job.FinishedAt = &finishedAt.Time
+	}
+	if parentID.Valid {
+		job.ParentID = &parentID.String
+	}
+	job.OwnerID = nullIntPtr(ownerID)
+	job.ProjectID = nullIntPtr(projectID)
+	if rollback.Valid {
+		if err := json.Unmarshal([]byte(rollback.String), &job.Rollback); err != nil {
+			return nil, fmt.Errorf("job %s: invalid rollback: %w", job.ID, err)
+		}
+	}
+
+	return &job, nil
+}
+
+var (
+	// ErrJobFinished is returned when canceling a job that already ended.
+	ErrJobFinished = errors.New("job already finished")
+	// ErrJobNotRunning is returned when a worker reports the outcome of a
+	// job that is no longer running, e.g. canceled meanwhile.
+	ErrJobNotRunning = errors.New("job not running")
+)
+
 type JobRepository struct {
 	db *Service
 }
@@ -42,18 +140,46 @@ func NewJobRepository(db *Service) *JobRepository {
 // ============================================================================
 
 func (r *JobRepository) Create(ctx context.Context, job *Job) error {
+	return insertJob(ctx, r.db, job, ownerFor(ctx, nil), projectFor(ctx, nil))
+}
+
+// execer is satisfied by both *Service and *Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// insertJob queues job as pending, for the given owner and project.
+func insertJob(ctx context.Context, q execer, job *Job, ownerID, projectID *int) error {
 	query := `
 		INSERT INTO jobs (
 			id, type, target, payload, status,
-			created_at, attempt_count, requested_by
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			created_at, attempt_count, requested_by, owner_id, project_id, run_after,
+			parent_id, step, max_attempts, retry_delay, rollback
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
 	`
 
 	job.CreatedAt = time.Now().UTC()
+	if job.RunAfter.IsZero() {
+		job.RunAfter = job.CreatedAt
+	}
+	job.RunAfter = job.RunAfter.UTC()
 	job.Status = types.JobPending
 	job.AttemptCount = 0
+	job.OwnerID, job.ProjectID = ownerID, projectID
+	if job.RequestedBy == nil {
+		job.RequestedBy = requesterFor(ctx)
+	}
+	var rollback *string
+	if job.Rollback != nil {
+		b, err := json.Marshal(job.Rollback)
+		if err != nil {
+			return err
+		}
+		s := string(b)
+		rollback = &s
+	}
 
-	_, err := r.db.ExecContext(ctx, query,
+	_, err := q.ExecContext(ctx, query,
 		job.ID,
 		job.Type,
 		job.Target,
@@ -62,79 +188,79 @@ func (r *JobRepository) Create(ctx context.Context, job *Job) error {
 		job.CreatedAt,
 		job.AttemptCount,
 		job.RequestedBy,
+		ownerID,
+		projectID,
+		job.RunAfter,
+		job.ParentID,
+		job.Step,
+		job.MaxAttempts,
+		job.RetryDelay,
+		rollback,
 	)
 
 	return err
 }
 
+// requesterFor names the user a job is created for; nil for jobs the
+// control plane starts on its own.
+func requesterFor(ctx context.Context) *string {
+	s, ok := ScopeFrom(ctx)
+	if !ok || s.UserID <= 0 {
+		return nil
+	}
+	uid := strconv.Itoa(s.UserID)
+	return &uid
+}
+
 func (r *JobRepository) Get(ctx context.Context, id string) (*Job, error) {
 	query := `
-		SELECT id, type, target, payload, status, error,
-		       created_at, started_at, finished_at,
-		       attempt_count, requested_by
+		SELECT ` + jobColumns + `
 		FROM jobs
-		WHERE id = $1
-	`
-
-	row := r.db.QueryRowContext(ctx, query, id)
-
-	var job Job
-	var errStr sql.NullString
-	var reqByStr sql.NullString
-	var startedAt sql.NullTime
-	var finishedAt sql.NullTime
-
-	err := row.Scan(
-		&job.ID,
-		&job.Type,
-		&job.Target,
-		&job.Payload,
-		&job.Status,
-		&errStr,
-		&job.CreatedAt,
-		&startedAt,
-		&finishedAt,
-		&job.AttemptCount,
-		&reqByStr,
-	)
+		WHERE id = $1`
 
+	filter, args := projectFilter(ctx, "project_id", []interface{}{id})
+	job, err := scanJob(r.db.QueryRowContext(ctx, query+filter, args...))
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("job not found: %s", id)
+			return nil, fmt.Errorf("job not found: %s: %w", id, err)
 		}
 		return nil, err
 	}
 
-	// Handle nullable fields
-	if errStr.Valid {
-		s := errStr.String
-		job.Error = &s
-	}
-	if reqByStr.Valid {
-		s := reqByStr.String
-		job.RequestedBy = &s
+	// A workflow comes with its steps, a step with what it waits for
+	if job.Type == types.JobTypeWorkflow {
+		if job.Steps, err = r.Steps(ctx, job.ID); err != nil {
+			return nil, err
+		}
+	} else if job.ParentID != nil {
+		deps, err := r.dependencies(ctx, job.ID)
+		if err != nil {
+			return nil, err
+		}
+		job.DependsOn = deps[job.ID]
 	}
-	if startedAt.Valid {
-		job.StartedAt = &startedAt.Time
+
+	// Pending jobs name the running ones they are queued behind
+	jobs := []Job{*job}
+	if err := r.queuedBehind(ctx, jobs); err != nil {
+		return nil, err
 	}
-	if finishedAt.Valid {
-		job.FinishedAt = &finishedAt.Time
+	job.QueuedBehind = jobs[0].QueuedBehind
+	if err := r.queuedBehind(ctx, job.Steps); err != nil {
+		return nil, err
 	}
 
-	return &job, nil
+	return job, nil
 }
 
 func (r *JobRepository) List(ctx context.Context, limit int) ([]Job, error) {
 	query := `
-		SELECT id, type, target, payload, status, error,
-		       created_at, started_at, finished_at,
-		       attempt_count, requested_by
+		SELECT ` + jobColumns + `
 		FROM jobs
-		ORDER BY created_at DESC
-		LIMIT $1
-	`
+		WHERE TRUE`
 
-	rows, err := r.db.QueryContext(ctx, query, limit)
+	filter, args := projectFilter(ctx, "project_id", []interface{}{limit})
+	rows, err := r.db.QueryContext(ctx, query+filter+` ORDER BY created_at DESC LIMIT $1`, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -143,49 +269,18 @@ func (r *JobRepository) List(ctx context.Context, limit int) ([]Job, error) {
 	var jobs []Job
 
 	for rows.Next() {
-		var job Job
-		var errStr sql.NullString
-		var reqByStr sql.NullString
-		var startedAt sql.NullTime
-		var finishedAt sql.NullTime
-
-		err := rows.Scan(
-			&job.ID,
-			&job.Type,
-			&job.Target,
-			&job.Payload,
-			&job.Status,
-			&errStr,
-			&job.CreatedAt,
-			&startedAt,
-			&finishedAt,
-			&job.AttemptCount,
-			&reqByStr,
-		)
-
+		job, err := scanJob(rows)
 		if err != nil {
 			return nil, err
 		}
+		jobs = append(jobs, *job)
+	}
 
-		if errStr.Valid {
-			s := errStr.String
-			job.Error = &s
-		}
-		if reqByStr.Valid {
-			s := reqByStr.String
-			job.RequestedBy = &s
-		}
-		if startedAt.Valid {
-			job.StartedAt = &startedAt.Time
-		}
-		if finishedAt.Valid {
-			job.FinishedAt = &finishedAt.Time
-		}
-
-		jobs = append(jobs, job)
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
-	return jobs, rows.Err()
+	return jobs, r.queuedBehind(ctx, jobs)
 }
 
 // ============================================================================
@@ -197,7 +292,8 @@ func (r *JobRepository) MarkStarted(ctx context.Context, id string) error {
 		UPDATE jobs
 		SET status = $1,
 		    started_at = $2,
-		    attempt_count = attempt_count + 1
+		    attempt_count = attempt_count + 1,
+		    lease_until = ` + leaseExpiry + `
 		WHERE id = $3
 	`
 
@@ -223,19 +319,25 @@ func (r *JobRepository) MarkStarted(ctx context.Context, id string) error {
 	return nil
 }
 
-func (r *JobRepository) MarkCompleted(ctx context.Context, id string) error {
+// MarkCompleted ends the given attempt of a running job successfully. Like
+// Heartbeat, it returns ErrJobNotRunning once that attempt is no longer the
+// one running.
+func (r *JobRepository) MarkCompleted(ctx context.Context, id string, attempt int) error {
 	query := `
 		UPDATE jobs
 		SET status = $1,
 		    finished_at = $2,
-		    error = NULL
-		WHERE id = $3
+		    error = NULL,
+		    progress = 100
+		WHERE id = $3 AND status = $4 AND attempt_count = $5
 	`
 
 	result, err := r.db.ExecContext(ctx, query,
 		types.JobCompleted,
 		time.Now().UTC(),
 		id,
+		types.JobInProgress,
+		attempt,
 	)
 
 	if err != nil {
@@ -248,13 +350,16 @@ func (r *JobRepository) MarkCompleted(ctx context.Context, id string) error {
 	}
 
 	if rows == 0 {
-		return fmt.Errorf("job not found: %s", id)
+		return fmt.Errorf("%w: %s", ErrJobNotRunning, id)
 	}
 
 	return nil
 }
 
-func (r *JobRepository) MarkFailed(ctx context.Context, id string, errorMsg string, isFatal bool) error {
+// MarkFailed records the failure of the given attempt of a running job,
+// ending the job when isFatal and requeuing it otherwise. It returns
+// ErrJobNotRunning once that attempt is no longer the one running.
+func (r *JobRepository) MarkFailed(ctx context.Context, id string, attempt int, errorMsg string, isFatal bool) error {
 	status := types.JobPending
 	if isFatal {
 		status = types.JobFailed
@@ -269,17 +374,17 @@ func (r *JobRepository) MarkFailed(ctx context.Context, id string, errorMsg stri
 			SET status = $1,
 			    error = $2,
 			    finished_at = $3
-			WHERE id = $4
+			WHERE id = $4 AND status = $5 AND attempt_count = $6
 		`
-		args = []interface{}{status, errorMsg, time.Now().UTC(), id}
+		args = []interface{}{status, errorMsg, time.Now().UTC(), id, types.JobInProgress, attempt}
 	} else {
 		query = `
 			UPDATE jobs
 			SET status = $1,
 			    error = $2
-			WHERE id = $3
+			WHERE id = $3 AND status = $4 AND attempt_count = $5
 		`
-		args = []interface{}{status, errorMsg, id}
+		args = []interface{}{status, errorMsg, id, types.JobInProgress, attempt}
 	}
 
 	result, err := r.db.ExecContext(ctx, query, args...)
@@ -293,41 +398,68 @@ func (r *JobRepository) MarkFailed(ctx context.Context, id string, errorMsg stri
 	}
 
 	if rows == 0 {
-		return fmt.Errorf("job not found: %s", id)
+		return fmt.Errorf("%w: %s", ErrJobNotRunning, id)
 	}
 
 	return nil
 }
 
+// MarkCanceled cancels a job that is pending or running, as seen by the
+// caller's scope. A running job keeps running until its worker notices
+// (see JobsCanceledChannel); whatever it reports then is discarded.
+// Canceling a workflow cancels its steps; canceling a step ends its
+// workflow.
 func (r *JobRepository) MarkCanceled(ctx context.Context, id string, reason string) error {
 	query := `
 		UPDATE jobs
 		SET status = $1,
 		    error = $2,
 		    finished_at = $3
-		WHERE id = $4
-	`
+		WHERE id = $4 AND status IN ($5, $6)`
 
-	result, err := r.db.ExecContext(ctx, query,
+	filter, args := projectFilter(ctx, "project_id", []interface{}{
 		types.JobCanceled,
 		reason,
 		time.Now().UTC(),
 		id,
-	)
+		types.JobPending,
+		types.JobInProgress,
+	})
 
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	rows, err := result.RowsAffected()
+	var jobType types.JobType
+	var parentID sql.NullString
+	err = tx.QueryRowContext(ctx, query+filter+` RETURNING type, parent_id`, args...).Scan(&jobType, &parentID)
+	if err == sql.ErrNoRows {
+		job, err := r.Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: %s is %s", ErrJobFinished, id, job.Status)
+	}
 	if err != nil {
 		return err
 	}
 
-	if rows == 0 {
-		return fmt.Errorf("job not found: %s", id)
+	if jobType == types.JobTypeWorkflow {
+		if err := endWorkflow(ctx, tx, id, reason); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
 	}
 
+	if parentID.Valid {
+		if _, err := r.AdvanceWorkflow(ctx, parentID.String); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -335,22 +467,24 @@ func (r *JobRepository) MarkCanceled(ctx context.Context, id string, reason stri
 // RECOVERY OPERATIONS
 // ============================================================================
 
-func (r *JobRepository) RecoverStuckJobs(ctx context.Context, timeout time.Duration) (int, error) {
+// RecoverStuckJobs requeues the running jobs whose lease ran out, as their
+// worker is gone. The attempt they were in counts; the next one is counted
+// when the job is claimed again.
+func (r *JobRepository) RecoverStuckJobs(ctx context.Context) (int, error) {
 	query := `
 		UPDATE jobs
 		SET status = $1,
-		    attempt_count = attempt_count + 1
+		    lease_until = NULL
 		WHERE status = $2
-		  AND started_at < $3
+		  AND ` + leaseExpired + `
+		  AND type <> $3 -- Workflows run for as long as their steps
 		RETURNING id
 	`
 
-	cutoff := time.Now().UTC().Add(-timeout)
-
 	rows, err := r.db.QueryContext(ctx, query,
 		types.JobPending,
 		types.JobInProgress,
-		cutoff,
+		types.JobTypeWorkflow,
 	)
 
 	if err != nil {
@@ -374,20 +508,18 @@ func (r *JobRepository) RecoverStuckJobs(ctx context.Context, timeout time.Durat
 	return len(recoveredIDs), rows.Err()
 }
 
-func (r *JobRepository) GetStuckJobs(ctx context.Context, timeout time.Duration) ([]Job, error) {
+// GetStuckJobs returns the running jobs whose lease ran out.
+func (r *JobRepository) GetStuckJobs(ctx context.Context) ([]Job, error) {
 	query := `
-		SELECT id, type, target, payload, status, error,
-		       created_at, started_at, finished_at,
-		       attempt_count, requested_by
+		SELECT ` + jobColumns + `
 		FROM jobs
 		WHERE status = $1
-		  AND started_at < $2
+		  AND ` + leaseExpired + `
+		  AND type <> $2
 		ORDER BY started_at ASC
 	`
 
-	cutoff := time.Now().UTC().Add(-timeout)
-
-	rows, err := r.db.QueryContext(ctx, query, types.JobInProgress, cutoff)
+	rows, err := r.db.QueryContext(ctx, query, types.JobInProgress, types.JobTypeWorkflow)
 	if err != nil {
 		return nil, err
 	}
@@ -396,46 +528,11 @@ func (r *JobRepository) GetStuckJobs(ctx context.Context, timeout time.Duration)
 	var jobs []Job
 
 	for rows.Next() {
-		var job Job
-		var errStr sql.NullString
-		var reqByStr sql.NullString
-		var startedAt sql.NullTime
-		var finishedAt sql.NullTime
-
-		err := rows.Scan(
-			&job.ID,
-			&job.Type,
-			&job.Target,
-			&job.Payload,
-			&job.Status,
-			&errStr,
-			&job.CreatedAt,
-			&startedAt,
-			&finishedAt,
-			&job.AttemptCount,
-			&reqByStr,
-		)
-
+		job, err := scanJob(rows)
 		if err != nil {
 			return nil, err
 		}
-
-		if errStr.Valid {
-			s := errStr.String
-			job.Error = &s
-		}
-		if reqByStr.Valid {
-			s := reqByStr.String
-			job.RequestedBy = &s
-		}
-		if startedAt.Valid {
-			job.StartedAt = &startedAt.Time
-		}
-		if finishedAt.Valid {
-			job.FinishedAt = &finishedAt.Time
-		}
-
-		jobs = append(jobs, job)
+		jobs = append(jobs, *job)
 	}
 
 	return jobs, rows.Err()
@@ -447,16 +544,12 @@ func (r *JobRepository) GetStuckJobs(ctx context.Context, timeout time.Duration)
 
 func (r *JobRepository) GetByStatus(ctx context.Context, status types.JobStatus, limit int) ([]Job, error) {
 	query := `
-		SELECT id, type, target, payload, status, error,
-		       created_at, started_at, finished_at,
-		       attempt_count, requested_by
+		SELECT ` + jobColumns + `
 		FROM jobs
-		WHERE status = $1
-		ORDER BY created_at DESC
-		LIMIT $2
-	`
+		WHERE status = $1`
 
-	rows, err := r.db.QueryContext(ctx, query, status, limit)
+	filter, args := projectFilter(ctx, "project_id", []interface{}{status, limit})
+	rows, err := r.db.QueryContext(ctx, query+filter+` ORDER BY created_at DESC LIMIT $2`, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -465,63 +558,28 @@ func (r *JobRepository) GetByStatus(ctx context.Context, status types.JobStatus,
 	var jobs []Job
 
 	for rows.Next() {
-		var job Job
-		var errStr sql.NullString
-		var reqByStr sql.NullString
-		var startedAt sql.NullTime
-		var finishedAt sql.NullTime
-
-		err := rows.Scan(
-			&job.ID,
-			&job.Type,
-			&job.Target,
-			&job.Payload,
-			&job.Status,
-			&errStr,
-			&job.CreatedAt,
-			&startedAt,
-			&finishedAt,
-			&job.AttemptCount,
-			&reqByStr,
-		)
-
+		job, err := scanJob(rows)
 		if err != nil {
 			return nil, err
 		}
+		jobs = append(jobs, *job)
+	}
 
-		if errStr.Valid {
-			s := errStr.String
-			job.Error = &s
-		}
-		if reqByStr.Valid {
-			s := reqByStr.String
-			job.RequestedBy = &s
-		}
-		if startedAt.Valid {
-			job.StartedAt = &startedAt.Time
-		}
-		if finishedAt.Valid {
-			job.FinishedAt = &finishedAt.Time
-		}
-
-		jobs = append(jobs, job)
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
-	return jobs, rows.Err()
+	return jobs, r.queuedBehind(ctx, jobs)
 }
 
 func (r *JobRepository) GetByTarget(ctx context.Context, target string, limit int) ([]Job, error) {
 	query := `
-		SELECT id, type, target, payload, status, error,
-		       created_at, started_at, finished_at,
-		       attempt_count, requested_by
+		SELECT ` + jobColumns + `
 		FROM jobs
-		WHERE target = $1
-		ORDER BY created_at DESC
-		LIMIT $2
-	`
+		WHERE target = $1`
 
-	rows, err := r.db.QueryContext(ctx, query, target, limit)
+	filter, args := projectFilter(ctx, "project_id", []interface{}{target, limit})
+	rows, err := r.db.QueryContext(ctx, query+filter+` ORDER BY created_at DESC LIMIT $2`, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -530,101 +588,33 @@ func (r *JobRepository) GetByTarget(ctx context.Context, target string, limit in
 	var jobs []Job
 
 	for rows.Next() {
-		var job Job
-		var errStr sql.NullString
-		var reqByStr sql.NullString
-		var startedAt sql.NullTime
-		var finishedAt sql.NullTime
-
-		err := rows.Scan(
-			&job.ID,
-			&job.Type,
-			&job.Target,
-			&job.Payload,
-			&job.Status,
-			&errStr,
-			&job.CreatedAt,
-			&startedAt,
-			&finishedAt,
-			&job.AttemptCount,
-			&reqByStr,
-		)
-
+		job, err := scanJob(rows)
 		if err != nil {
 			return nil, err
 		}
+		jobs = append(jobs, *job)
+	}
 
-		if errStr.Valid {
-			s := errStr.String
-			job.Error = &s
-		}
-		if reqByStr.Valid {
-			s := reqByStr.String
-			job.RequestedBy = &s
-		}
-		if startedAt.Valid {
-			job.StartedAt = &startedAt.Time
-		}
-		if finishedAt.Valid {
-			job.FinishedAt = &finishedAt.Time
-		}
-
-		jobs = append(jobs, job)
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
-	return jobs, rows.Err()
+	return jobs, r.queuedBehind(ctx, jobs)
 }
 
 func (r *JobRepository) GetLastBackupJob(ctx context.Context, instanceName string) (*Job, error) {
 	// Try by target first
 	query := `
-		SELECT id, type, target, payload, status, error,
-		       created_at, started_at, finished_at,
-		       attempt_count, requested_by
+		SELECT ` + jobColumns + `
 		FROM jobs
 		WHERE type = $1 AND target = $2
 		ORDER BY created_at DESC
 		LIMIT 1
 	`
 
-	row := r.db.QueryRowContext(ctx, query, types.JobTypeCreateSnapshot, instanceName)
-
-	var job Job
-	var errStr sql.NullString
-	var reqByStr sql.NullString
-	var startedAt sql.NullTime
-	var finishedAt sql.NullTime
-
-	err := row.Scan(
-		&job.ID,
-		&job.Type,
-		&job.Target,
-		&job.Payload,
-		&job.Status,
-		&errStr,
-		&job.CreatedAt,
-		&startedAt,
-		&finishedAt,
-		&job.AttemptCount,
-		&reqByStr,
-	)
-
+	job, err := scanJob(r.db.QueryRowContext(ctx, query, types.JobTypeCreateSnapshot, instanceName))
 	if err == nil {
-		if errStr.Valid {
-			s := errStr.String
-			job.Error = &s
-		}
-		if reqByStr.Valid {
-			s := reqByStr.String
-			job.RequestedBy = &s
-		}
-		if startedAt.Valid {
-			job.StartedAt = &startedAt.Time
-		}
-		if finishedAt.Valid {
-			job.FinishedAt = &finishedAt.Time
-		}
-		return &job, nil
+		return job, nil
 	}
 
 	if err != sql.ErrNoRows {
@@ -633,31 +623,14 @@ func (r *JobRepository) GetLastBackupJob(ctx context.Context, instanceName strin
 
 	// Fallback: search in payload (less efficient)
 	query = `
-		SELECT id, type, target, payload, status, error,
-		       created_at, started_at, finished_at,
-		       attempt_count, requested_by
+		SELECT ` + jobColumns + `
 		FROM jobs
 		WHERE type = $1 AND payload LIKE $2
 		ORDER BY created_at DESC
 		LIMIT 1
 	`
 
-	row = r.db.QueryRowContext(ctx, query, types.JobTypeCreateSnapshot, "%"+instanceName+"%")
-
-	err = row.Scan(
-		&job.ID,
-		&job.Type,
-		&job.Target,
-		&job.Payload,
-		&job.Status,
-		&errStr,
-		&job.CreatedAt,
-		&startedAt,
-		&finishedAt,
-		&job.AttemptCount,
-		&reqByStr,
-	)
-
+	job, err = scanJob(r.db.QueryRowContext(ctx, query, types.JobTypeCreateSnapshot, "%"+instanceName+"%"))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil // No backup found
@@ -665,22 +638,7 @@ func (r *JobRepository) GetLastBackupJob(ctx context.Context, instanceName strin
 		return nil, err
 	}
 
-	if errStr.Valid {
-		s := errStr.String
-		job.Error = &s
-	}
-	if reqByStr.Valid {
-		s := reqByStr.String
-		job.RequestedBy = &s
-	}
-	if startedAt.Valid {
-		job.StartedAt = &startedAt.Time
-	}
-	if finishedAt.Valid {
-		job.FinishedAt = &finishedAt.Time
-	}
-
-	return &job, nil
+	return job, nil
 }
 
 func (r *JobRepository) CountByStatus(ctx context.Context, status types.JobStatus) (int, error) {
@@ -805,22 +763,32 @@ func MarkJobStarted(id string) error {
 	return repo.MarkStarted(ctx, id)
 }
 
+// MarkJobCompleted ends whichever attempt of the job is running.
 func MarkJobCompleted(id string) error {
 	ctx := context.Background()
 	repo := NewJobRepository(GetService())
-	return repo.MarkCompleted(ctx, id)
+	job, err := repo.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	return repo.MarkCompleted(ctx, id, job.AttemptCount)
 }
 
+// MarkJobFailed fails whichever attempt of the job is running.
 func MarkJobFailed(id string, errorMsg string, isFatal bool) error {
 	ctx := context.Background()
 	repo := NewJobRepository(GetService())
-	return repo.MarkFailed(ctx, id, errorMsg, isFatal)
+	job, err := repo.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	return repo.MarkFailed(ctx, id, job.AttemptCount, errorMsg, isFatal)
 }
 
 func RecoverStuckJobs() error {
 	ctx := context.Background()
 	repo := NewJobRepository(GetService())
-	_, err := repo.RecoverStuckJobs(ctx, 5*time.Minute)
+	_, err := repo.RecoverStuckJobs(ctx)
 	return err
 }
 
@@ -828,4 +796,4 @@ func GetLastBackupJob(instanceName string) (*Job, error) {
 	ctx := context.Background()
 	repo := NewJobRepository(GetService())
 	return repo.GetLastBackupJob(ctx, instanceName)
-}
\ No newline at end of file
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// LoginThrottle is the failed login state of one key: a client IP or an
+// account.
+type LoginThrottle struct {
+	Key         string
+	Failures    int       // Since WindowStart
+	WindowStart time.Time // Start of the current counting window
+	Strikes     int       // Lockouts so far; each lasts longer than the last
+	LockedUntil time.Time
+	UpdatedAt   time.Time
+}
+
+// LoginThrottleRepository keeps login throttles in the database, so that
+// they are shared by control planes and survive restarts.
+type LoginThrottleRepository struct {
+	db *Service
+}
+
+func NewLoginThrottleRepository(db *Service) *LoginThrottleRepository {
+	return &LoginThrottleRepository{db: db}
+}
+
+const loginThrottleColumns = `key, failures, window_start, strikes, locked_until, updated_at`
+
+func scanLoginThrottle(row interface{ Scan(...interface{}) error }, t *LoginThrottle) error {
+	return row.Scan(&t.Key, &t.Failures, &t.WindowStart, &t.Strikes, &t.LockedUntil, &t.UpdatedAt)
+}
+
+// Get returns the throttle of key, zero when it has none.
+func (r *LoginThrottleRepository) Get(ctx context.Context, key string) (LoginThrottle, error) {
+	t := LoginThrottle{Key: key}
+	err := scanLoginThrottle(r.db.QueryRowContext(ctx,
+		`SELECT `+loginThrottleColumns+` FROM login_throttles WHERE key = $1`, key), &t)
+	if errors.Is(err, sql.ErrNoRows) {
+		return LoginThrottle{Key: key}, nil
+	}
+	return t, err
+}
+
+// Update applies fn to the throttle of key and stores the result. Updates
+// of one key are serialised, so concurrent failures are all counted.
+func (r *LoginThrottleRepository) Update(ctx context.Context, key string, fn func(*LoginThrottle)) (LoginThrottle, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return LoginThrottle{}, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO login_throttles (key) VALUES ($1) ON CONFLICT (key) DO NOTHING
+	`, key); err != nil {
+		return LoginThrottle{}, err
+	}
+	var t LoginThrottle
+	if err := scanLoginThrottle(tx.QueryRowContext(ctx,
+		`SELECT `+loginThrottleColumns+` FROM login_throttles WHERE key = $1 FOR UPDATE`, key), &t); err != nil {
+		return LoginThrottle{}, err
+	}
+
+	fn(&t)
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE login_throttles
+		SET failures = $2, window_start = $3, strikes = $4, locked_until = $5, updated_at = $6
+		WHERE key = $1
+	`, key, t.Failures, t.WindowStart.UTC(), t.Strikes, t.LockedUntil.UTC(), t.UpdatedAt.UTC()); err != nil {
+		return LoginThrottle{}, err
+	}
+	return t, tx.Commit()
+}
+
+// Delete forgets the throttle of key.
+func (r *LoginThrottleRepository) Delete(ctx context.Context, key string) error {
+	_, err := r.db.ExecContext(ctx, `DELETE FROM login_throttles WHERE key = $1`, key)
+	return err
+}
+
+// Purge removes the throttles neither locked nor updated since before.
+func (r *LoginThrottleRepository) Purge(ctx context.Context, before time.Time) error {
+	_, err := r.db.ExecContext(ctx, `
+		DELETE FROM login_throttles WHERE updated_at < $1 AND locked_until < $1
+	`, before.UTC())
+	return err
+}
@@ -0,0 +1,203 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+)
+
+// MFAState is a user's TOTP enrolment.
+type MFAState struct {
+	Secret   string // Empty when not enrolled
+	Enabled  bool   // Set once enrolment was confirmed with a code
+	LastStep int64  // Time step of the last accepted code
+}
+
+// MFARepository stores TOTP secrets, recovery codes and the 2FA policy.
+type MFARepository struct {
+	db *Service
+}
+
+func NewMFARepository(db *Service) *MFARepository {
+	return &MFARepository{db: db}
+}
+
+// Get returns the user's enrolment.
+func (r *MFARepository) Get(ctx context.Context, userID int) (*MFAState, error) {
+	var secret sql.NullString
+	var lastStep sql.NullInt64
+	var st MFAState
+	err := r.db.QueryRowContext(ctx, `
+		SELECT totp_secret, totp_enabled, totp_last_step FROM users WHERE id = $1
+	`, userID).Scan(&secret, &st.Enabled, &lastStep)
+	if err != nil {
+		return nil, err
+	}
+	st.Secret, st.LastStep = secret.String, lastStep.Int64
+	return &st, nil
+}
+
+// SetPendingSecret starts (or restarts) an enrolment. It fails with
+// sql.ErrNoRows when 2FA is already enabled.
+func (r *MFARepository) SetPendingSecret(ctx context.Context, userID int, secret string) error {
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE users SET totp_secret = $2, totp_last_step = NULL
+		WHERE id = $1 AND NOT totp_enabled
+	`, userID, secret)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Enable confirms the pending enrolment, accepting the code of the given
+// step, and replaces the recovery codes.
+func (r *MFARepository) Enable(ctx context.Context, userID int, step int64, codeHashes []string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		UPDATE users SET totp_enabled = TRUE, totp_last_step = $2
+		WHERE id = $1 AND NOT totp_enabled AND totp_secret IS NOT NULL
+	`, userID, step)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if err := replaceRecoveryCodes(ctx, tx, userID, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Disable removes the enrolment and its recovery codes.
+func (r *MFARepository) Disable(ctx context.Context, userID int) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE users SET totp_secret = NULL, totp_enabled = FALSE, totp_last_step = NULL
+		WHERE id = $1
+	`, userID); err != nil {
+		return err
+	}
+	if err := replaceRecoveryCodes(ctx, tx, userID, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ConsumeStep records an accepted code. It reports false when a code of
+// this or a later step was already accepted (a replay).
+func (r *MFARepository) ConsumeStep(ctx context.Context, userID int, step int64) (bool, error) {
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE users SET totp_last_step = $2
+		WHERE id = $1 AND (totp_last_step IS NULL OR totp_last_step < $2)
+	`, userID, step)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// ConsumeRecoveryCode marks an unused recovery code as used.
+func (r *MFARepository) ConsumeRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error) {
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE user_recovery_codes SET used_at = NOW()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`, userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// ReplaceRecoveryCodes invalidates all recovery codes of the user in favour
+// of new ones.
+func (r *MFARepository) ReplaceRecoveryCodes(ctx context.Context, userID int, codeHashes []string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *Tx, userID int, codeHashes []string) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM user_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	for _, h := range codeHashes {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO user_recovery_codes (user_id, code_hash) VALUES ($1, $2)
+		`, userID, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecoveryCodesLeft counts the unused recovery codes of the user.
+func (r *MFARepository) RecoveryCodesLeft(ctx context.Context, userID int) (int, error) {
+	var n int
+	err := r.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM user_recovery_codes WHERE user_id = $1 AND used_at IS NULL
+	`, userID).Scan(&n)
+	return n, err
+}
+
+// RequiredRoles returns the platform roles that must use 2FA.
+func (r *MFARepository) RequiredRoles(ctx context.Context) ([]string, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT role FROM mfa_required_roles ORDER BY role`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []string
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+// SetRequiredRoles replaces the 2FA policy.
+func (r *MFARepository) SetRequiredRoles(ctx context.Context, roles []string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM mfa_required_roles`); err != nil {
+		return err
+	}
+	for _, role := range roles {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO mfa_required_roles (role) VALUES ($1) ON CONFLICT DO NOTHING
+		`, role); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
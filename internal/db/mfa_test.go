@@ -0,0 +1,53 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func TestMFAEnrolment(t *testing.T) {
+	svc := testService(t)
+	alice := testUser(t, svc, "user")
+	repo := NewMFARepository(svc)
+	ctx := context.Background()
+
+	if err := repo.SetPendingSecret(ctx, alice.ID, "JBSWY3DPEHPK3PXP"); err != nil {
+		t.Fatalf("pending secret: %v", err)
+	}
+	codes := []string{"aaaa", "bbbb"}
+	if err := repo.Enable(ctx, alice.ID, 100, codes); err != nil {
+		t.Fatalf("enable: %v", err)
+	}
+	if err := repo.SetPendingSecret(ctx, alice.ID, "OTHER"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("enabled secrets must not be replaced: %v", err)
+	}
+
+	for _, tc := range []struct {
+		step int64
+		want bool
+	}{{100, false}, {99, false}, {101, true}, {101, false}} {
+		if ok, err := repo.ConsumeStep(ctx, alice.ID, tc.step); err != nil || ok != tc.want {
+			t.Errorf("ConsumeStep(%d) = %v, %v, want %v", tc.step, ok, err, tc.want)
+		}
+	}
+
+	if ok, _ := repo.ConsumeRecoveryCode(ctx, alice.ID, "aaaa"); !ok {
+		t.Error("recovery code rejected")
+	}
+	if ok, _ := repo.ConsumeRecoveryCode(ctx, alice.ID, "aaaa"); ok {
+		t.Error("recovery codes are single use")
+	}
+	if left, err := repo.RecoveryCodesLeft(ctx, alice.ID); err != nil || left != 1 {
+		t.Errorf("RecoveryCodesLeft = %d, %v, want 1", left, err)
+	}
+
+	if err := repo.Disable(ctx, alice.ID); err != nil {
+		t.Fatalf("disable: %v", err)
+	}
+	st, err := repo.Get(ctx, alice.ID)
+	if err != nil || st.Enabled || st.Secret != "" {
+		t.Errorf("after disable: %+v, %v", st, err)
+	}
+}
@@ -242,6 +242,859 @@ var migrations = []Migration{
 			ADD CONSTRAINT fk_instance FOREIGN KEY (instance_name) REFERENCES instances(name) ON DELETE SET NULL;
 		`,
 	},
+	{
+		Version:     12,
+		Description: "Create security groups",
+		Up: `
+			CREATE TABLE IF NOT EXISTS security_groups (
+				id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+				name VARCHAR(64) NOT NULL UNIQUE,
+				description TEXT DEFAULT '',
+				created_at TIMESTAMP NOT NULL DEFAULT NOW()
+			);
+
+			CREATE TABLE IF NOT EXISTS security_group_rules (
+				id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+				group_id UUID NOT NULL REFERENCES security_groups(id) ON DELETE CASCADE,
+				direction VARCHAR(8) NOT NULL CHECK (direction IN ('ingress', 'egress')),
+				protocol VARCHAR(8) NOT NULL CHECK (protocol IN ('tcp', 'udp', 'icmp', 'any')),
+				port_from INT NOT NULL DEFAULT 0 CHECK (port_from BETWEEN 0 AND 65535),
+				port_to INT NOT NULL DEFAULT 0 CHECK (port_to BETWEEN 0 AND 65535),
+				cidr VARCHAR(18) NOT NULL DEFAULT '0.0.0.0/0',
+				description TEXT DEFAULT '',
+				created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+				CHECK (port_to >= port_from)
+			);
+			CREATE INDEX IF NOT EXISTS idx_sg_rules_group ON security_group_rules(group_id);
+
+			CREATE TABLE IF NOT EXISTS instance_security_groups (
+				instance_name TEXT NOT NULL REFERENCES instances(name) ON DELETE CASCADE,
+				group_id UUID NOT NULL REFERENCES security_groups(id) ON DELETE CASCADE,
+				attached_at TIMESTAMP NOT NULL DEFAULT NOW(),
+				PRIMARY KEY (instance_name, group_id)
+			);
+			CREATE INDEX IF NOT EXISTS idx_instance_sg_group ON instance_security_groups(group_id);
+		`,
+		Down: `
+			DROP TABLE IF EXISTS instance_security_groups CASCADE;
+			DROP TABLE IF EXISTS security_group_rules CASCADE;
+			DROP TABLE IF EXISTS security_groups CASCADE;
+		`,
+	},
+	{
+		Version:     13,
+		Description: "Create floating IPs",
+		Up: `
+			-- instance_name has no FK on purpose: the binding outlives the
+			-- instance so a recreated VM with the same name gets its IP back.
+			CREATE TABLE IF NOT EXISTS floating_ips (
+				id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+				ip VARCHAR(15) NOT NULL UNIQUE,
+				network_id UUID NOT NULL REFERENCES networks(id),
+				instance_name TEXT,
+				description TEXT DEFAULT '',
+				created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+				attached_at TIMESTAMP
+			);
+			CREATE UNIQUE INDEX IF NOT EXISTS idx_floating_ips_instance
+				ON floating_ips(instance_name) WHERE instance_name IS NOT NULL;
+			CREATE INDEX IF NOT EXISTS idx_floating_ips_network ON floating_ips(network_id);
+		`,
+		Down: `
+			DROP TABLE IF EXISTS floating_ips CASCADE;
+		`,
+	},
+	{
+		Version:     14,
+		Description: "Create traffic ledger and quotas",
+		Up: `
+			-- Last raw counters seen per instance, used to compute deltas
+			CREATE TABLE IF NOT EXISTS traffic_counters (
+				instance_name TEXT PRIMARY KEY REFERENCES instances(name) ON DELETE CASCADE,
+				rx_bytes BIGINT NOT NULL DEFAULT 0,
+				tx_bytes BIGINT NOT NULL DEFAULT 0,
+				sampled_at TIMESTAMP NOT NULL DEFAULT NOW()
+			);
+
+			-- Accumulated traffic per billing period (kept after deletion)
+			CREATE TABLE IF NOT EXISTS traffic_ledger (
+				instance_name TEXT NOT NULL,
+				period_start DATE NOT NULL,
+				rx_bytes BIGINT NOT NULL DEFAULT 0,
+				tx_bytes BIGINT NOT NULL DEFAULT 0,
+				updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+				PRIMARY KEY (instance_name, period_start)
+			);
+			CREATE INDEX IF NOT EXISTS idx_traffic_ledger_period ON traffic_ledger(period_start);
+
+			CREATE TABLE IF NOT EXISTS traffic_quotas (
+				instance_name TEXT PRIMARY KEY REFERENCES instances(name) ON DELETE CASCADE,
+				monthly_bytes BIGINT NOT NULL CHECK (monthly_bytes > 0),
+				action VARCHAR(16) NOT NULL CHECK (action IN ('throttle', 'notify', 'stop')),
+				throttle_mbps INT NOT NULL DEFAULT 1 CHECK (throttle_mbps > 0),
+				triggered_period DATE,
+				created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+				updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+			);
+		`,
+		Down: `
+			DROP TABLE IF EXISTS traffic_quotas CASCADE;
+			DROP TABLE IF EXISTS traffic_ledger CASCADE;
+			DROP TABLE IF EXISTS traffic_counters CASCADE;
+		`,
+	},
+	{
+		Version:     15,
+		Description: "Add resource ownership",
+		Up: `
+			-- NULL owner: created before tenancy or by the control plane (admins only)
+			ALTER TABLE instances ADD COLUMN IF NOT EXISTS owner_id INT REFERENCES users(id) ON DELETE SET NULL;
+			CREATE INDEX IF NOT EXISTS idx_instances_owner ON instances(owner_id);
+
+			ALTER TABLE jobs ADD COLUMN IF NOT EXISTS owner_id INT REFERENCES users(id) ON DELETE SET NULL;
+			CREATE INDEX IF NOT EXISTS idx_jobs_owner ON jobs(owner_id);
+
+			-- NULL owner: shared pool managed by admins, usable by every tenant
+			ALTER TABLE networks ADD COLUMN IF NOT EXISTS owner_id INT REFERENCES users(id) ON DELETE CASCADE;
+			CREATE INDEX IF NOT EXISTS idx_networks_owner ON networks(owner_id);
+
+			-- ISO files live on disk; unregistered files form the shared library
+			CREATE TABLE IF NOT EXISTS isos (
+				name TEXT PRIMARY KEY,
+				owner_id INT REFERENCES users(id) ON DELETE CASCADE,
+				size_bytes BIGINT NOT NULL DEFAULT 0,
+				created_at TIMESTAMP NOT NULL DEFAULT NOW()
+			);
+			CREATE INDEX IF NOT EXISTS idx_isos_owner ON isos(owner_id);
+		`,
+		Down: `
+			DROP TABLE IF EXISTS isos CASCADE;
+			ALTER TABLE networks DROP COLUMN IF EXISTS owner_id;
+			ALTER TABLE jobs DROP COLUMN IF EXISTS owner_id;
+			ALTER TABLE instances DROP COLUMN IF EXISTS owner_id;
+		`,
+	},
+	{
+		Version:     16,
+		Description: "Create projects and memberships",
+		Up: `
+			CREATE TABLE IF NOT EXISTS projects (
+				id SERIAL PRIMARY KEY,
+				name VARCHAR(64) NOT NULL,
+				personal BOOLEAN NOT NULL DEFAULT FALSE,
+				created_by INT REFERENCES users(id) ON DELETE SET NULL,
+				created_at TIMESTAMP NOT NULL DEFAULT NOW()
+			);
+			-- Every user gets exactly one personal project
+			CREATE UNIQUE INDEX IF NOT EXISTS idx_projects_personal ON projects(created_by) WHERE personal;
+
+			CREATE TABLE IF NOT EXISTS project_members (
+				project_id INT NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+				user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				role VARCHAR(16) NOT NULL CHECK (role IN ('owner', 'admin', 'operator', 'viewer')),
+				created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+				PRIMARY KEY (project_id, user_id)
+			);
+			CREATE INDEX IF NOT EXISTS idx_project_members_user ON project_members(user_id);
+
+			-- Only the SHA-256 of the invitation token is stored
+			CREATE TABLE IF NOT EXISTS project_invitations (
+				id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+				project_id INT NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+				email TEXT NOT NULL,
+				role VARCHAR(16) NOT NULL CHECK (role IN ('owner', 'admin', 'operator', 'viewer')),
+				token_hash CHAR(64) NOT NULL UNIQUE,
+				invited_by INT REFERENCES users(id) ON DELETE SET NULL,
+				expires_at TIMESTAMP NOT NULL,
+				accepted_at TIMESTAMP,
+				created_at TIMESTAMP NOT NULL DEFAULT NOW()
+			);
+			CREATE INDEX IF NOT EXISTS idx_project_invitations_project ON project_invitations(project_id);
+
+			INSERT INTO projects (name, personal, created_by)
+			SELECT u.email, TRUE, u.id FROM users u
+			WHERE NOT EXISTS (SELECT 1 FROM projects p WHERE p.personal AND p.created_by = u.id);
+
+			INSERT INTO project_members (project_id, user_id, role)
+			SELECT id, created_by, 'owner' FROM projects WHERE personal
+			ON CONFLICT DO NOTHING;
+
+			-- Resources belong to a project; owner_id only records who created them.
+			-- NULL project: created by the control plane (instances, jobs, floating
+			-- IPs) or shared with every project (networks, ISOs, security groups).
+			ALTER TABLE instances ADD COLUMN IF NOT EXISTS project_id INT REFERENCES projects(id);
+			ALTER TABLE jobs ADD COLUMN IF NOT EXISTS project_id INT REFERENCES projects(id) ON DELETE SET NULL;
+			ALTER TABLE networks ADD COLUMN IF NOT EXISTS project_id INT REFERENCES projects(id);
+			ALTER TABLE isos ADD COLUMN IF NOT EXISTS project_id INT REFERENCES projects(id);
+			ALTER TABLE security_groups ADD COLUMN IF NOT EXISTS project_id INT REFERENCES projects(id);
+			ALTER TABLE floating_ips ADD COLUMN IF NOT EXISTS project_id INT REFERENCES projects(id);
+
+			-- Group names only need to be unique inside a project
+			ALTER TABLE security_groups DROP CONSTRAINT IF EXISTS security_groups_name_key;
+			CREATE UNIQUE INDEX IF NOT EXISTS idx_security_groups_project_name
+				ON security_groups(COALESCE(project_id, 0), name);
+
+			UPDATE instances t SET project_id = p.id FROM projects p WHERE p.personal AND p.created_by = t.owner_id;
+			UPDATE jobs t SET project_id = p.id FROM projects p WHERE p.personal AND p.created_by = t.owner_id;
+			UPDATE networks t SET project_id = p.id FROM projects p WHERE p.personal AND p.created_by = t.owner_id;
+			UPDATE isos t SET project_id = p.id FROM projects p WHERE p.personal AND p.created_by = t.owner_id;
+
+			-- Floating IPs follow the project of the instance they are bound to
+			UPDATE floating_ips f SET project_id = i.project_id
+			FROM instances i WHERE i.name = f.instance_name;
+
+			CREATE INDEX IF NOT EXISTS idx_instances_project ON instances(project_id);
+			CREATE INDEX IF NOT EXISTS idx_jobs_project ON jobs(project_id);
+			CREATE INDEX IF NOT EXISTS idx_networks_project ON networks(project_id);
+			CREATE INDEX IF NOT EXISTS idx_isos_project ON isos(project_id);
+			CREATE INDEX IF NOT EXISTS idx_floating_ips_project ON floating_ips(project_id);
+
+			-- Removing the creator must not take project resources with it
+			ALTER TABLE networks DROP CONSTRAINT IF EXISTS networks_owner_id_fkey;
+			ALTER TABLE networks ADD CONSTRAINT networks_owner_id_fkey
+				FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE SET NULL;
+			ALTER TABLE isos DROP CONSTRAINT IF EXISTS isos_owner_id_fkey;
+			ALTER TABLE isos ADD CONSTRAINT isos_owner_id_fkey
+				FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE SET NULL;
+		`,
+		Down: `
+			DROP INDEX IF EXISTS idx_security_groups_project_name;
+			ALTER TABLE floating_ips DROP COLUMN IF EXISTS project_id;
+			ALTER TABLE security_groups DROP COLUMN IF EXISTS project_id;
+			ALTER TABLE security_groups ADD CONSTRAINT security_groups_name_key UNIQUE (name);
+			ALTER TABLE isos DROP COLUMN IF EXISTS project_id;
+			ALTER TABLE networks DROP COLUMN IF EXISTS project_id;
+			ALTER TABLE jobs DROP COLUMN IF EXISTS project_id;
+			ALTER TABLE instances DROP COLUMN IF EXISTS project_id;
+			DROP TABLE IF EXISTS project_invitations CASCADE;
+			DROP TABLE IF EXISTS project_members CASCADE;
+			DROP TABLE IF EXISTS projects CASCADE;
+		`,
+	},
+	{
+		Version:     17,
+		Description: "Create role permissions",
+		Up: `
+			-- Project roles map to permissions inside their project; platform
+			-- roles (users.role, prefixed "platform:") apply everywhere.
+			-- Patterns may use "*" for a whole segment, e.g. "instances:*".
+			CREATE TABLE IF NOT EXISTS role_permissions (
+				role VARCHAR(32) NOT NULL,
+				permission VARCHAR(64) NOT NULL,
+				PRIMARY KEY (role, permission)
+			);
+
+			INSERT INTO role_permissions (role, permission) VALUES
+				('platform:admin', '*'),
+				('platform:user', 'projects:list'),
+				('platform:user', 'projects:create'),
+				('platform:user', 'invitations:accept'),
+
+				('owner', 'instances:*'),
+				('owner', 'snapshots:*'),
+				('owner', 'backups:*'),
+				('owner', 'files:*'),
+				('owner', 'isos:*'),
+				('owner', 'jobs:read'),
+				('owner', 'templates:read'),
+				('owner', 'networks:*'),
+				('owner', 'security_groups:*'),
+				('owner', 'floating_ips:*'),
+				('owner', 'traffic:*'),
+				('owner', 'projects:*'),
+				('owner', 'members:*'),
+
+				('admin', 'instances:*'),
+				('admin', 'snapshots:*'),
+				('admin', 'backups:*'),
+				('admin', 'files:*'),
+				('admin', 'isos:*'),
+				('admin', 'jobs:read'),
+				('admin', 'templates:read'),
+				('admin', 'networks:*'),
+				('admin', 'security_groups:*'),
+				('admin', 'floating_ips:*'),
+				('admin', 'traffic:*'),
+				('admin', 'projects:read'),
+				('admin', 'projects:update'),
+				('admin', 'projects:leave'),
+				('admin', 'members:*'),
+
+				('operator', 'instances:read'),
+				('operator', 'instances:operate'),
+				('operator', 'instances:resize'),
+				('operator', 'snapshots:*'),
+				('operator', 'backups:*'),
+				('operator', 'files:*'),
+				('operator', 'isos:read'),
+				('operator', 'jobs:read'),
+				('operator', 'templates:read'),
+				('operator', 'networks:read'),
+				('operator', 'security_groups:read'),
+				('operator', 'security_groups:attach'),
+				('operator', 'floating_ips:read'),
+				('operator', 'floating_ips:attach'),
+				('operator', 'traffic:*'),
+				('operator', 'projects:read'),
+				('operator', 'projects:leave'),
+				('operator', 'members:read'),
+
+				('viewer', 'instances:read'),
+				('viewer', 'snapshots:read'),
+				('viewer', 'files:read'),
+				('viewer', 'isos:read'),
+				('viewer', 'jobs:read'),
+				('viewer', 'templates:read'),
+				('viewer', 'networks:read'),
+				('viewer', 'security_groups:read'),
+				('viewer', 'floating_ips:read'),
+				('viewer', 'traffic:read'),
+				('viewer', 'projects:read'),
+				('viewer', 'projects:leave'),
+				('viewer', 'members:read')
+			ON CONFLICT DO NOTHING;
+		`,
+		Down: `
+			DROP TABLE IF EXISTS role_permissions CASCADE;
+		`,
+	},
+	{
+		Version:     18,
+		Description: "Persist token revocations and refresh tokens",
+		Up: `
+			-- Revoked access tokens by JWT ID, kept until they would expire anyway
+			CREATE TABLE IF NOT EXISTS revoked_tokens (
+				jti VARCHAR(64) PRIMARY KEY,
+				expires_at TIMESTAMP NOT NULL,
+				revoked_at TIMESTAMP NOT NULL DEFAULT NOW()
+			);
+			CREATE INDEX IF NOT EXISTS idx_revoked_tokens_expires ON revoked_tokens(expires_at);
+
+			-- Each login starts a family; every refresh replaces the presented
+			-- token with a new one of the same family. Presenting a replaced
+			-- token again revokes the whole family.
+			CREATE TABLE IF NOT EXISTS refresh_tokens (
+				jti VARCHAR(64) PRIMARY KEY,
+				family VARCHAR(64) NOT NULL,
+				user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				expires_at TIMESTAMP NOT NULL,
+				replaced_by VARCHAR(64),
+				used_at TIMESTAMP,
+				revoked_at TIMESTAMP,
+				created_at TIMESTAMP NOT NULL DEFAULT NOW()
+			);
+			CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family ON refresh_tokens(family);
+			CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user ON refresh_tokens(user_id);
+
+			-- Tokens issued before this instant are rejected ("log out everywhere")
+			ALTER TABLE users ADD COLUMN IF NOT EXISTS sessions_revoked_at TIMESTAMP;
+
+			INSERT INTO role_permissions (role, permission) VALUES
+				('platform:user', 'sessions:revoke')
+			ON CONFLICT DO NOTHING;
+		`,
+		Down: `
+			DELETE FROM role_permissions WHERE permission = 'sessions:revoke';
+			ALTER TABLE users DROP COLUMN IF EXISTS sessions_revoked_at;
+			DROP TABLE IF EXISTS refresh_tokens CASCADE;
+			DROP TABLE IF EXISTS revoked_tokens CASCADE;
+		`,
+	},
+	{
+		Version:     19,
+		Description: "Create API tokens",
+		Up: `
+			-- Long-lived tokens for automation. Only the SHA-256 of the token is
+			-- stored; the prefix identifies it in listings and logs.
+			CREATE TABLE IF NOT EXISTS api_tokens (
+				id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+				user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				name VARCHAR(64) NOT NULL,
+				prefix VARCHAR(16) NOT NULL,
+				token_hash CHAR(64) NOT NULL UNIQUE,
+				permissions JSONB NOT NULL DEFAULT '[]'::jsonb,
+				allowed_cidrs JSONB NOT NULL DEFAULT '[]'::jsonb,
+				expires_at TIMESTAMP,
+				last_used_at TIMESTAMP,
+				last_used_ip VARCHAR(45),
+				revoked_at TIMESTAMP,
+				created_at TIMESTAMP NOT NULL DEFAULT NOW()
+			);
+			CREATE INDEX IF NOT EXISTS idx_api_tokens_user ON api_tokens(user_id);
+
+			INSERT INTO role_permissions (role, permission) VALUES
+				('platform:user', 'api_tokens:manage')
+			ON CONFLICT DO NOTHING;
+		`,
+		Down: `
+			DELETE FROM role_permissions WHERE permission = 'api_tokens:manage';
+			DROP TABLE IF EXISTS api_tokens CASCADE;
+		`,
+	},
+	{
+		Version:     20,
+		Description: "Add TOTP two-factor authentication",
+		Up: `
+			-- The secret is set on enrolment and only used once confirmed.
+			-- totp_last_step rejects replays of an accepted code.
+			ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret VARCHAR(64);
+			ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+			ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT;
+
+			-- Single-use recovery codes, SHA-256 only
+			CREATE TABLE IF NOT EXISTS user_recovery_codes (
+				user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				code_hash CHAR(64) NOT NULL,
+				used_at TIMESTAMP,
+				PRIMARY KEY (user_id, code_hash)
+			);
+
+			-- Platform roles (users.role) whose members must use 2FA
+			CREATE TABLE IF NOT EXISTS mfa_required_roles (
+				role VARCHAR(32) PRIMARY KEY
+			);
+
+			INSERT INTO role_permissions (role, permission) VALUES
+				('platform:user', 'mfa:manage')
+			ON CONFLICT DO NOTHING;
+		`,
+		Down: `
+			DELETE FROM role_permissions WHERE permission = 'mfa:manage';
+			DROP TABLE IF EXISTS mfa_required_roles CASCADE;
+			DROP TABLE IF EXISTS user_recovery_codes CASCADE;
+			ALTER TABLE users DROP COLUMN IF EXISTS totp_last_step;
+			ALTER TABLE users DROP COLUMN IF EXISTS totp_enabled;
+			ALTER TABLE users DROP COLUMN IF EXISTS totp_secret;
+		`,
+	},
+	{
+		Version:     21,
+		Description: "Add OIDC identities",
+		Up: `
+			-- Links an account to the subject of an identity provider. The
+			-- subject is stable where the email may change.
+			CREATE TABLE IF NOT EXISTS user_identities (
+				issuer VARCHAR(255) NOT NULL,
+				subject VARCHAR(255) NOT NULL,
+				user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+				last_login_at TIMESTAMP,
+				PRIMARY KEY (issuer, subject)
+			);
+			CREATE INDEX IF NOT EXISTS idx_user_identities_user ON user_identities(user_id);
+		`,
+		Down: `
+			DROP TABLE IF EXISTS user_identities CASCADE;
+		`,
+	},
+	{
+		Version:     22,
+		Description: "Add user status and password reset",
+		Up: `
+			ALTER TABLE users ADD COLUMN IF NOT EXISTS status VARCHAR(16) NOT NULL DEFAULT 'active'
+				CHECK (status IN ('active', 'disabled', 'locked'));
+			ALTER TABLE users ADD COLUMN IF NOT EXISTS password_reset_required BOOLEAN NOT NULL DEFAULT FALSE;
+			ALTER TABLE users ADD COLUMN IF NOT EXISTS password_changed_at TIMESTAMP;
+			CREATE INDEX IF NOT EXISTS idx_users_status ON users(status);
+
+			INSERT INTO role_permissions (role, permission) VALUES
+				('platform:user', 'password:change')
+			ON CONFLICT DO NOTHING;
+		`,
+		Down: `
+			DELETE FROM role_permissions WHERE permission = 'password:change';
+			DROP INDEX IF EXISTS idx_users_status;
+			ALTER TABLE users DROP COLUMN IF EXISTS password_changed_at;
+			ALTER TABLE users DROP COLUMN IF EXISTS password_reset_required;
+			ALTER TABLE users DROP COLUMN IF EXISTS status;
+		`,
+	},
+	{
+		Version:     23,
+		Description: "Add generated system secrets",
+		Up: `
+			-- Secrets the control plane generates for itself on first start,
+			-- shared by every instance using this database
+			CREATE TABLE IF NOT EXISTS system_secrets (
+				name VARCHAR(64) PRIMARY KEY,
+				value BYTEA NOT NULL,
+				created_at TIMESTAMP NOT NULL DEFAULT NOW()
+			);
+		`,
+		Down: `
+			DROP TABLE IF EXISTS system_secrets CASCADE;
+		`,
+	},
+	{
+		Version:     24,
+		Description: "Add asymmetric JWT signing keys",
+		Up: `
+			-- The newest key that is not retired signs; every key that has not
+			-- expired verifies. Retired keys expire once the tokens they signed
+			-- have.
+			CREATE TABLE IF NOT EXISTS signing_keys (
+				kid VARCHAR(64) PRIMARY KEY,
+				algorithm VARCHAR(16) NOT NULL,
+				private_key BYTEA NOT NULL, -- PKCS #8 DER
+				public_key BYTEA NOT NULL,  -- PKIX DER
+				created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+				retired_at TIMESTAMP,
+				expires_at TIMESTAMP
+			);
+			CREATE INDEX IF NOT EXISTS idx_signing_keys_expires ON signing_keys(expires_at);
+		`,
+		Down: `
+			DROP TABLE IF EXISTS signing_keys CASCADE;
+		`,
+	},
+	{
+		Version:     25,
+		Description: "Add the audit log",
+		Up: `
+			-- Append-only: each row carries the hash of its predecessor, so
+			-- rows removed or edited by someone bypassing the trigger show up
+			-- in GET /audit/verify. Actors and projects are kept as values,
+			-- outliving the users and projects they name.
+			CREATE TABLE IF NOT EXISTS audit_events (
+				id BIGSERIAL PRIMARY KEY,
+				created_at TIMESTAMP NOT NULL,
+				actor_id INTEGER,
+				actor VARCHAR(255) NOT NULL,
+				source_ip VARCHAR(64) NOT NULL DEFAULT '',
+				action VARCHAR(100) NOT NULL,
+				target VARCHAR(255) NOT NULL DEFAULT '',
+				project_id INTEGER,
+				request JSONB NOT NULL DEFAULT '{}',
+				outcome VARCHAR(20) NOT NULL CHECK (outcome IN ('success', 'failure', 'denied')),
+				status_code INTEGER NOT NULL DEFAULT 0,
+				prev_hash CHAR(64) NOT NULL,
+				hash CHAR(64) NOT NULL
+			);
+			CREATE INDEX IF NOT EXISTS idx_audit_events_created ON audit_events(created_at);
+			CREATE INDEX IF NOT EXISTS idx_audit_events_actor ON audit_events(actor_id);
+			CREATE INDEX IF NOT EXISTS idx_audit_events_action ON audit_events(action);
+			CREATE INDEX IF NOT EXISTS idx_audit_events_project ON audit_events(project_id);
+
+			CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+			BEGIN
+				RAISE EXCEPTION 'audit_events is append-only';
+			END;
+			$$ LANGUAGE plpgsql;
+
+			DROP TRIGGER IF EXISTS audit_events_no_change ON audit_events;
+			CREATE TRIGGER audit_events_no_change BEFORE UPDATE OR DELETE ON audit_events
+				FOR EACH ROW EXECUTE PROCEDURE audit_events_append_only();
+			DROP TRIGGER IF EXISTS audit_events_no_truncate ON audit_events;
+			CREATE TRIGGER audit_events_no_truncate BEFORE TRUNCATE ON audit_events
+				FOR EACH STATEMENT EXECUTE PROCEDURE audit_events_append_only();
+		`,
+		Down: `
+			DROP TABLE IF EXISTS audit_events CASCADE;
+			DROP FUNCTION IF EXISTS audit_events_append_only();
+		`,
+	},
+	{
+		Version:     26,
+		Description: "Add resource quotas",
+		Up: `
+			-- Sizes counted against quotas. Rows from before are sized from
+			-- their limits where present, else with the defaults of AxHV.
+			ALTER TABLE instances ADD COLUMN IF NOT EXISTS vcpu INT NOT NULL DEFAULT 0;
+			ALTER TABLE instances ADD COLUMN IF NOT EXISTS memory_mib INT NOT NULL DEFAULT 0;
+			ALTER TABLE instances ADD COLUMN IF NOT EXISTS disk_gb INT NOT NULL DEFAULT 0;
+			UPDATE instances SET
+				vcpu = COALESCE(substring(COALESCE(limits->>'limits.cpu', limits->>'cpu') FROM '^\d+')::int, 1),
+				memory_mib = COALESCE(
+					substring(COALESCE(limits->>'limits.memory', limits->>'memory') FROM '^\d+')::int
+						* CASE WHEN COALESCE(limits->>'limits.memory', limits->>'memory') ~* 'g' THEN 1024 ELSE 1 END,
+					512),
+				disk_gb = COALESCE(substring(limits->>'disk' FROM '^\d+')::int, 10)
+			WHERE vcpu = 0;
+
+			ALTER TABLE floating_ips ADD COLUMN IF NOT EXISTS owner_id INT REFERENCES users(id) ON DELETE SET NULL;
+			CREATE INDEX IF NOT EXISTS idx_floating_ips_owner ON floating_ips(owner_id);
+
+			-- A row with scope_id 0 is the default of its scope; NULL limits
+			-- are unlimited, and so is a scope without any row.
+			CREATE TABLE IF NOT EXISTS quotas (
+				scope VARCHAR(16) NOT NULL CHECK (scope IN ('user', 'project')),
+				scope_id INT NOT NULL,
+				max_instances INT CHECK (max_instances >= 0),
+				max_vcpu INT CHECK (max_vcpu >= 0),
+				max_memory_mib INT CHECK (max_memory_mib >= 0),
+				max_disk_gb INT CHECK (max_disk_gb >= 0),
+				max_public_ips INT CHECK (max_public_ips >= 0),
+				max_snapshots INT CHECK (max_snapshots >= 0),
+				updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+				PRIMARY KEY (scope, scope_id)
+			);
+
+			INSERT INTO role_permissions (role, permission) VALUES
+				('platform:user', 'quotas:read')
+			ON CONFLICT DO NOTHING;
+		`,
+		Down: `
+			DELETE FROM role_permissions WHERE permission = 'quotas:read';
+			DROP TABLE IF EXISTS quotas;
+			ALTER TABLE floating_ips DROP COLUMN IF EXISTS owner_id;
+			ALTER TABLE instances DROP COLUMN IF EXISTS disk_gb;
+			ALTER TABLE instances DROP COLUMN IF EXISTS memory_mib;
+			ALTER TABLE instances DROP COLUMN IF EXISTS vcpu;
+		`,
+	},
+	{
+		Version:     27,
+		Description: "Add plans",
+		Up: `
+			-- NULL caps and forward limits are unlimited; an empty network_ids
+			-- allows every network the plan's public_networks admits
+			CREATE TABLE IF NOT EXISTS plans (
+				id SERIAL PRIMARY KEY,
+				name VARCHAR(64) UNIQUE NOT NULL,
+				description TEXT NOT NULL DEFAULT '',
+				max_instances INT CHECK (max_instances >= 0),
+				max_vcpu INT CHECK (max_vcpu >= 0),
+				max_memory_mib INT CHECK (max_memory_mib >= 0),
+				max_disk_gb INT CHECK (max_disk_gb >= 0),
+				max_public_ips INT CHECK (max_public_ips >= 0),
+				max_snapshots INT CHECK (max_snapshots >= 0),
+				public_networks BOOLEAN NOT NULL DEFAULT FALSE,
+				network_ids UUID[] NOT NULL DEFAULT '{}',
+				max_tcp_forwards INT CHECK (max_tcp_forwards >= 0),
+				max_udp_forwards INT CHECK (max_udp_forwards >= 0),
+				branding BOOLEAN NOT NULL DEFAULT FALSE,
+				is_default BOOLEAN NOT NULL DEFAULT FALSE,
+				created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+				updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+			);
+			CREATE UNIQUE INDEX IF NOT EXISTS idx_plans_default ON plans(is_default) WHERE is_default;
+
+			-- The limits previously hard-coded for everyone, and what the
+			-- placeholders called Pro
+			INSERT INTO plans (name, description, max_tcp_forwards, max_udp_forwards, is_default) VALUES
+				('free', 'Private networks, 3 TCP and 1 UDP port forwards', 3, 1, TRUE)
+			ON CONFLICT (name) DO NOTHING;
+			INSERT INTO plans (name, description, public_networks, branding) VALUES
+				('pro', 'Public networks, unlimited port forwards and custom branding', TRUE, TRUE)
+			ON CONFLICT (name) DO NOTHING;
+
+			ALTER TABLE users ADD COLUMN IF NOT EXISTS plan_id INT REFERENCES plans(id) ON DELETE SET NULL;
+			ALTER TABLE projects ADD COLUMN IF NOT EXISTS plan_id INT REFERENCES plans(id) ON DELETE SET NULL;
+
+			INSERT INTO role_permissions (role, permission) VALUES
+				('platform:user', 'plans:read'),
+				('platform:user', 'branding:manage')
+			ON CONFLICT DO NOTHING;
+		`,
+		Down: `
+			DELETE FROM role_permissions WHERE permission IN ('plans:read', 'branding:manage');
+			ALTER TABLE projects DROP COLUMN IF EXISTS plan_id;
+			ALTER TABLE users DROP COLUMN IF EXISTS plan_id;
+			DROP TABLE IF EXISTS plans;
+		`,
+	},
+	{
+		Version:     28,
+		Description: "Add login throttles",
+		Up: `
+			-- Failed login state by "ip:<address>" or "account:<email>"
+			CREATE TABLE IF NOT EXISTS login_throttles (
+				key TEXT PRIMARY KEY,
+				failures INT NOT NULL DEFAULT 0,
+				window_start TIMESTAMP NOT NULL DEFAULT 'epoch',
+				strikes INT NOT NULL DEFAULT 0,
+				locked_until TIMESTAMP NOT NULL DEFAULT 'epoch',
+				updated_at TIMESTAMP NOT NULL DEFAULT 'epoch'
+			);
+			CREATE INDEX IF NOT EXISTS idx_login_throttles_updated ON login_throttles(updated_at);
+		`,
+		Down: `DROP TABLE IF EXISTS login_throttles;`,
+	},
+	{
+		Version:     29,
+		Description: "Add usage metering and price sheets",
+		Up: `
+			-- Intervals in which an instance kept one state and size; the
+			-- open one has no end. Kept after the instance is deleted.
+			CREATE TABLE IF NOT EXISTS usage_records (
+				id BIGSERIAL PRIMARY KEY,
+				instance_name TEXT NOT NULL,
+				owner_id INT REFERENCES users(id) ON DELETE SET NULL,
+				project_id INT REFERENCES projects(id) ON DELETE SET NULL,
+				state VARCHAR(16) NOT NULL CHECK (state IN ('running', 'stopped')),
+				vcpu INT NOT NULL DEFAULT 0,
+				memory_mib INT NOT NULL DEFAULT 0,
+				disk_gb INT NOT NULL DEFAULT 0,
+				started_at TIMESTAMP NOT NULL,
+				ended_at TIMESTAMP CHECK (ended_at >= started_at)
+			);
+			CREATE UNIQUE INDEX IF NOT EXISTS idx_usage_records_open ON usage_records(instance_name) WHERE ended_at IS NULL;
+			CREATE INDEX IF NOT EXISTS idx_usage_records_period ON usage_records(started_at, ended_at);
+
+			CREATE TABLE IF NOT EXISTS price_sheets (
+				plan_id INT PRIMARY KEY REFERENCES plans(id) ON DELETE CASCADE,
+				currency CHAR(3) NOT NULL DEFAULT 'USD',
+				vcpu_hour NUMERIC(12, 6) NOT NULL DEFAULT 0 CHECK (vcpu_hour >= 0),
+				memory_gb_hour NUMERIC(12, 6) NOT NULL DEFAULT 0 CHECK (memory_gb_hour >= 0),
+				disk_gb_hour NUMERIC(12, 6) NOT NULL DEFAULT 0 CHECK (disk_gb_hour >= 0),
+				traffic_gb NUMERIC(12, 6) NOT NULL DEFAULT 0 CHECK (traffic_gb >= 0),
+				updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+			);
+
+			INSERT INTO role_permissions (role, permission) VALUES
+				('platform:user', 'billing:read')
+			ON CONFLICT DO NOTHING;
+		`,
+		Down: `
+			DELETE FROM role_permissions WHERE permission = 'billing:read';
+			DROP TABLE IF EXISTS price_sheets;
+			DROP TABLE IF EXISTS usage_records;
+		`,
+	},
+	{
+		Version:     30,
+		Description: "Queue jobs in the jobs table",
+		Up: `
+			-- Pending jobs run once run_after has passed; retries push it
+			-- back by their backoff.
+			ALTER TABLE jobs ADD COLUMN IF NOT EXISTS run_after TIMESTAMP;
+			UPDATE jobs SET run_after = created_at WHERE run_after IS NULL;
+			ALTER TABLE jobs ALTER COLUMN run_after SET DEFAULT (NOW() AT TIME ZONE 'UTC');
+			ALTER TABLE jobs ALTER COLUMN run_after SET NOT NULL;
+			CREATE INDEX IF NOT EXISTS idx_jobs_ready ON jobs(run_after) WHERE status = 'PENDING';
+
+			-- Wakes idle workers as soon as a job is queued or requeued
+			CREATE OR REPLACE FUNCTION jobs_notify_ready() RETURNS trigger AS $$
+			BEGIN
+				PERFORM pg_notify('jobs_ready', NEW.id);
+				RETURN NULL;
+			END;
+			$$ LANGUAGE plpgsql;
+
+			DROP TRIGGER IF EXISTS jobs_ready ON jobs;
+			CREATE TRIGGER jobs_ready AFTER INSERT OR UPDATE OF status, run_after ON jobs
+				FOR EACH ROW WHEN (NEW.status = 'PENDING') EXECUTE PROCEDURE jobs_notify_ready();
+		`,
+		Down: `
+			DROP TRIGGER IF EXISTS jobs_ready ON jobs;
+			DROP FUNCTION IF EXISTS jobs_notify_ready();
+			DROP INDEX IF EXISTS idx_jobs_ready;
+			ALTER TABLE jobs DROP COLUMN IF EXISTS run_after;
+		`,
+	},
+	{
+		Version:     31,
+		Description: "Cancel jobs",
+		Up: `
+			-- Tells the worker running a job, in whichever process, to stop
+			CREATE OR REPLACE FUNCTION jobs_notify_canceled() RETURNS trigger AS $$
+			BEGIN
+				PERFORM pg_notify('jobs_canceled', NEW.id);
+				RETURN NULL;
+			END;
+			$$ LANGUAGE plpgsql;
+
+			DROP TRIGGER IF EXISTS jobs_canceled ON jobs;
+			CREATE TRIGGER jobs_canceled AFTER UPDATE OF status ON jobs
+				FOR EACH ROW WHEN (NEW.status = 'CANCELED' AND OLD.status <> 'CANCELED')
+				EXECUTE PROCEDURE jobs_notify_canceled();
+
+			INSERT INTO role_permissions (role, permission) VALUES
+				('owner', 'jobs:cancel'),
+				('admin', 'jobs:cancel'),
+				('operator', 'jobs:cancel')
+			ON CONFLICT DO NOTHING;
+		`,
+		Down: `
+			DELETE FROM role_permissions WHERE permission = 'jobs:cancel';
+			DROP TRIGGER IF EXISTS jobs_canceled ON jobs;
+			DROP FUNCTION IF EXISTS jobs_notify_canceled();
+		`,
+	},
+	{
+		Version:     32,
+		Description: "Add workflow jobs",
+		Up: `
+			-- Steps of a workflow are jobs with its id as parent_id. Retry
+			-- policy 0 means the defaults; rollback is a JSON JobAction.
+			ALTER TABLE jobs ADD COLUMN IF NOT EXISTS parent_id TEXT REFERENCES jobs(id) ON DELETE CASCADE;
+			ALTER TABLE jobs ADD COLUMN IF NOT EXISTS step TEXT NOT NULL DEFAULT '';
+			ALTER TABLE jobs ADD COLUMN IF NOT EXISTS max_attempts INT NOT NULL DEFAULT 0 CHECK (max_attempts >= 0);
+			ALTER TABLE jobs ADD COLUMN IF NOT EXISTS retry_delay INT NOT NULL DEFAULT 0 CHECK (retry_delay >= 0);
+			ALTER TABLE jobs ADD COLUMN IF NOT EXISTS rollback TEXT;
+			CREATE INDEX IF NOT EXISTS idx_jobs_parent ON jobs(parent_id);
+
+			CREATE TABLE IF NOT EXISTS job_dependencies (
+				job_id TEXT NOT NULL REFERENCES jobs(id) ON DELETE CASCADE,
+				depends_on TEXT NOT NULL REFERENCES jobs(id) ON DELETE CASCADE,
+				PRIMARY KEY (job_id, depends_on),
+				CHECK (job_id <> depends_on)
+			);
+			CREATE INDEX IF NOT EXISTS idx_job_dependencies_depends_on ON job_dependencies(depends_on);
+		`,
+		Down: `
+			DROP TABLE IF EXISTS job_dependencies;
+			DROP INDEX IF EXISTS idx_jobs_parent;
+			ALTER TABLE jobs DROP COLUMN IF EXISTS rollback;
+			ALTER TABLE jobs DROP COLUMN IF EXISTS retry_delay;
+			ALTER TABLE jobs DROP COLUMN IF EXISTS max_attempts;
+			ALTER TABLE jobs DROP COLUMN IF EXISTS step;
+			ALTER TABLE jobs DROP COLUMN IF EXISTS parent_id;
+		`,
+	},
+	{
+		Version:     33,
+		Description: "Add job progress and logs",
+		Up: `
+			-- Progress (percent) and stage of the running attempt
+			ALTER TABLE jobs ADD COLUMN IF NOT EXISTS progress INT NOT NULL DEFAULT 0 CHECK (progress BETWEEN 0 AND 100);
+			ALTER TABLE jobs ADD COLUMN IF NOT EXISTS stage TEXT NOT NULL DEFAULT '';
+
+			CREATE TABLE IF NOT EXISTS job_logs (
+				id BIGSERIAL PRIMARY KEY,
+				job_id TEXT NOT NULL REFERENCES jobs(id) ON DELETE CASCADE,
+				attempt INT NOT NULL DEFAULT 0,
+				level VARCHAR(10) NOT NULL CHECK (level IN ('debug', 'info', 'warn', 'error')),
+				stage TEXT NOT NULL DEFAULT '',
+				message TEXT NOT NULL,
+				fields JSONB NOT NULL DEFAULT '{}',
+				created_at TIMESTAMP NOT NULL
+			);
+			CREATE INDEX IF NOT EXISTS idx_job_logs_job ON job_logs(job_id, id);
+		`,
+		Down: `
+			DROP TABLE IF EXISTS job_logs;
+			ALTER TABLE jobs DROP COLUMN IF EXISTS stage;
+			ALTER TABLE jobs DROP COLUMN IF EXISTS progress;
+		`,
+	},
+	{
+		Version:     34,
+		Description: "Add leases to running jobs",
+		Up: `
+			-- Renewed by the worker running the job; expired leases are requeued
+			ALTER TABLE jobs ADD COLUMN IF NOT EXISTS lease_until TIMESTAMP;
+			UPDATE jobs SET lease_until = started_at + interval '5 minutes'
+			WHERE status = 'IN_PROGRESS' AND type <> 'workflow';
+		`,
+		Down: `
+			ALTER TABLE jobs DROP COLUMN IF EXISTS lease_until;
+		`,
+	},
+	{
+		Version:     35,
+		Description: "Grant workflow creation",
+		Up: `
+			INSERT INTO role_permissions (role, permission) VALUES
+				('owner', 'workflows:create'),
+				('admin', 'workflows:create'),
+				('operator', 'workflows:create')
+			ON CONFLICT DO NOTHING;
+		`,
+		Down: `
+			DELETE FROM role_permissions WHERE permission = 'workflows:create';
+		`,
+	},
 }
 
 // ============================================================================
@@ -437,7 +1290,7 @@ func RunMaintenance(ctx context.Context, db *Service) error {
 	}
 
 	// Recover stuck jobs
-	recoveredJobs, err := jobsRepo.RecoverStuckJobs(ctx, 5*time.Minute)
+	recoveredJobs, err := jobsRepo.RecoverStuckJobs(ctx)
 	if err != nil {
 		log.Printf("[Maintenance] Error recovering stuck jobs: %v", err)
 	} else if recoveredJobs > 0 {
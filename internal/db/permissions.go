@@ -0,0 +1,85 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// PlatformRolePrefix marks role_permissions rows that belong to a platform
+// role (users.role) rather than to a project role.
+const PlatformRolePrefix = "platform:"
+
+var ErrInvalidRole = errors.New("unknown role")
+
+// PlatformRole returns the role_permissions key of a users.role value.
+func PlatformRole(role string) string {
+	return PlatformRolePrefix + role
+}
+
+// ValidPermissionRole reports whether role can carry permissions: a project
+// role or one of the platform roles.
+func ValidPermissionRole(role string) bool {
+	switch role {
+	case PlatformRole("admin"), PlatformRole("user"):
+		return true
+	}
+	return !strings.HasPrefix(role, PlatformRolePrefix) && ValidProjectRole(role)
+}
+
+// RolePermissionRepository stores the permission patterns granted to each
+// role.
+type RolePermissionRepository struct {
+	db *Service
+}
+
+func NewRolePermissionRepository(db *Service) *RolePermissionRepository {
+	return &RolePermissionRepository{db: db}
+}
+
+// List returns the permission patterns of every role.
+func (r *RolePermissionRepository) List(ctx context.Context) (map[string][]string, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT role, permission FROM role_permissions ORDER BY role, permission
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := make(map[string][]string)
+	for rows.Next() {
+		var role, perm string
+		if err := rows.Scan(&role, &perm); err != nil {
+			return nil, err
+		}
+		roles[role] = append(roles[role], perm)
+	}
+	return roles, rows.Err()
+}
+
+// Set replaces the permission patterns of role.
+func (r *RolePermissionRepository) Set(ctx context.Context, role string, perms []string) error {
+	if !ValidPermissionRole(role) {
+		return ErrInvalidRole
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM role_permissions WHERE role = $1`, role); err != nil {
+		return err
+	}
+	for _, p := range perms {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO role_permissions (role, permission) VALUES ($1, $2)
+			ON CONFLICT DO NOTHING
+		`, role, p); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,254 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ============================================================================
+// PLANS
+// ============================================================================
+
+// ErrPlanLimit is wrapped by errors refusing what the caller's plan does
+// not include.
+var ErrPlanLimit = errors.New("not allowed by plan")
+
+// Plan is a tier assigned to users and projects. Its caps apply like a
+// quota where no quota is set; the entitlements gate networks, port
+// forwards and branding.
+type Plan struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	QuotaLimits
+	PublicNetworks bool      `json:"public_networks"`
+	NetworkIDs     []string  `json:"network_ids"`      // Empty: any network
+	MaxTCPForwards *int      `json:"max_tcp_forwards"` // nil = unlimited
+	MaxUDPForwards *int      `json:"max_udp_forwards"`
+	Branding       bool      `json:"branding"`
+	IsDefault      bool      `json:"is_default"` // Plan of users and projects without one
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// AllowsNetwork fails with ErrPlanLimit when instances of the plan may not
+// be placed on n. A nil plan allows everything.
+func (p *Plan) AllowsNetwork(n Network) error {
+	if p == nil {
+		return nil
+	}
+	if n.IsPublic && !p.PublicNetworks {
+		return fmt.Errorf("%w: plan %q does not include public networks", ErrPlanLimit, p.Name)
+	}
+	if len(p.NetworkIDs) == 0 {
+		return nil
+	}
+	for _, id := range p.NetworkIDs {
+		if id == n.ID {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: plan %q does not include network %s", ErrPlanLimit, p.Name, n.Name)
+}
+
+// AllowsBranding fails with ErrPlanLimit unless the plan includes custom
+// branding.
+func (p *Plan) AllowsBranding() error {
+	if p == nil || p.Branding {
+		return nil
+	}
+	return fmt.Errorf("%w: plan %q does not include custom branding", ErrPlanLimit, p.Name)
+}
+
+// PortForwardLimits returns how many TCP and UDP port forwards an instance
+// may have; nil is unlimited.
+func (p *Plan) PortForwardLimits() (tcp, udp *int) {
+	if p == nil {
+		return nil, nil
+	}
+	return p.MaxTCPForwards, p.MaxUDPForwards
+}
+
+type PlanRepository struct {
+	db *Service
+}
+
+func NewPlanRepository(db *Service) *PlanRepository {
+	return &PlanRepository{db: db}
+}
+
+const planColumns = `id, name, description, max_instances, max_vcpu, max_memory_mib,
+	max_disk_gb, max_public_ips, max_snapshots, public_networks, network_ids,
+	max_tcp_forwards, max_udp_forwards, branding, is_default, created_at, updated_at`
+
+func scanPlan(row interface{ Scan(...interface{}) error }) (*Plan, error) {
+	var p Plan
+	var caps [6]sql.NullInt64
+	var tcp, udp sql.NullInt64
+	if err := row.Scan(&p.ID, &p.Name, &p.Description, &caps[0], &caps[1], &caps[2],
+		&caps[3], &caps[4], &caps[5], &p.PublicNetworks, pq.Array(&p.NetworkIDs),
+		&tcp, &udp, &p.Branding, &p.IsDefault, &p.CreatedAt, &p.UpdatedAt); err != nil {
+		return nil, err
+	}
+	p.Instances = nullIntPtr(caps[0])
+	p.VCPU = nullIntPtr(caps[1])
+	p.MemoryMiB = nullIntPtr(caps[2])
+	p.DiskGB = nullIntPtr(caps[3])
+	p.PublicIPs = nullIntPtr(caps[4])
+	p.Snapshots = nullIntPtr(caps[5])
+	p.MaxTCPForwards = nullIntPtr(tcp)
+	p.MaxUDPForwards = nullIntPtr(udp)
+	if p.NetworkIDs == nil {
+		p.NetworkIDs = []string{}
+	}
+	return &p, nil
+}
+
+// planOf returns the plan of a user or project, else the default plan,
+// else nil.
+func planOf(ctx context.Context, q rowQuerier, scope string, id int) (*Plan, error) {
+	table := "users"
+	if scope == QuotaScopeProject {
+		table = "projects"
+	}
+	p, err := scanPlan(q.QueryRowContext(ctx, `
+		SELECT `+planColumns+` FROM plans
+		WHERE id = COALESCE((SELECT plan_id FROM `+table+` WHERE id = $1),
+		                    (SELECT id FROM plans WHERE is_default))
+	`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return p, err
+}
+
+// Effective returns the plan governing the caller: the current project's,
+// else the caller's own, else the default plan. Platform admins and
+// internal callers get nil, which allows everything.
+func (r *PlanRepository) Effective(ctx context.Context) (*Plan, error) {
+	s, ok := ScopeFrom(ctx)
+	if !ok || s.Admin {
+		return nil, nil
+	}
+	p, err := scanPlan(r.db.QueryRowContext(ctx, `
+		SELECT `+planColumns+` FROM plans
+		WHERE id = COALESCE((SELECT plan_id FROM projects WHERE id = $1),
+		                    (SELECT plan_id FROM users WHERE id = $2),
+		                    (SELECT id FROM plans WHERE is_default))
+	`, s.ProjectID, s.UserID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return p, err
+}
+
+func (r *PlanRepository) List(ctx context.Context) ([]Plan, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT `+planColumns+` FROM plans ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	plans := []Plan{}
+	for rows.Next() {
+		p, err := scanPlan(rows)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, *p)
+	}
+	return plans, rows.Err()
+}
+
+func (r *PlanRepository) Get(ctx context.Context, id int) (*Plan, error) {
+	return scanPlan(r.db.QueryRowContext(ctx, `SELECT `+planColumns+` FROM plans WHERE id = $1`, id))
+}
+
+// Save creates the plan when its ID is 0 and replaces it otherwise. Making
+// it the default takes that from the previous default.
+func (r *PlanRepository) Save(ctx context.Context, p *Plan) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if p.IsDefault {
+		if _, err := tx.ExecContext(ctx, `UPDATE plans SET is_default = FALSE WHERE is_default AND id <> $1`, p.ID); err != nil {
+			return err
+		}
+	}
+	if p.NetworkIDs == nil {
+		p.NetworkIDs = []string{}
+	}
+
+	args := []interface{}{p.Name, p.Description, p.Instances, p.VCPU, p.MemoryMiB,
+		p.DiskGB, p.PublicIPs, p.Snapshots, p.PublicNetworks, pq.Array(p.NetworkIDs),
+		p.MaxTCPForwards, p.MaxUDPForwards, p.Branding, p.IsDefault}
+	var saved *Plan
+	if p.ID == 0 {
+		saved, err = scanPlan(tx.QueryRowContext(ctx, `
+			INSERT INTO plans (name, description, max_instances, max_vcpu, max_memory_mib,
+			                   max_disk_gb, max_public_ips, max_snapshots, public_networks, network_ids,
+			                   max_tcp_forwards, max_udp_forwards, branding, is_default)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+			RETURNING `+planColumns, args...))
+	} else {
+		saved, err = scanPlan(tx.QueryRowContext(ctx, `
+			UPDATE plans SET name = $1, description = $2, max_instances = $3, max_vcpu = $4,
+			       max_memory_mib = $5, max_disk_gb = $6, max_public_ips = $7, max_snapshots = $8,
+			       public_networks = $9, network_ids = $10, max_tcp_forwards = $11,
+			       max_udp_forwards = $12, branding = $13, is_default = $14, updated_at = NOW()
+			WHERE id = $15
+			RETURNING `+planColumns, append(args, p.ID)...))
+	}
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	*p = *saved
+	return nil
+}
+
+// Delete removes a plan; its users and projects fall back to the default.
+func (r *PlanRepository) Delete(ctx context.Context, id int) error {
+	result, err := r.db.ExecContext(ctx, `DELETE FROM plans WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return fmt.Errorf("plan not found: %d: %w", id, sql.ErrNoRows)
+	}
+	return nil
+}
+
+// Assign puts a user or project on a plan, or back on the default with a
+// nil planID.
+func (r *PlanRepository) Assign(ctx context.Context, scope string, id int, planID *int) error {
+	if !validQuotaScope(scope) {
+		return ErrInvalidQuotaScope
+	}
+	table := "users"
+	if scope == QuotaScopeProject {
+		table = "projects"
+	}
+	result, err := r.db.ExecContext(ctx, `UPDATE `+table+` SET plan_id = $1 WHERE id = $2`, planID, id)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return fmt.Errorf("%s not found: %d: %w", scope, id, sql.ErrNoRows)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"aexon/internal/types"
+)
+
+func TestPlanEntitlements(t *testing.T) {
+	free := &Plan{Name: "free", NetworkIDs: []string{"net-a"}}
+	private := Network{ID: "net-a", Name: "a"}
+
+	if err := free.AllowsNetwork(private); err != nil {
+		t.Errorf("listed private network refused: %v", err)
+	}
+	if err := free.AllowsNetwork(Network{ID: "net-b", Name: "b"}); !errors.Is(err, ErrPlanLimit) {
+		t.Errorf("unlisted network: %v", err)
+	}
+	if err := free.AllowsNetwork(Network{ID: "net-a", IsPublic: true}); !errors.Is(err, ErrPlanLimit) {
+		t.Errorf("public network without public_networks: %v", err)
+	}
+	if err := free.AllowsBranding(); !errors.Is(err, ErrPlanLimit) {
+		t.Errorf("branding without the entitlement: %v", err)
+	}
+
+	// No plan, as for admins, allows everything
+	var none *Plan
+	if none.AllowsNetwork(Network{IsPublic: true}) != nil || none.AllowsBranding() != nil {
+		t.Error("a nil plan refused something")
+	}
+	if tcp, udp := none.PortForwardLimits(); tcp != nil || udp != nil {
+		t.Error("a nil plan limits port forwards")
+	}
+}
+
+func TestPlanResolution(t *testing.T) {
+	svc := testService(t)
+	alice := testUser(t, svc, "user")
+	plans, quotas := NewPlanRepository(svc), NewQuotaRepository(svc)
+	ctx := context.Background()
+
+	def, err := plans.Effective(as(alice))
+	if err != nil || def == nil || !def.IsDefault {
+		t.Fatalf("Effective without a plan = %+v, %v", def, err)
+	}
+	if admin, err := plans.Effective(WithScope(ctx, Scope{UserID: alice.ID, Admin: true})); err != nil || admin != nil {
+		t.Errorf("Effective for an admin = %+v, %v", admin, err)
+	}
+
+	zero := 0
+	tiny := &Plan{Name: fmt.Sprintf("tiny-%d", time.Now().UnixNano()), QuotaLimits: QuotaLimits{Instances: &zero}}
+	if err := plans.Save(ctx, tiny); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	t.Cleanup(func() { plans.Delete(ctx, tiny.ID) })
+
+	// The project's plan wins over the user's
+	if err := plans.Assign(ctx, QuotaScopeUser, alice.ID, &def.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := plans.Assign(ctx, QuotaScopeProject, alice.ProjectID, &tiny.ID); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := plans.Effective(as(alice)); err != nil || p == nil || p.ID != tiny.ID {
+		t.Errorf("Effective = %+v, %v", p, err)
+	}
+
+	// Its caps apply where no quota is set
+	usage, err := quotas.Usage(ctx, QuotaScopeProject, alice.ProjectID)
+	if err != nil || usage.Source != QuotaSourcePlan || usage.Plan != tiny.Name {
+		t.Errorf("Usage = %+v, %v", usage, err)
+	}
+	err = NewInstanceRepository(svc).Create(as(alice), &types.Instance{Name: fmt.Sprintf("plan-vm-%d", time.Now().UnixNano()), Image: "alpine", Type: "vm"})
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("create past the plan's instance cap: %v", err)
+	}
+
+	// Deleting the plan puts the project back on the default
+	if err := plans.Delete(ctx, tiny.ID); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := plans.Effective(as(alice)); err != nil || p == nil || p.ID != def.ID {
+		t.Errorf("Effective after deleting the plan = %+v, %v", p, err)
+	}
+}
@@ -0,0 +1,575 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ============================================================================
+// PROJECTS
+// ============================================================================
+
+// Project roles, from least to most privileged.
+const (
+	ProjectRoleViewer   = "viewer"   // Read-only access to the project's resources
+	ProjectRoleOperator = "operator" // Day-to-day operation: power, snapshots, files
+	ProjectRoleAdmin    = "admin"    // Creates/deletes resources and manages members
+	ProjectRoleOwner    = "owner"    // Everything, including owners and the project itself
+)
+
+var projectRoleRank = map[string]int{
+	ProjectRoleViewer:   1,
+	ProjectRoleOperator: 2,
+	ProjectRoleAdmin:    3,
+	ProjectRoleOwner:    4,
+}
+
+// DefaultInvitationTTL is how long an invitation can be accepted.
+const DefaultInvitationTTL = 7 * 24 * time.Hour
+
+var (
+	ErrProjectRole        = errors.New("insufficient project role")
+	ErrLastOwner          = errors.New("a project must keep at least one owner")
+	ErrPersonalProject    = errors.New("personal projects cannot be deleted")
+	ErrProjectNotEmpty    = errors.New("project still owns resources")
+	ErrInvalidProjectRole = errors.New("role must be one of owner, admin, operator, viewer")
+	ErrInvitationInvalid  = errors.New("invitation is invalid, expired or already used")
+)
+
+// ValidProjectRole reports whether role is a known project role.
+func ValidProjectRole(role string) bool {
+	_, ok := projectRoleRank[role]
+	return ok
+}
+
+// ProjectRoleAtLeast reports whether role grants at least the rights of min.
+func ProjectRoleAtLeast(role, min string) bool {
+	return projectRoleRank[role] > 0 && projectRoleRank[role] >= projectRoleRank[min]
+}
+
+type Project struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Personal  bool      `json:"personal"`
+	CreatedBy *int      `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Role      string    `json:"role,omitempty"` // Caller's role, when listed for a user
+}
+
+type ProjectMember struct {
+	UserID    int       `json:"user_id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ProjectInvitation struct {
+	ID         string     `json:"id"`
+	ProjectID  int        `json:"project_id"`
+	Email      string     `json:"email"`
+	Role       string     `json:"role"`
+	InvitedBy  *int       `json:"invited_by,omitempty"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	AcceptedAt *time.Time `json:"accepted_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Token      string     `json:"token,omitempty"` // Only returned when the invitation is created
+}
+
+// rowQuerier is satisfied by both *Service and *Tx.
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+type ProjectRepository struct {
+	db *Service
+}
+
+func NewProjectRepository(db *Service) *ProjectRepository {
+	return &ProjectRepository{db: db}
+}
+
+// createProject inserts a project with userID as its owner.
+func createProject(ctx context.Context, tx *Tx, name string, personal bool, userID int) (*Project, error) {
+	p := &Project{Name: name, Personal: personal, CreatedBy: &userID, Role: ProjectRoleOwner}
+	err := tx.QueryRowContext(ctx, `
+		INSERT INTO projects (name, personal, created_by)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at
+	`, name, personal, userID).Scan(&p.ID, &p.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO project_members (project_id, user_id, role) VALUES ($1, $2, $3)
+	`, p.ID, userID, ProjectRoleOwner)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// authorize checks that the caller holds at least min in the project and
+// returns its role. Projects the caller is not a member of are reported as
+// missing. Admins and internal callers act as owners.
+func authorize(ctx context.Context, q rowQuerier, projectID int, min string) (string, error) {
+	s, ok := ScopeFrom(ctx)
+	if !ok || s.Admin {
+		var exists bool
+		err := q.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM projects WHERE id = $1)`, projectID).Scan(&exists)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return "", sql.ErrNoRows
+		}
+		return ProjectRoleOwner, nil
+	}
+
+	var role string
+	err := q.QueryRowContext(ctx, `
+		SELECT role FROM project_members WHERE project_id = $1 AND user_id = $2
+	`, projectID, s.UserID).Scan(&role)
+	if err != nil {
+		return "", err
+	}
+	if !ProjectRoleAtLeast(role, min) {
+		return role, ErrProjectRole
+	}
+	return role, nil
+}
+
+// Create makes a new project owned by the caller.
+func (r *ProjectRepository) Create(ctx context.Context, name string) (*Project, error) {
+	s, ok := ScopeFrom(ctx)
+	if !ok || s.UserID == 0 {
+		return nil, errors.New("projects are created on behalf of a user")
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	p, err := createProject(ctx, tx, name, false, s.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return p, tx.Commit()
+}
+
+// Get returns a project the caller is a member of, with the caller's role.
+func (r *ProjectRepository) Get(ctx context.Context, id int) (*Project, error) {
+	role, err := authorize(ctx, r.db, id, ProjectRoleViewer)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Project{Role: role}
+	var createdBy sql.NullInt64
+	err = r.db.QueryRowContext(ctx, `
+		SELECT id, name, personal, created_by, created_at FROM projects WHERE id = $1
+	`, id).Scan(&p.ID, &p.Name, &p.Personal, &createdBy, &p.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	p.CreatedBy = nullIntPtr(createdBy)
+	return p, nil
+}
+
+// ListForUser returns the projects userID belongs to with its role in each,
+// personal project first.
+func (r *ProjectRepository) ListForUser(ctx context.Context, userID int) ([]Project, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT p.id, p.name, p.personal, p.created_by, p.created_at, m.role
+		FROM projects p
+		JOIN project_members m ON m.project_id = p.id
+		WHERE m.user_id = $1
+		ORDER BY p.personal DESC, p.name
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var projects []Project
+	for rows.Next() {
+		var p Project
+		var createdBy sql.NullInt64
+		if err := rows.Scan(&p.ID, &p.Name, &p.Personal, &createdBy, &p.CreatedAt, &p.Role); err != nil {
+			return nil, err
+		}
+		p.CreatedBy = nullIntPtr(createdBy)
+		projects = append(projects, p)
+	}
+	return projects, rows.Err()
+}
+
+// MemberRole returns the role of userID in the project, or sql.ErrNoRows.
+func (r *ProjectRepository) MemberRole(ctx context.Context, projectID, userID int) (string, error) {
+	var role string
+	err := r.db.QueryRowContext(ctx, `
+		SELECT role FROM project_members WHERE project_id = $1 AND user_id = $2
+	`, projectID, userID).Scan(&role)
+	return role, err
+}
+
+// DefaultFor returns the project a user acts in when it does not pick one:
+// its personal project, or the oldest membership when it has none.
+func (r *ProjectRepository) DefaultFor(ctx context.Context, userID int) (int, string, error) {
+	var id int
+	var role string
+	err := r.db.QueryRowContext(ctx, `
+		SELECT p.id, m.role
+		FROM projects p
+		JOIN project_members m ON m.project_id = p.id
+		WHERE m.user_id = $1
+		ORDER BY p.personal DESC, m.created_at
+		LIMIT 1
+	`, userID).Scan(&id, &role)
+	return id, role, err
+}
+
+// Rename changes the display name of a project. Requires admin.
+func (r *ProjectRepository) Rename(ctx context.Context, id int, name string) error {
+	if _, err := authorize(ctx, r.db, id, ProjectRoleAdmin); err != nil {
+		return err
+	}
+	_, err := r.db.ExecContext(ctx, `UPDATE projects SET name = $2 WHERE id = $1`, id, name)
+	return err
+}
+
+// Delete removes an empty, non-personal project. Requires owner.
+func (r *ProjectRepository) Delete(ctx context.Context, id int) error {
+	p, err := r.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !ProjectRoleAtLeast(p.Role, ProjectRoleOwner) {
+		return ErrProjectRole
+	}
+	if p.Personal {
+		return ErrPersonalProject
+	}
+
+	// Instances, networks and ISOs reference the project without cascade
+	if _, err := r.db.ExecContext(ctx, `DELETE FROM projects WHERE id = $1`, id); err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+			return ErrProjectNotEmpty
+		}
+		return err
+	}
+	return nil
+}
+
+// ============================================================================
+// MEMBERS
+// ============================================================================
+
+// ListMembers returns the members of a project. Requires viewer.
+func (r *ProjectRepository) ListMembers(ctx context.Context, projectID int) ([]ProjectMember, error) {
+	if _, err := authorize(ctx, r.db, projectID, ProjectRoleViewer); err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT m.user_id, u.email, m.role, m.created_at
+		FROM project_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.project_id = $1
+		ORDER BY m.created_at
+	`, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []ProjectMember
+	for rows.Next() {
+		var m ProjectMember
+		if err := rows.Scan(&m.UserID, &m.Email, &m.Role, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// SetMemberRole changes the role of an existing member. Admins manage
+// everyone but owners; only owners may grant or take away ownership, and
+// the last owner cannot be demoted.
+func (r *ProjectRepository) SetMemberRole(ctx context.Context, projectID, userID int, role string) error {
+	if !ValidProjectRole(role) {
+		return ErrInvalidProjectRole
+	}
+	return r.changeMember(ctx, projectID, userID, false, func(tx *Tx, callerRole string) error {
+		if role == ProjectRoleOwner && callerRole != ProjectRoleOwner {
+			return ErrProjectRole
+		}
+		_, err := tx.ExecContext(ctx, `
+			UPDATE project_members SET role = $3 WHERE project_id = $1 AND user_id = $2
+		`, projectID, userID, role)
+		return err
+	})
+}
+
+// RemoveMember takes a user out of a project. Members may always leave;
+// removing someone else follows the same rules as SetMemberRole.
+func (r *ProjectRepository) RemoveMember(ctx context.Context, projectID, userID int) error {
+	return r.changeMember(ctx, projectID, userID, true, func(tx *Tx, _ string) error {
+		_, err := tx.ExecContext(ctx, `
+			DELETE FROM project_members WHERE project_id = $1 AND user_id = $2
+		`, projectID, userID)
+		return err
+	})
+}
+
+// changeMember runs apply on the membership of userID with the project's
+// members locked, after checking the caller's rights over that member, and
+// refuses the result if it leaves the project without an owner. allowSelf
+// lets any member apply the change to itself.
+func (r *ProjectRepository) changeMember(ctx context.Context, projectID, userID int, allowSelf bool, apply func(tx *Tx, callerRole string) error) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Serialises concurrent changes so two owners cannot demote each other
+	if _, err := tx.ExecContext(ctx, `SELECT 1 FROM project_members WHERE project_id = $1 FOR UPDATE`, projectID); err != nil {
+		return err
+	}
+
+	callerRole, err := authorize(ctx, tx, projectID, ProjectRoleViewer)
+	if err != nil {
+		return err
+	}
+
+	var current string
+	err = tx.QueryRowContext(ctx, `
+		SELECT role FROM project_members WHERE project_id = $1 AND user_id = $2
+	`, projectID, userID).Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	s, _ := ScopeFrom(ctx)
+	self := s.UserID == userID
+	switch {
+	case self && allowSelf:
+	case current == ProjectRoleOwner && callerRole != ProjectRoleOwner:
+		return ErrProjectRole
+	case !ProjectRoleAtLeast(callerRole, ProjectRoleAdmin):
+		return ErrProjectRole
+	}
+
+	if err := apply(tx, callerRole); err != nil {
+		return err
+	}
+
+	var owners int
+	err = tx.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM project_members WHERE project_id = $1 AND role = $2
+	`, projectID, ProjectRoleOwner).Scan(&owners)
+	if err != nil {
+		return err
+	}
+	if owners == 0 {
+		return ErrLastOwner
+	}
+
+	return tx.Commit()
+}
+
+// ============================================================================
+// INVITATIONS
+// ============================================================================
+
+func hashInvitationToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Invite creates an invitation for email to join the project with role.
+// Requires admin, and owner to invite owners. The plain token is only
+// available on the returned value.
+func (r *ProjectRepository) Invite(ctx context.Context, projectID int, email, role string, ttl time.Duration) (*ProjectInvitation, error) {
+	if !ValidProjectRole(role) {
+		return nil, ErrInvalidProjectRole
+	}
+	callerRole, err := authorize(ctx, r.db, projectID, ProjectRoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	if role == ProjectRoleOwner && callerRole != ProjectRoleOwner {
+		return nil, ErrProjectRole
+	}
+	if ttl <= 0 {
+		ttl = DefaultInvitationTTL
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+
+	inv := &ProjectInvitation{
+		ProjectID: projectID,
+		Email:     strings.ToLower(strings.TrimSpace(email)),
+		Role:      role,
+		InvitedBy: ownerFor(ctx, nil),
+		ExpiresAt: time.Now().UTC().Add(ttl),
+		Token:     hex.EncodeToString(raw),
+	}
+	err = r.db.QueryRowContext(ctx, `
+		INSERT INTO project_invitations (project_id, email, role, token_hash, invited_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`, projectID, inv.Email, role, hashInvitationToken(inv.Token), inv.InvitedBy, inv.ExpiresAt).
+		Scan(&inv.ID, &inv.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// ListInvitations returns the pending invitations of a project. Requires admin.
+func (r *ProjectRepository) ListInvitations(ctx context.Context, projectID int) ([]ProjectInvitation, error) {
+	if _, err := authorize(ctx, r.db, projectID, ProjectRoleAdmin); err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT id, project_id, email, role, invited_by, expires_at, created_at
+		FROM project_invitations
+		WHERE project_id = $1 AND accepted_at IS NULL AND expires_at > NOW()
+		ORDER BY created_at DESC
+	`, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invitations []ProjectInvitation
+	for rows.Next() {
+		var inv ProjectInvitation
+		var invitedBy sql.NullInt64
+		if err := rows.Scan(&inv.ID, &inv.ProjectID, &inv.Email, &inv.Role, &invitedBy, &inv.ExpiresAt, &inv.CreatedAt); err != nil {
+			return nil, err
+		}
+		inv.InvitedBy = nullIntPtr(invitedBy)
+		invitations = append(invitations, inv)
+	}
+	return invitations, rows.Err()
+}
+
+// RevokeInvitation deletes a pending invitation. Requires admin.
+func (r *ProjectRepository) RevokeInvitation(ctx context.Context, projectID int, invitationID string) error {
+	if _, err := authorize(ctx, r.db, projectID, ProjectRoleAdmin); err != nil {
+		return err
+	}
+	result, err := r.db.ExecContext(ctx, `
+		DELETE FROM project_invitations WHERE id = $1 AND project_id = $2 AND accepted_at IS NULL
+	`, invitationID, projectID)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GrantMember makes the user a member of the project with at least the
+// given role, for memberships managed by the platform rather than by the
+// project's members (such as identity provider mappings). A higher
+// existing role is kept.
+func (r *ProjectRepository) GrantMember(ctx context.Context, projectID, userID int, role string) error {
+	if !ValidProjectRole(role) {
+		return ErrInvalidProjectRole
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := grantMember(ctx, tx, projectID, userID, role); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// grantMember adds a membership or raises its role to role.
+func grantMember(ctx context.Context, tx *Tx, projectID, userID int, role string) error {
+	var current string
+	err := tx.QueryRowContext(ctx, `
+		SELECT role FROM project_members WHERE project_id = $1 AND user_id = $2 FOR UPDATE
+	`, projectID, userID).Scan(&current)
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO project_members (project_id, user_id, role) VALUES ($1, $2, $3)
+		`, projectID, userID, role)
+	case err == nil && !ProjectRoleAtLeast(current, role):
+		_, err = tx.ExecContext(ctx, `
+			UPDATE project_members SET role = $3 WHERE project_id = $1 AND user_id = $2
+		`, projectID, userID, role)
+	}
+	return err
+}
+
+// AcceptInvitation adds the caller to the invited project. The invitation
+// must be addressed to the caller's email, unexpired and unused. An
+// existing membership keeps the higher of both roles.
+func (r *ProjectRepository) AcceptInvitation(ctx context.Context, token string) (*Project, error) {
+	s, ok := ScopeFrom(ctx)
+	if !ok || s.UserID == 0 {
+		return nil, ErrInvitationInvalid
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var invID, role string
+	var projectID int
+	err = tx.QueryRowContext(ctx, `
+		SELECT i.id, i.project_id, i.role
+		FROM project_invitations i
+		JOIN users u ON u.id = $2 AND LOWER(u.email) = i.email
+		WHERE i.token_hash = $1 AND i.accepted_at IS NULL AND i.expires_at > NOW()
+		FOR UPDATE OF i
+	`, hashInvitationToken(token), s.UserID).Scan(&invID, &projectID, &role)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvitationInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := grantMember(ctx, tx, projectID, s.UserID, role); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE project_invitations SET accepted_at = NOW() WHERE id = $1`, invID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return r.Get(WithScope(ctx, Scope{UserID: s.UserID}), projectID)
+}
@@ -0,0 +1,132 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"aexon/internal/types"
+)
+
+func TestProjectRoleAtLeast(t *testing.T) {
+	cases := []struct {
+		role, min string
+		want      bool
+	}{
+		{ProjectRoleOwner, ProjectRoleAdmin, true},
+		{ProjectRoleAdmin, ProjectRoleAdmin, true},
+		{ProjectRoleOperator, ProjectRoleAdmin, false},
+		{ProjectRoleOperator, ProjectRoleViewer, true},
+		{ProjectRoleViewer, ProjectRoleOperator, false},
+		{"", ProjectRoleViewer, false},
+		{"root", ProjectRoleViewer, false},
+	}
+	for _, tc := range cases {
+		if got := ProjectRoleAtLeast(tc.role, tc.min); got != tc.want {
+			t.Errorf("ProjectRoleAtLeast(%q, %q) = %v, want %v", tc.role, tc.min, got, tc.want)
+		}
+	}
+}
+
+func TestProjectInvitation(t *testing.T) {
+	svc := testService(t)
+	alice, bob, carol := testUser(t, svc, "user"), testUser(t, svc, "user"), testUser(t, svc, "user")
+	repo := NewProjectRepository(svc)
+
+	team, err := repo.Create(as(alice), "team")
+	if err != nil {
+		t.Fatalf("create project: %v", err)
+	}
+	name := fmt.Sprintf("team-vm-%d", time.Now().UnixNano())
+	inst := &types.Instance{Name: name, Image: "alpine", Limits: map[string]string{}, Type: "vm"}
+	if err := NewInstanceRepository(svc).Create(in(alice, team.ID), inst); err != nil {
+		t.Fatalf("create instance: %v", err)
+	}
+
+	if _, err := repo.Get(as(bob), team.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("outsiders must not see the project: %v", err)
+	}
+	if _, err := repo.Invite(as(bob), team.ID, bob.Email, ProjectRoleOwner, 0); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("outsiders must not invite themselves: %v", err)
+	}
+
+	inv, err := repo.Invite(in(alice, team.ID), team.ID, bob.Email, ProjectRoleOperator, 0)
+	if err != nil {
+		t.Fatalf("invite: %v", err)
+	}
+	if _, err := repo.AcceptInvitation(as(carol), inv.Token); !errors.Is(err, ErrInvitationInvalid) {
+		t.Errorf("invitations are bound to the invited email: %v", err)
+	}
+	joined, err := repo.AcceptInvitation(as(bob), inv.Token)
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	if joined.ID != team.ID || joined.Role != ProjectRoleOperator {
+		t.Errorf("joined %d as %q, want %d as operator", joined.ID, joined.Role, team.ID)
+	}
+	if _, err := repo.AcceptInvitation(as(bob), inv.Token); !errors.Is(err, ErrInvitationInvalid) {
+		t.Errorf("invitations are single use: %v", err)
+	}
+
+	// Bob shares the VM inside the project only
+	if _, err := NewInstanceRepository(svc).Get(in(bob, team.ID), name); err != nil {
+		t.Errorf("members must see project instances: %v", err)
+	}
+	if _, err := NewInstanceRepository(svc).Get(as(bob), name); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("project instances leaked into bob's personal project: %v", err)
+	}
+
+	if _, err := repo.Invite(in(bob, team.ID), team.ID, carol.Email, ProjectRoleViewer, 0); !errors.Is(err, ErrProjectRole) {
+		t.Errorf("operators must not invite: %v", err)
+	}
+	if err := repo.Delete(in(alice, team.ID), team.ID); !errors.Is(err, ErrProjectNotEmpty) {
+		t.Errorf("projects with instances must not be deleted: %v", err)
+	}
+}
+
+func TestProjectOwnership(t *testing.T) {
+	svc := testService(t)
+	alice, bob := testUser(t, svc, "user"), testUser(t, svc, "user")
+	repo := NewProjectRepository(svc)
+
+	team, err := repo.Create(as(alice), "team")
+	if err != nil {
+		t.Fatalf("create project: %v", err)
+	}
+	inv, err := repo.Invite(as(alice), team.ID, bob.Email, ProjectRoleAdmin, 0)
+	if err != nil {
+		t.Fatalf("invite: %v", err)
+	}
+	if _, err := repo.AcceptInvitation(as(bob), inv.Token); err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+
+	if err := repo.SetMemberRole(as(bob), team.ID, alice.ID, ProjectRoleViewer); !errors.Is(err, ErrProjectRole) {
+		t.Errorf("admins must not demote owners: %v", err)
+	}
+	if err := repo.SetMemberRole(as(bob), team.ID, bob.ID, ProjectRoleOwner); !errors.Is(err, ErrProjectRole) {
+		t.Errorf("admins must not make themselves owners: %v", err)
+	}
+	if err := repo.SetMemberRole(as(alice), team.ID, alice.ID, ProjectRoleAdmin); !errors.Is(err, ErrLastOwner) {
+		t.Errorf("the last owner must not step down: %v", err)
+	}
+	if err := repo.RemoveMember(as(alice), team.ID, alice.ID); !errors.Is(err, ErrLastOwner) {
+		t.Errorf("the last owner must not leave: %v", err)
+	}
+
+	if err := repo.SetMemberRole(as(alice), team.ID, bob.ID, ProjectRoleOwner); err != nil {
+		t.Fatalf("promote: %v", err)
+	}
+	if err := repo.RemoveMember(as(alice), team.ID, alice.ID); err != nil {
+		t.Errorf("an owner may leave once another owner exists: %v", err)
+	}
+
+	if err := repo.Delete(as(bob), bob.ProjectID); !errors.Is(err, ErrPersonalProject) {
+		t.Errorf("personal projects must not be deleted: %v", err)
+	}
+	if err := repo.Delete(as(bob), team.ID); err != nil {
+		t.Errorf("owner cannot delete an empty project: %v", err)
+	}
+}
@@ -0,0 +1,304 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ============================================================================
+// RESOURCE QUOTAS
+// ============================================================================
+
+const (
+	QuotaScopeUser    = "user"
+	QuotaScopeProject = "project"
+
+	// QuotaDefault is the scope ID of the row applying to every user or
+	// project without a quota of its own.
+	QuotaDefault = 0
+)
+
+var (
+	ErrQuotaExceeded     = errors.New("quota exceeded")
+	ErrInvalidQuotaScope = errors.New("quota scope must be user or project")
+)
+
+// QuotaLimits caps what a user or project may hold; a nil field is
+// unlimited.
+type QuotaLimits struct {
+	Instances *int `json:"max_instances"`
+	VCPU      *int `json:"max_vcpu"`
+	MemoryMiB *int `json:"max_memory_mib"`
+	DiskGB    *int `json:"max_disk_gb"`
+	PublicIPs *int `json:"max_public_ips"`
+	Snapshots *int `json:"max_snapshots"`
+}
+
+type Quota struct {
+	Scope   string `json:"scope"`
+	ScopeID int    `json:"scope_id"`
+	QuotaLimits
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Resources is an amount of what quotas limit: held, or requested.
+type Resources struct {
+	Instances int `json:"instances"`
+	VCPU      int `json:"vcpu"`
+	MemoryMiB int `json:"memory_mib"`
+	DiskGB    int `json:"disk_gb"`
+	PublicIPs int `json:"public_ips"`
+	Snapshots int `json:"snapshots"` // AxHV has no snapshots yet, so always 0
+}
+
+// Where the limits of a scope come from.
+const (
+	QuotaSourceOwn     = "quota"   // A quota set for the user or project
+	QuotaSourceDefault = "default" // The default quota of the scope
+	QuotaSourcePlan    = "plan"    // The caps of its plan
+)
+
+// QuotaUsage reports a scope's usage against its effective quota. An
+// empty Source means unlimited.
+type QuotaUsage struct {
+	Scope   string      `json:"scope"`
+	ScopeID int         `json:"scope_id"`
+	Source  string      `json:"source"`
+	Plan    string      `json:"plan,omitempty"`
+	Quota   QuotaLimits `json:"quota"`
+	Usage   Resources   `json:"usage"`
+}
+
+// QuotaExceededError names the first limit a request would exceed. It
+// matches ErrQuotaExceeded with errors.Is.
+type QuotaExceededError struct {
+	Scope     string `json:"scope"`
+	ScopeID   int    `json:"scope_id"`
+	Resource  string `json:"resource"`
+	Limit     int    `json:"limit"`
+	Used      int    `json:"used"`
+	Requested int    `json:"requested"`
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("%s %d quota exceeded: %s %d + %d > %d",
+		e.Scope, e.ScopeID, e.Resource, e.Used, e.Requested, e.Limit)
+}
+
+func (e *QuotaExceededError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+func validQuotaScope(scope string) bool {
+	return scope == QuotaScopeUser || scope == QuotaScopeProject
+}
+
+// exceeds returns the first limit that used plus requested goes over.
+// Shrinking is always allowed, even above the limit.
+func (l QuotaLimits) exceeds(used, requested Resources) (string, int, int, int, bool) {
+	checks := []struct {
+		name       string
+		limit      *int
+		used, more int
+	}{
+		{"instances", l.Instances, used.Instances, requested.Instances},
+		{"vcpu", l.VCPU, used.VCPU, requested.VCPU},
+		{"memory_mib", l.MemoryMiB, used.MemoryMiB, requested.MemoryMiB},
+		{"disk_gb", l.DiskGB, used.DiskGB, requested.DiskGB},
+		{"public_ips", l.PublicIPs, used.PublicIPs, requested.PublicIPs},
+		{"snapshots", l.Snapshots, used.Snapshots, requested.Snapshots},
+	}
+	for _, c := range checks {
+		if c.limit != nil && c.more > 0 && c.used+c.more > *c.limit {
+			return c.name, *c.limit, c.used, c.more, true
+		}
+	}
+	return "", 0, 0, 0, false
+}
+
+type QuotaRepository struct {
+	db *Service
+}
+
+func NewQuotaRepository(db *Service) *QuotaRepository {
+	return &QuotaRepository{db: db}
+}
+
+const quotaColumns = `scope, scope_id, max_instances, max_vcpu, max_memory_mib,
+	max_disk_gb, max_public_ips, max_snapshots, updated_at`
+
+func scanQuota(row interface{ Scan(...interface{}) error }) (*Quota, error) {
+	var q Quota
+	var limits [6]sql.NullInt64
+	if err := row.Scan(&q.Scope, &q.ScopeID, &limits[0], &limits[1], &limits[2],
+		&limits[3], &limits[4], &limits[5], &q.UpdatedAt); err != nil {
+		return nil, err
+	}
+	q.Instances = nullIntPtr(limits[0])
+	q.VCPU = nullIntPtr(limits[1])
+	q.MemoryMiB = nullIntPtr(limits[2])
+	q.DiskGB = nullIntPtr(limits[3])
+	q.PublicIPs = nullIntPtr(limits[4])
+	q.Snapshots = nullIntPtr(limits[5])
+	return &q, nil
+}
+
+// effectiveQuota returns the limits of a scope: its own quota, else the
+// default quota of the scope, else the caps of its plan.
+func effectiveQuota(ctx context.Context, q rowQuerier, scope string, id int) (*QuotaUsage, error) {
+	u := &QuotaUsage{Scope: scope, ScopeID: id}
+	quota, err := scanQuota(q.QueryRowContext(ctx, `
+		SELECT `+quotaColumns+` FROM quotas
+		WHERE scope = $1 AND scope_id IN ($2, 0)
+		ORDER BY scope_id DESC LIMIT 1
+	`, scope, id))
+	switch {
+	case err == nil:
+		u.Quota, u.Source = quota.QuotaLimits, QuotaSourceOwn
+		if quota.ScopeID != id {
+			u.Source = QuotaSourceDefault
+		}
+		return u, nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, err
+	}
+
+	plan, err := planOf(ctx, q, scope, id)
+	if err != nil {
+		return nil, err
+	}
+	if plan != nil {
+		u.Quota, u.Source, u.Plan = plan.QuotaLimits, QuotaSourcePlan, plan.Name
+	}
+	return u, nil
+}
+
+// quotaUsage sums what the scope holds.
+func quotaUsage(ctx context.Context, q rowQuerier, scope string, id int) (Resources, error) {
+	column := "owner_id"
+	if scope == QuotaScopeProject {
+		column = "project_id"
+	}
+	var u Resources
+	err := q.QueryRowContext(ctx, `
+		SELECT COUNT(*), COALESCE(SUM(vcpu), 0), COALESCE(SUM(memory_mib), 0), COALESCE(SUM(disk_gb), 0),
+		       (SELECT COUNT(*) FROM floating_ips WHERE `+column+` = $1)
+		FROM instances WHERE `+column+` = $1
+	`, id).Scan(&u.Instances, &u.VCPU, &u.MemoryMiB, &u.DiskGB, &u.PublicIPs)
+	return u, err
+}
+
+// checkQuota fails with a *QuotaExceededError when adding requested (a
+// delta when resizing) to what the owner and the project hold would exceed
+// either's quota. The scopes stay locked until tx ends, so concurrent
+// checks of the same owner or project see each other's rows.
+func checkQuota(ctx context.Context, tx *Tx, owner, project *int, requested Resources) error {
+	scopes := []struct {
+		name string
+		id   *int
+	}{{QuotaScopeUser, owner}, {QuotaScopeProject, project}}
+	for _, s := range scopes {
+		if s.id == nil {
+			continue
+		}
+		// Always user before project, so checks cannot deadlock
+		lock := fmt.Sprintf("quota:%s:%d", s.name, *s.id)
+		if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, lock); err != nil {
+			return err
+		}
+		effective, err := effectiveQuota(ctx, tx, s.name, *s.id)
+		if err != nil {
+			return err
+		}
+		if effective.Source == "" {
+			continue
+		}
+		used, err := quotaUsage(ctx, tx, s.name, *s.id)
+		if err != nil {
+			return err
+		}
+		if resource, limit, u, more, over := effective.Quota.exceeds(used, requested); over {
+			return &QuotaExceededError{Scope: s.name, ScopeID: *s.id, Resource: resource, Limit: limit, Used: u, Requested: more}
+		}
+	}
+	return nil
+}
+
+// List returns every quota set, defaults first.
+func (r *QuotaRepository) List(ctx context.Context) ([]Quota, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT `+quotaColumns+` FROM quotas ORDER BY scope, scope_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	quotas := []Quota{}
+	for rows.Next() {
+		q, err := scanQuota(rows)
+		if err != nil {
+			return nil, err
+		}
+		quotas = append(quotas, *q)
+	}
+	return quotas, rows.Err()
+}
+
+// Set creates or replaces the quota of a user or project, or the default
+// of the scope when id is QuotaDefault. Usage above the new limits is
+// kept; only growth is refused.
+func (r *QuotaRepository) Set(ctx context.Context, scope string, id int, limits QuotaLimits) (*Quota, error) {
+	if !validQuotaScope(scope) {
+		return nil, ErrInvalidQuotaScope
+	}
+	return scanQuota(r.db.QueryRowContext(ctx, `
+		INSERT INTO quotas (scope, scope_id, max_instances, max_vcpu, max_memory_mib,
+		                    max_disk_gb, max_public_ips, max_snapshots)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (scope, scope_id) DO UPDATE SET
+			max_instances = EXCLUDED.max_instances,
+			max_vcpu = EXCLUDED.max_vcpu,
+			max_memory_mib = EXCLUDED.max_memory_mib,
+			max_disk_gb = EXCLUDED.max_disk_gb,
+			max_public_ips = EXCLUDED.max_public_ips,
+			max_snapshots = EXCLUDED.max_snapshots,
+			updated_at = NOW()
+		RETURNING `+quotaColumns,
+		scope, id, limits.Instances, limits.VCPU, limits.MemoryMiB,
+		limits.DiskGB, limits.PublicIPs, limits.Snapshots))
+}
+
+// Delete removes a quota, so the scope falls back to its default quota or
+// its plan.
+func (r *QuotaRepository) Delete(ctx context.Context, scope string, id int) error {
+	if !validQuotaScope(scope) {
+		return ErrInvalidQuotaScope
+	}
+	result, err := r.db.ExecContext(ctx, `DELETE FROM quotas WHERE scope = $1 AND scope_id = $2`, scope, id)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return fmt.Errorf("quota not found: %s %d: %w", scope, id, sql.ErrNoRows)
+	}
+	return nil
+}
+
+// Usage reports what a user or project holds against its effective quota.
+func (r *QuotaRepository) Usage(ctx context.Context, scope string, id int) (*QuotaUsage, error) {
+	if !validQuotaScope(scope) {
+		return nil, ErrInvalidQuotaScope
+	}
+	report, err := effectiveQuota(ctx, r.db, scope, id)
+	if err != nil {
+		return nil, err
+	}
+	if report.Usage, err = quotaUsage(ctx, r.db, scope, id); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"aexon/internal/types"
+)
+
+func TestQuotaExceeds(t *testing.T) {
+	two, eight := 2, 8
+	limits := QuotaLimits{Instances: &two, VCPU: &eight}
+
+	if _, _, _, _, over := limits.exceeds(Resources{Instances: 1, VCPU: 4}, Resources{Instances: 1, VCPU: 4, MemoryMiB: 1 << 20}); over {
+		t.Error("a request at the limit, or of an unlimited resource, was refused")
+	}
+	resource, limit, used, more, over := limits.exceeds(Resources{Instances: 1, VCPU: 6}, Resources{Instances: 1, VCPU: 4})
+	if !over || resource != "vcpu" || limit != 8 || used != 6 || more != 4 {
+		t.Errorf("exceeds = %s %d %d %d %v", resource, limit, used, more, over)
+	}
+	// Shrinking an instance of a scope already over its quota stays possible
+	if _, _, _, _, over := limits.exceeds(Resources{Instances: 3, VCPU: 12}, Resources{VCPU: -2}); over {
+		t.Error("shrinking was refused")
+	}
+
+	err := error(&QuotaExceededError{Scope: QuotaScopeUser, ScopeID: 1, Resource: "vcpu"})
+	if !errors.Is(fmt.Errorf("create: %w", err), ErrQuotaExceeded) {
+		t.Error("QuotaExceededError does not match ErrQuotaExceeded")
+	}
+}
+
+func TestQuotaEnforcement(t *testing.T) {
+	svc := testService(t)
+	alice := testUser(t, svc, "user")
+	repo, quotas := NewInstanceRepository(svc), NewQuotaRepository(svc)
+	ctx := context.Background()
+
+	one, four := 1, 4
+	if _, err := quotas.Set(ctx, QuotaScopeUser, alice.ID, QuotaLimits{Instances: &four, VCPU: &four}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if _, err := quotas.Set(ctx, QuotaScopeProject, alice.ProjectID, QuotaLimits{Instances: &one}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	t.Cleanup(func() {
+		quotas.Delete(ctx, QuotaScopeUser, alice.ID)
+		quotas.Delete(ctx, QuotaScopeProject, alice.ProjectID)
+	})
+
+	name := fmt.Sprintf("quota-vm-%d", time.Now().UnixNano())
+	if err := repo.Create(as(alice), &types.Instance{Name: name, Image: "alpine", Type: "vm", VCPU: 2, MemoryMiB: 512, DiskGB: 10}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	err := repo.Create(as(alice), &types.Instance{Name: name + "-2", Image: "alpine", Type: "vm", VCPU: 1})
+	var qe *QuotaExceededError
+	if !errors.As(err, &qe) || qe.Scope != QuotaScopeProject || qe.Resource != "instances" {
+		t.Fatalf("second instance in a one-instance project: %v", err)
+	}
+
+	if _, err := repo.Resize(as(alice), name, 5, 0); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("resize past the user's vCPU quota: %v", err)
+	}
+	resized, err := repo.Resize(as(alice), name, 4, 1024)
+	if err != nil || resized.VCPU != 4 || resized.MemoryMiB != 1024 || resized.Limits["limits.cpu"] != "4" {
+		t.Fatalf("resize within quota = %+v, %v", resized, err)
+	}
+
+	usage, err := quotas.Usage(ctx, QuotaScopeUser, alice.ID)
+	if err != nil || usage.Source != QuotaSourceOwn || usage.Usage.Instances != 1 || usage.Usage.VCPU != 4 ||
+		usage.Usage.MemoryMiB != 1024 || usage.Usage.DiskGB != 10 {
+		t.Errorf("Usage = %+v, %v", usage, err)
+	}
+
+	// Without its own quota the project falls back to its plan
+	if err := quotas.Delete(ctx, QuotaScopeProject, alice.ProjectID); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Create(as(alice), &types.Instance{Name: name + "-2", Image: "alpine", Type: "vm"}); err != nil {
+		t.Errorf("create after lifting the project quota: %v", err)
+	}
+}
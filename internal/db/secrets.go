@@ -0,0 +1,27 @@
+package db
+
+import "context"
+
+// SecretRepository keeps secrets generated by the control plane itself.
+type SecretRepository struct {
+	db *Service
+}
+
+func NewSecretRepository(db *Service) *SecretRepository {
+	return &SecretRepository{db: db}
+}
+
+// GetOrCreate returns the secret stored under name, storing value first if
+// there is none yet. Concurrent first starts agree on a single value.
+func (r *SecretRepository) GetOrCreate(ctx context.Context, name string, value []byte) ([]byte, error) {
+	if _, err := r.db.ExecContext(ctx, `
+		INSERT INTO system_secrets (name, value) VALUES ($1, $2)
+		ON CONFLICT (name) DO NOTHING
+	`, name, value); err != nil {
+		return nil, err
+	}
+
+	var stored []byte
+	err := r.db.QueryRowContext(ctx, `SELECT value FROM system_secrets WHERE name = $1`, name).Scan(&stored)
+	return stored, err
+}
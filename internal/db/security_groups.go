@@ -0,0 +1,354 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ============================================================================
+// SECURITY GROUPS
+// ============================================================================
+
+type SecurityGroup struct {
+	ID          string              `json:"id"`
+	Name        string              `json:"name"`
+	Description string              `json:"description"`
+	CreatedAt   time.Time           `json:"created_at"`
+	ProjectID   *int                `json:"project_id,omitempty"` // nil = shared with every project
+	Rules       []SecurityGroupRule `json:"rules"`
+}
+
+type SecurityGroupRule struct {
+	ID          string    `json:"id"`
+	GroupID     string    `json:"group_id"`
+	Direction   string    `json:"direction"` // "ingress" or "egress"
+	Protocol    string    `json:"protocol"`  // "tcp", "udp", "icmp" or "any"
+	PortFrom    int       `json:"port_from"`
+	PortTo      int       `json:"port_to"`
+	CIDR        string    `json:"cidr"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Validate normalises defaults and rejects rules nft could not render.
+func (r *SecurityGroupRule) Validate() error {
+	switch r.Direction {
+	case "ingress", "egress":
+	default:
+		return fmt.Errorf("direction must be ingress or egress")
+	}
+
+	switch r.Protocol {
+	case "tcp", "udp":
+		if r.PortFrom <= 0 || r.PortFrom > 65535 {
+			return fmt.Errorf("port_from must be between 1 and 65535")
+		}
+		if r.PortTo == 0 {
+			r.PortTo = r.PortFrom
+		}
+		if r.PortTo < r.PortFrom || r.PortTo > 65535 {
+			return fmt.Errorf("port_to must be between port_from and 65535")
+		}
+	case "icmp", "any":
+		if r.PortFrom != 0 || r.PortTo != 0 {
+			return fmt.Errorf("ports are only valid for tcp and udp")
+		}
+	default:
+		return fmt.Errorf("protocol must be tcp, udp, icmp or any")
+	}
+
+	if r.CIDR == "" {
+		r.CIDR = "0.0.0.0/0"
+	}
+	ip, ipNet, err := net.ParseCIDR(r.CIDR)
+	if err != nil || ip.To4() == nil {
+		return fmt.Errorf("cidr must be an IPv4 CIDR")
+	}
+	r.CIDR = ipNet.String()
+	return nil
+}
+
+type SecurityGroupRepository struct {
+	db *Service
+}
+
+func NewSecurityGroupRepository(db *Service) *SecurityGroupRepository {
+	return &SecurityGroupRepository{db: db}
+}
+
+// Create inserts the group together with its initial rules in one
+// transaction. Groups created by a tenant belong to its project; groups
+// created by admins are shared.
+func (r *SecurityGroupRepository) Create(ctx context.Context, group *SecurityGroup) error {
+	for i := range group.Rules {
+		if err := group.Rules[i].Validate(); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if pid, ok := tenantOf(ctx); ok {
+		group.ProjectID = &pid
+	}
+	query := `
+		INSERT INTO security_groups (name, description, project_id)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at
+	`
+	if err := tx.QueryRowContext(ctx, query, group.Name, group.Description, group.ProjectID).Scan(&group.ID, &group.CreatedAt); err != nil {
+		return err
+	}
+
+	for i := range group.Rules {
+		rule := &group.Rules[i]
+		rule.GroupID = group.ID
+		if err := tx.QueryRowContext(ctx, insertRuleQuery, rule.GroupID, rule.Direction, rule.Protocol,
+			rule.PortFrom, rule.PortTo, rule.CIDR, rule.Description).Scan(&rule.ID, &rule.CreatedAt); err != nil {
+			return err
+		}
+	}
+
+	if group.Rules == nil {
+		group.Rules = []SecurityGroupRule{}
+	}
+	return tx.Commit()
+}
+
+const insertRuleQuery = `
+	INSERT INTO security_group_rules (group_id, direction, protocol, port_from, port_to, cidr, description)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	RETURNING id, created_at
+`
+
+func (r *SecurityGroupRepository) Get(ctx context.Context, id string) (*SecurityGroup, error) {
+	filter, args := sharedFilter(ctx, "project_id", []interface{}{id})
+	query := `SELECT id, name, COALESCE(description, ''), created_at, project_id FROM security_groups WHERE id = $1` + filter
+
+	var g SecurityGroup
+	if err := scanSecurityGroup(r.db.QueryRowContext(ctx, query, args...), &g); err != nil {
+		return nil, err
+	}
+
+	rules, err := r.listRules(ctx, `WHERE group_id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	g.Rules = rules
+	return &g, nil
+}
+
+func (r *SecurityGroupRepository) List(ctx context.Context) ([]SecurityGroup, error) {
+	filter, args := sharedFilter(ctx, "project_id", nil)
+	query := `SELECT id, name, COALESCE(description, ''), created_at, project_id FROM security_groups WHERE TRUE` + filter + ` ORDER BY name`
+	return r.listGroups(ctx, query, args...)
+}
+
+// ListByInstance returns the groups attached to an instance, rules included.
+func (r *SecurityGroupRepository) ListByInstance(ctx context.Context, instanceName string) ([]SecurityGroup, error) {
+	query := `
+		SELECT g.id, g.name, COALESCE(g.description, ''), g.created_at, g.project_id
+		FROM security_groups g
+		JOIN instance_security_groups isg ON isg.group_id = g.id
+		WHERE isg.instance_name = $1
+		ORDER BY g.name
+	`
+	return r.listGroups(ctx, query, instanceName)
+}
+
+func (r *SecurityGroupRepository) listGroups(ctx context.Context, query string, args ...interface{}) ([]SecurityGroup, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []SecurityGroup{}
+	for rows.Next() {
+		var g SecurityGroup
+		if err := scanSecurityGroup(rows, &g); err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range groups {
+		rules, err := r.listRules(ctx, `WHERE group_id = $1`, groups[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		groups[i].Rules = rules
+	}
+	return groups, nil
+}
+
+func scanSecurityGroup(row interface{ Scan(...interface{}) error }, g *SecurityGroup) error {
+	var projectID sql.NullInt64
+	if err := row.Scan(&g.ID, &g.Name, &g.Description, &g.CreatedAt, &projectID); err != nil {
+		return err
+	}
+	g.ProjectID = nullIntPtr(projectID)
+	return nil
+}
+
+func (r *SecurityGroupRepository) listRules(ctx context.Context, where string, args ...interface{}) ([]SecurityGroupRule, error) {
+	query := `
+		SELECT id, group_id, direction, protocol, port_from, port_to, cidr,
+		       COALESCE(description, ''), created_at
+		FROM security_group_rules
+	` + where + ` ORDER BY created_at, id`
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []SecurityGroupRule{}
+	for rows.Next() {
+		var rule SecurityGroupRule
+		if err := rows.Scan(&rule.ID, &rule.GroupID, &rule.Direction, &rule.Protocol,
+			&rule.PortFrom, &rule.PortTo, &rule.CIDR, &rule.Description, &rule.CreatedAt); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// writable checks that the caller may change the group: tenants only change
+// their project's groups, shared ones are read-only to them.
+func (r *SecurityGroupRepository) writable(ctx context.Context, id string) error {
+	filter, args := sharedFilter(ctx, "project_id", []interface{}{id})
+	var projectID sql.NullInt64
+	err := r.db.QueryRowContext(ctx, `SELECT project_id FROM security_groups WHERE id = $1`+filter, args...).Scan(&projectID)
+	if err != nil {
+		return err
+	}
+	if _, restricted := tenantOf(ctx); restricted && !projectID.Valid {
+		return ErrSharedResource
+	}
+	return nil
+}
+
+func (r *SecurityGroupRepository) Delete(ctx context.Context, id string) error {
+	if err := r.writable(ctx, id); err != nil {
+		return err
+	}
+	res, err := r.db.ExecContext(ctx, `DELETE FROM security_groups WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (r *SecurityGroupRepository) AddRule(ctx context.Context, rule *SecurityGroupRule) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+	if err := r.writable(ctx, rule.GroupID); err != nil {
+		return err
+	}
+	return r.db.QueryRowContext(ctx, insertRuleQuery, rule.GroupID, rule.Direction, rule.Protocol,
+		rule.PortFrom, rule.PortTo, rule.CIDR, rule.Description).Scan(&rule.ID, &rule.CreatedAt)
+}
+
+func (r *SecurityGroupRepository) DeleteRule(ctx context.Context, groupID, ruleID string) error {
+	if err := r.writable(ctx, groupID); err != nil {
+		return err
+	}
+	res, err := r.db.ExecContext(ctx, `DELETE FROM security_group_rules WHERE id = $1 AND group_id = $2`, ruleID, groupID)
+	if err != nil {
+		return err
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ============================================================================
+// INSTANCE ATTACHMENTS
+// ============================================================================
+
+func (r *SecurityGroupRepository) Attach(ctx context.Context, instanceName, groupID string) error {
+	query := `
+		INSERT INTO instance_security_groups (instance_name, group_id)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING
+	`
+	_, err := r.db.ExecContext(ctx, query, instanceName, groupID)
+	return err
+}
+
+func (r *SecurityGroupRepository) Detach(ctx context.Context, instanceName, groupID string) error {
+	res, err := r.db.ExecContext(ctx,
+		`DELETE FROM instance_security_groups WHERE instance_name = $1 AND group_id = $2`, instanceName, groupID)
+	if err != nil {
+		return err
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListInstanceRules returns the rules of every group attached to each
+// instance, keyed by instance name. Instances without groups are absent.
+func (r *SecurityGroupRepository) ListInstanceRules(ctx context.Context) (map[string][]SecurityGroupRule, error) {
+	query := `
+		SELECT isg.instance_name, r.id, r.group_id, r.direction, r.protocol,
+		       r.port_from, r.port_to, r.cidr, COALESCE(r.description, ''), r.created_at
+		FROM instance_security_groups isg
+		LEFT JOIN security_group_rules r ON r.group_id = isg.group_id
+		ORDER BY isg.instance_name, r.created_at, r.id
+	`
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string][]SecurityGroupRule)
+	for rows.Next() {
+		var instance string
+		var id, groupID, direction, protocol, cidr, desc sql.NullString
+		var portFrom, portTo sql.NullInt64
+		var createdAt sql.NullTime
+		if err := rows.Scan(&instance, &id, &groupID, &direction, &protocol,
+			&portFrom, &portTo, &cidr, &desc, &createdAt); err != nil {
+			return nil, err
+		}
+		if _, ok := result[instance]; !ok {
+			result[instance] = []SecurityGroupRule{}
+		}
+		if !id.Valid {
+			continue // Group attached but empty: still deny-by-default
+		}
+		result[instance] = append(result[instance], SecurityGroupRule{
+			ID:          id.String,
+			GroupID:     groupID.String,
+			Direction:   direction.String,
+			Protocol:    protocol.String,
+			PortFrom:    int(portFrom.Int64),
+			PortTo:      int(portTo.Int64),
+			CIDR:        cidr.String,
+			Description: desc.String,
+			CreatedAt:   createdAt.Time,
+		})
+	}
+	return result, rows.Err()
+}
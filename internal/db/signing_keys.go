@@ -0,0 +1,116 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// SigningKey is an asymmetric JWT signing key pair.
+type SigningKey struct {
+	KID        string
+	Algorithm  string
+	PrivateKey []byte // PKCS #8 DER
+	PublicKey  []byte // PKIX DER
+	CreatedAt  time.Time
+	RetiredAt  *time.Time // No longer signs
+	ExpiresAt  *time.Time // No longer verifies
+}
+
+// SigningKeyRepository stores the JWT signing keys shared by all control
+// plane instances.
+type SigningKeyRepository struct {
+	db *Service
+}
+
+func NewSigningKeyRepository(db *Service) *SigningKeyRepository {
+	return &SigningKeyRepository{db: db}
+}
+
+// ListUsable returns the keys that have not expired, newest first.
+func (r *SigningKeyRepository) ListUsable(ctx context.Context) ([]SigningKey, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT kid, algorithm, private_key, public_key, created_at, retired_at, expires_at
+		FROM signing_keys
+		WHERE expires_at IS NULL OR expires_at > NOW()
+		ORDER BY created_at DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []SigningKey
+	for rows.Next() {
+		var k SigningKey
+		var retiredAt, expiresAt sql.NullTime
+		if err := rows.Scan(&k.KID, &k.Algorithm, &k.PrivateKey, &k.PublicKey, &k.CreatedAt, &retiredAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		if retiredAt.Valid {
+			k.RetiredAt = &retiredAt.Time
+		}
+		if expiresAt.Valid {
+			k.ExpiresAt = &expiresAt.Time
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// FirstCreated returns when the first key was created, expired or not; the
+// zero time when there is none.
+func (r *SigningKeyRepository) FirstCreated(ctx context.Context) (time.Time, error) {
+	var first sql.NullTime
+	err := r.db.QueryRowContext(ctx, `SELECT MIN(created_at) FROM signing_keys`).Scan(&first)
+	return first.Time, err
+}
+
+// Rotate makes next the signing key unless the current one is younger than
+// minAge, so that instances rotating on the same schedule rotate once. The
+// current key is retired and expires after overlap. It reports whether next
+// was stored.
+func (r *SigningKeyRepository) Rotate(ctx context.Context, next *SigningKey, overlap, minAge time.Duration) (bool, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// Serialises rotations, including the very first one
+	if _, err := tx.ExecContext(ctx, `LOCK TABLE signing_keys IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+		return false, err
+	}
+
+	var current string
+	var age float64
+	err = tx.QueryRowContext(ctx, `
+		SELECT kid, EXTRACT(EPOCH FROM NOW() - created_at)
+		FROM signing_keys WHERE retired_at IS NULL
+		ORDER BY created_at DESC LIMIT 1
+	`).Scan(&current, &age)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return false, err
+	case time.Duration(age*float64(time.Second)) < minAge:
+		return false, nil
+	default:
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE signing_keys SET retired_at = NOW(), expires_at = NOW() + $2 * INTERVAL '1 second'
+			WHERE kid = $1
+		`, current, int64(overlap.Seconds())); err != nil {
+			return false, err
+		}
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO signing_keys (kid, algorithm, private_key, public_key)
+		VALUES ($1, $2, $3, $4)
+		RETURNING created_at
+	`, next.KID, next.Algorithm, next.PrivateKey, next.PublicKey).Scan(&next.CreatedAt)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
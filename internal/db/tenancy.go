@@ -0,0 +1,111 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrSharedResource is returned when a tenant tries to change a resource
+// published to everyone (shared network pools, the ISO library).
+var ErrSharedResource = errors.New("shared resource can only be changed by an admin")
+
+// ============================================================================
+// TENANT SCOPE
+// ============================================================================
+
+// Scope identifies who a repository call runs on behalf of and in which
+// project. Handlers attach it to the request context (see
+// auth.AuthMiddleware); repositories read it back and restrict every query
+// to the rows of that project.
+//
+// A context without a scope belongs to the control plane itself (workers,
+// schedulers, reconcilers) and sees everything, as do platform admins.
+type Scope struct {
+	UserID    int
+	Admin     bool
+	ProjectID int    // Project the request acts in
+	Role      string // Caller's role in ProjectID
+}
+
+type scopeKey struct{}
+
+// WithScope returns a copy of ctx carrying the given tenant scope.
+func WithScope(ctx context.Context, s Scope) context.Context {
+	return context.WithValue(ctx, scopeKey{}, &s)
+}
+
+// WithoutScope drops the tenant scope so internal reconcilers triggered by
+// a request still operate on the whole fleet.
+func WithoutScope(ctx context.Context) context.Context {
+	return context.WithValue(ctx, scopeKey{}, (*Scope)(nil))
+}
+
+// ScopeFrom returns the tenant scope of ctx, if any.
+func ScopeFrom(ctx context.Context) (Scope, bool) {
+	s, _ := ctx.Value(scopeKey{}).(*Scope)
+	if s == nil {
+		return Scope{}, false
+	}
+	return *s, true
+}
+
+// tenantOf returns the project whose rows ctx is restricted to. Admins and
+// internal callers are unrestricted; a scope without a project matches
+// nothing.
+func tenantOf(ctx context.Context) (int, bool) {
+	s, ok := ScopeFrom(ctx)
+	if !ok || s.Admin {
+		return 0, false
+	}
+	return s.ProjectID, true
+}
+
+// projectFilter appends "AND <column> = $n" for restricted callers. Rows
+// outside any project are invisible to tenants.
+func projectFilter(ctx context.Context, column string, args []interface{}) (string, []interface{}) {
+	pid, ok := tenantOf(ctx)
+	if !ok {
+		return "", args
+	}
+	args = append(args, pid)
+	return fmt.Sprintf(" AND %s = $%d", column, len(args)), args
+}
+
+// sharedFilter is the read-side filter of resources that may be published
+// to every project: a NULL project means shared (admin-managed pools, the
+// ISO library) and stays visible.
+func sharedFilter(ctx context.Context, column string, args []interface{}) (string, []interface{}) {
+	pid, ok := tenantOf(ctx)
+	if !ok {
+		return "", args
+	}
+	args = append(args, pid)
+	return fmt.Sprintf(" AND (%s = $%d OR %s IS NULL)", column, len(args), column), args
+}
+
+// ownerFor returns the creator to record on insert: the caller when it is a
+// user, or the explicit owner chosen by an internal caller.
+func ownerFor(ctx context.Context, explicit *int) *int {
+	if s, ok := ScopeFrom(ctx); ok && s.UserID > 0 {
+		if s.Admin && explicit != nil {
+			return explicit
+		}
+		uid := s.UserID
+		return &uid
+	}
+	return explicit
+}
+
+// projectFor returns the project a new row belongs to: the one the caller
+// acts in, unless an admin or internal caller picked another explicitly.
+func projectFor(ctx context.Context, explicit *int) *int {
+	if s, ok := ScopeFrom(ctx); ok && s.ProjectID > 0 {
+		if s.Admin && explicit != nil {
+			return explicit
+		}
+		pid := s.ProjectID
+		return &pid
+	}
+	return explicit
+}
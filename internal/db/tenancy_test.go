@@ -0,0 +1,306 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"aexon/internal/types"
+)
+
+// testService connects to the database configured through DB_* and applies
+// the migrations. Tests needing Postgres are skipped when it is unreachable.
+func testService(t *testing.T) *Service {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.ConnectTimeout = 2 * time.Second
+	svc, err := InitService(cfg)
+	if err != nil || svc == nil { // InitService only reports the error once
+		t.Skipf("postgres not available: %v", err)
+	}
+	if err := RunMigrations(context.Background(), svc); err != nil {
+		t.Fatalf("migrations failed: %v", err)
+	}
+	return svc
+}
+
+// tenant is a throwaway user acting in its personal project.
+type tenant struct {
+	*User
+	ProjectID int
+}
+
+// testUser creates a throwaway user and removes it (and what its projects
+// own) at the end of the test.
+func testUser(t *testing.T, svc *Service, role string) *tenant {
+	t.Helper()
+	ctx := context.Background()
+	u := &User{
+		Email:        fmt.Sprintf("tenant-%d@test.local", time.Now().UnixNano()),
+		PasswordHash: "x",
+		Role:         role,
+	}
+	if err := NewUserRepository(svc).Create(ctx, u); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	t.Cleanup(func() {
+		owned := `(SELECT id FROM projects WHERE created_by = $1)`
+		svc.ExecContext(ctx, `DELETE FROM instances WHERE owner_id = $1 OR project_id IN `+owned, u.ID)
+		svc.ExecContext(ctx, `DELETE FROM isos WHERE owner_id = $1 OR project_id IN `+owned, u.ID)
+		svc.ExecContext(ctx, `DELETE FROM jobs WHERE owner_id = $1`, u.ID)
+		svc.ExecContext(ctx, `DELETE FROM projects WHERE created_by = $1`, u.ID)
+		svc.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, u.ID)
+	})
+
+	pid, _, err := NewProjectRepository(svc).DefaultFor(ctx, u.ID)
+	if err != nil {
+		t.Fatalf("personal project missing: %v", err)
+	}
+	return &tenant{User: u, ProjectID: pid}
+}
+
+// as acts as u in its personal project.
+func as(u *tenant) context.Context {
+	return in(u, u.ProjectID)
+}
+
+// in acts as u in the given project, with u's actual role there.
+func in(u *tenant, projectID int) context.Context {
+	role, _ := NewProjectRepository(GetService()).MemberRole(context.Background(), projectID, u.ID)
+	return WithScope(context.Background(), Scope{
+		UserID:    u.ID,
+		Admin:     u.Role == "admin",
+		ProjectID: projectID,
+		Role:      role,
+	})
+}
+
+func TestProjectFilter(t *testing.T) {
+	clause, args := projectFilter(context.Background(), "project_id", []interface{}{"x"})
+	if clause != "" || len(args) != 1 {
+		t.Errorf("internal callers must be unrestricted, got %q %v", clause, args)
+	}
+
+	admin := WithScope(context.Background(), Scope{UserID: 1, Admin: true, ProjectID: 3})
+	if clause, _ := projectFilter(admin, "project_id", nil); clause != "" {
+		t.Errorf("admins must be unrestricted, got %q", clause)
+	}
+
+	tenant := WithScope(context.Background(), Scope{UserID: 7, ProjectID: 9})
+	clause, args = projectFilter(tenant, "i.project_id", []interface{}{"x"})
+	if clause != " AND i.project_id = $2" || len(args) != 2 || args[1] != 9 {
+		t.Errorf("unexpected tenant filter %q %v", clause, args)
+	}
+	clause, _ = sharedFilter(tenant, "project_id", nil)
+	if clause != " AND (project_id = $1 OR project_id IS NULL)" {
+		t.Errorf("unexpected shared filter %q", clause)
+	}
+
+	// A user outside any project matches nothing rather than everything
+	orphan := WithScope(context.Background(), Scope{UserID: 7})
+	if _, args := projectFilter(orphan, "project_id", nil); len(args) != 1 || args[0] != 0 {
+		t.Errorf("users without a project must be restricted, got %v", args)
+	}
+
+	if _, ok := ScopeFrom(WithoutScope(tenant)); ok {
+		t.Error("WithoutScope must drop the tenant")
+	}
+}
+
+func TestOwnerFor(t *testing.T) {
+	other := 42
+	if got := ownerFor(context.Background(), &other); got != &other {
+		t.Error("internal callers keep the explicit owner")
+	}
+	if got := ownerFor(WithScope(context.Background(), Scope{UserID: 7}), &other); got == nil || *got != 7 {
+		t.Errorf("tenants always own what they create, got %v", got)
+	}
+	if got := ownerFor(WithScope(context.Background(), Scope{UserID: 1, Admin: true}), &other); *got != 42 {
+		t.Errorf("admins may create on behalf of others, got %v", *got)
+	}
+}
+
+func TestProjectFor(t *testing.T) {
+	other := 42
+	if got := projectFor(context.Background(), &other); got != &other {
+		t.Error("internal callers keep the explicit project")
+	}
+	if got := projectFor(WithScope(context.Background(), Scope{UserID: 7, ProjectID: 9}), &other); got == nil || *got != 9 {
+		t.Errorf("tenants always create in their current project, got %v", got)
+	}
+	if got := projectFor(WithScope(context.Background(), Scope{UserID: 1, Admin: true, ProjectID: 3}), nil); got == nil || *got != 3 {
+		t.Errorf("admins create in their current project by default, got %v", got)
+	}
+}
+
+func TestInstanceIsolation(t *testing.T) {
+	svc := testService(t)
+	alice, bob := testUser(t, svc, "user"), testUser(t, svc, "user")
+	admin := testUser(t, svc, "admin")
+	repo := NewInstanceRepository(svc)
+
+	name := fmt.Sprintf("tenant-vm-%d", time.Now().UnixNano())
+	inst := &types.Instance{Name: name, Image: "alpine", Limits: map[string]string{}, Type: "vm"}
+	if err := repo.Create(as(alice), inst); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if inst.OwnerID == nil || *inst.OwnerID != alice.ID {
+		t.Fatalf("owner not recorded: %v", inst.OwnerID)
+	}
+	if inst.ProjectID == nil || *inst.ProjectID != alice.ProjectID {
+		t.Fatalf("project not recorded: %v", inst.ProjectID)
+	}
+
+	if _, err := repo.Get(as(bob), name); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("bob read alice's instance: %v", err)
+	}
+	list, err := repo.List(as(bob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range list {
+		if i.Name == name {
+			t.Error("bob lists alice's instance")
+		}
+	}
+	if err := repo.UpdateLimits(as(bob), name, map[string]string{"limits.cpu": "64"}); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("bob resized alice's instance: %v", err)
+	}
+	if err := repo.UpdateBackupConfig(as(bob), name, true, "@hourly", 1); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("bob changed alice's backups: %v", err)
+	}
+	if err := repo.Delete(as(bob), name); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("bob deleted alice's instance: %v", err)
+	}
+
+	if _, err := repo.Get(as(alice), name); err != nil {
+		t.Errorf("alice lost her instance: %v", err)
+	}
+	if _, err := repo.Get(as(admin), name); err != nil {
+		t.Errorf("admin must see every tenant: %v", err)
+	}
+	if err := repo.Delete(as(alice), name); err != nil {
+		t.Errorf("alice cannot delete her instance: %v", err)
+	}
+}
+
+func TestJobIsolation(t *testing.T) {
+	svc := testService(t)
+	alice, bob := testUser(t, svc, "user"), testUser(t, svc, "user")
+	repo := NewJobRepository(svc)
+
+	job := &Job{ID: fmt.Sprintf("job-%d", time.Now().UnixNano()), Type: types.JobTypeCreateSnapshot, Target: "vm", Payload: "{}"}
+	if err := repo.Create(as(alice), job); err != nil {
+		t.Fatalf("create job: %v", err)
+	}
+
+	if _, err := repo.Get(as(bob), job.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("bob read alice's job: %v", err)
+	}
+	jobs, err := repo.List(as(bob), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, j := range jobs {
+		if j.ID == job.ID {
+			t.Error("bob lists alice's job")
+		}
+	}
+	got, err := repo.Get(as(alice), job.ID)
+	if err != nil {
+		t.Fatalf("alice cannot read her job: %v", err)
+	}
+	if got.RequestedBy == nil || *got.RequestedBy != strconv.Itoa(alice.ID) {
+		t.Errorf("requested_by = %v, want %d", got.RequestedBy, alice.ID)
+	}
+	// Workers run without a scope
+	if _, err := repo.Get(context.Background(), job.ID); err != nil {
+		t.Errorf("internal callers must see every job: %v", err)
+	}
+}
+
+func TestNetworkIsolation(t *testing.T) {
+	svc := testService(t)
+	alice, bob := testUser(t, svc, "user"), testUser(t, svc, "user")
+	admin := testUser(t, svc, "admin")
+
+	octet := time.Now().UnixNano() % 200
+	private, err := svc.CreateNetwork(as(alice), Network{
+		Name: "alice-net", CIDR: fmt.Sprintf("10.%d.1.0/24", octet), Gateway: fmt.Sprintf("10.%d.1.1", octet),
+	})
+	if err != nil {
+		t.Fatalf("create private network: %v", err)
+	}
+	shared, err := svc.CreateNetwork(as(admin), Network{
+		Name: "shared-net", CIDR: fmt.Sprintf("10.%d.2.0/24", octet), Gateway: fmt.Sprintf("10.%d.2.1", octet),
+	})
+	if err != nil {
+		t.Fatalf("create shared network: %v", err)
+	}
+	t.Cleanup(func() {
+		svc.DeleteNetwork(context.Background(), private.ID)
+		svc.DeleteNetwork(context.Background(), shared.ID)
+	})
+
+	if shared.ProjectID != nil {
+		t.Error("admin pools must be shared")
+	}
+	if _, err := svc.GetNetwork(as(bob), private.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("bob read alice's network: %v", err)
+	}
+	if _, err := svc.GetNetwork(as(bob), shared.ID); err != nil {
+		t.Errorf("shared pool must be visible: %v", err)
+	}
+	if _, err := svc.AllocateInNetwork(as(bob), private.ID, "bob-vm"); err == nil {
+		t.Error("bob allocated in alice's network")
+	}
+	if err := svc.DeleteNetwork(as(bob), private.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("bob deleted alice's network: %v", err)
+	}
+	if err := svc.DeleteNetwork(as(bob), shared.ID); !errors.Is(err, ErrSharedResource) {
+		t.Errorf("tenants must not delete shared pools: %v", err)
+	}
+
+	nets, err := svc.ListNetworks(as(bob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range nets {
+		if n.ID == private.ID {
+			t.Error("bob lists alice's network")
+		}
+	}
+}
+
+func TestISOIsolation(t *testing.T) {
+	svc := testService(t)
+	alice, bob := testUser(t, svc, "user"), testUser(t, svc, "user")
+	repo := NewISORepository(svc)
+
+	name := fmt.Sprintf("alice-%d.iso", time.Now().UnixNano())
+	if _, err := repo.Register(as(alice), name, 1024); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	visible, err := repo.Visible(as(bob), []string{name, "library.iso"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(visible, ",") != "library.iso" {
+		t.Errorf("bob sees %v, want only the shared library", visible)
+	}
+	if err := repo.Delete(as(bob), name); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("bob deleted alice's ISO: %v", err)
+	}
+	if err := repo.Delete(as(bob), "library.iso"); !errors.Is(err, ErrSharedResource) {
+		t.Errorf("tenants must not delete the shared library: %v", err)
+	}
+	if err := repo.Delete(as(alice), name); err != nil {
+		t.Errorf("alice cannot delete her ISO: %v", err)
+	}
+}
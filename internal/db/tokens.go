@@ -0,0 +1,199 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token is unknown, expired or revoked")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used")
+)
+
+// TokenRepository persists revoked access tokens and issued refresh tokens.
+type TokenRepository struct {
+	db *Service
+}
+
+func NewTokenRepository(db *Service) *TokenRepository {
+	return &TokenRepository{db: db}
+}
+
+// Revoke records that the token with the given JWT ID must be rejected until
+// it expires.
+func (r *TokenRepository) Revoke(ctx context.Context, jti string, expiresAt time.Time) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2)
+		ON CONFLICT (jti) DO NOTHING
+	`, jti, expiresAt.UTC())
+	return err
+}
+
+// Consume revokes the token with the given JWT ID, reporting false when it
+// was already revoked, so that a single-use token is accepted once across
+// all instances.
+func (r *TokenRepository) Consume(ctx context.Context, jti string, expiresAt time.Time) (bool, error) {
+	result, err := r.db.ExecContext(ctx, `
+		INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2)
+		ON CONFLICT (jti) DO NOTHING
+	`, jti, expiresAt.UTC())
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows == 1, err
+}
+
+// Revoked returns the unexpired revocations by JWT ID.
+func (r *TokenRepository) Revoked(ctx context.Context) (map[string]time.Time, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT jti, expires_at FROM revoked_tokens WHERE expires_at > NOW()
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revoked := make(map[string]time.Time)
+	for rows.Next() {
+		var jti string
+		var expiresAt time.Time
+		if err := rows.Scan(&jti, &expiresAt); err != nil {
+			return nil, err
+		}
+		revoked[jti] = expiresAt
+	}
+	return revoked, rows.Err()
+}
+
+// SessionCutoffs returns, per user, the instant before which all of their
+// tokens were revoked.
+func (r *TokenRepository) SessionCutoffs(ctx context.Context) (map[int]time.Time, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT id, sessions_revoked_at FROM users WHERE sessions_revoked_at IS NOT NULL
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cutoffs := make(map[int]time.Time)
+	for rows.Next() {
+		var id int
+		var at time.Time
+		if err := rows.Scan(&id, &at); err != nil {
+			return nil, err
+		}
+		cutoffs[id] = at
+	}
+	return cutoffs, rows.Err()
+}
+
+// RevokeSessions rejects every token the user was issued so far, including
+// all refresh token families, and returns the cutoff instant.
+func (r *TokenRepository) RevokeSessions(ctx context.Context, userID int) (time.Time, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	var at time.Time
+	err = tx.QueryRowContext(ctx, `
+		UPDATE users SET sessions_revoked_at = NOW() WHERE id = $1
+		RETURNING sessions_revoked_at
+	`, userID).Scan(&at)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE refresh_tokens SET revoked_at = NOW()
+		WHERE user_id = $1 AND revoked_at IS NULL
+	`, userID); err != nil {
+		return time.Time{}, err
+	}
+	return at, tx.Commit()
+}
+
+// CreateRefreshToken records a newly issued refresh token.
+func (r *TokenRepository) CreateRefreshToken(ctx context.Context, jti, family string, userID int, expiresAt time.Time) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO refresh_tokens (jti, family, user_id, expires_at) VALUES ($1, $2, $3, $4)
+	`, jti, family, userID, expiresAt.UTC())
+	return err
+}
+
+// RotateRefreshToken marks the presented refresh token as used and records
+// its successor in the same family. Presenting an already used token revokes
+// the whole family and returns ErrRefreshTokenReused.
+func (r *TokenRepository) RotateRefreshToken(ctx context.Context, jti, next string, expiresAt time.Time) (userID int, err error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var family string
+	var usedAt, revokedAt sql.NullTime
+	var expired bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT family, user_id, used_at, revoked_at, expires_at <= NOW()
+		FROM refresh_tokens WHERE jti = $1
+		FOR UPDATE
+	`, jti).Scan(&family, &userID, &usedAt, &revokedAt, &expired)
+	if err == sql.ErrNoRows {
+		return 0, ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if usedAt.Valid {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE refresh_tokens SET revoked_at = NOW()
+			WHERE family = $1 AND revoked_at IS NULL
+		`, family); err != nil {
+			return 0, err
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, err
+		}
+		return userID, ErrRefreshTokenReused
+	}
+	if revokedAt.Valid || expired {
+		return 0, ErrRefreshTokenInvalid
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE refresh_tokens SET used_at = NOW(), replaced_by = $2 WHERE jti = $1
+	`, jti, next); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO refresh_tokens (jti, family, user_id, expires_at) VALUES ($1, $2, $3, $4)
+	`, next, family, userID, expiresAt.UTC()); err != nil {
+		return 0, err
+	}
+	return userID, tx.Commit()
+}
+
+// RevokeFamily revokes the refresh token family the given token belongs to.
+func (r *TokenRepository) RevokeFamily(ctx context.Context, jti string) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE refresh_tokens SET revoked_at = NOW()
+		WHERE revoked_at IS NULL
+		  AND family = (SELECT family FROM refresh_tokens WHERE jti = $1)
+	`, jti)
+	return err
+}
+
+// PurgeExpired drops revocations and refresh tokens past their expiry.
+func (r *TokenRepository) PurgeExpired(ctx context.Context) error {
+	if _, err := r.db.ExecContext(ctx, `DELETE FROM revoked_tokens WHERE expires_at <= NOW()`); err != nil {
+		return err
+	}
+	_, err := r.db.ExecContext(ctx, `DELETE FROM refresh_tokens WHERE expires_at <= NOW()`)
+	return err
+}
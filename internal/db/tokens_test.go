@@ -0,0 +1,80 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRefreshTokenRotation(t *testing.T) {
+	svc := testService(t)
+	alice := testUser(t, svc, "user")
+	repo := NewTokenRepository(svc)
+	ctx := context.Background()
+
+	jti := func(n int) string { return fmt.Sprintf("rt-%d-%d", alice.ID, n) }
+	expires := time.Now().Add(time.Hour)
+
+	if err := repo.CreateRefreshToken(ctx, jti(0), "family-"+jti(0), alice.ID, expires); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	uid, err := repo.RotateRefreshToken(ctx, jti(0), jti(1), expires)
+	if err != nil || uid != alice.ID {
+		t.Fatalf("rotate: uid %d, %v", uid, err)
+	}
+
+	// Replaying the first token burns the family, including its successor
+	if _, err := repo.RotateRefreshToken(ctx, jti(0), jti(2), expires); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("replay: %v, want ErrRefreshTokenReused", err)
+	}
+	if _, err := repo.RotateRefreshToken(ctx, jti(1), jti(3), expires); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Errorf("successor of a replayed token must be revoked: %v", err)
+	}
+	if _, err := repo.RotateRefreshToken(ctx, "unknown", jti(4), expires); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Errorf("unknown token: %v", err)
+	}
+}
+
+func TestRevokeSessions(t *testing.T) {
+	svc := testService(t)
+	alice := testUser(t, svc, "user")
+	repo := NewTokenRepository(svc)
+	ctx := context.Background()
+
+	family := fmt.Sprintf("rt-%d", alice.ID)
+	if err := repo.CreateRefreshToken(ctx, family, family, alice.ID, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	at, err := repo.RevokeSessions(ctx, alice.ID)
+	if err != nil {
+		t.Fatalf("revoke sessions: %v", err)
+	}
+	if _, err := repo.RotateRefreshToken(ctx, family, family+"-next", time.Now().Add(time.Hour)); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Errorf("refresh tokens must not survive a global logout: %v", err)
+	}
+
+	cutoffs, err := repo.SessionCutoffs(ctx)
+	if err != nil {
+		t.Fatalf("cutoffs: %v", err)
+	}
+	if !cutoffs[alice.ID].Equal(at) {
+		t.Errorf("cutoff %v, want %v", cutoffs[alice.ID], at)
+	}
+}
+
+func TestConsumeToken(t *testing.T) {
+	svc := testService(t)
+	repo := NewTokenRepository(svc)
+	ctx := context.Background()
+
+	jti := fmt.Sprintf("challenge-%d", time.Now().UnixNano())
+	t.Cleanup(func() { svc.ExecContext(ctx, `DELETE FROM revoked_tokens WHERE jti = $1`, jti) })
+	if ok, err := repo.Consume(ctx, jti, time.Now().Add(time.Minute)); err != nil || !ok {
+		t.Fatalf("first use: %v, %v", ok, err)
+	}
+	if ok, err := repo.Consume(ctx, jti, time.Now().Add(time.Minute)); err != nil || ok {
+		t.Errorf("second use accepted: %v, %v", ok, err)
+	}
+}
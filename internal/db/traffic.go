@@ -0,0 +1,270 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// ============================================================================
+// TRAFFIC LEDGER
+// ============================================================================
+
+// TrafficPeriod returns the billing period containing t: the calendar
+// month in UTC, identified by its first day.
+func TrafficPeriod(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+type TrafficCounter struct {
+	RxBytes   uint64
+	TxBytes   uint64
+	SampledAt time.Time
+}
+
+type TrafficUsage struct {
+	InstanceName string    `json:"instance_name"`
+	PeriodStart  time.Time `json:"period_start"`
+	RxBytes      uint64    `json:"rx_bytes"`
+	TxBytes      uint64    `json:"tx_bytes"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// Total is the amount counted against the quota (both directions).
+func (u TrafficUsage) Total() uint64 {
+	return u.RxBytes + u.TxBytes
+}
+
+type TrafficQuota struct {
+	InstanceName    string     `json:"instance_name"`
+	MonthlyBytes    uint64     `json:"monthly_bytes"`
+	Action          string     `json:"action"` // "throttle", "notify" or "stop"
+	ThrottleMbps    int        `json:"throttle_mbps"`
+	TriggeredPeriod *time.Time `json:"triggered_period,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+func (q *TrafficQuota) Validate() error {
+	if q.MonthlyBytes == 0 {
+		return fmt.Errorf("monthly_bytes must be positive")
+	}
+	switch q.Action {
+	case "throttle", "notify", "stop":
+	default:
+		return fmt.Errorf("action must be throttle, notify or stop")
+	}
+	if q.ThrottleMbps < 0 {
+		return fmt.Errorf("throttle_mbps must be positive")
+	}
+	if q.ThrottleMbps == 0 {
+		q.ThrottleMbps = 1
+	}
+	return nil
+}
+
+type TrafficRepository struct {
+	db *Service
+}
+
+func NewTrafficRepository(db *Service) *TrafficRepository {
+	return &TrafficRepository{db: db}
+}
+
+// GetCounter returns the last raw counters sampled for an instance, or nil
+// if it has never been sampled.
+func (r *TrafficRepository) GetCounter(ctx context.Context, instanceName string) (*TrafficCounter, error) {
+	var c TrafficCounter
+	var rx, tx int64
+	err := r.db.QueryRowContext(ctx,
+		`SELECT rx_bytes, tx_bytes, sampled_at FROM traffic_counters WHERE instance_name = $1`, instanceName).
+		Scan(&rx, &tx, &c.SampledAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.RxBytes, c.TxBytes = uint64(rx), uint64(tx)
+	return &c, nil
+}
+
+// RecordSample stores the new raw counters and adds the deltas to the
+// ledger of the given period, atomically.
+func (r *TrafficRepository) RecordSample(ctx context.Context, instanceName string, period time.Time, counter TrafficCounter, deltaRx, deltaTx uint64) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO traffic_counters (instance_name, rx_bytes, tx_bytes, sampled_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (instance_name) DO UPDATE
+		SET rx_bytes = EXCLUDED.rx_bytes, tx_bytes = EXCLUDED.tx_bytes, sampled_at = EXCLUDED.sampled_at
+	`, instanceName, int64(counter.RxBytes), int64(counter.TxBytes), counter.SampledAt)
+	if err != nil {
+		return err
+	}
+
+	if deltaRx > 0 || deltaTx > 0 {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO traffic_ledger (instance_name, period_start, rx_bytes, tx_bytes, updated_at)
+			VALUES ($1, $2, $3, $4, NOW())
+			ON CONFLICT (instance_name, period_start) DO UPDATE
+			SET rx_bytes = traffic_ledger.rx_bytes + EXCLUDED.rx_bytes,
+			    tx_bytes = traffic_ledger.tx_bytes + EXCLUDED.tx_bytes,
+			    updated_at = NOW()
+		`, instanceName, period, int64(deltaRx), int64(deltaTx))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetUsage returns the traffic of one period. A period without traffic
+// yields a zero usage rather than an error.
+func (r *TrafficRepository) GetUsage(ctx context.Context, instanceName string, period time.Time) (*TrafficUsage, error) {
+	u := TrafficUsage{InstanceName: instanceName, PeriodStart: period}
+	var rx, tx int64
+	err := r.db.QueryRowContext(ctx, `
+		SELECT rx_bytes, tx_bytes, updated_at FROM traffic_ledger
+		WHERE instance_name = $1 AND period_start = $2
+	`, instanceName, period).Scan(&rx, &tx, &u.UpdatedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	u.RxBytes, u.TxBytes = uint64(rx), uint64(tx)
+	return &u, nil
+}
+
+// ListUsage returns every recorded period of an instance, newest first.
+func (r *TrafficRepository) ListUsage(ctx context.Context, instanceName string, limit int) ([]TrafficUsage, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT period_start, rx_bytes, tx_bytes, updated_at FROM traffic_ledger
+		WHERE instance_name = $1
+		ORDER BY period_start DESC
+		LIMIT $2
+	`, instanceName, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := []TrafficUsage{}
+	for rows.Next() {
+		u := TrafficUsage{InstanceName: instanceName}
+		var rx, tx int64
+		if err := rows.Scan(&u.PeriodStart, &rx, &tx, &u.UpdatedAt); err != nil {
+			return nil, err
+		}
+		u.RxBytes, u.TxBytes = uint64(rx), uint64(tx)
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
+
+// ============================================================================
+// TRAFFIC QUOTAS
+// ============================================================================
+
+const trafficQuotaColumns = `instance_name, monthly_bytes, action, throttle_mbps, triggered_period, created_at, updated_at`
+
+func scanTrafficQuota(row interface{ Scan(...interface{}) error }) (*TrafficQuota, error) {
+	var q TrafficQuota
+	var monthly int64
+	var triggered sql.NullTime
+	if err := row.Scan(&q.InstanceName, &monthly, &q.Action, &q.ThrottleMbps, &triggered,
+		&q.CreatedAt, &q.UpdatedAt); err != nil {
+		return nil, err
+	}
+	q.MonthlyBytes = uint64(monthly)
+	if triggered.Valid {
+		q.TriggeredPeriod = &triggered.Time
+	}
+	return &q, nil
+}
+
+func (r *TrafficRepository) GetQuota(ctx context.Context, instanceName string) (*TrafficQuota, error) {
+	return scanTrafficQuota(r.db.QueryRowContext(ctx,
+		`SELECT `+trafficQuotaColumns+` FROM traffic_quotas WHERE instance_name = $1`, instanceName))
+}
+
+func (r *TrafficRepository) ListQuotas(ctx context.Context) ([]TrafficQuota, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT `+trafficQuotaColumns+` FROM traffic_quotas ORDER BY instance_name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var quotas []TrafficQuota
+	for rows.Next() {
+		q, err := scanTrafficQuota(rows)
+		if err != nil {
+			return nil, err
+		}
+		quotas = append(quotas, *q)
+	}
+	return quotas, rows.Err()
+}
+
+// ListActiveThrottles returns the throttle quotas that fired in period.
+func (r *TrafficRepository) ListActiveThrottles(ctx context.Context, period time.Time) ([]TrafficQuota, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT `+trafficQuotaColumns+` FROM traffic_quotas
+		WHERE action = 'throttle' AND triggered_period = $1 ORDER BY instance_name`, period)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var quotas []TrafficQuota
+	for rows.Next() {
+		q, err := scanTrafficQuota(rows)
+		if err != nil {
+			return nil, err
+		}
+		quotas = append(quotas, *q)
+	}
+	return quotas, rows.Err()
+}
+
+// SetQuota creates or replaces the quota. Changing it re-arms the action
+// for the current period.
+func (r *TrafficRepository) SetQuota(ctx context.Context, q *TrafficQuota) error {
+	if err := q.Validate(); err != nil {
+		return err
+	}
+	return r.db.QueryRowContext(ctx, `
+		INSERT INTO traffic_quotas (instance_name, monthly_bytes, action, throttle_mbps)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (instance_name) DO UPDATE
+		SET monthly_bytes = EXCLUDED.monthly_bytes, action = EXCLUDED.action,
+		    throttle_mbps = EXCLUDED.throttle_mbps, triggered_period = NULL, updated_at = NOW()
+		RETURNING created_at, updated_at
+	`, q.InstanceName, int64(q.MonthlyBytes), q.Action, q.ThrottleMbps).Scan(&q.CreatedAt, &q.UpdatedAt)
+}
+
+func (r *TrafficRepository) DeleteQuota(ctx context.Context, instanceName string) error {
+	res, err := r.db.ExecContext(ctx, `DELETE FROM traffic_quotas WHERE instance_name = $1`, instanceName)
+	if err != nil {
+		return err
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// MarkQuotaTriggered records that the action ran for a period so it is not
+// repeated on every sample.
+func (r *TrafficRepository) MarkQuotaTriggered(ctx context.Context, instanceName string, period time.Time) error {
+	_, err := r.db.ExecContext(ctx,
+		`UPDATE traffic_quotas SET triggered_period = $2, updated_at = NOW() WHERE instance_name = $1`,
+		instanceName, period)
+	return err
+}
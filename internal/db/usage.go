@@ -0,0 +1,268 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"aexon/internal/types"
+)
+
+// ============================================================================
+// USAGE METERING
+// ============================================================================
+
+// Instance states told apart by metering. A running (or paused) instance
+// is charged for its vCPUs, memory and disk; a stopped one for its disk.
+const (
+	UsageRunning = "running"
+	UsageStopped = "stopped"
+)
+
+// Bytes in the GB of memory, disk and traffic usage.
+const bytesPerGB = 1 << 30
+
+// UsageRecord is an interval during which an instance kept one state and
+// size. The open interval of an instance has no end.
+type UsageRecord struct {
+	ID           int64      `json:"id"`
+	InstanceName string     `json:"instance_name"`
+	OwnerID      *int       `json:"owner_id,omitempty"`
+	ProjectID    *int       `json:"project_id,omitempty"`
+	State        string     `json:"state"`
+	VCPU         int        `json:"vcpu"`
+	MemoryMiB    int        `json:"memory_mib"`
+	DiskGB       int        `json:"disk_gb"`
+	StartedAt    time.Time  `json:"started_at"`
+	EndedAt      *time.Time `json:"ended_at"`
+}
+
+// UsageSummary is what one user or project (the scopes of quotas)
+// consumed in a period. ScopeID 0 gathers instances without an owner or
+// project.
+type UsageSummary struct {
+	Scope         string  `json:"scope"`
+	ScopeID       int     `json:"scope_id"`
+	VCPUHours     float64 `json:"vcpu_hours"`
+	MemoryGBHours float64 `json:"memory_gb_hours"`
+	DiskGBHours   float64 `json:"disk_gb_hours"`
+	TrafficGB     float64 `json:"traffic_gb"`
+}
+
+type UsageRepository struct {
+	db *Service
+}
+
+func NewUsageRepository(db *Service) *UsageRepository {
+	return &UsageRepository{db: db}
+}
+
+const usageRecordColumns = `id, instance_name, owner_id, project_id, state, vcpu, memory_mib, disk_gb, started_at, ended_at`
+
+func scanUsageRecord(row interface{ Scan(...interface{}) error }) (*UsageRecord, error) {
+	var u UsageRecord
+	var owner, project sql.NullInt64
+	var ended sql.NullTime
+	if err := row.Scan(&u.ID, &u.InstanceName, &owner, &project, &u.State,
+		&u.VCPU, &u.MemoryMiB, &u.DiskGB, &u.StartedAt, &ended); err != nil {
+		return nil, err
+	}
+	u.OwnerID = nullIntPtr(owner)
+	u.ProjectID = nullIntPtr(project)
+	if ended.Valid {
+		u.EndedAt = &ended.Time
+	}
+	return &u, nil
+}
+
+// Observe records that inst is in state at the given time, with its
+// current size and owner. When any of those changed, the open interval is
+// closed and a new one opened; otherwise nothing happens, so observing
+// the same state repeatedly is cheap. An empty state keeps the state of
+// the open interval (stopped when there is none), e.g. after a resize.
+func (r *UsageRepository) Observe(ctx context.Context, inst *types.Instance, state string, at time.Time) error {
+	at = at.UTC()
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	open, err := scanUsageRecord(tx.QueryRowContext(ctx, `
+		SELECT `+usageRecordColumns+` FROM usage_records
+		WHERE instance_name = $1 AND ended_at IS NULL
+		FOR UPDATE
+	`, inst.Name))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if state == "" {
+		state = UsageStopped
+		if open != nil {
+			state = open.State
+		}
+	}
+	if open != nil {
+		if open.State == state && open.VCPU == inst.VCPU && open.MemoryMiB == inst.MemoryMiB &&
+			open.DiskGB == inst.DiskGB && equalIntPtr(open.OwnerID, inst.OwnerID) &&
+			equalIntPtr(open.ProjectID, inst.ProjectID) {
+			return nil
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE usage_records SET ended_at = $2 WHERE id = $1`, open.ID, at); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO usage_records (instance_name, owner_id, project_id, state, vcpu, memory_mib, disk_gb, started_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, inst.Name, inst.OwnerID, inst.ProjectID, state, inst.VCPU, inst.MemoryMiB, inst.DiskGB, at); err != nil {
+		if IsUniqueViolation(err) {
+			return nil // Observed concurrently; the next observation reconciles
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+func equalIntPtr(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// Close ends the open interval of a deleted instance.
+func (r *UsageRepository) Close(ctx context.Context, instanceName string, at time.Time) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE usage_records SET ended_at = $2 WHERE instance_name = $1 AND ended_at IS NULL
+	`, instanceName, at.UTC())
+	return err
+}
+
+// CloseMissing ends the open intervals of instances that no longer exist,
+// e.g. deleted while metering was down.
+func (r *UsageRepository) CloseMissing(ctx context.Context, at time.Time) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE usage_records SET ended_at = $1
+		WHERE ended_at IS NULL AND instance_name NOT IN (SELECT name FROM instances)
+	`, at.UTC())
+	return err
+}
+
+// ListRecords returns the intervals of an instance overlapping [from, to),
+// newest first.
+func (r *UsageRepository) ListRecords(ctx context.Context, instanceName string, from, to time.Time) ([]UsageRecord, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT `+usageRecordColumns+` FROM usage_records
+		WHERE instance_name = $1 AND started_at < $3 AND (ended_at IS NULL OR ended_at > $2)
+		ORDER BY started_at DESC
+	`, instanceName, from.UTC(), to.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []UsageRecord{}
+	for rows.Next() {
+		u, err := scanUsageRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, *u)
+	}
+	return records, rows.Err()
+}
+
+// Summarize aggregates the usage of the month starting at period (see
+// TrafficPeriod) by user or project. Intervals are clipped to the month,
+// and open ones count up to now. Traffic is attributed to the owner of
+// the instance's last interval of the month.
+func (r *UsageRepository) Summarize(ctx context.Context, period time.Time, groupBy string, now time.Time) ([]UsageSummary, error) {
+	column := "owner_id"
+	switch groupBy {
+	case QuotaScopeUser:
+	case QuotaScopeProject:
+		column = "project_id"
+	default:
+		return nil, fmt.Errorf("invalid grouping %q: must be user or project", groupBy)
+	}
+	from := TrafficPeriod(period)
+	to := from.AddDate(0, 1, 0)
+
+	byScope := make(map[int]*UsageSummary)
+	summary := func(id int) *UsageSummary {
+		if byScope[id] == nil {
+			byScope[id] = &UsageSummary{Scope: groupBy, ScopeID: id}
+		}
+		return byScope[id]
+	}
+
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT COALESCE(`+column+`, 0),
+		       SUM(CASE WHEN state = 'running' THEN vcpu * hours ELSE 0 END),
+		       SUM(CASE WHEN state = 'running' THEN memory_mib / 1024.0 * hours ELSE 0 END),
+		       SUM(disk_gb * hours)
+		FROM (
+			SELECT `+column+`, state, vcpu, memory_mib, disk_gb,
+			       EXTRACT(EPOCH FROM LEAST(COALESCE(ended_at, $3), $2) - GREATEST(started_at, $1)) / 3600 AS hours
+			FROM usage_records
+			WHERE started_at < $2 AND (ended_at IS NULL OR ended_at > $1) AND started_at < $3
+		) u
+		GROUP BY 1
+	`, from, to, now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var vcpu, memory, disk float64
+		if err := rows.Scan(&id, &vcpu, &memory, &disk); err != nil {
+			return nil, err
+		}
+		s := summary(id)
+		s.VCPUHours, s.MemoryGBHours, s.DiskGBHours = vcpu, memory, disk
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	traffic, err := r.db.QueryContext(ctx, `
+		SELECT COALESCE(u.`+column+`, i.`+column+`, 0), SUM(t.rx_bytes + t.tx_bytes)
+		FROM traffic_ledger t
+		LEFT JOIN LATERAL (
+			SELECT owner_id, project_id FROM usage_records
+			WHERE instance_name = t.instance_name AND started_at < $2
+			ORDER BY started_at DESC LIMIT 1
+		) u ON TRUE
+		LEFT JOIN instances i ON i.name = t.instance_name
+		WHERE t.period_start = $1
+		GROUP BY 1
+	`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer traffic.Close()
+	for traffic.Next() {
+		var id int
+		var bytes int64
+		if err := traffic.Scan(&id, &bytes); err != nil {
+			return nil, err
+		}
+		summary(id).TrafficGB = float64(bytes) / bytesPerGB
+	}
+	if err := traffic.Err(); err != nil {
+		return nil, err
+	}
+
+	summaries := make([]UsageSummary, 0, len(byScope))
+	for _, s := range byScope {
+		summaries = append(summaries, *s)
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].ScopeID < summaries[j].ScopeID })
+	return summaries, nil
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"aexon/internal/types"
+)
+
+func TestBuildInvoice(t *testing.T) {
+	period := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	s := UsageSummary{Scope: QuotaScopeUser, ScopeID: 7, VCPUHours: 10, MemoryGBHours: 20, DiskGBHours: 1000, TrafficGB: 1.5}
+	sheet := &PriceSheet{Currency: "EUR", VCPUHour: 0.01, MemoryGBHour: 0.005, DiskGBHour: 0.0001, TrafficGB: 0.02}
+
+	inv := BuildInvoice(s, period, &Plan{Name: "pro"}, sheet)
+	if inv.Plan != "pro" || inv.Currency != "EUR" || !inv.PeriodEnd.Equal(period.AddDate(0, 1, 0)) || len(inv.Lines) != 4 {
+		t.Fatalf("invoice = %+v", inv)
+	}
+	want := map[string]float64{"vcpu": 0.1, "memory": 0.1, "disk": 0.1, "traffic": 0.03}
+	for _, l := range inv.Lines {
+		if math.Abs(l.Amount-want[l.Resource]) > 1e-9 {
+			t.Errorf("%s amount = %v, want %v", l.Resource, l.Amount, want[l.Resource])
+		}
+	}
+	if math.Abs(inv.Total-0.33) > 1e-9 {
+		t.Errorf("total = %v, want 0.33", inv.Total)
+	}
+
+	// Without a price sheet only the quantities are reported
+	bare := BuildInvoice(s, period, nil, nil)
+	if bare.Total != 0 || bare.Currency != "" || bare.Lines[0].Quantity != 10 {
+		t.Errorf("invoice without prices = %+v", bare)
+	}
+}
+
+func TestUsageMetering(t *testing.T) {
+	svc := testService(t)
+	alice := testUser(t, svc, "user")
+	usage := NewUsageRepository(svc)
+	ctx := context.Background()
+
+	// Metered in a month of its own, so other tests' records do not mix in
+	period := time.Date(2001, 2, 1, 0, 0, 0, 0, time.UTC)
+	inst := &types.Instance{
+		Name: fmt.Sprintf("usage-vm-%d", time.Now().UnixNano()), Image: "alpine", Type: "vm",
+		VCPU: 2, MemoryMiB: 2048, DiskGB: 10, OwnerID: &alice.ID, ProjectID: &alice.ProjectID,
+	}
+	t.Cleanup(func() { svc.ExecContext(ctx, `DELETE FROM usage_records WHERE instance_name = $1`, inst.Name) })
+
+	// Running for 9 hours of the period, then stopped for 10
+	start := period.Add(-time.Hour) // Clipped to the period
+	steps := []struct {
+		at    time.Time
+		state string
+	}{
+		{start, UsageRunning},
+		{period.Add(5 * time.Hour), UsageRunning}, // Unchanged: no new interval
+		{period.Add(9 * time.Hour), UsageStopped},
+		{period.Add(19 * time.Hour), ""}, // Keeps stopped
+	}
+	for _, s := range steps {
+		if err := usage.Observe(ctx, inst, s.state, s.at); err != nil {
+			t.Fatalf("Observe(%s): %v", s.state, err)
+		}
+	}
+	if err := usage.Close(ctx, inst.Name, period.Add(19*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := usage.ListRecords(ctx, inst.Name, period, period.AddDate(0, 1, 0))
+	if err != nil || len(records) != 2 || records[0].State != UsageStopped || records[0].EndedAt == nil {
+		t.Fatalf("records = %+v, %v", records, err)
+	}
+
+	summaries, err := usage.Summarize(ctx, period, QuotaScopeUser, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got *UsageSummary
+	for i := range summaries {
+		if summaries[i].ScopeID == alice.ID {
+			got = &summaries[i]
+		}
+	}
+	if got == nil || math.Abs(got.VCPUHours-18) > 1e-6 || math.Abs(got.MemoryGBHours-18) > 1e-6 ||
+		math.Abs(got.DiskGBHours-190) > 1e-6 {
+		t.Errorf("summary = %+v", got)
+	}
+}
@@ -3,17 +3,70 @@ package db
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
+
+	"github.com/lib/pq"
+)
+
+// Account states. Only active users can log in or use their tokens.
+const (
+	UserStatusActive   = "active"
+	UserStatusDisabled = "disabled" // Switched off by an administrator
+	UserStatusLocked   = "locked"   // Blocked for security reasons until unlocked
+)
+
+var (
+	ErrInvalidUserStatus = errors.New("status must be one of active, disabled, locked")
+	ErrInvalidUserRole   = errors.New("role must be one of admin, user")
+	ErrLastAdmin         = errors.New("at least one active admin must remain")
+	ErrUserHasResources  = errors.New("user still owns resources")
+	ErrEmailTaken        = errors.New("email already registered")
+	ErrAlreadySetUp      = errors.New("the first administrator already exists")
 )
 
+// ValidUserStatus reports whether status is a known account state.
+func ValidUserStatus(status string) bool {
+	switch status {
+	case UserStatusActive, UserStatusDisabled, UserStatusLocked:
+		return true
+	}
+	return false
+}
+
+// ValidUserRole reports whether role is a platform role.
+func ValidUserRole(role string) bool {
+	return role == "admin" || role == "user"
+}
+
 // User represents a system user
 type User struct {
-	ID           int       `json:"id"`
-	Email        string    `json:"email"`
-	PasswordHash string    `json:"-"` // Never return hash in JSON
-	Role         string    `json:"role"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ID                    int       `json:"id"`
+	Email                 string    `json:"email"`
+	PasswordHash          string    `json:"-"` // Never return hash in JSON
+	Role                  string    `json:"role"`
+	Status                string    `json:"status"`
+	PasswordResetRequired bool      `json:"password_reset_required"`
+	CreatedAt             time.Time `json:"created_at"`
+	UpdatedAt             time.Time `json:"updated_at"`
+}
+
+// UserFilter narrows List. Empty fields match everything.
+type UserFilter struct {
+	Status string
+	Role   string
+	Query  string // Substring of the email
+	Limit  int
+	Offset int
+}
+
+// UserUpdate holds the fields an administrator changes; nil keeps a field.
+type UserUpdate struct {
+	Email  *string
+	Role   *string
+	Status *string
 }
 
 // UserRepository handles user persistence
@@ -26,32 +79,78 @@ func NewUserRepository(service *Service) *UserRepository {
 	return &UserRepository{service: service}
 }
 
-// Create creates a new user via DB Transaction
+const userColumns = `u.id, u.email, u.password_hash, u.role, u.status, u.password_reset_required,
+	u.created_at, u.updated_at`
+
+func scanUser(row interface{ Scan(...interface{}) error }, u *User) error {
+	return row.Scan(&u.ID, &u.Email, &u.PasswordHash, &u.Role, &u.Status, &u.PasswordResetRequired,
+		&u.CreatedAt, &u.UpdatedAt)
+}
+
+// Create creates a new user via DB Transaction, together with its personal
+// project.
 func (r *UserRepository) Create(ctx context.Context, user *User) error {
+	tx, err := r.service.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertUser(ctx, tx, user); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func insertUser(ctx context.Context, tx *Tx, user *User) error {
 	query := `
-		INSERT INTO users (email, password_hash, role)
-		VALUES ($1, $2, $3)
-		RETURNING id, created_at, updated_at
+		INSERT INTO users (email, password_hash, role, password_reset_required)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, status, created_at, updated_at
 	`
 
-	err := r.service.QueryRowContext(ctx, query, user.Email, user.PasswordHash, user.Role).
-		Scan(&user.ID, &user.CreatedAt, &user.UpdatedAt)
+	err := tx.QueryRowContext(ctx, query, user.Email, user.PasswordHash, user.Role, user.PasswordResetRequired).
+		Scan(&user.ID, &user.Status, &user.CreatedAt, &user.UpdatedAt)
+	if isUniqueViolation(err) {
+		return ErrEmailTaken
+	}
+	if err != nil {
+		return err
+	}
 
+	_, err = createProject(ctx, tx, user.Email, true, user.ID)
 	return err
 }
 
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
 // GetByEmail retrieves a user by email
 func (r *UserRepository) GetByEmail(ctx context.Context, email string) (*User, error) {
-	query := `
-		SELECT id, email, password_hash, role, created_at, updated_at
-		FROM users
-		WHERE email = $1
-	`
+	query := `SELECT ` + userColumns + ` FROM users u WHERE u.email = $1`
+
+	var user User
+	err := scanUser(r.service.QueryRowContext(ctx, query, email), &user)
+
+	if err == sql.ErrNoRows {
+		return nil, nil // Not found
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// GetByID retrieves a user by id
+func (r *UserRepository) GetByID(ctx context.Context, id int) (*User, error) {
+	query := `SELECT ` + userColumns + ` FROM users u WHERE u.id = $1`
 
 	var user User
-	err := r.service.QueryRowContext(ctx, query, email).Scan(
-		&user.ID, &user.Email, &user.PasswordHash, &user.Role, &user.CreatedAt, &user.UpdatedAt,
-	)
+	err := scanUser(r.service.QueryRowContext(ctx, query, id), &user)
 
 	if err == sql.ErrNoRows {
 		return nil, nil // Not found
@@ -63,6 +162,34 @@ func (r *UserRepository) GetByEmail(ctx context.Context, email string) (*User, e
 	return &user, nil
 }
 
+// CreateFirstAdmin creates user as an admin, provided no user exists yet.
+// It fails with ErrAlreadySetUp otherwise.
+func (r *UserRepository) CreateFirstAdmin(ctx context.Context, user *User) error {
+	tx, err := r.service.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Concurrent setups wait here and then see the first one's user
+	if _, err := tx.ExecContext(ctx, `LOCK TABLE users IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+		return err
+	}
+	var exists bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users)`).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return ErrAlreadySetUp
+	}
+
+	user.Role = "admin"
+	if err := insertUser(ctx, tx, user); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 // Count returns the total number of users
 func (r *UserRepository) Count(ctx context.Context) (int, error) {
 	query := `SELECT COUNT(*) FROM users`
@@ -70,3 +197,217 @@ func (r *UserRepository) Count(ctx context.Context) (int, error) {
 	err := r.service.QueryRowContext(ctx, query).Scan(&count)
 	return count, err
 }
+
+// List returns the users matching the filter, oldest first, and the number
+// of matches ignoring Limit and Offset.
+func (r *UserRepository) List(ctx context.Context, f UserFilter) ([]User, int, error) {
+	where := []string{"TRUE"}
+	var args []interface{}
+	if f.Status != "" {
+		args = append(args, f.Status)
+		where = append(where, fmt.Sprintf("u.status = $%d", len(args)))
+	}
+	if f.Role != "" {
+		args = append(args, f.Role)
+		where = append(where, fmt.Sprintf("u.role = $%d", len(args)))
+	}
+	if f.Query != "" {
+		args = append(args, f.Query)
+		where = append(where, fmt.Sprintf("u.email ILIKE '%%' || $%d || '%%'", len(args)))
+	}
+	cond := strings.Join(where, " AND ")
+
+	var total int
+	if err := r.service.QueryRowContext(ctx, `SELECT COUNT(*) FROM users u WHERE `+cond, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `SELECT ` + userColumns + ` FROM users u WHERE ` + cond + ` ORDER BY u.id`
+	if f.Limit > 0 {
+		args = append(args, f.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	if f.Offset > 0 {
+		args = append(args, f.Offset)
+		query += fmt.Sprintf(" OFFSET $%d", len(args))
+	}
+	rows, err := r.service.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var u User
+		if err := scanUser(rows, &u); err != nil {
+			return nil, 0, err
+		}
+		users = append(users, u)
+	}
+	return users, total, rows.Err()
+}
+
+// SetRole changes the platform role of a user
+func (r *UserRepository) SetRole(ctx context.Context, id int, role string) error {
+	res, err := r.service.ExecContext(ctx, `
+		UPDATE users SET role = $2, updated_at = NOW() WHERE id = $1
+	`, id, role)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Update applies an administrator's changes. It refuses to leave the
+// platform without an active admin.
+func (r *UserRepository) Update(ctx context.Context, id int, upd UserUpdate) (*User, error) {
+	if upd.Role != nil && !ValidUserRole(*upd.Role) {
+		return nil, ErrInvalidUserRole
+	}
+	if upd.Status != nil && !ValidUserStatus(*upd.Status) {
+		return nil, ErrInvalidUserStatus
+	}
+
+	tx, err := r.service.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := lockAdmins(ctx, tx); err != nil {
+		return nil, err
+	}
+
+	var u User
+	err = scanUser(tx.QueryRowContext(ctx, `
+		UPDATE users u SET
+			email = COALESCE($2, u.email),
+			role = COALESCE($3, u.role),
+			status = COALESCE($4, u.status),
+			updated_at = NOW()
+		WHERE u.id = $1
+		RETURNING `+userColumns,
+		id, upd.Email, upd.Role, upd.Status), &u)
+	if isUniqueViolation(err) {
+		return nil, ErrEmailTaken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := requireAdmin(ctx, tx); err != nil {
+		return nil, err
+	}
+	return &u, tx.Commit()
+}
+
+// SetPassword replaces the password hash. resetRequired makes the user
+// choose a new password on the next login.
+func (r *UserRepository) SetPassword(ctx context.Context, id int, hash string, resetRequired bool) error {
+	res, err := r.service.ExecContext(ctx, `
+		UPDATE users SET password_hash = $2, password_reset_required = $3,
+			password_changed_at = NOW(), updated_at = NOW()
+		WHERE id = $1
+	`, id, hash, resetRequired)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RequirePasswordReset makes the user choose a new password on the next
+// login, keeping the current one to authenticate with.
+func (r *UserRepository) RequirePasswordReset(ctx context.Context, id int) error {
+	res, err := r.service.ExecContext(ctx, `
+		UPDATE users SET password_reset_required = TRUE, updated_at = NOW() WHERE id = $1
+	`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Delete removes a user together with its personal project. Users whose
+// personal project still owns resources, or who are the last owner of a
+// shared project, are kept.
+func (r *UserRepository) Delete(ctx context.Context, id int) error {
+	tx, err := r.service.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockAdmins(ctx, tx); err != nil {
+		return err
+	}
+
+	var orphaned int
+	err = tx.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM project_members m
+		JOIN projects p ON p.id = m.project_id AND NOT p.personal
+		WHERE m.user_id = $1 AND m.role = $2
+		  AND NOT EXISTS (
+			SELECT 1 FROM project_members o
+			WHERE o.project_id = m.project_id AND o.user_id <> $1 AND o.role = $2
+		  )
+	`, id, ProjectRoleOwner).Scan(&orphaned)
+	if err != nil {
+		return err
+	}
+	if orphaned > 0 {
+		return ErrLastOwner
+	}
+
+	// Instances, networks and ISOs reference the project without cascade
+	if _, err := tx.ExecContext(ctx, `DELETE FROM projects WHERE personal AND created_by = $1`, id); err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+			return ErrUserHasResources
+		}
+		return err
+	}
+	res, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+
+	if err := requireAdmin(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// lockAdmins serialises changes that could remove the last active admin.
+func lockAdmins(ctx context.Context, tx *Tx) error {
+	_, err := tx.ExecContext(ctx, `
+		SELECT 1 FROM users WHERE role = 'admin' AND status = $1 FOR UPDATE
+	`, UserStatusActive)
+	return err
+}
+
+func requireAdmin(ctx context.Context, tx *Tx) error {
+	var admins int
+	err := tx.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM users WHERE role = 'admin' AND status = $1
+	`, UserStatusActive).Scan(&admins)
+	if err != nil {
+		return err
+	}
+	if admins == 0 {
+		return ErrLastAdmin
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func TestUserManagement(t *testing.T) {
+	svc := testService(t)
+	repo := NewUserRepository(svc)
+	ctx := context.Background()
+	alice := testUser(t, svc, "user")
+
+	users, total, err := repo.List(ctx, UserFilter{Query: alice.Email, Status: UserStatusActive})
+	if err != nil || total != 1 || len(users) != 1 || users[0].ID != alice.ID {
+		t.Fatalf("List = %v, %d, %v, want only %d", users, total, err, alice.ID)
+	}
+
+	bogus := "frozen"
+	if _, err := repo.Update(ctx, alice.ID, UserUpdate{Status: &bogus}); !errors.Is(err, ErrInvalidUserStatus) {
+		t.Errorf("invalid status: %v", err)
+	}
+	locked := UserStatusLocked
+	u, err := repo.Update(ctx, alice.ID, UserUpdate{Status: &locked})
+	if err != nil || u.Status != UserStatusLocked || u.Role != "user" {
+		t.Fatalf("Update = %+v, %v", u, err)
+	}
+	if _, err := repo.Update(ctx, -1, UserUpdate{Status: &locked}); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("unknown user: %v", err)
+	}
+
+	if err := repo.SetPassword(ctx, alice.ID, "new-hash", true); err != nil {
+		t.Fatalf("SetPassword: %v", err)
+	}
+	got, err := repo.GetByID(ctx, alice.ID)
+	if err != nil || got.PasswordHash != "new-hash" || !got.PasswordResetRequired {
+		t.Errorf("after SetPassword: %+v, %v", got, err)
+	}
+
+	// Users sharing a project they alone own are kept
+	shared, err := NewProjectRepository(svc).Create(as(alice), "shared")
+	if err != nil {
+		t.Fatalf("create project: %v", err)
+	}
+	if err := repo.Delete(ctx, alice.ID); !errors.Is(err, ErrLastOwner) {
+		t.Errorf("Delete of last owner: %v", err)
+	}
+	svc.ExecContext(ctx, `DELETE FROM projects WHERE id = $1`, shared.ID)
+	if err := repo.Delete(ctx, alice.ID); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if u, _ := repo.GetByID(ctx, alice.ID); u != nil {
+		t.Error("user still exists")
+	}
+}
@@ -0,0 +1,409 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"aexon/internal/types"
+
+	"github.com/lib/pq"
+)
+
+// ============================================================================
+// WORKFLOWS
+// ============================================================================
+
+// A workflow is a job of type workflow whose steps are jobs of their own
+// (parent_id), run once every step they depend on has completed. Workers
+// never run the workflow itself: AdvanceWorkflow derives its status from
+// its steps as they start and end.
+//
+// When a step fails for good or is canceled, the workflow ends with it:
+// steps not yet finished are canceled, and the rollbacks of completed steps
+// are queued as further steps ("rollback:<step>"), each waiting for the
+// previous one, in the reverse order the steps completed.
+
+// rollbackPrefix starts the step name of rollbacks. Step names cannot
+// contain ":", so rollbacks never clash with the steps they undo.
+const rollbackPrefix = "rollback:"
+
+// JobAction is a job to run, e.g. to roll back a workflow step.
+type JobAction struct {
+	Type    types.JobType `json:"type"`
+	Target  string        `json:"target"`
+	Payload string        `json:"payload"`
+}
+
+// WorkflowStep describes a step of a workflow to create.
+type WorkflowStep struct {
+	Name        string        `json:"name"`
+	Type        types.JobType `json:"type"`
+	Target      string        `json:"target"`
+	Payload     string        `json:"payload"`
+	DependsOn   []string      `json:"depends_on,omitempty"`   // Names of earlier steps
+	MaxAttempts int           `json:"max_attempts,omitempty"` // 0: types.MaxRetries
+	RetryDelay  int           `json:"retry_delay,omitempty"`  // Seconds; 0: types.BaseDelay
+	Rollback    *JobAction    `json:"rollback,omitempty"`     // Undoes the step
+}
+
+var workflowStepName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// ValidateWorkflow checks that step names are unique and that dependencies
+// name other steps without forming a cycle.
+func ValidateWorkflow(steps []WorkflowStep) error {
+	if len(steps) == 0 {
+		return errors.New("workflow has no steps")
+	}
+	index := make(map[string]int, len(steps))
+	for i, s := range steps {
+		if !workflowStepName.MatchString(s.Name) {
+			return fmt.Errorf("invalid step name %q", s.Name)
+		}
+		if _, dup := index[s.Name]; dup {
+			return fmt.Errorf("duplicate step %q", s.Name)
+		}
+		if s.Type == "" || s.Type == types.JobTypeWorkflow {
+			return fmt.Errorf("step %q: invalid type %q", s.Name, s.Type)
+		}
+		if s.MaxAttempts < 0 || s.RetryDelay < 0 {
+			return fmt.Errorf("step %q: retry policy cannot be negative", s.Name)
+		}
+		if s.Rollback != nil && (s.Rollback.Type == "" || s.Rollback.Type == types.JobTypeWorkflow) {
+			return fmt.Errorf("step %q: invalid rollback type %q", s.Name, s.Rollback.Type)
+		}
+		index[s.Name] = i
+	}
+	for _, s := range steps {
+		for _, d := range s.DependsOn {
+			if _, ok := index[d]; !ok || d == s.Name {
+				return fmt.Errorf("step %q: invalid dependency %q", s.Name, d)
+			}
+		}
+	}
+
+	// Depth-first search; reaching a step still on the path closes a cycle
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make([]int, len(steps))
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case visiting:
+			return fmt.Errorf("dependency cycle through step %q", steps[i].Name)
+		case done:
+			return nil
+		}
+		state[i] = visiting
+		for _, d := range steps[i].DependsOn {
+			if err := visit(index[d]); err != nil {
+				return err
+			}
+		}
+		state[i] = done
+		return nil
+	}
+	for i := range steps {
+		if err := visit(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateWorkflow queues wf as a workflow of the given steps, for the
+// caller's scope. Step jobs are named "<workflow id>.<step name>".
+func (r *JobRepository) CreateWorkflow(ctx context.Context, wf *Job, steps []WorkflowStep) error {
+	if err := ValidateWorkflow(steps); err != nil {
+		return err
+	}
+	wf.Type = types.JobTypeWorkflow
+	if wf.Payload == "" {
+		wf.Payload = "{}"
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	owner, project := ownerFor(ctx, nil), projectFor(ctx, nil)
+	if err := insertJob(ctx, tx, wf, owner, project); err != nil {
+		return err
+	}
+
+	wf.Steps = make([]Job, 0, len(steps))
+	for _, s := range steps {
+		step := Job{
+			ID: wf.ID + "." + s.Name, Type: s.Type, Target: s.Target, Payload: s.Payload,
+			RequestedBy: wf.RequestedBy, RunAfter: wf.RunAfter, ParentID: &wf.ID, Step: s.Name,
+			MaxAttempts: s.MaxAttempts, RetryDelay: s.RetryDelay, Rollback: s.Rollback,
+		}
+		for _, d := range s.DependsOn {
+			step.DependsOn = append(step.DependsOn, wf.ID+"."+d)
+		}
+		if err := insertJob(ctx, tx, &step, owner, project); err != nil {
+			return err
+		}
+		wf.Steps = append(wf.Steps, step)
+	}
+	for _, step := range wf.Steps {
+		if err := addDependencies(ctx, tx, step.ID, step.DependsOn); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func addDependencies(ctx context.Context, tx *Tx, jobID string, dependsOn []string) error {
+	for _, d := range dependsOn {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO job_dependencies (job_id, depends_on) VALUES ($1, $2)
+		`, jobID, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Steps returns the steps of a workflow, rollbacks included, in the order
+// they were queued.
+func (r *JobRepository) Steps(ctx context.Context, workflowID string) ([]Job, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT `+jobColumns+`
+		FROM jobs
+		WHERE parent_id = $1
+		ORDER BY created_at, id
+	`, workflowID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	steps := []Job{}
+	ids := []string{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, *job)
+		ids = append(ids, job.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	deps, err := r.dependencies(ctx, ids...)
+	if err != nil {
+		return nil, err
+	}
+	for i := range steps {
+		steps[i].DependsOn = deps[steps[i].ID]
+	}
+	return steps, nil
+}
+
+// dependencies maps each of the given jobs to the jobs it waits for.
+func (r *JobRepository) dependencies(ctx context.Context, ids ...string) (map[string][]string, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT job_id, depends_on FROM job_dependencies
+		WHERE job_id = ANY($1)
+		ORDER BY job_id, depends_on
+	`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deps := make(map[string][]string)
+	for rows.Next() {
+		var id, dep string
+		if err := rows.Scan(&id, &dep); err != nil {
+			return nil, err
+		}
+		deps[id] = append(deps[id], dep)
+	}
+	return deps, rows.Err()
+}
+
+// AdvanceWorkflow brings a workflow up to date after one of its steps
+// started or ended, and returns it with its steps. Steps that became
+// runnable are requeued so that idle workers, in any process, wake up.
+func (r *JobRepository) AdvanceWorkflow(ctx context.Context, workflowID string) (*Job, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var status types.JobStatus
+	if err := tx.QueryRowContext(ctx, `
+		SELECT status FROM jobs WHERE id = $1 AND type = $2 FOR UPDATE
+	`, workflowID, types.JobTypeWorkflow).Scan(&status); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("workflow not found: %s: %w", workflowID, err)
+		}
+		return nil, err
+	}
+
+	if status == types.JobPending || status == types.JobInProgress {
+		rows, err := tx.QueryContext(ctx, `
+			SELECT step, status, COALESCE(error, '') FROM jobs
+			WHERE parent_id = $1 AND step NOT LIKE $2
+			ORDER BY finished_at NULLS LAST
+		`, workflowID, rollbackPrefix+"%")
+		if err != nil {
+			return nil, err
+		}
+		total, completed, started := 0, 0, 0
+		var failed, failedErr string
+		var failedStatus types.JobStatus
+		for rows.Next() {
+			var step, errMsg string
+			var s types.JobStatus
+			if err := rows.Scan(&step, &s, &errMsg); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			total++
+			switch s {
+			case types.JobCompleted:
+				completed++
+				started++
+			case types.JobInProgress:
+				started++
+			case types.JobFailed, types.JobCanceled:
+				if failed == "" {
+					failed, failedStatus, failedErr = step, s, errMsg
+				}
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+
+		now := time.Now().UTC()
+		switch {
+		case failed != "":
+			end := types.JobFailed
+			if failedStatus == types.JobCanceled {
+				end = types.JobCanceled
+			}
+			reason := fmt.Sprintf("step %s %s: %s", failed, failedStatus, failedErr)
+			if _, err := tx.ExecContext(ctx, `
+				UPDATE jobs SET status = $2, error = $3, finished_at = $4 WHERE id = $1
+			`, workflowID, end, reason, now); err != nil {
+				return nil, err
+			}
+			if err := endWorkflow(ctx, tx, workflowID, reason); err != nil {
+				return nil, err
+			}
+		case completed == total:
+			if _, err := tx.ExecContext(ctx, `
+				UPDATE jobs SET status = $2, error = NULL, finished_at = $3 WHERE id = $1
+			`, workflowID, types.JobCompleted, now); err != nil {
+				return nil, err
+			}
+		case started > 0 && status == types.JobPending:
+			if _, err := tx.ExecContext(ctx, `
+				UPDATE jobs SET status = $2, started_at = $3 WHERE id = $1
+			`, workflowID, types.JobInProgress, now); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// A rollback that did not complete stops the ones after it
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE jobs j SET status = $2, error = 'dependency did not complete', finished_at = $4
+		WHERE j.parent_id = $1 AND j.status = $3 AND EXISTS (
+			SELECT 1 FROM job_dependencies d JOIN jobs dep ON dep.id = d.depends_on
+			WHERE d.job_id = j.id AND dep.status IN ($2, $5)
+		)
+	`, workflowID, types.JobCanceled, types.JobPending, time.Now().UTC(), types.JobFailed); err != nil {
+		return nil, err
+	}
+	// Touching run_after NOTIFYs JobsChannel (migration 30)
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE jobs SET run_after = run_after WHERE parent_id = $1 AND status = $2
+	`, workflowID, types.JobPending); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return r.Get(ctx, workflowID)
+}
+
+// endWorkflow cancels the unfinished steps of a workflow that failed or
+// was canceled, and queues the rollbacks of its completed steps.
+func endWorkflow(ctx context.Context, tx *Tx, workflowID, reason string) error {
+	now := time.Now().UTC()
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE jobs SET status = $2, error = $3, finished_at = $4
+		WHERE parent_id = $1 AND status IN ($5, $6) AND step NOT LIKE $7
+	`, workflowID, types.JobCanceled, "workflow ended: "+reason, now,
+		types.JobPending, types.JobInProgress, rollbackPrefix+"%"); err != nil {
+		return err
+	}
+
+	var owner, project sql.NullInt64
+	var requestedBy sql.NullString
+	if err := tx.QueryRowContext(ctx, `
+		SELECT owner_id, project_id, requested_by FROM jobs WHERE id = $1
+	`, workflowID).Scan(&owner, &project, &requestedBy); err != nil {
+		return err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT `+jobColumns+` FROM jobs
+		WHERE parent_id = $1 AND status = $2 AND rollback IS NOT NULL AND step NOT LIKE $3
+		ORDER BY finished_at DESC
+	`, workflowID, types.JobCompleted, rollbackPrefix+"%")
+	if err != nil {
+		return err
+	}
+	var undo []Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		undo = append(undo, *job)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var previous string
+	for _, step := range undo {
+		rollback := Job{
+			ID: step.ID + ".rollback", Type: step.Rollback.Type, Target: step.Rollback.Target,
+			Payload: step.Rollback.Payload, ParentID: &workflowID, Step: rollbackPrefix + step.Step,
+		}
+		if requestedBy.Valid {
+			rollback.RequestedBy = &requestedBy.String
+		}
+		if err := insertJob(ctx, tx, &rollback, nullIntPtr(owner), nullIntPtr(project)); err != nil {
+			return err
+		}
+		if previous != "" {
+			if err := addDependencies(ctx, tx, rollback.ID, []string{previous}); err != nil {
+				return err
+			}
+		}
+		previous = rollback.ID
+	}
+	return nil
+}
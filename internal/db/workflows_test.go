@@ -0,0 +1,102 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"aexon/internal/types"
+)
+
+func TestValidateWorkflow(t *testing.T) {
+	step := func(name string, deps ...string) WorkflowStep {
+		return WorkflowStep{Name: name, Type: types.JobTypeStateChange, DependsOn: deps}
+	}
+	tests := []struct {
+		name  string
+		steps []WorkflowStep
+		err   string
+	}{
+		{"chain", []WorkflowStep{step("stop"), step("snapshot", "stop"), step("resize", "snapshot"), step("start", "resize")}, ""},
+		{"diamond", []WorkflowStep{step("a"), step("b", "a"), step("c", "a"), step("d", "b", "c")}, ""},
+		{"empty", nil, "no steps"},
+		{"bad name", []WorkflowStep{step("Stop:now")}, "invalid step name"},
+		{"duplicate", []WorkflowStep{step("a"), step("a")}, "duplicate"},
+		{"unknown dependency", []WorkflowStep{step("a", "b")}, "invalid dependency"},
+		{"self", []WorkflowStep{step("a", "a")}, "invalid dependency"},
+		{"cycle", []WorkflowStep{step("a", "c"), step("b", "a"), step("c", "b")}, "cycle"},
+		{"nested workflow", []WorkflowStep{{Name: "a", Type: types.JobTypeWorkflow}}, "invalid type"},
+		{"negative retries", []WorkflowStep{{Name: "a", Type: types.JobTypeStateChange, MaxAttempts: -1}}, "retry policy"},
+	}
+	for _, tt := range tests {
+		err := ValidateWorkflow(tt.steps)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: ValidateWorkflow() = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestWorkflowLifecycle(t *testing.T) {
+	svc := testService(t)
+	repo := NewJobRepository(svc)
+	ctx := context.Background()
+
+	// Ready before anything else left in the table, so its steps are claimed first
+	wf := &Job{ID: fmt.Sprintf("wf-%d", time.Now().UnixNano()), Target: "vm", RunAfter: time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)}
+	undo := &JobAction{Type: types.JobTypeStateChange, Target: "vm", Payload: `{"action":"start"}`}
+	err := repo.CreateWorkflow(ctx, wf, []WorkflowStep{
+		{Name: "stop", Type: types.JobTypeStateChange, Target: "vm", Payload: `{"action":"stop"}`, Rollback: undo},
+		{Name: "snapshot", Type: types.JobTypeCreateSnapshot, Target: "vm", Payload: "{}", DependsOn: []string{"stop"}, MaxAttempts: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { svc.ExecContext(ctx, `DELETE FROM jobs WHERE id = $1`, wf.ID) })
+
+	claim := func(want string) *Job {
+		t.Helper()
+		got, err := repo.Claim(ctx, JobLimits{})
+		if err != nil || got == nil || got.ID != want {
+			t.Fatalf("Claim() = %+v, %v; want %s", got, err, want)
+		}
+		if _, err := repo.AdvanceWorkflow(ctx, wf.ID); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	// The snapshot waits for the stop; the workflow itself never runs
+	stop := claim(wf.ID + ".stop")
+	if got, _ := repo.Claim(ctx, JobLimits{}); got != nil && strings.HasPrefix(got.ID, wf.ID) {
+		t.Fatalf("claimed %s before its dependency completed", got.ID)
+	}
+	if err := repo.MarkCompleted(ctx, stop.ID, stop.AttemptCount); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.AdvanceWorkflow(ctx, wf.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := claim(wf.ID + ".snapshot")
+	if snapshot.MaxAttempts != 1 || len(snapshot.DependsOn) != 1 || snapshot.DependsOn[0] != stop.ID {
+		t.Errorf("snapshot step = %+v", snapshot)
+	}
+	if err := repo.MarkFailed(ctx, snapshot.ID, snapshot.AttemptCount, "disk full", true); err != nil {
+		t.Fatal(err)
+	}
+	got, err := repo.AdvanceWorkflow(ctx, wf.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The failure ends the workflow and queues the stop's rollback
+	if got.Status != types.JobFailed || got.Error == nil || !strings.Contains(*got.Error, "snapshot") || len(got.Steps) != 3 {
+		t.Fatalf("failed workflow = %+v", got)
+	}
+	rollback := got.Steps[2]
+	if rollback.Step != "rollback:stop" || rollback.Type != undo.Type || rollback.Payload != undo.Payload || rollback.Status != types.JobPending {
+		t.Errorf("rollback step = %+v", rollback)
+	}
+}
@@ -6,6 +6,16 @@ type EventType string
 const (
 	JobUpdate   EventType = "job_update"
 	StateChange EventType = "state_change"
+	// JobCanceled é emitido quando um job pendente ou em execução é cancelado.
+	JobCanceled EventType = "job_canceled"
+	// WorkflowProgress é emitido quando um passo de um workflow começa ou termina.
+	WorkflowProgress EventType = "workflow_progress"
+	// JobProgress é emitido quando um job em execução avança de etapa.
+	JobProgress EventType = "job_progress"
+	// JobLog é emitido a cada linha de log de um job (ver db.JobLog).
+	JobLog EventType = "job_log"
+	// TrafficQuota é emitido quando uma instância atinge a cota mensal de tráfego.
+	TrafficQuota EventType = "traffic_quota"
 )
 
 // Event representa uma mensagem no barramento de eventos.
@@ -15,6 +25,9 @@ type Event struct {
 	Target    string      `json:"target,omitempty"`
 	Payload   interface{} `json:"payload"`
 	Timestamp int64       `json:"timestamp"`
+	// ProjectID é o projeto dono do job ou da instância do evento; só os
+	// clientes desse projeto (e os admins) o recebem. nil = só admins.
+	ProjectID *int `json:"-"`
 }
 
 // GlobalBus é o canal onde todos os eventos são publicados.
@@ -0,0 +1,187 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"aexon/internal/db"
+	"aexon/internal/events"
+	"aexon/internal/provider/axhv/pb"
+)
+
+// DefaultTrafficInterval is how often the traffic collector samples counters.
+const DefaultTrafficInterval = time.Minute
+
+// Hypervisor is the subset of the AxHV client used by the traffic collector.
+type Hypervisor interface {
+	GetVmStats(ctx context.Context, id string) (*pb.VmStatsResponse, error)
+	StopVm(ctx context.Context, id string) (*pb.VmResponse, error)
+}
+
+// Throttler reapplies the bandwidth caps of throttled instances.
+type Throttler interface {
+	SyncThrottles(ctx context.Context) error
+}
+
+// TrafficCollector turns the cumulative TAP counters reported by AxHV into
+// a per-period ledger and enforces monthly traffic quotas.
+type TrafficCollector struct {
+	hv        Hypervisor
+	throttler Throttler
+	repo      *db.TrafficRepository
+	interval  time.Duration
+}
+
+func NewTrafficCollector(hv Hypervisor, throttler Throttler, interval time.Duration) *TrafficCollector {
+	if interval <= 0 {
+		interval = DefaultTrafficInterval
+	}
+	return &TrafficCollector{
+		hv:        hv,
+		throttler: throttler,
+		repo:      db.NewTrafficRepository(db.GetService()),
+		interval:  interval,
+	}
+}
+
+// CounterDelta returns the bytes transferred between two samples of a
+// cumulative counter. A counter lower than the previous one means the VM
+// (and its TAP) was recreated, so everything counted since is new traffic.
+func CounterDelta(prev, cur uint64) uint64 {
+	if cur >= prev {
+		return cur - prev
+	}
+	return cur
+}
+
+// QuotaExceeded reports whether the quota action must fire for period:
+// usage reached the limit and the action has not run in this period yet.
+func QuotaExceeded(q db.TrafficQuota, used uint64, period time.Time) bool {
+	if used < q.MonthlyBytes {
+		return false
+	}
+	return q.TriggeredPeriod == nil || !q.TriggeredPeriod.Equal(period)
+}
+
+// Run samples every interval until ctx is cancelled.
+func (c *TrafficCollector) Run(ctx context.Context) {
+	log.Printf("[Traffic] Starting traffic collector (every %s)", c.interval)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("[Traffic] Collector stopped")
+			return
+		case <-ticker.C:
+			c.Collect(ctx)
+		}
+	}
+}
+
+// Collect takes one sample of every known instance, then evaluates quotas.
+func (c *TrafficCollector) Collect(ctx context.Context) {
+	instances, err := db.NewInstanceRepository(db.GetService()).List(ctx)
+	if err != nil {
+		log.Printf("[Traffic] ERROR: Failed to list instances: %v", err)
+		return
+	}
+
+	period := db.TrafficPeriod(time.Now())
+	for _, inst := range instances {
+		if err := c.sample(ctx, inst.Name, period); err != nil {
+			log.Printf("[Traffic] ERROR: Failed to record traffic of %s: %v", inst.Name, err)
+		}
+	}
+
+	if err := c.enforce(ctx, period); err != nil {
+		log.Printf("[Traffic] ERROR: Quota enforcement failed: %v", err)
+	}
+}
+
+func (c *TrafficCollector) sample(ctx context.Context, name string, period time.Time) error {
+	stats, err := c.hv.GetVmStats(ctx, name)
+	if err != nil {
+		return nil // Stopped VMs have no TAP; the next start resets counters anyway
+	}
+
+	prev, err := c.repo.GetCounter(ctx, name)
+	if err != nil {
+		return err
+	}
+	cur := db.TrafficCounter{RxBytes: stats.NetRxBytes, TxBytes: stats.NetTxBytes, SampledAt: time.Now()}
+
+	// The first sample only establishes the baseline.
+	var rx, tx uint64
+	if prev != nil {
+		rx = CounterDelta(prev.RxBytes, cur.RxBytes)
+		tx = CounterDelta(prev.TxBytes, cur.TxBytes)
+	}
+	return c.repo.RecordSample(ctx, name, period, cur, rx, tx)
+}
+
+func (c *TrafficCollector) enforce(ctx context.Context, period time.Time) error {
+	quotas, err := c.repo.ListQuotas(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, q := range quotas {
+		usage, err := c.repo.GetUsage(ctx, q.InstanceName, period)
+		if err != nil {
+			return err
+		}
+		if !QuotaExceeded(q, usage.Total(), period) {
+			continue
+		}
+
+		log.Printf("[Traffic] %s reached its monthly quota (%d/%d bytes), action: %s",
+			q.InstanceName, usage.Total(), q.MonthlyBytes, q.Action)
+		if err := c.act(ctx, q); err != nil {
+			log.Printf("[Traffic] ERROR: Quota action on %s failed: %v", q.InstanceName, err)
+			continue // Retried on the next pass
+		}
+		if err := c.repo.MarkQuotaTriggered(ctx, q.InstanceName, period); err != nil {
+			return err
+		}
+		// The event goes to the instance's project; without it, to admins only
+		var project *int
+		if inst, err := db.NewInstanceRepository(db.GetService()).Get(ctx, q.InstanceName); err == nil {
+			project = inst.ProjectID
+		}
+		events.Publish(events.Event{
+			Type:   events.TrafficQuota,
+			Target: q.InstanceName,
+			Payload: map[string]interface{}{
+				"action":        q.Action,
+				"period_start":  period.Format("2006-01"),
+				"used_bytes":    usage.Total(),
+				"monthly_bytes": q.MonthlyBytes,
+			},
+			Timestamp: time.Now().Unix(),
+			ProjectID: project,
+		})
+	}
+
+	// Reapplied every pass so caps lapse when the period rolls over.
+	if c.throttler != nil {
+		return c.throttler.SyncThrottles(ctx)
+	}
+	return nil
+}
+
+func (c *TrafficCollector) act(ctx context.Context, q db.TrafficQuota) error {
+	switch q.Action {
+	case "stop":
+		if _, err := c.hv.StopVm(ctx, q.InstanceName); err != nil {
+			return fmt.Errorf("stop: %w", err)
+		}
+	case "throttle", "notify":
+		// Throttles are applied by SyncThrottles once the quota is marked;
+		// notify only publishes the event.
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+
+	"aexon/internal/db"
+)
+
+func TestCounterDelta(t *testing.T) {
+	cases := []struct {
+		prev, cur, want uint64
+	}{
+		{100, 150, 50},
+		{100, 100, 0},
+		{5000, 120, 120}, // VM restarted, counters reset
+		{0, 42, 42},
+	}
+	for _, tc := range cases {
+		if got := CounterDelta(tc.prev, tc.cur); got != tc.want {
+			t.Errorf("CounterDelta(%d, %d) = %d, want %d", tc.prev, tc.cur, got, tc.want)
+		}
+	}
+}
+
+func TestTrafficPeriod(t *testing.T) {
+	got := db.TrafficPeriod(time.Date(2024, 3, 31, 23, 30, 0, 0, time.FixedZone("BRT", -3*3600)))
+	want := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	if !got.Equal(want) {
+		t.Errorf("TrafficPeriod = %s, want %s (periods are UTC)", got, want)
+	}
+}
+
+func TestQuotaExceeded(t *testing.T) {
+	period := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	previous := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	q := db.TrafficQuota{MonthlyBytes: 1000, Action: "notify"}
+
+	if QuotaExceeded(q, 999, period) {
+		t.Error("usage below the quota must not fire")
+	}
+	if !QuotaExceeded(q, 1000, period) {
+		t.Error("usage at the quota must fire")
+	}
+
+	q.TriggeredPeriod = &period
+	if QuotaExceeded(q, 5000, period) {
+		t.Error("action must fire only once per period")
+	}
+
+	q.TriggeredPeriod = &previous
+	if !QuotaExceeded(q, 5000, period) {
+		t.Error("a new period must re-arm the quota")
+	}
+}
+
+func TestUsageState(t *testing.T) {
+	if UsageState(true) != db.UsageRunning || UsageState(false) != db.UsageStopped {
+		t.Error("UsageState does not map AxHV's view to the metered state")
+	}
+}
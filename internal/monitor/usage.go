@@ -0,0 +1,94 @@
+package monitor
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"aexon/internal/db"
+	"aexon/internal/provider/axhv/pb"
+)
+
+// DefaultUsageInterval is how often the usage meter observes instances.
+const DefaultUsageInterval = time.Minute
+
+// VmLister is the subset of the AxHV client used by the usage meter.
+type VmLister interface {
+	ListVms(ctx context.Context) (*pb.ListVmsResponse, error)
+}
+
+// UsageMeter records the state and size of every instance into usage
+// intervals. Handlers report the transitions they cause right away; the
+// meter catches the rest (crashes, quota stops, deletions while down).
+type UsageMeter struct {
+	hv       VmLister
+	repo     *db.UsageRepository
+	interval time.Duration
+}
+
+func NewUsageMeter(hv VmLister, interval time.Duration) *UsageMeter {
+	if interval <= 0 {
+		interval = DefaultUsageInterval
+	}
+	return &UsageMeter{
+		hv:       hv,
+		repo:     db.NewUsageRepository(db.GetService()),
+		interval: interval,
+	}
+}
+
+// Run observes every interval until ctx is cancelled.
+func (m *UsageMeter) Run(ctx context.Context) {
+	log.Printf("[Usage] Starting usage meter (every %s)", m.interval)
+	m.Collect(ctx)
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("[Usage] Meter stopped")
+			return
+		case <-ticker.C:
+			m.Collect(ctx)
+		}
+	}
+}
+
+// Collect observes the state of every known instance. Nothing is recorded
+// when AxHV cannot be reached, rather than metering everything as stopped.
+func (m *UsageMeter) Collect(ctx context.Context) {
+	vms, err := m.hv.ListVms(ctx)
+	if err != nil {
+		log.Printf("[Usage] ERROR: Failed to list VMs: %v", err)
+		return
+	}
+	running := make(map[string]bool, len(vms.Vms))
+	for _, vm := range vms.Vms {
+		running[vm.Id] = true
+	}
+
+	instances, err := db.NewInstanceRepository(db.GetService()).List(ctx)
+	if err != nil {
+		log.Printf("[Usage] ERROR: Failed to list instances: %v", err)
+		return
+	}
+	now := time.Now()
+	for i := range instances {
+		if err := m.repo.Observe(ctx, &instances[i], UsageState(running[instances[i].Name]), now); err != nil {
+			log.Printf("[Usage] ERROR: Failed to record usage of %s: %v", instances[i].Name, err)
+		}
+	}
+	if err := m.repo.CloseMissing(ctx, now); err != nil {
+		log.Printf("[Usage] ERROR: Failed to close usage of deleted instances: %v", err)
+	}
+}
+
+// UsageState is the metered state of an instance AxHV does or does not
+// report as running.
+func UsageState(running bool) string {
+	if running {
+		return db.UsageRunning
+	}
+	return db.UsageStopped
+}
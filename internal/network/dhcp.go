@@ -0,0 +1,122 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/server4"
+)
+
+// LeaseTime is short enough that a changed reservation propagates quickly
+// and long enough not to flood the server.
+const LeaseTime = 1 * time.Hour
+
+type dhcpListener struct {
+	gateway net.IP
+	server  *server4.Server
+}
+
+func (l *dhcpListener) Close() {
+	l.server.Close()
+}
+
+func (g *GuestServices) startDHCP(bridge string, gateway net.IP) (*dhcpListener, error) {
+	addr := &net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ServerPort}
+	srv, err := server4.NewServer(bridge, addr, g.dhcpHandler(bridge))
+	if err != nil {
+		return nil, err
+	}
+	go srv.Serve()
+	log.Printf("[Network] DHCP serving on %s", bridge)
+	return &dhcpListener{gateway: gateway, server: srv}, nil
+}
+
+func (g *GuestServices) dhcpHandler(bridge string) server4.Handler {
+	return func(conn net.PacketConn, peer net.Addr, req *dhcpv4.DHCPv4) {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		reply, err := g.DHCPReply(ctx, bridge, req)
+		if err != nil {
+			log.Printf("[Network] DHCP %s on %s: %v", req.ClientHWAddr, bridge, err)
+			return
+		}
+		if reply == nil {
+			return
+		}
+		if _, err := conn.WriteTo(reply.ToBytes(), peer); err != nil {
+			log.Printf("[Network] DHCP reply to %s failed: %v", req.ClientHWAddr, err)
+		}
+	}
+}
+
+// DHCPReply answers a client on a bridge with its IPAM reservation. The
+// client is identified by the bridge port its MAC was learned on, never by
+// what it claims, so a guest cannot obtain another instance's address.
+// A nil reply means the message needs no answer.
+func (g *GuestServices) DHCPReply(ctx context.Context, bridge string, req *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, error) {
+	if req.OpCode != dhcpv4.OpcodeBootRequest {
+		return nil, nil
+	}
+
+	var replyType dhcpv4.MessageType
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeDiscover:
+		replyType = dhcpv4.MessageTypeOffer
+	case dhcpv4.MessageTypeRequest:
+		replyType = dhcpv4.MessageTypeAck
+	default:
+		return nil, nil // Release/Decline/Inform: reservations are static
+	}
+
+	port, err := g.driver.LookupPort(ctx, bridge, req.ClientHWAddr)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(port, TapPrefix) {
+		return nil, fmt.Errorf("port %s is not an instance TAP", port)
+	}
+	instance := strings.TrimPrefix(port, TapPrefix)
+
+	lease, ok := g.leaseFor(instance)
+	if !ok || BridgeName(lease.Network.ID) != bridge {
+		return nil, fmt.Errorf("no reservation for %s on %s", instance, bridge)
+	}
+
+	_, ipNet, err := net.ParseCIDR(lease.Network.CIDR)
+	if err != nil {
+		return nil, err
+	}
+	gw := net.ParseIP(lease.Network.Gateway).To4()
+
+	if replyType == dhcpv4.MessageTypeAck {
+		requested := req.RequestedIPAddress()
+		if requested == nil || requested.IsUnspecified() {
+			requested = req.ClientIPAddr
+		}
+		if requested != nil && !requested.IsUnspecified() && !requested.Equal(lease.IP) {
+			return dhcpv4.NewReplyFromRequest(req,
+				dhcpv4.WithMessageType(dhcpv4.MessageTypeNak),
+				dhcpv4.WithOption(dhcpv4.OptServerIdentifier(gw)),
+			)
+		}
+	}
+
+	return dhcpv4.NewReplyFromRequest(req,
+		dhcpv4.WithMessageType(replyType),
+		dhcpv4.WithYourIP(lease.IP),
+		dhcpv4.WithServerIP(gw),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(gw)),
+		dhcpv4.WithNetmask(ipNet.Mask),
+		dhcpv4.WithRouter(gw),
+		dhcpv4.WithDNS(gw),
+		dhcpv4.WithOption(dhcpv4.OptDomainName(DomainFor(lease.Network))),
+		dhcpv4.WithOption(dhcpv4.OptHostName(lease.Instance)),
+		dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(LeaseTime)),
+	)
+}
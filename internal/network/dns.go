@@ -0,0 +1,140 @@
+package network
+
+import (
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultUpstream is used when the client's network has no dns1.
+const DefaultUpstream = "1.1.1.1"
+
+// recordTTL is kept low: records move whenever an instance is recreated.
+const recordTTL = 30
+
+type dnsListener struct {
+	gateway net.IP
+	udp     *dns.Server
+	tcp     *dns.Server
+}
+
+func (l *dnsListener) Close() {
+	l.udp.Shutdown()
+	l.tcp.Shutdown()
+}
+
+// startDNS binds the resolver on the bridge gateway address. Binding
+// synchronously surfaces "address in use" before the server is recorded.
+func (g *GuestServices) startDNS(gateway net.IP) (*dnsListener, error) {
+	addr := net.JoinHostPort(gateway.String(), "53")
+
+	pc, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp4", addr)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+
+	l := &dnsListener{
+		gateway: gateway,
+		udp:     &dns.Server{PacketConn: pc, Handler: g},
+		tcp:     &dns.Server{Listener: ln, Handler: g},
+	}
+	go l.udp.ActivateAndServe()
+	go l.tcp.ActivateAndServe()
+	log.Printf("[Network] DNS serving on %s", addr)
+	return l, nil
+}
+
+// ServeDNS answers the axion zone from the lease snapshot and forwards
+// everything else to the dns1 of the client's network.
+func (g *GuestServices) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if len(req.Question) != 1 {
+		resp := new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeFormatError)
+		w.WriteMsg(resp)
+		return
+	}
+
+	q := req.Question[0]
+	if dns.IsSubDomain(DomainSuffix+".", strings.ToLower(q.Name)) {
+		w.WriteMsg(g.Resolve(req))
+		return
+	}
+
+	var clientIP net.IP
+	if addr, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		clientIP = addr.IP
+	} else if addr, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		clientIP = addr.IP
+	}
+	upstream := net.JoinHostPort(g.UpstreamFor(clientIP), "53")
+
+	network := "udp"
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		network = "tcp"
+	}
+	client := &dns.Client{Net: network, Timeout: 3 * time.Second}
+	resp, _, err := client.Exchange(req, upstream)
+	if err != nil {
+		log.Printf("[Network] DNS forward of %s to %s failed: %v", q.Name, upstream, err)
+		resp = new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeServerFailure)
+	}
+	w.WriteMsg(resp)
+}
+
+// Resolve builds an authoritative answer for a name inside the axion zone.
+func (g *GuestServices) Resolve(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	name := strings.ToLower(dns.Fqdn(q.Name))
+
+	g.mu.RLock()
+	ip, ok := g.records[name]
+	g.mu.RUnlock()
+
+	resp := new(dns.Msg)
+	if !ok {
+		resp.SetRcode(req, dns.RcodeNameError)
+		resp.Authoritative = true
+		return resp
+	}
+
+	resp.SetReply(req)
+	resp.Authoritative = true
+	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY {
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: recordTTL},
+			A:   ip,
+		})
+	}
+	// Other types on an existing name: NOERROR with no data.
+	return resp
+}
+
+// UpstreamFor picks the forwarder of the network containing the client.
+func (g *GuestServices) UpstreamFor(clientIP net.IP) string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	if clientIP != nil {
+		for _, n := range g.networks {
+			_, ipNet, err := net.ParseCIDR(n.CIDR)
+			if err != nil || !ipNet.Contains(clientIP) {
+				continue
+			}
+			// dns1 pointing at our own gateway would forward in a loop
+			if net.ParseIP(n.DNS1) != nil && n.DNS1 != n.Gateway {
+				return n.DNS1
+			}
+			break
+		}
+	}
+	return DefaultUpstream
+}
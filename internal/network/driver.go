@@ -0,0 +1,125 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+// ============================================================================
+// HOST NETWORK DRIVER
+// ============================================================================
+
+const (
+	// BridgePrefix marks every bridge managed by Axion so reconciliation can
+	// tell our links apart from anything else living on the host.
+	BridgePrefix = "axbr-"
+	// VlanPrefix is used for the 802.1Q sub-interfaces enslaved to a bridge.
+	VlanPrefix = "axvl-"
+	// TapPrefix is the AxHV naming scheme for instance TAP devices.
+	TapPrefix = "axhv-"
+
+	// NativeCIDR is the pool served by AxHV's own axhv-br0. The daemon owns
+	// that bridge and its NAT, so the driver never touches it.
+	NativeCIDR = "172.16.0.0/24"
+)
+
+// BridgeSpec describes the host-side materialisation of one network.
+type BridgeSpec struct {
+	Name    string // Linux interface name (max 15 chars)
+	Address string // Gateway address in CIDR form, e.g. 10.0.0.1/24
+	VlanID  int    // 0 = untagged
+	Parent  string // Uplink used as the VLAN parent (required when VlanID > 0)
+}
+
+// MasqueradeRule NATs traffic leaving a private pool through any interface
+// other than its own bridge.
+type MasqueradeRule struct {
+	Bridge string
+	Subnet string
+}
+
+// FloatingNAT maps a public address 1:1 onto an instance's private IP.
+// The public address is bound as a /32 on Bridge so the host answers ARP.
+type FloatingNAT struct {
+	PublicIP  string
+	PrivateIP string
+	Bridge    string
+}
+
+// Throttle caps the bandwidth of an instance TAP in both directions.
+type Throttle struct {
+	Instance string
+	Tap      string
+	Mbps     int
+}
+
+// Driver applies network state to the host. Implementations must be
+// idempotent: Reconcile calls every method on each pass.
+type Driver interface {
+	EnsureBridge(ctx context.Context, spec BridgeSpec) error
+	DeleteBridge(ctx context.Context, name string) error
+	// ListBridges returns only Axion-managed bridges (BridgePrefix).
+	ListBridges(ctx context.Context) ([]string, error)
+	// AttachInterface enslaves an existing link (e.g. an AxHV TAP) to a bridge.
+	AttachInterface(ctx context.Context, ifname string, bridge string) error
+	// SyncMasquerade replaces the full set of masquerade rules.
+	SyncMasquerade(ctx context.Context, rules []MasqueradeRule) error
+	// SyncFirewall replaces the security group rules of every instance.
+	SyncFirewall(ctx context.Context, instances []InstanceFirewall) error
+	// SyncFloatingIPs replaces the full set of 1:1 NAT bindings.
+	SyncFloatingIPs(ctx context.Context, bindings []FloatingNAT) error
+	// SyncThrottles replaces the full set of bandwidth caps.
+	SyncThrottles(ctx context.Context, throttles []Throttle) error
+	// LookupPort returns the bridge port (TAP) a MAC address was learned on.
+	LookupPort(ctx context.Context, bridge string, mac net.HardwareAddr) (string, error)
+}
+
+// NewDriver builds the driver selected by AXION_NET_DRIVER:
+// "netlink" (default) touches the host, "dryrun" only logs.
+func NewDriver(kind string) (Driver, error) {
+	switch strings.ToLower(kind) {
+	case "", "netlink":
+		return NewNetlinkDriver(), nil
+	case "dryrun", "fake":
+		return NewFakeDriver(true), nil
+	default:
+		return nil, fmt.Errorf("unknown network driver: %s", kind)
+	}
+}
+
+// DefaultDriver returns the driver configured through the environment.
+func DefaultDriver() Driver {
+	drv, err := NewDriver(os.Getenv("AXION_NET_DRIVER"))
+	if err != nil {
+		log.Printf("[Network] %v, falling back to dry-run", err)
+		return NewFakeDriver(true)
+	}
+	return drv
+}
+
+// BridgeName derives a stable interface name from a network ID.
+func BridgeName(networkID string) string {
+	return BridgePrefix + shortID(networkID)
+}
+
+// vlanFor returns the VLAN sub-interface paired with a bridge.
+func vlanFor(bridge string) string {
+	return VlanPrefix + strings.TrimPrefix(bridge, BridgePrefix)
+}
+
+// TapName mirrors the TAP naming used by the AxHV daemon.
+func TapName(instanceName string) string {
+	return TapPrefix + instanceName
+}
+
+func shortID(id string) string {
+	id = strings.ReplaceAll(id, "-", "")
+	if len(id) > 8 {
+		id = id[:8]
+	}
+	return id
+}
@@ -0,0 +1,135 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+)
+
+// FakeDriver keeps host state in memory. It backs the "dryrun" mode and
+// the unit tests.
+type FakeDriver struct {
+	mu          sync.Mutex
+	verbose     bool
+	Bridges     map[string]BridgeSpec
+	Attachments map[string]string // ifname -> bridge
+	Masquerade  []MasqueradeRule
+	Firewall    []InstanceFirewall
+	FloatingIPs []FloatingNAT
+	Throttles   []Throttle
+	FDB         map[string]string // mac -> ifname
+	Calls       []string
+}
+
+func NewFakeDriver(verbose bool) *FakeDriver {
+	return &FakeDriver{
+		verbose:     verbose,
+		Bridges:     make(map[string]BridgeSpec),
+		Attachments: make(map[string]string),
+		FDB:         make(map[string]string),
+	}
+}
+
+func (d *FakeDriver) record(format string, args ...interface{}) {
+	call := fmt.Sprintf(format, args...)
+	d.Calls = append(d.Calls, call)
+	if d.verbose {
+		log.Printf("[Network] dry-run: %s", call)
+	}
+}
+
+func (d *FakeDriver) EnsureBridge(ctx context.Context, spec BridgeSpec) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if spec.VlanID > 0 && spec.Parent == "" {
+		return fmt.Errorf("bridge %s: vlan %d requires an uplink", spec.Name, spec.VlanID)
+	}
+	d.Bridges[spec.Name] = spec
+	d.record("ensure-bridge %s addr=%s vlan=%d", spec.Name, spec.Address, spec.VlanID)
+	return nil
+}
+
+func (d *FakeDriver) DeleteBridge(ctx context.Context, name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.Bridges, name)
+	for ifname, br := range d.Attachments {
+		if br == name {
+			delete(d.Attachments, ifname)
+		}
+	}
+	d.record("delete-bridge %s", name)
+	return nil
+}
+
+func (d *FakeDriver) ListBridges(ctx context.Context) ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	names := make([]string, 0, len(d.Bridges))
+	for name := range d.Bridges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (d *FakeDriver) AttachInterface(ctx context.Context, ifname string, bridge string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.Bridges[bridge]; !ok {
+		return fmt.Errorf("bridge %s: not found", bridge)
+	}
+	d.Attachments[ifname] = bridge
+	d.record("attach %s -> %s", ifname, bridge)
+	return nil
+}
+
+func (d *FakeDriver) SyncMasquerade(ctx context.Context, rules []MasqueradeRule) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Masquerade = append([]MasqueradeRule(nil), rules...)
+	d.record("sync-masquerade %d rules", len(rules))
+	return nil
+}
+
+func (d *FakeDriver) SyncFirewall(ctx context.Context, instances []InstanceFirewall) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Firewall = append([]InstanceFirewall(nil), instances...)
+	d.record("sync-firewall %d instances", len(instances))
+	return nil
+}
+
+func (d *FakeDriver) SyncFloatingIPs(ctx context.Context, bindings []FloatingNAT) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, f := range bindings {
+		if _, ok := d.Bridges[f.Bridge]; !ok {
+			return fmt.Errorf("bridge %s: not found", f.Bridge)
+		}
+	}
+	d.FloatingIPs = append([]FloatingNAT(nil), bindings...)
+	d.record("sync-floating-ips %d bindings", len(bindings))
+	return nil
+}
+
+func (d *FakeDriver) SyncThrottles(ctx context.Context, throttles []Throttle) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Throttles = append([]Throttle(nil), throttles...)
+	d.record("sync-throttles %d instances", len(throttles))
+	return nil
+}
+
+func (d *FakeDriver) LookupPort(ctx context.Context, bridge string, mac net.HardwareAddr) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ifname, ok := d.FDB[mac.String()]
+	if !ok || d.Attachments[ifname] != bridge {
+		return "", fmt.Errorf("%s not learned on %s", mac, bridge)
+	}
+	return ifname, nil
+}
@@ -0,0 +1,163 @@
+package network
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"aexon/internal/db"
+)
+
+// ============================================================================
+// SECURITY GROUP FIREWALL
+// ============================================================================
+
+// Filtering happens in the bridge family so it applies to every TAP,
+// whichever bridge (axhv-br0 or axbr-*) it is enslaved to:
+//   - traffic towards the VM leaves the bridge through the TAP
+//     (forward for VM-to-VM, output for routed/host traffic);
+//   - traffic from the VM enters the bridge through the TAP
+//     (forward for VM-to-VM, input for routed/host traffic).
+const filterTable = "axion_filter"
+
+// AnyCIDR matches every IPv4 source/destination.
+const AnyCIDR = "0.0.0.0/0"
+
+// FirewallRule is one allow entry. Anything not allowed is dropped once an
+// instance has at least one security group.
+type FirewallRule struct {
+	Direction string `json:"direction"`
+	Protocol  string `json:"protocol"`
+	PortFrom  int    `json:"port_from,omitempty"`
+	PortTo    int    `json:"port_to,omitempty"`
+	CIDR      string `json:"cidr"`
+}
+
+// InstanceFirewall is the effective rule set for one instance TAP.
+type InstanceFirewall struct {
+	Instance string
+	Tap      string
+	Ingress  []FirewallRule
+	Egress   []FirewallRule
+}
+
+// EgressRestricted reports whether outbound traffic is filtered. Groups
+// without egress rules leave outbound traffic open, as is customary.
+func (f InstanceFirewall) EgressRestricted() bool {
+	return len(f.Egress) > 0
+}
+
+// BuildFirewall merges the security group rules of one instance into its
+// effective rule set, dropping duplicates across groups.
+func BuildFirewall(instanceName string, rules []db.SecurityGroupRule) InstanceFirewall {
+	fw := InstanceFirewall{
+		Instance: instanceName,
+		Tap:      TapName(instanceName),
+		Ingress:  []FirewallRule{},
+		Egress:   []FirewallRule{},
+	}
+	seen := make(map[FirewallRule]bool)
+	for _, r := range rules {
+		rule := FirewallRule{
+			Direction: r.Direction,
+			Protocol:  r.Protocol,
+			PortFrom:  r.PortFrom,
+			PortTo:    r.PortTo,
+			CIDR:      r.CIDR,
+		}
+		if rule.CIDR == "" {
+			rule.CIDR = AnyCIDR
+		}
+		if seen[rule] {
+			continue
+		}
+		seen[rule] = true
+
+		if rule.Direction == "egress" {
+			fw.Egress = append(fw.Egress, rule)
+		} else {
+			fw.Ingress = append(fw.Ingress, rule)
+		}
+	}
+	return fw
+}
+
+// RenderFirewall produces the nft script for the security group table.
+// Instances without groups are not referenced and stay unrestricted.
+func RenderFirewall(instances []InstanceFirewall) string {
+	sorted := append([]InstanceFirewall(nil), instances...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Instance < sorted[j].Instance })
+
+	var b strings.Builder
+	writeTableReset(&b, "bridge", filterTable)
+	fmt.Fprintf(&b, "table bridge %s {\n", filterTable)
+
+	// Base chains: dispatch each TAP to its own chains.
+	for _, hook := range []string{"forward", "output", "input"} {
+		fmt.Fprintf(&b, "\tchain %s {\n", hook)
+		fmt.Fprintf(&b, "\t\ttype filter hook %s priority filter; policy accept;\n", hook)
+		for i, fw := range sorted {
+			comment := fmt.Sprintf("%q", "axion:"+fw.Instance)
+			if hook != "input" {
+				fmt.Fprintf(&b, "\t\toifname %q jump sg_in_%d comment %s\n", fw.Tap, i, comment)
+			}
+			if hook != "output" && fw.EgressRestricted() {
+				fmt.Fprintf(&b, "\t\tiifname %q jump sg_out_%d comment %s\n", fw.Tap, i, comment)
+			}
+		}
+		b.WriteString("\t}\n")
+	}
+
+	for i, fw := range sorted {
+		fmt.Fprintf(&b, "\tchain sg_in_%d {\n", i)
+		b.WriteString("\t\tct state established,related accept\n")
+		b.WriteString("\t\tether type arp accept\n")
+		b.WriteString("\t\tudp sport 67 udp dport 68 accept\n") // DHCP replies
+		for _, r := range fw.Ingress {
+			fmt.Fprintf(&b, "\t\t%s accept\n", renderMatch(r, "saddr"))
+		}
+		b.WriteString("\t\tdrop\n")
+		b.WriteString("\t}\n")
+
+		if !fw.EgressRestricted() {
+			continue
+		}
+		fmt.Fprintf(&b, "\tchain sg_out_%d {\n", i)
+		b.WriteString("\t\tct state established,related accept\n")
+		b.WriteString("\t\tether type arp accept\n")
+		b.WriteString("\t\tudp sport 68 udp dport 67 accept\n") // DHCP requests
+		for _, r := range fw.Egress {
+			fmt.Fprintf(&b, "\t\t%s accept\n", renderMatch(r, "daddr"))
+		}
+		b.WriteString("\t\tdrop\n")
+		b.WriteString("\t}\n")
+	}
+
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// renderMatch turns a rule into nft match expressions. addr is "saddr" for
+// ingress (who may reach the VM) and "daddr" for egress.
+func renderMatch(r FirewallRule, addr string) string {
+	var parts []string
+	if r.CIDR != "" && r.CIDR != AnyCIDR {
+		parts = append(parts, fmt.Sprintf("ip %s %s", addr, r.CIDR))
+	}
+
+	switch r.Protocol {
+	case "tcp", "udp":
+		ports := fmt.Sprintf("%d", r.PortFrom)
+		if r.PortTo > r.PortFrom {
+			ports = fmt.Sprintf("%d-%d", r.PortFrom, r.PortTo)
+		}
+		parts = append(parts, fmt.Sprintf("%s dport %s", r.Protocol, ports))
+	case "icmp":
+		parts = append(parts, "meta l4proto icmp")
+	default:
+		if len(parts) == 0 {
+			parts = append(parts, "ether type ip")
+		}
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,114 @@
+package network
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"aexon/internal/db"
+)
+
+func TestBuildFirewallMergesGroups(t *testing.T) {
+	rules := []db.SecurityGroupRule{
+		{GroupID: "web", Direction: "ingress", Protocol: "tcp", PortFrom: 443, PortTo: 443, CIDR: AnyCIDR},
+		{GroupID: "ssh", Direction: "ingress", Protocol: "tcp", PortFrom: 22, PortTo: 22, CIDR: "10.0.0.0/8"},
+		{GroupID: "dup", Direction: "ingress", Protocol: "tcp", PortFrom: 443, PortTo: 443, CIDR: AnyCIDR},
+		{GroupID: "web", Direction: "egress", Protocol: "udp", PortFrom: 53, PortTo: 53},
+	}
+
+	fw := BuildFirewall("vm-a", rules)
+	if fw.Tap != "axhv-vm-a" {
+		t.Errorf("tap = %s", fw.Tap)
+	}
+	if len(fw.Ingress) != 2 {
+		t.Errorf("expected duplicate ingress rule to collapse, got %+v", fw.Ingress)
+	}
+	if len(fw.Egress) != 1 || fw.Egress[0].CIDR != AnyCIDR {
+		t.Errorf("unexpected egress rules: %+v", fw.Egress)
+	}
+}
+
+func TestRenderFirewall(t *testing.T) {
+	script := RenderFirewall([]InstanceFirewall{
+		BuildFirewall("vm-b", []db.SecurityGroupRule{
+			{Direction: "egress", Protocol: "tcp", PortFrom: 80, PortTo: 443, CIDR: "192.0.2.0/24"},
+		}),
+		BuildFirewall("vm-a", []db.SecurityGroupRule{
+			{Direction: "ingress", Protocol: "tcp", PortFrom: 22, PortTo: 22, CIDR: "10.0.0.0/8"},
+			{Direction: "ingress", Protocol: "icmp", CIDR: AnyCIDR},
+		}),
+		BuildFirewall("vm-empty", nil),
+	})
+
+	if !strings.HasPrefix(script, "table bridge axion_filter\ndelete table bridge axion_filter\n") {
+		t.Errorf("script must reset the table first:\n%s", script)
+	}
+
+	for _, want := range []string{
+		`oifname "axhv-vm-a" jump sg_in_0`,
+		`iifname "axhv-vm-b" jump sg_out_1`,
+		`oifname "axhv-vm-empty" jump sg_in_2`,
+		"ip saddr 10.0.0.0/8 tcp dport 22 accept",
+		"meta l4proto icmp accept",
+		"ip daddr 192.0.2.0/24 tcp dport 80-443 accept",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("missing %q in:\n%s", want, script)
+		}
+	}
+
+	// Egress stays open for instances without egress rules.
+	if strings.Contains(script, `iifname "axhv-vm-a"`) {
+		t.Errorf("vm-a has no egress rules and must not be filtered outbound:\n%s", script)
+	}
+	// Input hook only carries egress dispatch.
+	input := script[strings.Index(script, "chain input"):]
+	input = input[:strings.Index(input, "}")]
+	if strings.Contains(input, "oifname") {
+		t.Errorf("input chain must not match on oifname:\n%s", input)
+	}
+}
+
+func TestApplyFirewallUsesDriver(t *testing.T) {
+	drv := NewFakeDriver(false)
+	m := NewManager(drv)
+
+	err := m.ApplyFirewall(context.Background(), map[string][]db.SecurityGroupRule{
+		"vm-a": {{Direction: "ingress", Protocol: "any", CIDR: "10.0.0.0/24"}},
+		"vm-b": {},
+	})
+	if err != nil {
+		t.Fatalf("ApplyFirewall failed: %v", err)
+	}
+	if len(drv.Firewall) != 2 {
+		t.Fatalf("expected 2 instances pushed, got %d", len(drv.Firewall))
+	}
+}
+
+func TestSecurityGroupRuleValidate(t *testing.T) {
+	cases := []struct {
+		rule db.SecurityGroupRule
+		ok   bool
+	}{
+		{db.SecurityGroupRule{Direction: "ingress", Protocol: "tcp", PortFrom: 22}, true},
+		{db.SecurityGroupRule{Direction: "ingress", Protocol: "tcp"}, false},
+		{db.SecurityGroupRule{Direction: "egress", Protocol: "udp", PortFrom: 100, PortTo: 50}, false},
+		{db.SecurityGroupRule{Direction: "ingress", Protocol: "icmp", PortFrom: 8}, false},
+		{db.SecurityGroupRule{Direction: "sideways", Protocol: "any"}, false},
+		{db.SecurityGroupRule{Direction: "ingress", Protocol: "any", CIDR: "10.1.2.3/8"}, true},
+		{db.SecurityGroupRule{Direction: "ingress", Protocol: "any", CIDR: "not-a-cidr"}, false},
+	}
+
+	for i, tc := range cases {
+		err := tc.rule.Validate()
+		if (err == nil) != tc.ok {
+			t.Errorf("case %d: Validate() = %v, want ok=%v", i, err, tc.ok)
+		}
+	}
+
+	r := db.SecurityGroupRule{Direction: "ingress", Protocol: "any", CIDR: "10.1.2.3/8"}
+	_ = r.Validate()
+	if r.CIDR != "10.0.0.0/8" {
+		t.Errorf("cidr not normalised: %s", r.CIDR)
+	}
+}
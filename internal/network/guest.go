@@ -0,0 +1,197 @@
+package network
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"aexon/internal/db"
+)
+
+// ============================================================================
+// GUEST SERVICES (DHCP + DNS)
+// ============================================================================
+
+// DomainSuffix is the private zone answered by the embedded resolver.
+const DomainSuffix = "axion"
+
+// GuestLease is an IPAM reservation as seen by the guest services.
+type GuestLease struct {
+	Instance string
+	IP       net.IP
+	Network  db.Network
+}
+
+// GuestServices runs one DHCP server and one DNS resolver per managed
+// bridge. Both answer from an in-memory snapshot of ip_leases that the
+// Manager refreshes on every reconciliation, so no packet hits the DB.
+type GuestServices struct {
+	driver Driver
+	serve  bool // false in tests: tables only, no sockets
+
+	mu       sync.RWMutex
+	leases   map[string]GuestLease // instance -> lease
+	records  map[string]net.IP     // fqdn (lowercase, trailing dot) -> ip
+	networks []db.Network
+
+	dhcp map[string]*dhcpListener // bridge -> listener
+	dns  map[string]*dnsListener  // bridge -> listener
+}
+
+func NewGuestServices(driver Driver) *GuestServices {
+	return &GuestServices{
+		driver:  driver,
+		serve:   true,
+		leases:  make(map[string]GuestLease),
+		records: make(map[string]net.IP),
+		dhcp:    make(map[string]*dhcpListener),
+		dns:     make(map[string]*dnsListener),
+	}
+}
+
+// DefaultGuestServices honours AXION_GUEST_SERVICES=off for hosts that
+// already run their own DHCP/DNS on the bridges.
+func DefaultGuestServices(driver Driver) *GuestServices {
+	if strings.EqualFold(os.Getenv("AXION_GUEST_SERVICES"), "off") {
+		log.Println("[Network] Guest DHCP/DNS disabled (AXION_GUEST_SERVICES=off)")
+		return nil
+	}
+	return NewGuestServices(driver)
+}
+
+var nonLabel = regexp.MustCompile(`[^a-z0-9]+`)
+
+// DomainFor returns the zone of a network, e.g. "corporate-pool-a.axion".
+func DomainFor(n db.Network) string {
+	label := strings.Trim(nonLabel.ReplaceAllString(strings.ToLower(n.Name), "-"), "-")
+	if label == "" {
+		label = shortID(n.ID)
+	}
+	return label + "." + DomainSuffix
+}
+
+// FQDN returns the name an instance answers to inside its network.
+func FQDN(instanceName string, n db.Network) string {
+	return strings.ToLower(instanceName) + "." + DomainFor(n)
+}
+
+// Update replaces the lease snapshot and starts/stops listeners so that
+// exactly the given managed networks are served.
+func (g *GuestServices) Update(networks []db.Network, attachments []db.NetworkAttachment) error {
+	byID := make(map[string]db.Network, len(networks))
+	for _, n := range networks {
+		byID[n.ID] = n
+	}
+
+	leases := make(map[string]GuestLease, len(attachments))
+	records := make(map[string]net.IP, len(attachments))
+	for _, a := range attachments {
+		n, ok := byID[a.NetworkID]
+		ip := net.ParseIP(a.IP).To4()
+		if !ok || ip == nil {
+			continue
+		}
+		leases[a.InstanceName] = GuestLease{Instance: a.InstanceName, IP: ip, Network: n}
+		records[FQDN(a.InstanceName, n)+"."] = ip
+	}
+
+	g.mu.Lock()
+	g.leases = leases
+	g.records = records
+	g.networks = networks
+	g.mu.Unlock()
+
+	if !g.serve {
+		return nil
+	}
+	return g.syncListeners(networks)
+}
+
+func (g *GuestServices) syncListeners(networks []db.Network) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var errs []string
+	desired := make(map[string]bool)
+	for _, n := range networks {
+		if !IsManaged(n) {
+			continue
+		}
+		bridge := BridgeName(n.ID)
+		gw := net.ParseIP(n.Gateway).To4()
+		if gw == nil {
+			continue
+		}
+		desired[bridge] = true
+
+		if l, ok := g.dhcp[bridge]; !ok || !l.gateway.Equal(gw) {
+			if ok {
+				l.Close()
+			}
+			l, err := g.startDHCP(bridge, gw)
+			if err != nil {
+				delete(g.dhcp, bridge)
+				errs = append(errs, fmt.Sprintf("dhcp on %s: %v", bridge, err))
+			} else {
+				g.dhcp[bridge] = l
+			}
+		}
+
+		if l, ok := g.dns[bridge]; !ok || !l.gateway.Equal(gw) {
+			if ok {
+				l.Close()
+			}
+			l, err := g.startDNS(gw)
+			if err != nil {
+				delete(g.dns, bridge)
+				errs = append(errs, fmt.Sprintf("dns on %s: %v", gw, err))
+			} else {
+				g.dns[bridge] = l
+			}
+		}
+	}
+
+	for bridge, l := range g.dhcp {
+		if !desired[bridge] {
+			l.Close()
+			delete(g.dhcp, bridge)
+		}
+	}
+	for bridge, l := range g.dns {
+		if !desired[bridge] {
+			l.Close()
+			delete(g.dns, bridge)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("guest services: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Close stops every listener.
+func (g *GuestServices) Close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for bridge, l := range g.dhcp {
+		l.Close()
+		delete(g.dhcp, bridge)
+	}
+	for bridge, l := range g.dns {
+		l.Close()
+		delete(g.dns, bridge)
+	}
+}
+
+// leaseFor returns the reservation of an instance.
+func (g *GuestServices) leaseFor(instanceName string) (GuestLease, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	l, ok := g.leases[instanceName]
+	return l, ok
+}
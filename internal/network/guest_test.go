@@ -0,0 +1,130 @@
+package network
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"aexon/internal/db"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/miekg/dns"
+)
+
+func testGuestServices(t *testing.T) (*GuestServices, *FakeDriver) {
+	t.Helper()
+	drv := NewFakeDriver(false)
+	g := NewGuestServices(drv)
+	g.serve = false
+
+	nets := testNetworks()
+	nets[1].DNS1 = "9.9.9.9"
+	attachments := []db.NetworkAttachment{
+		{InstanceName: "web-1", NetworkID: nets[1].ID, IP: "10.0.0.5"},
+		{InstanceName: "db-1", NetworkID: nets[1].ID, IP: "10.0.0.6"},
+		{InstanceName: "legacy", NetworkID: nets[0].ID, IP: "172.16.0.9"},
+	}
+	if err := g.Update(nets, attachments); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	drv.Bridges["axbr-22222222"] = BridgeSpec{Name: "axbr-22222222"}
+	drv.Attachments["axhv-web-1"] = "axbr-22222222"
+	drv.FDB["52:54:00:00:00:01"] = "axhv-web-1"
+	return g, drv
+}
+
+func TestDomainFor(t *testing.T) {
+	n := db.Network{ID: "abcdef01-0000", Name: "Corporate Pool A"}
+	if got := DomainFor(n); got != "corporate-pool-a.axion" {
+		t.Errorf("DomainFor = %s", got)
+	}
+	n.Name = "***"
+	if got := DomainFor(n); got != "abcdef01.axion" {
+		t.Errorf("DomainFor fallback = %s", got)
+	}
+}
+
+func TestDHCPHandsOutReservation(t *testing.T) {
+	g, _ := testGuestServices(t)
+	mac, _ := net.ParseMAC("52:54:00:00:00:01")
+
+	discover, err := dhcpv4.NewDiscovery(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer, err := g.DHCPReply(context.Background(), "axbr-22222222", discover)
+	if err != nil {
+		t.Fatalf("DHCPReply failed: %v", err)
+	}
+	if offer.MessageType() != dhcpv4.MessageTypeOffer {
+		t.Errorf("message type = %s", offer.MessageType())
+	}
+	if !offer.YourIPAddr.Equal(net.ParseIP("10.0.0.5")) {
+		t.Errorf("offered %s, want 10.0.0.5", offer.YourIPAddr)
+	}
+	if gw := offer.Router(); len(gw) != 1 || !gw[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("router = %v", gw)
+	}
+	if d := offer.DomainName(); d != "corporate-pool-a.axion" {
+		t.Errorf("domain = %s", d)
+	}
+
+	request, _ := dhcpv4.NewRequestFromOffer(offer)
+	ack, err := g.DHCPReply(context.Background(), "axbr-22222222", request)
+	if err != nil || ack.MessageType() != dhcpv4.MessageTypeAck {
+		t.Fatalf("expected ACK, got %v / %v", ack, err)
+	}
+
+	// A client asking for someone else's address is refused.
+	request.UpdateOption(dhcpv4.OptRequestedIPAddress(net.ParseIP("10.0.0.6")))
+	nak, err := g.DHCPReply(context.Background(), "axbr-22222222", request)
+	if err != nil || nak.MessageType() != dhcpv4.MessageTypeNak {
+		t.Fatalf("expected NAK, got %v / %v", nak, err)
+	}
+}
+
+func TestDHCPIgnoresUnknownClients(t *testing.T) {
+	g, _ := testGuestServices(t)
+	mac, _ := net.ParseMAC("52:54:00:00:00:99")
+	discover, _ := dhcpv4.NewDiscovery(mac)
+
+	if _, err := g.DHCPReply(context.Background(), "axbr-22222222", discover); err == nil {
+		t.Error("expected an error for a MAC not learned on the bridge")
+	}
+}
+
+func TestDNSResolvesInstances(t *testing.T) {
+	g, _ := testGuestServices(t)
+
+	q := new(dns.Msg)
+	q.SetQuestion("Web-1.corporate-pool-a.axion.", dns.TypeA)
+	resp := g.Resolve(q)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Fatalf("unexpected response: %v", resp)
+	}
+	if a := resp.Answer[0].(*dns.A); !a.A.Equal(net.ParseIP("10.0.0.5")) {
+		t.Errorf("A = %s", a.A)
+	}
+
+	q.SetQuestion("legacy.default-axhv-nat.axion.", dns.TypeA)
+	if resp := g.Resolve(q); len(resp.Answer) != 1 {
+		t.Errorf("native pool instance should resolve too: %v", resp)
+	}
+
+	q.SetQuestion("ghost.corporate-pool-a.axion.", dns.TypeA)
+	if resp := g.Resolve(q); resp.Rcode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN, got %s", dns.RcodeToString[resp.Rcode])
+	}
+}
+
+func TestDNSUpstreamPerNetwork(t *testing.T) {
+	g, _ := testGuestServices(t)
+
+	if got := g.UpstreamFor(net.ParseIP("10.0.0.5")); got != "9.9.9.9" {
+		t.Errorf("upstream = %s, want network dns1", got)
+	}
+	if got := g.UpstreamFor(net.ParseIP("192.168.1.1")); got != DefaultUpstream {
+		t.Errorf("upstream = %s, want default", got)
+	}
+}
@@ -0,0 +1,295 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"aexon/internal/db"
+)
+
+// Manager reconciles the `networks` table with the host: every managed pool
+// gets a bridge carrying its gateway address, an optional VLAN uplink and,
+// for private pools, a masquerade rule.
+type Manager struct {
+	driver Driver
+	uplink string
+	guest  *GuestServices
+	mu     sync.Mutex
+}
+
+func NewManager(driver Driver) *Manager {
+	return &Manager{
+		driver: driver,
+		uplink: os.Getenv("AXION_UPLINK_IFACE"),
+	}
+}
+
+// Driver exposes the underlying driver so sibling subsystems can share it.
+func (m *Manager) Driver() Driver {
+	return m.driver
+}
+
+// SetGuestServices enables the embedded DHCP/DNS servers. They are kept in
+// sync with every reconciliation; nil disables them.
+func (m *Manager) SetGuestServices(g *GuestServices) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.guest = g
+}
+
+// Close stops the guest services, if any.
+func (m *Manager) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.guest != nil {
+		m.guest.Close()
+	}
+}
+
+// IsManaged reports whether a network is materialised by Axion (as opposed
+// to AxHV's native pool).
+func IsManaged(n db.Network) bool {
+	return n.CIDR != NativeCIDR
+}
+
+// Reconcile loads networks and lease attachments from the database and
+// applies them.
+func (m *Manager) Reconcile(ctx context.Context) error {
+	// Host state covers every tenant, whoever triggered the pass
+	ctx = db.WithoutScope(ctx)
+	svc := db.GetService()
+	networks, err := svc.ListNetworks(ctx)
+	if err != nil {
+		return fmt.Errorf("load networks: %w", err)
+	}
+	attachments, err := svc.ListNetworkAttachments(ctx)
+	if err != nil {
+		return fmt.Errorf("load attachments: %w", err)
+	}
+	return m.Apply(ctx, networks, attachments)
+}
+
+// Apply converges the host to the given desired state. Bridge failures are
+// collected so one broken network does not block the others.
+func (m *Manager) Apply(ctx context.Context, networks []db.Network, attachments []db.NetworkAttachment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var errs []error
+	desired := make(map[string]bool)
+	var masq []MasqueradeRule
+	var served []db.Network // Networks whose bridge is up
+
+	for _, n := range networks {
+		if !IsManaged(n) {
+			served = append(served, n) // Native pool: DNS records only
+			continue
+		}
+		spec, err := m.bridgeSpec(n)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("network %s: %w", n.Name, err))
+			continue
+		}
+		desired[spec.Name] = true
+
+		if err := m.driver.EnsureBridge(ctx, spec); err != nil {
+			errs = append(errs, fmt.Errorf("network %s: %w", n.Name, err))
+			continue
+		}
+		served = append(served, n)
+		if !n.IsPublic {
+			masq = append(masq, MasqueradeRule{Bridge: spec.Name, Subnet: n.CIDR})
+		}
+	}
+
+	existing, err := m.driver.ListBridges(ctx)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("list bridges: %w", err))
+	}
+	for _, name := range existing {
+		if desired[name] {
+			continue
+		}
+		log.Printf("[Network] Removing stale bridge %s", name)
+		if err := m.driver.DeleteBridge(ctx, name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := m.driver.SyncMasquerade(ctx, masq); err != nil {
+		errs = append(errs, fmt.Errorf("masquerade: %w", err))
+	}
+
+	for _, a := range attachments {
+		bridge := BridgeName(a.NetworkID)
+		if !desired[bridge] {
+			continue
+		}
+		// TAPs only exist while the VM runs; a missing one is not an error.
+		if err := m.driver.AttachInterface(ctx, TapName(a.InstanceName), bridge); err != nil {
+			log.Printf("[Network] Skipping attachment of %s: %v", a.InstanceName, err)
+		}
+	}
+
+	if m.guest != nil {
+		if err := m.guest.Update(served, attachments); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	log.Printf("[Network] Reconciled %d managed network(s)", len(desired))
+	return nil
+}
+
+// AttachInstance moves the instance TAP onto its network bridge. It is a
+// no-op for AxHV's native pool.
+func (m *Manager) AttachInstance(ctx context.Context, instanceName string, n db.Network) error {
+	if !IsManaged(n) {
+		return nil
+	}
+	return m.driver.AttachInterface(ctx, TapName(instanceName), BridgeName(n.ID))
+}
+
+// RefreshLeases reloads the DHCP/DNS lease snapshot without touching
+// bridges. Called whenever IPAM reserves or releases an address.
+func (m *Manager) RefreshLeases(ctx context.Context) error {
+	ctx = db.WithoutScope(ctx)
+	m.mu.Lock()
+	guest := m.guest
+	m.mu.Unlock()
+	if guest == nil {
+		return nil
+	}
+
+	svc := db.GetService()
+	networks, err := svc.ListNetworks(ctx)
+	if err != nil {
+		return fmt.Errorf("load networks: %w", err)
+	}
+	attachments, err := svc.ListNetworkAttachments(ctx)
+	if err != nil {
+		return fmt.Errorf("load attachments: %w", err)
+	}
+	return guest.Update(networks, attachments)
+}
+
+// SyncFirewall loads every security group attachment from the database and
+// rewrites the filter table.
+func (m *Manager) SyncFirewall(ctx context.Context) error {
+	ctx = db.WithoutScope(ctx)
+	rules, err := db.NewSecurityGroupRepository(db.GetService()).ListInstanceRules(ctx)
+	if err != nil {
+		return fmt.Errorf("load security groups: %w", err)
+	}
+	return m.ApplyFirewall(ctx, rules)
+}
+
+// ApplyFirewall pushes the given per-instance rules to the driver.
+func (m *Manager) ApplyFirewall(ctx context.Context, rules map[string][]db.SecurityGroupRule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	instances := make([]InstanceFirewall, 0, len(rules))
+	for name, r := range rules {
+		instances = append(instances, BuildFirewall(name, r))
+	}
+	if err := m.driver.SyncFirewall(ctx, instances); err != nil {
+		return fmt.Errorf("firewall: %w", err)
+	}
+	log.Printf("[Network] Firewall synced for %d instance(s)", len(instances))
+	return nil
+}
+
+// SyncFloatingIPs loads floating IP bindings from the database and rewrites
+// the 1:1 NAT table. Bindings whose instance has no lease (deleted, not yet
+// recreated) are kept in the database but not programmed.
+func (m *Manager) SyncFloatingIPs(ctx context.Context) error {
+	ctx = db.WithoutScope(ctx)
+	svc := db.GetService()
+	bindings, err := db.NewFloatingIPRepository(svc).ListBindings(ctx)
+	if err != nil {
+		return fmt.Errorf("load floating IPs: %w", err)
+	}
+	return m.ApplyFloatingIPs(ctx, bindings)
+}
+
+// ApplyFloatingIPs pushes the given bindings to the driver.
+func (m *Manager) ApplyFloatingIPs(ctx context.Context, bindings []db.FloatingIP) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	nat := make([]FloatingNAT, 0, len(bindings))
+	for _, f := range bindings {
+		if f.InstanceName == nil || f.PrivateIP == nil {
+			continue
+		}
+		nat = append(nat, FloatingNAT{
+			PublicIP:  f.IP,
+			PrivateIP: *f.PrivateIP,
+			Bridge:    BridgeName(f.NetworkID),
+		})
+	}
+	if err := m.driver.SyncFloatingIPs(ctx, nat); err != nil {
+		return fmt.Errorf("floating IPs: %w", err)
+	}
+	log.Printf("[Network] Floating IPs synced (%d bound)", len(nat))
+	return nil
+}
+
+// SyncThrottles caps every instance whose throttle quota fired in the
+// current period. Caps lapse on their own when the period rolls over.
+func (m *Manager) SyncThrottles(ctx context.Context) error {
+	ctx = db.WithoutScope(ctx)
+	quotas, err := db.NewTrafficRepository(db.GetService()).ListActiveThrottles(ctx, db.TrafficPeriod(time.Now()))
+	if err != nil {
+		return fmt.Errorf("load traffic quotas: %w", err)
+	}
+	return m.ApplyThrottles(ctx, quotas)
+}
+
+// ApplyThrottles pushes the caps of the given quotas to the driver.
+func (m *Manager) ApplyThrottles(ctx context.Context, quotas []db.TrafficQuota) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	throttles := make([]Throttle, 0, len(quotas))
+	for _, q := range quotas {
+		throttles = append(throttles, Throttle{
+			Instance: q.InstanceName,
+			Tap:      TapName(q.InstanceName),
+			Mbps:     q.ThrottleMbps,
+		})
+	}
+	if err := m.driver.SyncThrottles(ctx, throttles); err != nil {
+		return fmt.Errorf("throttles: %w", err)
+	}
+	return nil
+}
+
+func (m *Manager) bridgeSpec(n db.Network) (BridgeSpec, error) {
+	_, ipNet, err := net.ParseCIDR(n.CIDR)
+	if err != nil {
+		return BridgeSpec{}, fmt.Errorf("invalid cidr %s: %w", n.CIDR, err)
+	}
+	gw := net.ParseIP(n.Gateway)
+	if gw == nil || !ipNet.Contains(gw) {
+		return BridgeSpec{}, fmt.Errorf("gateway %s outside %s", n.Gateway, n.CIDR)
+	}
+	ones, _ := ipNet.Mask.Size()
+
+	return BridgeSpec{
+		Name:    BridgeName(n.ID),
+		Address: fmt.Sprintf("%s/%d", gw.String(), ones),
+		VlanID:  n.VlanID,
+		Parent:  m.uplink,
+	}, nil
+}
@@ -0,0 +1,201 @@
+package network
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"aexon/internal/db"
+)
+
+func testNetworks() []db.Network {
+	return []db.Network{
+		{ID: "11111111-aaaa-bbbb-cccc-000000000001", Name: "Default AxHV NAT", CIDR: NativeCIDR, Gateway: "172.16.0.1"},
+		{ID: "22222222-aaaa-bbbb-cccc-000000000002", Name: "Corporate Pool A", CIDR: "10.0.0.0/24", Gateway: "10.0.0.1", VlanID: 42},
+		{ID: "33333333-aaaa-bbbb-cccc-000000000003", Name: "Public", CIDR: "203.0.113.0/28", Gateway: "203.0.113.1", IsPublic: true},
+	}
+}
+
+func TestApplyMaterialisesManagedNetworks(t *testing.T) {
+	drv := NewFakeDriver(false)
+	m := NewManager(drv)
+	m.uplink = "eth0"
+
+	attachments := []db.NetworkAttachment{
+		{InstanceName: "vm-a", NetworkID: "22222222-aaaa-bbbb-cccc-000000000002"},
+		{InstanceName: "vm-native", NetworkID: "11111111-aaaa-bbbb-cccc-000000000001"},
+	}
+
+	if err := m.Apply(context.Background(), testNetworks(), attachments); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+
+	if _, ok := drv.Bridges[BridgeName("11111111-aaaa-bbbb-cccc-000000000001")]; ok {
+		t.Error("native AxHV pool must not get a bridge")
+	}
+
+	corp, ok := drv.Bridges["axbr-22222222"]
+	if !ok {
+		t.Fatalf("expected bridge axbr-22222222, got %v", drv.Bridges)
+	}
+	if corp.Address != "10.0.0.1/24" {
+		t.Errorf("gateway address = %s, want 10.0.0.1/24", corp.Address)
+	}
+	if corp.VlanID != 42 || corp.Parent != "eth0" {
+		t.Errorf("vlan = %d parent = %s, want 42/eth0", corp.VlanID, corp.Parent)
+	}
+
+	if len(drv.Masquerade) != 1 || drv.Masquerade[0].Subnet != "10.0.0.0/24" {
+		t.Errorf("expected masquerade only for the private pool, got %+v", drv.Masquerade)
+	}
+
+	if drv.Attachments["axhv-vm-a"] != "axbr-22222222" {
+		t.Errorf("vm-a TAP not attached: %v", drv.Attachments)
+	}
+	if _, ok := drv.Attachments["axhv-vm-native"]; ok {
+		t.Error("native pool TAP must stay on axhv-br0")
+	}
+}
+
+func TestApplyRemovesStaleBridges(t *testing.T) {
+	drv := NewFakeDriver(false)
+	drv.Bridges["axbr-deadbeef"] = BridgeSpec{Name: "axbr-deadbeef"}
+	m := NewManager(drv)
+
+	if err := m.Apply(context.Background(), testNetworks()[2:], nil); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+
+	if _, ok := drv.Bridges["axbr-deadbeef"]; ok {
+		t.Error("stale bridge was not removed")
+	}
+	if _, ok := drv.Bridges["axbr-33333333"]; !ok {
+		t.Error("public network bridge missing")
+	}
+}
+
+func TestApplyIsIdempotent(t *testing.T) {
+	drv := NewFakeDriver(false)
+	m := NewManager(drv)
+	m.uplink = "eth0"
+
+	for i := 0; i < 2; i++ {
+		if err := m.Apply(context.Background(), testNetworks(), nil); err != nil {
+			t.Fatalf("pass %d: %v", i, err)
+		}
+	}
+	if len(drv.Bridges) != 2 {
+		t.Errorf("expected 2 bridges after two passes, got %d", len(drv.Bridges))
+	}
+}
+
+func TestApplyReportsInvalidNetworks(t *testing.T) {
+	drv := NewFakeDriver(false)
+	m := NewManager(drv)
+
+	nets := []db.Network{
+		{ID: "44444444-0000-0000-0000-000000000004", Name: "Broken", CIDR: "10.9.0.0/24", Gateway: "10.8.0.1"},
+		{ID: "55555555-0000-0000-0000-000000000005", Name: "Tagged", CIDR: "10.5.0.0/24", Gateway: "10.5.0.1", VlanID: 7},
+		{ID: "66666666-0000-0000-0000-000000000006", Name: "Fine", CIDR: "10.6.0.0/24", Gateway: "10.6.0.1"},
+	}
+
+	err := m.Apply(context.Background(), nets, nil)
+	if err == nil {
+		t.Fatal("expected errors for gateway outside cidr and vlan without uplink")
+	}
+	if !strings.Contains(err.Error(), "Broken") || !strings.Contains(err.Error(), "Tagged") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, ok := drv.Bridges["axbr-66666666"]; !ok {
+		t.Error("valid network should still be materialised")
+	}
+}
+
+func TestRenderMasquerade(t *testing.T) {
+	script := RenderMasquerade([]MasqueradeRule{
+		{Bridge: "axbr-bbbb", Subnet: "10.1.0.0/24"},
+		{Bridge: "axbr-aaaa", Subnet: "10.0.0.0/24"},
+	})
+
+	if !strings.HasPrefix(script, "table ip axion_nat\ndelete table ip axion_nat\n") {
+		t.Errorf("script must reset the table first:\n%s", script)
+	}
+	first := strings.Index(script, "axbr-aaaa")
+	second := strings.Index(script, "axbr-bbbb")
+	if first < 0 || second < 0 || first > second {
+		t.Errorf("rules must be sorted by bridge:\n%s", script)
+	}
+	if !strings.Contains(script, `ip saddr 10.0.0.0/24 oifname != "axbr-aaaa" masquerade`) {
+		t.Errorf("missing masquerade rule:\n%s", script)
+	}
+}
+
+func TestRenderFloatingNAT(t *testing.T) {
+	script := RenderFloatingNAT([]FloatingNAT{
+		{PublicIP: "203.0.113.7", PrivateIP: "10.0.0.5", Bridge: "axbr-33333333"},
+	})
+
+	if !strings.HasPrefix(script, "table ip axion_fip\ndelete table ip axion_fip\n") {
+		t.Errorf("script must reset the table first:\n%s", script)
+	}
+	for _, want := range []string{
+		"ip daddr 203.0.113.7 dnat to 10.0.0.5",
+		"ip saddr 10.0.0.5 snat to 203.0.113.7",
+		"type nat hook postrouting priority 90;",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("missing %q in:\n%s", want, script)
+		}
+	}
+}
+
+func TestApplyFloatingIPsSkipsOrphans(t *testing.T) {
+	drv := NewFakeDriver(false)
+	drv.Bridges["axbr-33333333"] = BridgeSpec{Name: "axbr-33333333"}
+	m := NewManager(drv)
+
+	instance, private := "web-1", "10.0.0.5"
+	deleted := "gone"
+	err := m.ApplyFloatingIPs(context.Background(), []db.FloatingIP{
+		{IP: "203.0.113.7", NetworkID: "33333333-aaaa-bbbb-cccc-000000000003", InstanceName: &instance, PrivateIP: &private},
+		{IP: "203.0.113.8", NetworkID: "33333333-aaaa-bbbb-cccc-000000000003", InstanceName: &deleted},
+		{IP: "203.0.113.9", NetworkID: "33333333-aaaa-bbbb-cccc-000000000003"},
+	})
+	if err != nil {
+		t.Fatalf("ApplyFloatingIPs failed: %v", err)
+	}
+	if len(drv.FloatingIPs) != 1 || drv.FloatingIPs[0].Bridge != "axbr-33333333" {
+		t.Errorf("expected only the bound address, got %+v", drv.FloatingIPs)
+	}
+}
+
+func TestRenderThrottles(t *testing.T) {
+	script := RenderThrottles([]Throttle{{Instance: "web-1", Tap: "axhv-web-1", Mbps: 8}})
+
+	if !strings.HasPrefix(script, "table bridge axion_shape\ndelete table bridge axion_shape\n") {
+		t.Errorf("script must reset the table first:\n%s", script)
+	}
+	for _, want := range []string{
+		`oifname "axhv-web-1" limit rate over 1000 kbytes/second drop`,
+		`iifname "axhv-web-1" limit rate over 1000 kbytes/second drop`,
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("missing %q in:\n%s", want, script)
+		}
+	}
+}
+
+func TestApplyThrottles(t *testing.T) {
+	drv := NewFakeDriver(false)
+	m := NewManager(drv)
+
+	err := m.ApplyThrottles(context.Background(), []db.TrafficQuota{
+		{InstanceName: "web-1", Action: "throttle", ThrottleMbps: 2},
+	})
+	if err != nil {
+		t.Fatalf("ApplyThrottles failed: %v", err)
+	}
+	if len(drv.Throttles) != 1 || drv.Throttles[0].Tap != "axhv-web-1" || drv.Throttles[0].Mbps != 2 {
+		t.Errorf("unexpected throttles: %+v", drv.Throttles)
+	}
+}
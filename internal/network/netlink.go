@@ -0,0 +1,234 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// NetlinkDriver materialises networks on the local host using rtnetlink for
+// links/addresses and nftables for NAT.
+type NetlinkDriver struct {
+	nft NftRunner
+}
+
+func NewNetlinkDriver() *NetlinkDriver {
+	return &NetlinkDriver{nft: ExecNft}
+}
+
+func (d *NetlinkDriver) EnsureBridge(ctx context.Context, spec BridgeSpec) error {
+	bridge, err := d.ensureLink(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: spec.Name}})
+	if err != nil {
+		return fmt.Errorf("bridge %s: %w", spec.Name, err)
+	}
+
+	if spec.Address != "" {
+		addr, err := netlink.ParseAddr(spec.Address)
+		if err != nil {
+			return fmt.Errorf("invalid gateway address %s: %w", spec.Address, err)
+		}
+		if err := netlink.AddrReplace(bridge, addr); err != nil {
+			return fmt.Errorf("assign %s to %s: %w", spec.Address, spec.Name, err)
+		}
+	}
+
+	if spec.VlanID > 0 {
+		if spec.Parent == "" {
+			return fmt.Errorf("bridge %s: vlan %d requires an uplink (AXION_UPLINK_IFACE)", spec.Name, spec.VlanID)
+		}
+		parent, err := netlink.LinkByName(spec.Parent)
+		if err != nil {
+			return fmt.Errorf("uplink %s: %w", spec.Parent, err)
+		}
+		vlanName := vlanFor(spec.Name)
+		vlan, err := d.ensureLink(&netlink.Vlan{
+			LinkAttrs: netlink.LinkAttrs{Name: vlanName, ParentIndex: parent.Attrs().Index},
+			VlanId:    spec.VlanID,
+		})
+		if err != nil {
+			return fmt.Errorf("vlan %s: %w", vlanName, err)
+		}
+		if err := netlink.LinkSetMaster(vlan, bridge); err != nil {
+			return fmt.Errorf("enslave %s: %w", vlanName, err)
+		}
+		if err := netlink.LinkSetUp(vlan); err != nil {
+			return fmt.Errorf("set %s up: %w", vlanName, err)
+		}
+	}
+
+	if err := netlink.LinkSetUp(bridge); err != nil {
+		return fmt.Errorf("set %s up: %w", spec.Name, err)
+	}
+	return nil
+}
+
+// ensureLink returns the existing link with the same name or creates it.
+func (d *NetlinkDriver) ensureLink(link netlink.Link) (netlink.Link, error) {
+	name := link.Attrs().Name
+	existing, err := netlink.LinkByName(name)
+	if err == nil {
+		if existing.Type() != link.Type() {
+			return nil, fmt.Errorf("link %s exists with type %s, want %s", name, existing.Type(), link.Type())
+		}
+		return existing, nil
+	}
+	var notFound netlink.LinkNotFoundError
+	if !errors.As(err, &notFound) {
+		return nil, err
+	}
+
+	if err := netlink.LinkAdd(link); err != nil {
+		return nil, err
+	}
+	log.Printf("[Network] Created %s %s", link.Type(), name)
+	return netlink.LinkByName(name)
+}
+
+func (d *NetlinkDriver) DeleteBridge(ctx context.Context, name string) error {
+	for _, ifname := range []string{vlanFor(name), name} {
+		link, err := netlink.LinkByName(ifname)
+		if err != nil {
+			continue // Already gone
+		}
+		if err := netlink.LinkDel(link); err != nil {
+			return fmt.Errorf("delete %s: %w", ifname, err)
+		}
+		log.Printf("[Network] Deleted %s", ifname)
+	}
+	return nil
+}
+
+func (d *NetlinkDriver) ListBridges(ctx context.Context) ([]string, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, l := range links {
+		if l.Type() == "bridge" && strings.HasPrefix(l.Attrs().Name, BridgePrefix) {
+			names = append(names, l.Attrs().Name)
+		}
+	}
+	return names, nil
+}
+
+func (d *NetlinkDriver) AttachInterface(ctx context.Context, ifname string, bridge string) error {
+	link, err := netlink.LinkByName(ifname)
+	if err != nil {
+		return fmt.Errorf("interface %s: %w", ifname, err)
+	}
+	br, err := netlink.LinkByName(bridge)
+	if err != nil {
+		return fmt.Errorf("bridge %s: %w", bridge, err)
+	}
+	if link.Attrs().MasterIndex == br.Attrs().Index {
+		return nil
+	}
+	if err := netlink.LinkSetMaster(link, br); err != nil {
+		return fmt.Errorf("attach %s to %s: %w", ifname, bridge, err)
+	}
+	log.Printf("[Network] Attached %s to %s", ifname, bridge)
+	return nil
+}
+
+func (d *NetlinkDriver) SyncMasquerade(ctx context.Context, rules []MasqueradeRule) error {
+	if len(rules) > 0 {
+		if err := os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644); err != nil {
+			log.Printf("[Network] Warning: could not enable ip_forward: %v", err)
+		}
+	}
+	return d.nft(ctx, RenderMasquerade(rules))
+}
+
+func (d *NetlinkDriver) SyncFirewall(ctx context.Context, instances []InstanceFirewall) error {
+	return d.nft(ctx, RenderFirewall(instances))
+}
+
+func (d *NetlinkDriver) SyncFloatingIPs(ctx context.Context, bindings []FloatingNAT) error {
+	// Desired /32s per bridge
+	want := make(map[string]map[string]bool)
+	for _, f := range bindings {
+		if want[f.Bridge] == nil {
+			want[f.Bridge] = make(map[string]bool)
+		}
+		want[f.Bridge][f.PublicIP+"/32"] = true
+	}
+
+	bridges, err := d.ListBridges(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range bridges {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			continue
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+		if err != nil {
+			return fmt.Errorf("list addresses of %s: %w", name, err)
+		}
+		have := make(map[string]bool)
+		for _, a := range addrs {
+			if ones, _ := a.Mask.Size(); ones != 32 {
+				continue // Gateway address
+			}
+			cidr := a.IPNet.String()
+			have[cidr] = true
+			if !want[name][cidr] {
+				if err := netlink.AddrDel(link, &a); err != nil {
+					return fmt.Errorf("remove %s from %s: %w", cidr, name, err)
+				}
+				log.Printf("[Network] Released floating IP %s from %s", cidr, name)
+			}
+		}
+		for cidr := range want[name] {
+			if have[cidr] {
+				continue
+			}
+			addr, err := netlink.ParseAddr(cidr)
+			if err != nil {
+				return err
+			}
+			if err := netlink.AddrAdd(link, addr); err != nil {
+				return fmt.Errorf("bind %s to %s: %w", cidr, name, err)
+			}
+			log.Printf("[Network] Bound floating IP %s to %s", cidr, name)
+		}
+	}
+
+	return d.nft(ctx, RenderFloatingNAT(bindings))
+}
+
+func (d *NetlinkDriver) SyncThrottles(ctx context.Context, throttles []Throttle) error {
+	return d.nft(ctx, RenderThrottles(throttles))
+}
+
+func (d *NetlinkDriver) LookupPort(ctx context.Context, bridge string, mac net.HardwareAddr) (string, error) {
+	br, err := netlink.LinkByName(bridge)
+	if err != nil {
+		return "", fmt.Errorf("bridge %s: %w", bridge, err)
+	}
+	fdb, err := netlink.NeighListExecute(netlink.Ndmsg{Family: syscall.AF_BRIDGE})
+	if err != nil {
+		return "", fmt.Errorf("fdb dump: %w", err)
+	}
+	for _, entry := range fdb {
+		if entry.MasterIndex != br.Attrs().Index || !bytes.Equal(entry.HardwareAddr, mac) {
+			continue
+		}
+		port, err := netlink.LinkByIndex(entry.LinkIndex)
+		if err != nil {
+			return "", err
+		}
+		return port.Attrs().Name, nil
+	}
+	return "", fmt.Errorf("%s not learned on %s", mac, bridge)
+}
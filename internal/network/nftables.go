@@ -0,0 +1,122 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// ============================================================================
+// NFTABLES RENDERING
+// ============================================================================
+
+// Each Axion feature owns a dedicated table and rewrites it atomically.
+// The "declare, delete, redeclare" preamble makes the script idempotent:
+// nft creates the table if missing, drops it, then loads the new contents
+// in a single transaction.
+const natTable = "axion_nat"
+
+// fipTable holds the floating IP 1:1 NAT. Its postrouting chain runs before
+// the masquerade chain (srcnat = 100) so floating traffic keeps its address.
+const fipTable = "axion_fip"
+
+// shapeTable polices throttled instances on the bridge. Each rule owns its
+// own token bucket, so the cap applies separately to each direction.
+const shapeTable = "axion_shape"
+
+// RenderMasquerade produces the nft script for the masquerade table.
+func RenderMasquerade(rules []MasqueradeRule) string {
+	sorted := append([]MasqueradeRule(nil), rules...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Bridge < sorted[j].Bridge })
+
+	var b strings.Builder
+	writeTableReset(&b, "ip", natTable)
+	fmt.Fprintf(&b, "table ip %s {\n", natTable)
+	b.WriteString("\tchain postrouting {\n")
+	b.WriteString("\t\ttype nat hook postrouting priority srcnat; policy accept;\n")
+	for _, r := range sorted {
+		fmt.Fprintf(&b, "\t\tip saddr %s oifname != %q masquerade comment %q\n", r.Subnet, r.Bridge, "axion:"+r.Bridge)
+	}
+	b.WriteString("\t}\n")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// RenderFloatingNAT produces the nft script for the floating IP table.
+func RenderFloatingNAT(bindings []FloatingNAT) string {
+	sorted := append([]FloatingNAT(nil), bindings...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].PublicIP < sorted[j].PublicIP })
+
+	var b strings.Builder
+	writeTableReset(&b, "ip", fipTable)
+	fmt.Fprintf(&b, "table ip %s {\n", fipTable)
+
+	// Inbound from the wire and from the host itself
+	for _, hook := range []string{"prerouting", "output"} {
+		fmt.Fprintf(&b, "\tchain %s {\n", hook)
+		fmt.Fprintf(&b, "\t\ttype nat hook %s priority -100; policy accept;\n", hook)
+		for _, f := range sorted {
+			fmt.Fprintf(&b, "\t\tip daddr %s dnat to %s comment %q\n", f.PublicIP, f.PrivateIP, "axion:fip")
+		}
+		b.WriteString("\t}\n")
+	}
+
+	b.WriteString("\tchain postrouting {\n")
+	b.WriteString("\t\ttype nat hook postrouting priority 90; policy accept;\n")
+	for _, f := range sorted {
+		fmt.Fprintf(&b, "\t\tip saddr %s snat to %s comment %q\n", f.PrivateIP, f.PublicIP, "axion:fip")
+	}
+	b.WriteString("\t}\n")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// RenderThrottles produces the nft script for the bandwidth cap table.
+func RenderThrottles(throttles []Throttle) string {
+	sorted := append([]Throttle(nil), throttles...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Instance < sorted[j].Instance })
+
+	var b strings.Builder
+	writeTableReset(&b, "bridge", shapeTable)
+	fmt.Fprintf(&b, "table bridge %s {\n", shapeTable)
+	for _, hook := range []string{"forward", "output", "input"} {
+		fmt.Fprintf(&b, "\tchain %s {\n", hook)
+		fmt.Fprintf(&b, "\t\ttype filter hook %s priority -10; policy accept;\n", hook)
+		for _, t := range sorted {
+			rate := t.Mbps * 125 // Mbit/s -> kbytes/s
+			comment := fmt.Sprintf("%q", "axion:"+t.Instance)
+			if hook != "input" {
+				fmt.Fprintf(&b, "\t\toifname %q limit rate over %d kbytes/second drop comment %s\n", t.Tap, rate, comment)
+			}
+			if hook != "output" {
+				fmt.Fprintf(&b, "\t\tiifname %q limit rate over %d kbytes/second drop comment %s\n", t.Tap, rate, comment)
+			}
+		}
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func writeTableReset(b *strings.Builder, family, table string) {
+	fmt.Fprintf(b, "table %s %s\n", family, table)
+	fmt.Fprintf(b, "delete table %s %s\n", family, table)
+}
+
+// NftRunner feeds a script to nft. Swappable for tests.
+type NftRunner func(ctx context.Context, script string) error
+
+// ExecNft runs `nft -f -` with the given script on stdin.
+func ExecNft(ctx context.Context, script string) error {
+	cmd := exec.CommandContext(ctx, "nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("nft failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
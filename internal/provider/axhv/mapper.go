@@ -1,6 +1,7 @@
 package axhv
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
@@ -65,12 +66,11 @@ func MapCreateRequestV2(name string, image string, vcpu int, memoryMiB int, disk
 		RootPassword:       password,
 	}
 
-	// Note: Free tier limits are NOT applied here - caller can enforce if needed
+	// Port forward limits depend on the plan; see CheckPortForwards
 	return pbReq, nil
 }
 
 // MapCreateRequest maps the internal CreateInstanceRequest to the protobuf CreateVmRequest.
-// It also enforces Free Tier limitations.
 func MapCreateRequest(req types.Instance, ip string, gateway string) (*pb.CreateVmRequest, error) {
 
 	// Parse Limits
@@ -129,12 +129,7 @@ func MapCreateRequest(req types.Instance, ip string, gateway string) (*pb.Create
 		PortMapTcp:   portMap,
 	}
 
-	// Enforce Free Tier Limits (Hardcoded enforcement for now as requested)
-	// In a real scenario, we might check req.Plan or User context.
-	// Assuming all creations via this path are subject to these rules for the task context "Free Tier Enforcement".
-
-	applyFreeTierLimits(pbReq)
-
+	// Port forward limits depend on the plan; see CheckPortForwards
 	return pbReq, nil
 }
 
@@ -165,44 +160,19 @@ func mapImageToPaths(imageName string) (string, string, error) {
 	}
 }
 
-func applyFreeTierLimits(req *pb.CreateVmRequest) {
-	// Bandwidth: 0 = unlimited (no traffic shaping)
-	// Removed: req.BandwidthLimitMbps = 10
-
-	// 2. Port Limits
-	// As we don't have ports in the generic input yet (usually added later),
-	// we initialize the maps to empty or filtered if they were passed.
-	// If the request had ports (e.g. from a rich request object), we would filter them here.
-	// Since types.Instance doesn't strictly have a list of initial ports in its basic struct
-	// (usually added via AddPort), we ensure the map is initialized to allow strict validation if we were to add them.
-
-	// Example of restricting if we were populating from a source that had ports:
-	limitTcp := 3
-	limitUdp := 1
-
-	if len(req.PortMapTcp) > limitTcp {
-		newMap := make(map[uint32]uint32)
-		i := 0
-		for k, v := range req.PortMapTcp {
-			if i >= limitTcp {
-				break
-			}
-			newMap[k] = v
-			i++
-		}
-		req.PortMapTcp = newMap
-	}
+// ErrPortForwardLimit reports more port forwards than the plan allows.
+var ErrPortForwardLimit = errors.New("too many port forwards")
 
-	if len(req.PortMapUdp) > limitUdp {
-		newMap := make(map[uint32]uint32)
-		i := 0
-		for k, v := range req.PortMapUdp {
-			if i >= limitUdp {
-				break
-			}
-			newMap[k] = v
-			i++
-		}
-		req.PortMapUdp = newMap
+// CheckPortForwards fails when the request forwards more TCP or UDP ports
+// than allowed; a nil limit is unlimited. Requests over the limit are
+// refused rather than truncated, since which ports would survive is
+// arbitrary.
+func CheckPortForwards(req *pb.CreateVmRequest, maxTCP, maxUDP *int) error {
+	if maxTCP != nil && len(req.PortMapTcp) > *maxTCP {
+		return fmt.Errorf("%w: %d TCP forwards requested, %d allowed", ErrPortForwardLimit, len(req.PortMapTcp), *maxTCP)
+	}
+	if maxUDP != nil && len(req.PortMapUdp) > *maxUDP {
+		return fmt.Errorf("%w: %d UDP forwards requested, %d allowed", ErrPortForwardLimit, len(req.PortMapUdp), *maxUDP)
 	}
+	return nil
 }
@@ -1,10 +1,14 @@
 package lxc
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -113,6 +117,86 @@ func NewClient() (*InstanceService, error) {
 	}, nil
 }
 
+// wait espera a operação terminar. Se ctx terminar antes (job cancelado
+// ou timeout), pede ao LXD para cancelar a operação, quando ela permite, e
+// retorna o erro de ctx.
+func wait(ctx context.Context, op lxd.Operation) error {
+	err := op.WaitContext(ctx)
+	if ctx.Err() != nil {
+		if cancelErr := op.Cancel(); cancelErr != nil {
+			log.Printf("[LXD Provider] Operação não cancelável: %v", cancelErr)
+		}
+		return ctx.Err()
+	}
+	return err
+}
+
+// Progress recebe o percentual concluído e a etapa de uma operação longa.
+// Pode ser nil.
+type Progress func(percent int, stage string)
+
+func (p Progress) report(percent int, stage string) {
+	if p != nil {
+		p(percent, stage)
+	}
+}
+
+var progressPercent = regexp.MustCompile(`(\d+)%`)
+
+// operationPercent lê o percentual que o LXD publica nos metadados de uma
+// operação, como {"create_instance_from_image_unpack_progress": "Unpack: 45%"}.
+func operationPercent(metadata map[string]interface{}) (int, bool) {
+	for key, value := range metadata {
+		text, ok := value.(string)
+		if !ok || !strings.HasSuffix(key, "_progress") {
+			continue
+		}
+		if m := progressPercent.FindStringSubmatch(text); m != nil {
+			n, err := strconv.Atoi(m[1])
+			if err == nil && n <= 100 {
+				return n, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// waitProgress é wait relatando em progress, entre from e to, o andamento
+// da operação na etapa stage.
+func waitProgress(ctx context.Context, op lxd.Operation, progress Progress, from, to int, stage string) error {
+	progress.report(from, stage)
+	if progress == nil {
+		return wait(ctx, op)
+	}
+
+	var mu sync.Mutex
+	last, done := from, false
+	target, err := op.AddHandler(func(o api.Operation) {
+		n, ok := operationPercent(o.Metadata)
+		if !ok {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		// Só relata avanços, e nada depois que a espera terminou
+		if percent := from + (to-from)*n/100; !done && percent > last {
+			last = percent
+			progress(percent, stage)
+		}
+	})
+	if err != nil {
+		log.Printf("[LXD Provider] Progresso da operação indisponível: %v", err)
+	} else {
+		defer func() {
+			mu.Lock()
+			done = true
+			mu.Unlock()
+			op.RemoveHandler(target)
+		}()
+	}
+	return wait(ctx, op)
+}
+
 // CheckPortAvailability verifica se a porta do host está livre e dentro do range permitido.
 func (s *InstanceService) CheckPortAvailability(hostPort int) error {
 	if hostPort < 10000 || hostPort > 60000 {
@@ -297,7 +381,7 @@ func (s *InstanceService) ListInstances() ([]InstanceMetric, error) {
 	return metrics, nil
 }
 
-func (s *InstanceService) UpdateInstanceState(name string, action string) error {
+func (s *InstanceService) UpdateInstanceState(ctx context.Context, name string, action string) error {
 	if _, busy := s.locks.LoadOrStore(name, true); busy {
 		return fmt.Errorf("LOCKED: container '%s' já está processando um comando. Tente novamente em alguns segundos", name)
 	}
@@ -315,25 +399,19 @@ func (s *InstanceService) UpdateInstanceState(name string, action string) error
 		return fmt.Errorf("falha ao solicitar mudança de estado: %w", err)
 	}
 
-	done := make(chan error, 1)
-	go func() {
-		done <- op.Wait()
-	}()
-
-	select {
-	case err := <-done:
-		if err != nil {
-			return fmt.Errorf("erro durante execução da operação: %w", err)
+	waitCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if err := wait(waitCtx, op); err != nil {
+		if ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("TIMEOUT: operação demorou mais que 30s e foi abortada pelo backend. O estado do container é incerto")
 		}
-		log.Printf("[LXD Provider] Ação '%s' em '%s' concluída com sucesso (Lock liberado)", action, name)
-		return nil
-
-	case <-time.After(30 * time.Second):
-		return fmt.Errorf("TIMEOUT: operação demorou mais que 30s e foi abortada pelo backend. O estado do container é incerto")
+		return fmt.Errorf("erro durante execução da operação: %w", err)
 	}
+	log.Printf("[LXD Provider] Ação '%s' em '%s' concluída com sucesso (Lock liberado)", action, name)
+	return nil
 }
 
-func (s *InstanceService) UpdateInstanceLimits(name string, memoryLimit string, cpuLimit string) error {
+func (s *InstanceService) UpdateInstanceLimits(ctx context.Context, name string, memoryLimit string, cpuLimit string) error {
 	if _, busy := s.locks.LoadOrStore(name, true); busy {
 		return fmt.Errorf("LOCKED: container '%s' já está processando um comando. Tente novamente em alguns segundos", name)
 	}
@@ -367,25 +445,21 @@ func (s *InstanceService) UpdateInstanceLimits(name string, memoryLimit string,
 		return fmt.Errorf("falha ao solicitar atualização de limites: %w", err)
 	}
 
-	done := make(chan error, 1)
-	go func() {
-		done <- op.Wait()
-	}()
-
-	select {
-	case err := <-done:
-		if err != nil {
-			return fmt.Errorf("erro ao aplicar novos limites: %w", err)
+	waitCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if err := wait(waitCtx, op); err != nil {
+		if ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("TIMEOUT: atualização de limites demorou muito")
 		}
-		log.Printf("[LXD Provider] Limites atualizados com sucesso para %s", name)
-		return nil
-	case <-time.After(30 * time.Second):
-		return fmt.Errorf("TIMEOUT: atualização de limites demorou muito")
+		return fmt.Errorf("erro ao aplicar novos limites: %w", err)
 	}
+	log.Printf("[LXD Provider] Limites atualizados com sucesso para %s", name)
+	return nil
 }
 
 // CreateInstance cria um novo container ou VM a partir de uma imagem LOCAL com suporte a Cloud-Init.
-func (s *InstanceService) CreateInstance(name string, imageAlias string, instanceType string, limits map[string]string, userData string) error {
+// O andamento é relatado em progress.
+func (s *InstanceService) CreateInstance(ctx context.Context, name string, imageAlias string, instanceType string, limits map[string]string, userData string, progress Progress) error {
 	// 1. Lock check
 	if _, busy := s.locks.LoadOrStore(name, true); busy {
 		return fmt.Errorf("LOCKED: %s está ocupado", name)
@@ -448,7 +522,7 @@ func (s *InstanceService) CreateInstance(name string, imageAlias string, instanc
 
 	// 5. Esperar a Operação (Aqui que a VM demora 10s+)
 	log.Printf("[Create] Aguardando operação do LXD...")
-	if err := op.Wait(); err != nil {
+	if err := waitProgress(ctx, op, progress, 20, 80, "criando a partir da imagem"); err != nil {
 		return fmt.Errorf("LXD falhou durante a criação: %w", err)
 	}
 
@@ -461,6 +535,7 @@ func (s *InstanceService) CreateInstance(name string, imageAlias string, instanc
 
 	// 7. Auto-Start: Iniciar a instância imediatamente
 	log.Printf("[Create] Iniciando boot de %s...", name)
+	progress.report(85, "iniciando instância")
 	reqState := api.InstanceStatePut{
 		Action:  "start",
 		Timeout: -1,
@@ -471,7 +546,7 @@ func (s *InstanceService) CreateInstance(name string, imageAlias string, instanc
 		return fmt.Errorf("falha ao solicitar start pós-criação: %w", err)
 	}
 
-	if err := opStart.Wait(); err != nil {
+	if err := wait(ctx, opStart); err != nil {
 		return fmt.Errorf("falha ao iniciar instância: %w", err)
 	}
 
@@ -479,8 +554,9 @@ func (s *InstanceService) CreateInstance(name string, imageAlias string, instanc
 	return nil
 }
 
-// CreateInstanceWithISO creates a new VM with an ISO file for installation
-func (s *InstanceService) CreateInstanceWithISO(name string, imageAlias string, instanceType string, limits map[string]string, userData string, isoPath string) error {
+// CreateInstanceWithISO creates a new VM with an ISO file for installation,
+// reporting how far it got in progress
+func (s *InstanceService) CreateInstanceWithISO(ctx context.Context, name string, imageAlias string, instanceType string, limits map[string]string, userData string, isoPath string, progress Progress) error {
 	// 1. Lock check
 	if _, busy := s.locks.LoadOrStore(name, true); busy {
 		return fmt.Errorf("LOCKED: %s está ocupado", name)
@@ -561,7 +637,7 @@ func (s *InstanceService) CreateInstanceWithISO(name string, imageAlias string,
 
 	// 6. Esperar a Operação
 	log.Printf("[Create] Aguardando operação do LXD...")
-	if err := op.Wait(); err != nil {
+	if err := waitProgress(ctx, op, progress, 20, 80, "criando VM"); err != nil {
 		return fmt.Errorf("LXD falhou durante a criação da VM com ISO: %w", err)
 	}
 
@@ -574,6 +650,7 @@ func (s *InstanceService) CreateInstanceWithISO(name string, imageAlias string,
 
 	// 8. Auto-Start: Iniciar a instância imediatamente
 	log.Printf("[Create] Iniciando boot de %s a partir do ISO...", name)
+	progress.report(85, "iniciando VM pelo ISO")
 	reqState := api.InstanceStatePut{
 		Action:  "start",
 		Timeout: -1,
@@ -584,14 +661,14 @@ func (s *InstanceService) CreateInstanceWithISO(name string, imageAlias string,
 		return fmt.Errorf("falha ao solicitar start pós-criação: %w", err)
 	}
 
-	if err := opStart.Wait(); err != nil {
+	if err := wait(ctx, opStart); err != nil {
 		return fmt.Errorf("falha ao iniciar instância: %w", err)
 	}
 
 	log.Printf("[Create] Sucesso confirmado para VM com ISO: %s", name)
 	return nil
 }
-func (s *InstanceService) DeleteInstance(name string) error {
+func (s *InstanceService) DeleteInstance(ctx context.Context, name string, progress Progress) error {
 	if _, busy := s.locks.LoadOrStore(name, true); busy {
 		return fmt.Errorf("LOCKED: container '%s' já está sendo operado", name)
 	}
@@ -609,6 +686,7 @@ func (s *InstanceService) DeleteInstance(name string) error {
 
 	if strings.ToUpper(inst.Status) == "RUNNING" {
 		log.Printf("[LXD Provider] Parando '%s' antes da exclusão...", name)
+		progress.report(20, "parando instância")
 		req := api.InstanceStatePut{
 			Action:  "stop",
 			Timeout: -1,
@@ -618,7 +696,7 @@ func (s *InstanceService) DeleteInstance(name string) error {
 		if err != nil {
 			return fmt.Errorf("falha ao parar container: %w", err)
 		}
-		if err := op.Wait(); err != nil {
+		if err := wait(ctx, op); err != nil {
 			return fmt.Errorf("erro ao aguardar parada do container: %w", err)
 		}
 	}
@@ -628,7 +706,7 @@ func (s *InstanceService) DeleteInstance(name string) error {
 		return fmt.Errorf("falha ao solicitar exclusão: %w", err)
 	}
 
-	if err := op.Wait(); err != nil {
+	if err := waitProgress(ctx, op, progress, 50, 95, "removendo instância"); err != nil {
 		return fmt.Errorf("erro durante a exclusão do container: %w", err)
 	}
 
@@ -646,7 +724,7 @@ func (s *InstanceService) ListSnapshots(instanceName string) ([]api.InstanceSnap
 	return snaps, nil
 }
 
-func (s *InstanceService) CreateSnapshot(instanceName string, snapshotName string) error {
+func (s *InstanceService) CreateSnapshot(ctx context.Context, instanceName string, snapshotName string, progress Progress) error {
 	if _, busy := s.locks.LoadOrStore(instanceName, true); busy {
 		return fmt.Errorf("LOCKED: container '%s' já está sendo operado", instanceName)
 	}
@@ -663,7 +741,7 @@ func (s *InstanceService) CreateSnapshot(instanceName string, snapshotName strin
 		return fmt.Errorf("falha ao solicitar criação de snapshot: %w", err)
 	}
 
-	if err := op.Wait(); err != nil {
+	if err := waitProgress(ctx, op, progress, 10, 95, "criando snapshot"); err != nil {
 		return fmt.Errorf("erro durante a criação do snapshot: %w", err)
 	}
 
@@ -671,7 +749,7 @@ func (s *InstanceService) CreateSnapshot(instanceName string, snapshotName strin
 	return nil
 }
 
-func (s *InstanceService) RestoreSnapshot(instanceName string, snapshotName string) error {
+func (s *InstanceService) RestoreSnapshot(ctx context.Context, instanceName string, snapshotName string, progress Progress) error {
 	if _, busy := s.locks.LoadOrStore(instanceName, true); busy {
 		return fmt.Errorf("LOCKED: container '%s' já está sendo operado", instanceName)
 	}
@@ -686,6 +764,7 @@ func (s *InstanceService) RestoreSnapshot(instanceName string, snapshotName stri
 
 	if strings.ToUpper(inst.Status) == "RUNNING" {
 		log.Printf("[LXD Provider] Parando container para restauração...")
+		progress.report(20, "parando instância")
 		stopReq := api.InstanceStatePut{
 			Action:  "stop",
 			Timeout: -1,
@@ -695,7 +774,7 @@ func (s *InstanceService) RestoreSnapshot(instanceName string, snapshotName stri
 		if err != nil {
 			return fmt.Errorf("falha ao parar container: %w", err)
 		}
-		if err := op.Wait(); err != nil {
+		if err := wait(ctx, op); err != nil {
 			return fmt.Errorf("erro ao aguardar parada: %w", err)
 		}
 
@@ -717,7 +796,7 @@ func (s *InstanceService) RestoreSnapshot(instanceName string, snapshotName stri
 		return fmt.Errorf("falha ao solicitar restauração: %w", err)
 	}
 
-	if err := op.Wait(); err != nil {
+	if err := waitProgress(ctx, op, progress, 40, 95, "restaurando snapshot"); err != nil {
 		return fmt.Errorf("erro durante a restauração do snapshot: %w", err)
 	}
 
@@ -725,7 +804,7 @@ func (s *InstanceService) RestoreSnapshot(instanceName string, snapshotName stri
 	return nil
 }
 
-func (s *InstanceService) DeleteSnapshot(instanceName string, snapshotName string) error {
+func (s *InstanceService) DeleteSnapshot(ctx context.Context, instanceName string, snapshotName string) error {
 	if _, busy := s.locks.LoadOrStore(instanceName, true); busy {
 		return fmt.Errorf("LOCKED: container '%s' já está sendo operado", instanceName)
 	}
@@ -738,7 +817,7 @@ func (s *InstanceService) DeleteSnapshot(instanceName string, snapshotName strin
 		return fmt.Errorf("falha ao solicitar exclusão de snapshot: %w", err)
 	}
 
-	if err := op.Wait(); err != nil {
+	if err := wait(ctx, op); err != nil {
 		return fmt.Errorf("erro durante a exclusão do snapshot: %w", err)
 	}
 
@@ -747,7 +826,7 @@ func (s *InstanceService) DeleteSnapshot(instanceName string, snapshotName strin
 
 // --- Port Forwarding (Proxy Devices) ---
 
-func (s *InstanceService) AddProxyDevice(instanceName string, hostPort int, containerPort int, protocol string) error {
+func (s *InstanceService) AddProxyDevice(ctx context.Context, instanceName string, hostPort int, containerPort int, protocol string) error {
 	if _, busy := s.locks.LoadOrStore(instanceName, true); busy {
 		return fmt.Errorf("LOCKED: container '%s' já está sendo operado", instanceName)
 	}
@@ -835,7 +914,7 @@ func (s *InstanceService) AddProxyDevice(instanceName string, hostPort int, cont
 		return fmt.Errorf("falha ao adicionar porta: %w", err)
 	}
 
-	if err := op.Wait(); err != nil {
+	if err := wait(ctx, op); err != nil {
 		return fmt.Errorf("erro ao aplicar proxy device: %w", err)
 	}
 
@@ -843,7 +922,7 @@ func (s *InstanceService) AddProxyDevice(instanceName string, hostPort int, cont
 	return nil
 }
 
-func (s *InstanceService) RemoveProxyDevice(instanceName string, hostPort int) error {
+func (s *InstanceService) RemoveProxyDevice(ctx context.Context, instanceName string, hostPort int) error {
 	if _, busy := s.locks.LoadOrStore(instanceName, true); busy {
 		return fmt.Errorf("LOCKED: container '%s' já está sendo operado", instanceName)
 	}
@@ -877,7 +956,7 @@ func (s *InstanceService) RemoveProxyDevice(instanceName string, hostPort int) e
 		return fmt.Errorf("falha ao remover porta: %w", err)
 	}
 
-	if err := op.Wait(); err != nil {
+	if err := wait(ctx, op); err != nil {
 		return fmt.Errorf("erro ao remover proxy device: %w", err)
 	}
 
@@ -1,6 +1,7 @@
 package scheduler
 
 import (
+	"context"
 	"database/sql"
 	"log"
 	"sort"
@@ -61,7 +62,7 @@ func (s *BackupScheduler) AddInstanceJob(instance types.Instance) {
 	_, err := s.cron.AddFunc(instance.BackupSchedule, func() {
 		log.Printf("Running backup for instance %s", instance.Name)
 		snapshotName := "auto-backup-" + time.Now().UTC().Format("2006-01-02-15-04-05")
-		if err := s.lxcClient.CreateSnapshot(instance.Name, snapshotName); err != nil {
+		if err := s.lxcClient.CreateSnapshot(context.Background(), instance.Name, snapshotName, nil); err != nil {
 			log.Printf("Error creating snapshot for instance %s: %v", instance.Name, err)
 			return
 		}
@@ -86,7 +87,7 @@ func (s *BackupScheduler) AddInstanceJob(instance types.Instance) {
 
 			for i := 0; i < len(autoBackups)-instance.BackupRetention; i++ {
 				log.Printf("Deleting old backup %s for instance %s", autoBackups[i].Name, instance.Name)
-				if err := s.lxcClient.DeleteSnapshot(instance.Name, autoBackups[i].Name); err != nil {
+				if err := s.lxcClient.DeleteSnapshot(context.Background(), instance.Name, autoBackups[i].Name); err != nil {
 					log.Printf("Error deleting snapshot %s for instance %s: %v", autoBackups[i].Name, instance.Name, err)
 				}
 			}
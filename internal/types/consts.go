@@ -28,6 +28,9 @@ const (
 	// Port Forwarding Jobs
 	JobTypeAddPort    JobType = "add_port"
 	JobTypeRemovePort JobType = "remove_port"
+
+	// Workflow: agrupa jobs (passos) que rodam conforme suas dependências
+	JobTypeWorkflow JobType = "workflow"
 )
 
 // Constantes de retry
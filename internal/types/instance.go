@@ -29,4 +29,9 @@ type Instance struct {
 	DiskUsage          int64               `json:"disk_usage"`           // Bytes usados
 	DiskLimit          int64               `json:"disk_limit"`           // Bytes totais (tamanho do disco)
 	BandwidthLimitMbps int                 `json:"bandwidth_limit_mbps"` // 0 = unlimited
+	VCPU               int                 `json:"vcpu"`                 // Size counted against quotas
+	MemoryMiB          int                 `json:"memory_mib"`
+	DiskGB             int                 `json:"disk_gb"`
+	OwnerID            *int                `json:"owner_id,omitempty"`   // User who created the VM
+	ProjectID          *int                `json:"project_id,omitempty"` // Project owning the VM (nil = admins only)
 }
@@ -0,0 +1,81 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"aexon/internal/db"
+	"aexon/internal/provider/axhv"
+	"aexon/internal/provider/axhv/pb"
+	"aexon/internal/types"
+)
+
+// AxHVProvider executa os jobs pelo daemon AxHV. Só as mudanças de estado
+// têm RPC próprio; os demais tipos continuam nos handlers da API.
+type AxHVProvider struct {
+	client *axhv.Client
+}
+
+func NewAxHVProvider(client *axhv.Client) *AxHVProvider {
+	return &AxHVProvider{client: client}
+}
+
+func (p *AxHVProvider) Supports(t types.JobType) bool {
+	return t == types.JobTypeStateChange
+}
+
+func (p *AxHVProvider) Execute(ctx context.Context, job *db.Job, progress Progress) error {
+	if job.Type != types.JobTypeStateChange {
+		return fmt.Errorf("%w: %s", ErrUnsupported, job.Type)
+	}
+	var payload struct {
+		Action string `json:"action"`
+	}
+	if err := decodePayload(job, &payload); err != nil {
+		return err
+	}
+
+	var rpc func(context.Context, string) (*pb.VmResponse, error)
+	usage := db.UsageRunning
+	switch payload.Action {
+	case "start":
+		rpc = p.client.StartVm
+	case "stop":
+		rpc, usage = p.client.StopVm, db.UsageStopped
+	case "reboot":
+		rpc = p.client.RebootVm
+	case "pause":
+		// Pausada, a VM mantém seus recursos e segue medida como em execução
+		rpc, usage = p.client.PauseVm, ""
+	case "resume":
+		rpc = p.client.ResumeVm
+	default:
+		return fmt.Errorf("%w: ação desconhecida %q", ErrInvalidPayload, payload.Action)
+	}
+
+	progress.Stage(30, "aguardando o AxHV")
+	progress.Logf(db.JobLogInfo, map[string]interface{}{"action": payload.Action}, "Enviando %s ao AxHV", payload.Action)
+	resp, err := rpc(ctx, job.Target)
+	if err != nil {
+		return fmt.Errorf("AxHV RPC falhou: %w", err)
+	}
+	if !resp.Success {
+		return fmt.Errorf("AxHV: %s", resp.Message)
+	}
+	progress.Logf(db.JobLogInfo, map[string]interface{}{"action": payload.Action, "message": resp.Message}, "AxHV concluiu %s", payload.Action)
+
+	// Como o handler de estado, registra a transição sem esperar o medidor
+	if usage != "" {
+		progress.Stage(90, "registrando uso")
+		inst, err := db.NewInstanceRepository(db.GetService()).Get(ctx, job.Target)
+		if err == nil {
+			err = db.NewUsageRepository(db.GetService()).Observe(ctx, inst, usage, time.Now())
+		}
+		if err != nil {
+			log.Printf("[Worker System] Erro ao registrar uso de %s como %s: %v", job.Target, usage, err)
+		}
+	}
+	return nil
+}
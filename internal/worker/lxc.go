@@ -0,0 +1,139 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"aexon/internal/db"
+	"aexon/internal/provider/lxc"
+	"aexon/internal/service"
+	"aexon/internal/types"
+)
+
+// LXCProvider executa os jobs num servidor LXD.
+type LXCProvider struct {
+	client *lxc.InstanceService
+}
+
+func NewLXCProvider(client *lxc.InstanceService) *LXCProvider {
+	return &LXCProvider{client: client}
+}
+
+func (p *LXCProvider) Supports(t types.JobType) bool {
+	_, ok := jobStages[t]
+	return ok
+}
+
+// lxcProgress repassa ao job o andamento das operações do LXD, registrando
+// no log do job cada etapa nova.
+func lxcProgress(progress Progress) lxc.Progress {
+	var mu sync.Mutex
+	last := ""
+	return func(percent int, stage string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if stage != last {
+			last = stage
+			progress.Logf(db.JobLogInfo, map[string]interface{}{"progress": percent}, "Etapa: %s", stage)
+		}
+		progress.Stage(percent, stage)
+	}
+}
+
+func (p *LXCProvider) Execute(ctx context.Context, job *db.Job, progress Progress) error {
+	switch job.Type {
+	case types.JobTypeStateChange:
+		var payload struct {
+			Action string `json:"action"`
+		}
+		if err := decodePayload(job, &payload); err != nil {
+			return err
+		}
+		return p.client.UpdateInstanceState(ctx, job.Target, payload.Action)
+
+	case types.JobTypeUpdateLimits:
+		var payload struct {
+			Memory string `json:"memory"`
+			CPU    string `json:"cpu"`
+		}
+		if err := decodePayload(job, &payload); err != nil {
+			return err
+		}
+		return p.client.UpdateInstanceLimits(ctx, job.Target, payload.Memory, payload.CPU)
+
+	case types.JobTypeCreateInstance:
+		var payload struct {
+			Name     string            `json:"name"`
+			Image    string            `json:"image"`
+			Limits   map[string]string `json:"limits"`
+			UserData string            `json:"user_data"` // Adicionado suporte a user_data
+			Type     string            `json:"type"`      // Instance type: "container" or "virtual-machine"
+			ISOImage string            `json:"iso_image"` // Nome do arquivo ISO para boot customizado (opcional)
+		}
+		if err := decodePayload(job, &payload); err != nil {
+			return err
+		}
+		// If Type is empty, default to "container"
+		instanceType := payload.Type
+		if instanceType == "" {
+			instanceType = "container"
+		}
+
+		// If ISOImage is provided, create VM with ISO boot
+		if payload.ISOImage != "" {
+			// Get the full ISO path using the storage service
+			storageService, err := service.NewStorageService()
+			if err != nil {
+				return fmt.Errorf("failed to initialize storage service: %v", err)
+			}
+			isoPath := storageService.GetISOPath(payload.ISOImage)
+			progress.Logf(db.JobLogInfo, map[string]interface{}{"iso": isoPath}, "Criando VM com boot por ISO")
+			return p.client.CreateInstanceWithISO(ctx, payload.Name, payload.Image, instanceType, payload.Limits, payload.UserData, isoPath, lxcProgress(progress))
+		}
+		progress.Logf(db.JobLogInfo, map[string]interface{}{"image": payload.Image, "type": instanceType}, "Criando instância a partir da imagem")
+		return p.client.CreateInstance(ctx, payload.Name, payload.Image, instanceType, payload.Limits, payload.UserData, lxcProgress(progress))
+
+	case types.JobTypeDeleteInstance:
+		return p.client.DeleteInstance(ctx, job.Target, lxcProgress(progress))
+
+	// --- Snapshot Operations ---
+	case types.JobTypeCreateSnapshot, types.JobTypeRestoreSnapshot, types.JobTypeDeleteSnapshot:
+		var payload struct {
+			SnapshotName string `json:"snapshot_name"`
+		}
+		if err := decodePayload(job, &payload); err != nil {
+			return err
+		}
+		switch job.Type {
+		case types.JobTypeCreateSnapshot:
+			return p.client.CreateSnapshot(ctx, job.Target, payload.SnapshotName, lxcProgress(progress))
+		case types.JobTypeRestoreSnapshot:
+			return p.client.RestoreSnapshot(ctx, job.Target, payload.SnapshotName, lxcProgress(progress))
+		default:
+			return p.client.DeleteSnapshot(ctx, job.Target, payload.SnapshotName)
+		}
+
+	// --- Port Forwarding ---
+	case types.JobTypeAddPort:
+		var payload struct {
+			HostPort      int    `json:"host_port"`
+			ContainerPort int    `json:"container_port"`
+			Protocol      string `json:"protocol"`
+		}
+		if err := decodePayload(job, &payload); err != nil {
+			return err
+		}
+		return p.client.AddProxyDevice(ctx, job.Target, payload.HostPort, payload.ContainerPort, payload.Protocol)
+
+	case types.JobTypeRemovePort:
+		var payload struct {
+			HostPort int `json:"host_port"`
+		}
+		if err := decodePayload(job, &payload); err != nil {
+			return err
+		}
+		return p.client.RemoveProxyDevice(ctx, job.Target, payload.HostPort)
+	}
+	return fmt.Errorf("%w: %s", ErrUnsupported, job.Type)
+}
@@ -0,0 +1,42 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"aexon/internal/db"
+	"aexon/internal/types"
+)
+
+// Erros que uma nova tentativa não resolve: o job falha sem retry.
+var (
+	ErrUnsupported    = errors.New("tipo de job não suportado pelo provider")
+	ErrInvalidPayload = errors.New("payload inválido")
+)
+
+// Provider executa os jobs no hypervisor.
+type Provider interface {
+	// Supports diz se o provider executa jobs do tipo t.
+	Supports(t types.JobType) bool
+	// Execute executa o job, relatando o andamento em progress. ctx é
+	// cancelado quando o job é cancelado ou estoura JobTimeout.
+	Execute(ctx context.Context, job *db.Job, progress Progress) error
+}
+
+// Progress recebe o andamento de um job em execução.
+type Progress interface {
+	// Stage marca a etapa em que o job está e o percentual concluído.
+	Stage(percent int, stage string)
+	// Logf grava uma linha de log do job, com campos estruturados opcionais.
+	Logf(level string, fields map[string]interface{}, format string, args ...interface{})
+}
+
+// decodePayload lê o payload JSON do job em v.
+func decodePayload(job *db.Job, v interface{}) error {
+	if err := json.Unmarshal([]byte(job.Payload), v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+	return nil
+}
@@ -2,249 +2,511 @@ package worker
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math"
+	"sync"
 	"time"
 
 	"aexon/internal/db"
 	"aexon/internal/events"
-	"aexon/internal/provider/lxc"
-	"aexon/internal/service"
 	"aexon/internal/types"
-)
 
-var JobQueue chan string
+	"github.com/lib/pq"
+)
 
 // Timeout aumentado para suportar criações (download de imagem)
 const JobTimeout = 5 * time.Minute
 
-func Init(numWorkers int, lxcClient *lxc.InstanceService) {
-	JobQueue = make(chan string, 100)
+// ErrCanceled é a causa do cancelamento do contexto de um job cancelado
+// pela API.
+var ErrCanceled = errors.New("job cancelado")
+
+// ErrLeaseLost é a causa do cancelamento do contexto de um job cujo lease
+// não pôde ser renovado: o job já não está em execução por este worker.
+var ErrLeaseLost = errors.New("lease do job perdido")
+
+// PollInterval é o intervalo máximo entre buscas por jobs prontos, caso
+// uma notificação (LISTEN/NOTIFY) se perca.
+const PollInterval = 5 * time.Second
+
+// RecoverInterval é o intervalo entre as buscas por jobs cujo lease
+// expirou (db.JobLease), em qualquer processo, para devolvê-los à fila.
+const RecoverInterval = 30 * time.Second
+
+// queue é a parte de db.JobRepository de que o pool precisa.
+type queue interface {
+	Claim(ctx context.Context, limits db.JobLimits) (*db.Job, error)
+	Get(ctx context.Context, id string) (*db.Job, error)
+	Heartbeat(ctx context.Context, id string, attempt int) error
+	Retry(ctx context.Context, id string, attempt int, errorMsg string, at time.Time) error
+	MarkCompleted(ctx context.Context, id string, attempt int) error
+	MarkFailed(ctx context.Context, id string, attempt int, errorMsg string, isFatal bool) error
+	NextRunAfter(ctx context.Context, limits db.JobLimits) (time.Time, bool, error)
+	RecoverStuckJobs(ctx context.Context) (int, error)
+	AdvanceWorkflow(ctx context.Context, id string) (*db.Job, error)
+	SetProgress(ctx context.Context, id string, progress int, stage string) error
+	AppendLog(ctx context.Context, l *db.JobLog) error
+}
+
+// Pool executa os jobs pendentes da tabela jobs. Cada worker reivindica um
+// job por vez (SELECT ... FOR UPDATE SKIP LOCKED), então vários processos
+// podem partilhar a mesma fila.
+type Pool struct {
+	repo     queue
+	provider Provider
+	limits   db.JobLimits
+	renew    time.Duration // Intervalo entre renovações do lease
+	wake     chan struct{}
+	stop     chan struct{}
+	wg       sync.WaitGroup
+
+	mu      sync.Mutex
+	running map[string]context.CancelCauseFunc // Por ID do job
+}
+
+var defaultPool *Pool
 
-	if err := db.RecoverStuckJobs(); err != nil {
-		log.Printf("[Worker System] Erro ao recuperar jobs: %v", err)
+// Init inicia numWorkers workers, que executam os jobs no provider, e a
+// recuperação periódica de jobs presos. Os limites valem para todos os
+// processos que partilham a fila. Sem provider nenhum job poderia rodar,
+// então nenhum worker é iniciado e Init retorna nil.
+func Init(numWorkers int, provider Provider, limits db.JobLimits) *Pool {
+	if provider == nil {
+		log.Println("[Worker System] Nenhum provider configurado; workers não iniciados")
+		return nil
 	}
+	p := newPool(db.NewJobRepository(db.GetService()), provider, limits, numWorkers)
 
-	for i := 0; i < numWorkers; i++ {
-		go worker(i, lxcClient)
+	listener, err := db.GetService().ListenJobs()
+	if err != nil {
+		log.Printf("[Worker System] LISTEN indisponível, usando polling a cada %v: %v", PollInterval, err)
+	} else {
+		p.wg.Add(1)
+		go func() {
+			defer listener.Close()
+			p.listen(listener.Notify)
+		}()
 	}
+
+	p.start(numWorkers)
+	defaultPool = p
 	log.Printf("[Worker System] Iniciados %d workers", numWorkers)
+	return p
 }
 
-func DispatchJob(jobID string) {
-	JobQueue <- jobID
+func newPool(repo queue, provider Provider, limits db.JobLimits, numWorkers int) *Pool {
+	return &Pool{
+		repo:     repo,
+		provider: provider,
+		limits:   limits,
+		renew:    db.JobLease / 3,
+		wake:     make(chan struct{}, numWorkers),
+		stop:     make(chan struct{}),
+		running:  make(map[string]context.CancelCauseFunc),
+	}
 }
 
-func worker(id int, lxcClient *lxc.InstanceService) {
-	log.Printf("[Worker %d] Pronto", id)
-	for jobID := range JobQueue {
-		processJob(id, jobID, lxcClient)
+// start inicia a recuperação de jobs presos e os workers.
+func (p *Pool) start(numWorkers int) {
+	p.wg.Add(1)
+	go p.recoverLoop()
+
+	for i := 0; i < numWorkers; i++ {
+		p.wg.Add(1)
+		go p.worker(i)
 	}
 }
 
-func processJob(workerID int, jobID string, lxcClient *lxc.InstanceService) {
-	if err := db.MarkJobStarted(jobID); err != nil {
-		log.Printf("[Worker %d] Erro ao iniciar job %s: %v", workerID, jobID, err)
-		return
+// DispatchJob acorda um worker para um job já gravado na tabela. Nunca
+// bloqueia: o job espera na tabela até um worker ficar livre.
+func DispatchJob(jobID string) {
+	if defaultPool != nil {
+		defaultPool.notify()
 	}
+}
 
-	job, err := db.GetJob(jobID)
-	if err != nil {
-		log.Printf("[Worker %d] Erro ao ler job %s: %v", workerID, jobID, err)
-		return
+// Supports diz se os workers executam jobs do tipo t, para que a API
+// recuse os que ficariam na fila só para falhar.
+func Supports(t types.JobType) bool {
+	return defaultPool != nil && defaultPool.provider.Supports(t)
+}
+
+// CancelJob interrompe o job, se estiver em execução neste processo. O
+// job já deve estar marcado como cancelado no banco; os outros processos
+// ficam sabendo pelo NOTIFY de db.JobsCanceledChannel.
+func CancelJob(jobID string) {
+	if defaultPool != nil {
+		defaultPool.cancel(jobID)
 	}
+}
 
-	events.Publish(events.Event{
-		Type:      events.JobUpdate,
-		JobID:     job.ID,
-		Target:    job.Target,
-		Payload:   job,
-		Timestamp: time.Now().Unix(),
-	})
+func (p *Pool) cancel(jobID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cancel, ok := p.running[jobID]; ok {
+		cancel(ErrCanceled)
+	}
+}
 
-	log.Printf("[Worker %d] Executando Job %s (%s em %s) - Tentativa %d/%d",
-		workerID, job.ID, job.Type, job.Target, job.AttemptCount, types.MaxRetries)
+func (p *Pool) notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default: // Todos os workers já foram acordados
+	}
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), JobTimeout)
-	defer cancel()
+// listen acorda os workers a cada NOTIFY de db.JobsChannel e cancela os
+// jobs notificados em db.JobsCanceledChannel.
+func (p *Pool) listen(notifications <-chan *pq.Notification) {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case n := <-notifications:
+			switch {
+			case n == nil:
+				// Após uma reconexão: notificações podem ter sido perdidas
+				p.notify()
+			case n.Channel == db.JobsCanceledChannel:
+				p.cancel(n.Extra)
+			default:
+				p.notify()
+			}
+		}
+	}
+}
 
-	execErr := executeLogic(ctx, job, lxcClient)
+// recoverLoop devolve à fila, a cada RecoverInterval, os jobs cujo worker
+// sumiu sem renovar o lease, e acorda os workers para eles.
+func (p *Pool) recoverLoop() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(RecoverInterval)
+	defer ticker.Stop()
+	for {
+		n, err := p.repo.RecoverStuckJobs(context.Background())
+		if err != nil {
+			log.Printf("[Worker System] Erro ao recuperar jobs: %v", err)
+		} else if n > 0 {
+			p.notify()
+		}
 
-	if execErr != nil {
-		log.Printf("[Worker %d] Job %s FALHOU: %v", workerID, job.ID, execErr)
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
 
-		isFatal := job.AttemptCount >= types.MaxRetries
-		if err := db.MarkJobFailed(job.ID, execErr.Error(), isFatal); err != nil {
-			log.Printf("[Worker %d] Erro ao atualizar status de falha: %v", workerID, err)
+// heartbeat renova o lease do job enquanto ctx não termina. Se o job
+// deixou de estar em execução (cancelado, ou recuperado após o lease
+// expirar), cancela ctx com ErrLeaseLost.
+func (p *Pool) heartbeat(ctx context.Context, job *db.Job, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(p.renew)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := p.repo.Heartbeat(context.Background(), job.ID, job.AttemptCount)
+		if errors.Is(err, db.ErrJobNotRunning) {
+			cancel(ErrLeaseLost)
+			return
 		}
+		if err != nil {
+			log.Printf("[Worker System] Erro ao renovar lease do job %s: %v", job.ID, err)
+		}
+	}
+}
 
-		updatedJob, _ := db.GetJob(jobID)
-		events.Publish(events.Event{
-			Type:      events.JobUpdate,
-			JobID:     updatedJob.ID,
-			Target:    updatedJob.Target,
-			Payload:   updatedJob,
-			Timestamp: time.Now().Unix(),
-		})
+// Shutdown para de reivindicar jobs e espera os que estão em execução
+// terminarem. Se ctx expirar antes, os jobs ainda em execução ficam
+// IN_PROGRESS até o lease expirar (db.JobLease); então a recuperação
+// periódica de qualquer processo os devolve à fila.
+func (p *Pool) Shutdown(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	close(p.stop)
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
 
-		if !isFatal {
-			backoffSeconds := float64(types.BaseDelay) * math.Pow(2, float64(job.AttemptCount-1))
-			delay := time.Duration(backoffSeconds) * time.Second
+	select {
+	case <-done:
+		log.Println("[Worker System] Workers drenados")
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("workers ainda executando jobs: %w", ctx.Err())
+	}
+}
 
-			log.Printf("[Worker %d] Agendando retry para job %s em %v", workerID, job.ID, delay)
+func (p *Pool) worker(id int) {
+	defer p.wg.Done()
+	log.Printf("[Worker %d] Pronto", id)
+	for {
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
 
-			go func() {
-				time.Sleep(delay)
-				JobQueue <- jobID
-			}()
+		job, err := p.repo.Claim(context.Background(), p.limits)
+		if err != nil {
+			log.Printf("[Worker %d] Erro ao buscar job: %v", id, err)
+		} else if job != nil {
+			p.processJob(id, job)
+			continue
 		}
 
-	} else {
-		log.Printf("[Worker %d] Job %s CONCLUÍDO", workerID, job.ID)
-		if err := db.MarkJobCompleted(job.ID); err != nil {
-			log.Printf("[Worker %d] Erro ao concluir job: %v", workerID, err)
+		timer := time.NewTimer(p.idleWait())
+		select {
+		case <-p.stop:
+			timer.Stop()
+			return
+		case <-p.wake:
+		case <-timer.C:
 		}
+		timer.Stop()
+	}
+}
 
-		updatedJob, _ := db.GetJob(jobID)
-		events.Publish(events.Event{
-			Type:      events.JobUpdate,
-			JobID:     updatedJob.ID,
-			Target:    updatedJob.Target,
-			Payload:   updatedJob,
-			Timestamp: time.Now().Unix(),
-		})
+// idleWait é quanto um worker sem job espera antes de buscar de novo: até
+// o próximo retry agendado, no máximo PollInterval.
+func (p *Pool) idleWait() time.Duration {
+	next, ok, err := p.repo.NextRunAfter(context.Background(), p.limits)
+	if err != nil || !ok {
+		return PollInterval
 	}
+	if wait := time.Until(next); wait < PollInterval {
+		if wait < 0 {
+			return 0
+		}
+		return wait
+	}
+	return PollInterval
 }
 
-func executeLogic(ctx context.Context, job *db.Job, lxcClient *lxc.InstanceService) error {
-	errChan := make(chan error, 1)
+// maxAttempts é o número de tentativas de um job: o da sua política de
+// retry (passos de workflow), ou types.MaxRetries.
+func maxAttempts(job *db.Job) int {
+	if job.MaxAttempts > 0 {
+		return job.MaxAttempts
+	}
+	return types.MaxRetries
+}
 
-	go func() {
-		var err error
-		switch job.Type {
-		case types.JobTypeStateChange:
-			var payload struct {
-				Action string `json:"action"`
-			}
-			if e := json.Unmarshal([]byte(job.Payload), &payload); e != nil {
-				err = fmt.Errorf("payload inválido: %v", e)
-			} else {
-				err = lxcClient.UpdateInstanceState(job.Target, payload.Action)
-			}
+// retryDelay é o backoff exponencial antes da próxima tentativa.
+func retryDelay(job *db.Job) time.Duration {
+	base := types.BaseDelay
+	if job.RetryDelay > 0 {
+		base = job.RetryDelay
+	}
+	backoffSeconds := float64(base) * math.Pow(2, float64(job.AttemptCount-1))
+	return time.Duration(backoffSeconds) * time.Second
+}
 
-		case types.JobTypeUpdateLimits:
-			var payload struct {
-				Memory string `json:"memory"`
-				CPU    string `json:"cpu"`
-			}
-			if e := json.Unmarshal([]byte(job.Payload), &payload); e != nil {
-				err = fmt.Errorf("payload inválido: %v", e)
-			} else {
-				err = lxcClient.UpdateInstanceLimits(job.Target, payload.Memory, payload.CPU)
-			}
+func (p *Pool) publishJob(jobID string) {
+	job, err := p.repo.Get(context.Background(), jobID)
+	if err != nil {
+		return
+	}
+	events.Publish(events.Event{
+		Type:      events.JobUpdate,
+		JobID:     job.ID,
+		Target:    job.Target,
+		Payload:   job,
+		Timestamp: time.Now().Unix(),
+		ProjectID: job.ProjectID,
+	})
+}
 
-		case types.JobTypeCreateInstance:
-			var payload struct {
-				Name     string            `json:"name"`
-				Image    string            `json:"image"`
-				Limits   map[string]string `json:"limits"`
-				UserData string            `json:"user_data"` // Adicionado suporte a user_data
-				Type     string            `json:"type"`      // Instance type: "container" or "virtual-machine"
-				ISOImage string            `json:"iso_image"` // Nome do arquivo ISO para boot customizado (opcional)
-			}
-			if e := json.Unmarshal([]byte(job.Payload), &payload); e != nil {
-				err = fmt.Errorf("payload inválido: %v", e)
-			} else {
-				// If Type is empty, default to "container"
-				instanceType := payload.Type
-				if instanceType == "" {
-					instanceType = "container"
-				}
-
-				// If ISOImage is provided, create VM with ISO boot
-				if payload.ISOImage != "" {
-					// Get the full ISO path using the storage service
-					storageService, errStorage := service.NewStorageService()
-					if errStorage != nil {
-						err = fmt.Errorf("failed to initialize storage service: %v", errStorage)
-					} else {
-						isoPath := storageService.GetISOPath(payload.ISOImage)
-						err = lxcClient.CreateInstanceWithISO(payload.Name, payload.Image, instanceType, payload.Limits, payload.UserData, isoPath)
-					}
-				} else {
-					err = lxcClient.CreateInstance(payload.Name, payload.Image, instanceType, payload.Limits, payload.UserData)
-				}
-			}
+// workflowProgress é o payload de events.WorkflowProgress.
+type workflowProgress struct {
+	Workflow  *db.Job `json:"workflow"` // Com seus passos
+	Step      string  `json:"step"`
+	Completed int     `json:"completed"`
+	Total     int     `json:"total"`
+}
 
-		case types.JobTypeDeleteInstance:
-			err = lxcClient.DeleteInstance(job.Target)
+// advanceWorkflow atualiza o workflow de um passo que começou ou terminou
+// e publica o progresso.
+func (p *Pool) advanceWorkflow(step *db.Job) {
+	if step.ParentID == nil {
+		return
+	}
+	wf, err := p.repo.AdvanceWorkflow(context.Background(), *step.ParentID)
+	if err != nil {
+		log.Printf("[Worker System] Erro ao avançar workflow %s: %v", *step.ParentID, err)
+		return
+	}
 
-		// --- Snapshot Operations ---
-		case types.JobTypeCreateSnapshot:
-			var payload struct {
-				SnapshotName string `json:"snapshot_name"`
-			}
-			if e := json.Unmarshal([]byte(job.Payload), &payload); e != nil {
-				err = fmt.Errorf("payload inválido: %v", e)
-			} else {
-				err = lxcClient.CreateSnapshot(job.Target, payload.SnapshotName)
-			}
+	progress := workflowProgress{Workflow: wf, Step: step.Step, Total: len(wf.Steps)}
+	for _, s := range wf.Steps {
+		if s.Status == types.JobCompleted {
+			progress.Completed++
+		}
+	}
+	events.Publish(events.Event{
+		Type:      events.WorkflowProgress,
+		JobID:     wf.ID,
+		Target:    step.Target,
+		Payload:   progress,
+		Timestamp: time.Now().Unix(),
+		ProjectID: wf.ProjectID,
+	})
+}
 
-		case types.JobTypeRestoreSnapshot:
-			var payload struct {
-				SnapshotName string `json:"snapshot_name"`
-			}
-			if e := json.Unmarshal([]byte(job.Payload), &payload); e != nil {
-				err = fmt.Errorf("payload inválido: %v", e)
-			} else {
-				err = lxcClient.RestoreSnapshot(job.Target, payload.SnapshotName)
-			}
+// reporter é o Progress de um job em execução: grava o progresso e os logs
+// e os publica no barramento de eventos, que os transmite pela telemetria
+// (WebSocket). Erros ao gravar não interrompem o job.
+type reporter struct {
+	repo queue
+	job  *db.Job
+}
 
-		case types.JobTypeDeleteSnapshot:
-			var payload struct {
-				SnapshotName string `json:"snapshot_name"`
-			}
-			if e := json.Unmarshal([]byte(job.Payload), &payload); e != nil {
-				err = fmt.Errorf("payload inválido: %v", e)
-			} else {
-				err = lxcClient.DeleteSnapshot(job.Target, payload.SnapshotName)
-			}
+func (r *reporter) Stage(percent int, stage string) {
+	if err := r.repo.SetProgress(context.Background(), r.job.ID, percent, stage); err != nil {
+		log.Printf("[Worker System] Erro ao gravar progresso do job %s: %v", r.job.ID, err)
+		return
+	}
+	r.job.Progress, r.job.Stage = percent, stage
+	events.Publish(events.Event{
+		Type:   events.JobProgress,
+		JobID:  r.job.ID,
+		Target: r.job.Target,
+		Payload: map[string]interface{}{
+			"progress": percent,
+			"stage":    stage,
+		},
+		Timestamp: time.Now().Unix(),
+		ProjectID: r.job.ProjectID,
+	})
+}
 
-		// --- Port Forwarding ---
-		case types.JobTypeAddPort:
-			var payload struct {
-				HostPort      int    `json:"host_port"`
-				ContainerPort int    `json:"container_port"`
-				Protocol      string `json:"protocol"`
-			}
-			if e := json.Unmarshal([]byte(job.Payload), &payload); e != nil {
-				err = fmt.Errorf("payload inválido: %v", e)
-			} else {
-				err = lxcClient.AddProxyDevice(job.Target, payload.HostPort, payload.ContainerPort, payload.Protocol)
-			}
+func (r *reporter) Logf(level string, fields map[string]interface{}, format string, args ...interface{}) {
+	line := &db.JobLog{JobID: r.job.ID, Level: level, Message: fmt.Sprintf(format, args...), Fields: fields}
+	if err := r.repo.AppendLog(context.Background(), line); err != nil {
+		log.Printf("[Worker System] Erro ao gravar log do job %s: %v", r.job.ID, err)
+		return
+	}
+	events.Publish(events.Event{
+		Type:      events.JobLog,
+		JobID:     r.job.ID,
+		Target:    r.job.Target,
+		Payload:   line,
+		Timestamp: time.Now().Unix(),
+		ProjectID: r.job.ProjectID,
+	})
+}
 
-		case types.JobTypeRemovePort:
-			var payload struct {
-				HostPort int `json:"host_port"`
-			}
-			if e := json.Unmarshal([]byte(job.Payload), &payload); e != nil {
-				err = fmt.Errorf("payload inválido: %v", e)
-			} else {
-				err = lxcClient.RemoveProxyDevice(job.Target, payload.HostPort)
-			}
+// jobStages nomeia a etapa principal de cada tipo de job.
+var jobStages = map[types.JobType]string{
+	types.JobTypeStateChange:     "alterando estado",
+	types.JobTypeUpdateLimits:    "atualizando limites",
+	types.JobTypeCreateInstance:  "criando instância",
+	types.JobTypeDeleteInstance:  "removendo instância",
+	types.JobTypeCreateSnapshot:  "criando snapshot",
+	types.JobTypeRestoreSnapshot: "restaurando snapshot",
+	types.JobTypeDeleteSnapshot:  "removendo snapshot",
+	types.JobTypeAddPort:         "adicionando porta",
+	types.JobTypeRemovePort:      "removendo porta",
+}
 
-		default:
-			err = fmt.Errorf("tipo desconhecido: %s", job.Type)
-		}
-		errChan <- err
+// settle trata o erro ao gravar o resultado da tentativa de job. Se ela já
+// não é a que roda (o lease expirou entre dois heartbeats e o job foi
+// reivindicado de novo, ou foi cancelado), o resultado é descartado, como
+// quando o heartbeat perde o lease.
+func settle(workerID int, job *db.Job, action string, err error) {
+	if errors.Is(err, db.ErrJobNotRunning) {
+		log.Printf("[Worker %d] Job %s abandonado: a tentativa %d não está mais em execução", workerID, job.ID, job.AttemptCount)
+	} else if err != nil {
+		log.Printf("[Worker %d] Erro ao %s: %v", workerID, action, err)
+	}
+}
+
+func (p *Pool) processJob(workerID int, job *db.Job) {
+	events.Publish(events.Event{
+		Type:      events.JobUpdate,
+		JobID:     job.ID,
+		Target:    job.Target,
+		Payload:   job,
+		Timestamp: time.Now().Unix(),
+		ProjectID: job.ProjectID,
+	})
+	p.advanceWorkflow(job)
+
+	log.Printf("[Worker %d] Executando Job %s (%s em %s) - Tentativa %d/%d",
+		workerID, job.ID, job.Type, job.Target, job.AttemptCount, maxAttempts(job))
+	rep := &reporter{repo: p.repo, job: job}
+	rep.Logf(db.JobLogInfo, map[string]interface{}{"attempt": job.AttemptCount, "max_attempts": maxAttempts(job)},
+		"Tentativa %d de %d iniciada", job.AttemptCount, maxAttempts(job))
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	p.mu.Lock()
+	p.running[job.ID] = cancel
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.running, job.ID)
+		p.mu.Unlock()
+		cancel(nil)
 	}()
+	// Cancelado entre ser reivindicado e registrado acima
+	if current, err := p.repo.Get(context.Background(), job.ID); err == nil && current.Status == types.JobCanceled {
+		cancel(ErrCanceled)
+	}
+	go p.heartbeat(ctx, job, cancel)
 
-	select {
-	case err := <-errChan:
-		return err
-	case <-ctx.Done():
-		return fmt.Errorf("timeout de execução (%s)", JobTimeout)
+	ctx, cancelTimeout := context.WithTimeout(ctx, JobTimeout)
+	defer cancelTimeout()
+
+	if stage, ok := jobStages[job.Type]; ok && p.provider.Supports(job.Type) {
+		rep.Stage(10, stage)
+	}
+	execErr := p.provider.Execute(ctx, job, rep)
+	if execErr != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		execErr = fmt.Errorf("timeout de execução (%s)", JobTimeout)
 	}
+
+	if errors.Is(context.Cause(ctx), ErrCanceled) {
+		// O status já foi gravado por quem cancelou
+		log.Printf("[Worker %d] Job %s CANCELADO", workerID, job.ID)
+		rep.Logf(db.JobLogWarn, nil, "Cancelado durante a execução")
+	} else if errors.Is(context.Cause(ctx), ErrLeaseLost) {
+		// O job voltou à fila, ou foi cancelado, sem este worker: o que ele
+		// tiver feito não vale mais
+		log.Printf("[Worker %d] Job %s abandonado: %v", workerID, job.ID, ErrLeaseLost)
+	} else if execErr != nil {
+		log.Printf("[Worker %d] Job %s FALHOU: %v", workerID, job.ID, execErr)
+		rep.Logf(db.JobLogError, map[string]interface{}{"error": execErr.Error()}, "Tentativa %d falhou", job.AttemptCount)
+
+		if job.AttemptCount >= maxAttempts(job) || errors.Is(execErr, ErrUnsupported) || errors.Is(execErr, ErrInvalidPayload) {
+			settle(workerID, job, "atualizar status de falha",
+				p.repo.MarkFailed(context.Background(), job.ID, job.AttemptCount, execErr.Error(), true))
+		} else {
+			delay := retryDelay(job)
+			log.Printf("[Worker %d] Agendando retry para job %s em %v", workerID, job.ID, delay)
+			rep.Logf(db.JobLogInfo, map[string]interface{}{"retry_in": delay.String()}, "Nova tentativa em %v", delay)
+			settle(workerID, job, "agendar retry",
+				p.repo.Retry(context.Background(), job.ID, job.AttemptCount, execErr.Error(), time.Now().Add(delay)))
+		}
+	} else {
+		log.Printf("[Worker %d] Job %s CONCLUÍDO", workerID, job.ID)
+		rep.Logf(db.JobLogInfo, nil, "Concluído")
+		settle(workerID, job, "concluir job",
+			p.repo.MarkCompleted(context.Background(), job.ID, job.AttemptCount))
+	}
+
+	p.publishJob(job.ID)
+	p.advanceWorkflow(job)
+	// Jobs que esperavam por este (mesmo alvo ou limite) podem rodar agora
+	p.notify()
 }
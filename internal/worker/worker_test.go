@@ -0,0 +1,498 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"aexon/internal/db"
+	"aexon/internal/events"
+	"aexon/internal/types"
+
+	"github.com/lib/pq"
+)
+
+// fakeQueue guarda os jobs em memória, no lugar da tabela jobs.
+type fakeQueue struct {
+	mu        sync.Mutex
+	jobs      map[string]*db.Job
+	pending   []string // Na ordem em que são reivindicados
+	retries   map[string]time.Time
+	advanced  []string // Workflows avançados, em ordem
+	recovered int      // Chamadas a RecoverStuckJobs
+	heartbeat error
+	progress  []string
+	logs      []db.JobLog
+	done      chan string // ID de cada job cuja tentativa terminou
+}
+
+func newFakeQueue(jobs ...*db.Job) *fakeQueue {
+	q := &fakeQueue{
+		jobs:    make(map[string]*db.Job),
+		retries: make(map[string]time.Time),
+		done:    make(chan string, 16),
+	}
+	for _, job := range jobs {
+		q.add(job)
+	}
+	return q
+}
+
+func (q *fakeQueue) add(job *db.Job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if job.Status == "" {
+		job.Status = types.JobPending
+	}
+	q.jobs[job.ID] = job
+	if job.Status == types.JobPending && job.Type != types.JobTypeWorkflow {
+		q.pending = append(q.pending, job.ID)
+	}
+}
+
+func (q *fakeQueue) job(id string) db.Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return *q.jobs[id]
+}
+
+// wait espera o fim de uma tentativa do job.
+func (q *fakeQueue) wait(t *testing.T, id string) {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case got := <-q.done:
+			if got == id {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("job %s não terminou", id)
+		}
+	}
+}
+
+func (q *fakeQueue) Claim(ctx context.Context, limits db.JobLimits) (*db.Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) == 0 {
+		return nil, nil
+	}
+	job := q.jobs[q.pending[0]]
+	q.pending = q.pending[1:]
+	job.Status = types.JobInProgress
+	job.AttemptCount++
+	claimed := *job
+	return &claimed, nil
+}
+
+func (q *fakeQueue) Get(ctx context.Context, id string) (*db.Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return nil, fmt.Errorf("job not found: %s", id)
+	}
+	got := *job
+	return &got, nil
+}
+
+func (q *fakeQueue) Heartbeat(ctx context.Context, id string, attempt int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.heartbeat
+}
+
+// finish grava o resultado de uma tentativa, se ainda for a que roda; um
+// retry é agendado para at.
+func (q *fakeQueue) finish(id string, attempt int, status types.JobStatus, errorMsg string, at time.Time) error {
+	q.mu.Lock()
+	job := q.jobs[id]
+	if job.Status != types.JobInProgress || job.AttemptCount != attempt {
+		q.mu.Unlock()
+		return fmt.Errorf("%w: %s", db.ErrJobNotRunning, id)
+	}
+	job.Status = status
+	if errorMsg != "" {
+		job.Error = &errorMsg
+	}
+	if status == types.JobPending {
+		q.pending = append(q.pending, id)
+		q.retries[id] = at
+	}
+	q.mu.Unlock()
+	q.done <- id
+	return nil
+}
+
+func (q *fakeQueue) Retry(ctx context.Context, id string, attempt int, errorMsg string, at time.Time) error {
+	return q.finish(id, attempt, types.JobPending, errorMsg, at)
+}
+
+func (q *fakeQueue) MarkCompleted(ctx context.Context, id string, attempt int) error {
+	return q.finish(id, attempt, types.JobCompleted, "", time.Time{})
+}
+
+func (q *fakeQueue) MarkFailed(ctx context.Context, id string, attempt int, errorMsg string, isFatal bool) error {
+	return q.finish(id, attempt, types.JobFailed, errorMsg, time.Time{})
+}
+
+func (q *fakeQueue) NextRunAfter(ctx context.Context, limits db.JobLimits) (time.Time, bool, error) {
+	return time.Time{}, false, nil
+}
+
+func (q *fakeQueue) RecoverStuckJobs(ctx context.Context) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.recovered++
+	return 0, nil
+}
+
+// AdvanceWorkflow imita o banco: um passo que falhou encerra o workflow.
+func (q *fakeQueue) AdvanceWorkflow(ctx context.Context, id string) (*db.Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.advanced = append(q.advanced, id)
+	wf, ok := q.jobs[id]
+	if !ok {
+		return nil, fmt.Errorf("job not found: %s", id)
+	}
+	got := *wf
+	got.Steps = nil
+	for _, job := range q.jobs {
+		if job.ParentID != nil && *job.ParentID == id {
+			got.Steps = append(got.Steps, *job)
+			if job.Status == types.JobFailed {
+				wf.Status = types.JobFailed
+			}
+		}
+	}
+	got.Status = wf.Status
+	return &got, nil
+}
+
+func (q *fakeQueue) SetProgress(ctx context.Context, id string, progress int, stage string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.progress = append(q.progress, fmt.Sprintf("%d %s", progress, stage))
+	return nil
+}
+
+func (q *fakeQueue) AppendLog(ctx context.Context, l *db.JobLog) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.logs = append(q.logs, *l)
+	return nil
+}
+
+// fakeProvider executa os jobs com exec.
+type fakeProvider struct {
+	exec func(ctx context.Context, job *db.Job, progress Progress) error
+}
+
+func (f *fakeProvider) Supports(t types.JobType) bool {
+	return t != types.JobTypeDeleteInstance
+}
+
+func (f *fakeProvider) Execute(ctx context.Context, job *db.Job, progress Progress) error {
+	return f.exec(ctx, job, progress)
+}
+
+func failing(err error) *fakeProvider {
+	return &fakeProvider{exec: func(context.Context, *db.Job, Progress) error { return err }}
+}
+
+func shutdown(t *testing.T, p *Pool) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	tests := []struct {
+		job      db.Job
+		attempts int
+		delay    time.Duration
+	}{
+		{db.Job{AttemptCount: 1}, types.MaxRetries, types.BaseDelay * time.Second},
+		{db.Job{AttemptCount: 3}, types.MaxRetries, 4 * types.BaseDelay * time.Second},
+		{db.Job{AttemptCount: 2, MaxAttempts: 5, RetryDelay: 10}, 5, 20 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := maxAttempts(&tt.job); got != tt.attempts {
+			t.Errorf("maxAttempts(%+v) = %d, want %d", tt.job, got, tt.attempts)
+		}
+		if got := retryDelay(&tt.job); got != tt.delay {
+			t.Errorf("retryDelay(%+v) = %v, want %v", tt.job, got, tt.delay)
+		}
+	}
+}
+
+func TestProcessJobRetries(t *testing.T) {
+	q := newFakeQueue(&db.Job{ID: "flaky", Type: types.JobTypeStateChange, MaxAttempts: 2})
+	p := newPool(q, failing(errors.New("AxHV indisponível")), db.JobLimits{}, 1)
+
+	// A primeira falha agenda um retry com backoff
+	job, _ := q.Claim(context.Background(), db.JobLimits{})
+	before := time.Now()
+	p.processJob(0, job)
+	got := q.job("flaky")
+	if got.Status != types.JobPending || got.Error == nil || *got.Error != "AxHV indisponível" {
+		t.Fatalf("after the first failure: %+v", got)
+	}
+	if at := q.retries["flaky"]; at.Before(before.Add(retryDelay(job))) || at.After(time.Now().Add(retryDelay(job))) {
+		t.Errorf("retry at %v, want %v from now", at, retryDelay(job))
+	}
+
+	// A última tentativa falha o job
+	job, _ = q.Claim(context.Background(), db.JobLimits{})
+	p.processJob(0, job)
+	if got := q.job("flaky"); got.Status != types.JobFailed || got.AttemptCount != 2 {
+		t.Errorf("after the last attempt: %+v", got)
+	}
+
+	// Erros que uma nova tentativa não resolve não são repetidos
+	for _, err := range []error{ErrUnsupported, ErrInvalidPayload} {
+		q := newFakeQueue(&db.Job{ID: "bad", Type: types.JobTypeStateChange})
+		p := newPool(q, failing(fmt.Errorf("%w: x", err)), db.JobLimits{}, 1)
+		job, _ := q.Claim(context.Background(), db.JobLimits{})
+		p.processJob(0, job)
+		if got := q.job("bad"); got.Status != types.JobFailed || len(q.retries) != 0 {
+			t.Errorf("%v: job %+v, retries %v", err, got, q.retries)
+		}
+	}
+}
+
+func TestPoolClaimLoop(t *testing.T) {
+	q := newFakeQueue(
+		&db.Job{ID: "a", Type: types.JobTypeStateChange},
+		&db.Job{ID: "b", Type: types.JobTypeStateChange},
+	)
+	var mu sync.Mutex
+	var ran []string
+	p := newPool(q, &fakeProvider{exec: func(ctx context.Context, job *db.Job, progress Progress) error {
+		mu.Lock()
+		defer mu.Unlock()
+		ran = append(ran, job.ID)
+		return nil
+	}}, db.JobLimits{}, 1)
+	p.start(1)
+
+	q.wait(t, "a")
+	q.wait(t, "b")
+	shutdown(t, p)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ran) != 2 || ran[0] != "a" || ran[1] != "b" {
+		t.Errorf("ran %v, want [a b]", ran)
+	}
+	for _, id := range ran {
+		if got := q.job(id); got.Status != types.JobCompleted {
+			t.Errorf("job %s = %+v", id, got)
+		}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.recovered == 0 {
+		t.Error("stuck jobs are never recovered")
+	}
+}
+
+func TestPoolWakeup(t *testing.T) {
+	q := newFakeQueue()
+	p := newPool(q, failing(nil), db.JobLimits{}, 1)
+	notifications := make(chan *pq.Notification)
+	p.wg.Add(1)
+	go p.listen(notifications)
+	p.start(1)
+	defer shutdown(t, p)
+
+	// O worker ocioso acorda com o NOTIFY, bem antes de PollInterval
+	time.Sleep(50 * time.Millisecond)
+	q.add(&db.Job{ID: "queued", Type: types.JobTypeStateChange})
+	notifications <- &pq.Notification{Channel: db.JobsChannel, Extra: "queued"}
+	q.wait(t, "queued")
+	if got := q.job("queued"); got.Status != types.JobCompleted {
+		t.Errorf("job = %+v", got)
+	}
+}
+
+func TestPoolLeaseLost(t *testing.T) {
+	q := newFakeQueue(&db.Job{ID: "orphan", Type: types.JobTypeStateChange})
+	q.heartbeat = fmt.Errorf("%w: orphan", db.ErrJobNotRunning)
+	var cause error
+	p := newPool(q, &fakeProvider{exec: func(ctx context.Context, job *db.Job, progress Progress) error {
+		<-ctx.Done()
+		cause = context.Cause(ctx)
+		return ctx.Err()
+	}}, db.JobLimits{}, 1)
+	p.renew = 10 * time.Millisecond
+
+	// Recuperado por outro processo: o worker para sem gravar resultado
+	job, _ := q.Claim(context.Background(), db.JobLimits{})
+	p.processJob(0, job)
+	if !errors.Is(cause, ErrLeaseLost) {
+		t.Errorf("job context ended with %v, want ErrLeaseLost", cause)
+	}
+	if got := q.job("orphan"); got.Status != types.JobInProgress || len(q.retries) != 0 {
+		t.Errorf("job marked after losing its lease: %+v", got)
+	}
+}
+
+func TestProcessJobAttemptSuperseded(t *testing.T) {
+	// O lease expira entre dois heartbeats: o job volta à fila e outro
+	// worker reivindica a tentativa 2 enquanto a 1 ainda roda
+	for _, exec := range []error{nil, errors.New("AxHV indisponível")} {
+		q := newFakeQueue(&db.Job{ID: "slow", Type: types.JobTypeStateChange, MaxAttempts: 3})
+		p := newPool(q, &fakeProvider{exec: func(ctx context.Context, job *db.Job, progress Progress) error {
+			q.mu.Lock()
+			q.jobs["slow"].AttemptCount++
+			q.mu.Unlock()
+			return exec
+		}}, db.JobLimits{}, 1)
+
+		job, _ := q.Claim(context.Background(), db.JobLimits{})
+		p.processJob(0, job)
+		if got := q.job("slow"); got.Status != types.JobInProgress || got.AttemptCount != 2 || got.Error != nil || len(q.retries) != 0 {
+			t.Errorf("exec %v: attempt 1 settled attempt 2: %+v, retries %v", exec, got, q.retries)
+		}
+	}
+}
+
+func TestPoolCancel(t *testing.T) {
+	q := newFakeQueue(
+		&db.Job{ID: "long", Type: types.JobTypeStateChange},
+		&db.Job{ID: "notified", Type: types.JobTypeStateChange},
+	)
+	started := make(chan string)
+	causes := make(chan error, 2)
+	p := newPool(q, &fakeProvider{exec: func(ctx context.Context, job *db.Job, progress Progress) error {
+		started <- job.ID
+		<-ctx.Done()
+		causes <- context.Cause(ctx)
+		return ctx.Err()
+	}}, db.JobLimits{}, 1)
+	notifications := make(chan *pq.Notification)
+	p.wg.Add(1)
+	go p.listen(notifications)
+	p.start(1)
+	defer shutdown(t, p)
+
+	// A API grava o cancelamento e então interrompe o job, neste processo
+	// diretamente ou nos outros pelo NOTIFY
+	cancelJob := func(id string, notify bool) {
+		t.Helper()
+		if got := <-started; got != id {
+			t.Fatalf("started %s, want %s", got, id)
+		}
+		q.mu.Lock()
+		q.jobs[id].Status = types.JobCanceled
+		q.mu.Unlock()
+		if notify {
+			notifications <- &pq.Notification{Channel: db.JobsCanceledChannel, Extra: id}
+		} else {
+			p.cancel(id)
+		}
+		select {
+		case cause := <-causes:
+			if !errors.Is(cause, ErrCanceled) {
+				t.Errorf("%s: context ended with %v, want ErrCanceled", id, cause)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: context not canceled", id)
+		}
+	}
+	cancelJob("long", false)
+	cancelJob("notified", true)
+
+	// O status gravado por quem cancelou fica
+	time.Sleep(50 * time.Millisecond)
+	for _, id := range []string{"long", "notified"} {
+		if got := q.job(id); got.Status != types.JobCanceled || got.Error != nil {
+			t.Errorf("job %s = %+v", id, got)
+		}
+	}
+}
+
+func TestProcessJobCanceledBeforeStart(t *testing.T) {
+	q := newFakeQueue(&db.Job{ID: "early", Type: types.JobTypeStateChange})
+	var cause error
+	p := newPool(q, &fakeProvider{exec: func(ctx context.Context, job *db.Job, progress Progress) error {
+		cause = context.Cause(ctx)
+		return ctx.Err()
+	}}, db.JobLimits{}, 1)
+
+	// Cancelado entre ser reivindicado e o worker registrá-lo
+	job, _ := q.Claim(context.Background(), db.JobLimits{})
+	q.jobs["early"].Status = types.JobCanceled
+	p.processJob(0, job)
+	if !errors.Is(cause, ErrCanceled) {
+		t.Errorf("job ran with %v, want its context canceled", cause)
+	}
+	if len(q.retries) != 0 {
+		t.Errorf("canceled job retried: %v", q.retries)
+	}
+}
+
+func TestWorkflowStepFailure(t *testing.T) {
+	wf := "wf"
+	q := newFakeQueue(
+		&db.Job{ID: wf, Type: types.JobTypeWorkflow, Target: "vm"},
+		&db.Job{ID: "wf.stop", Type: types.JobTypeStateChange, Target: "vm", ParentID: &wf, Step: "stop", MaxAttempts: 1},
+	)
+	p := newPool(q, failing(errors.New("AxHV indisponível")), db.JobLimits{}, 1)
+	for len(events.GlobalBus) > 0 {
+		<-events.GlobalBus
+	}
+
+	// O passo sem novas tentativas falha e encerra o workflow
+	job, _ := q.Claim(context.Background(), db.JobLimits{})
+	p.processJob(0, job)
+	if got := q.job("wf.stop"); got.Status != types.JobFailed || len(q.retries) != 0 {
+		t.Fatalf("step %+v, retries %v", got, q.retries)
+	}
+	if len(q.advanced) != 2 || q.advanced[0] != wf || q.advanced[1] != wf {
+		t.Errorf("advanced %v, want the workflow when the step starts and ends", q.advanced)
+	}
+	if got := q.job(wf); got.Status != types.JobFailed {
+		t.Errorf("workflow %+v, want it failed", got)
+	}
+
+	var last *workflowProgress
+	for len(events.GlobalBus) > 0 {
+		if evt := <-events.GlobalBus; evt.Type == events.WorkflowProgress {
+			progress := evt.Payload.(workflowProgress)
+			last = &progress
+		}
+	}
+	if last == nil || last.Step != "stop" || last.Total != 1 || last.Completed != 0 || last.Workflow.Status != types.JobFailed {
+		t.Errorf("last workflow progress = %+v", last)
+	}
+}
+
+func TestLXCProgress(t *testing.T) {
+	q := newFakeQueue(&db.Job{ID: "create", Type: types.JobTypeCreateInstance})
+	job, _ := q.Claim(context.Background(), db.JobLimits{})
+	progress := lxcProgress(&reporter{repo: q, job: job})
+
+	// Cada etapa nova vai para o log; o percentual, para o job
+	progress(20, "criando a partir da imagem")
+	progress(50, "criando a partir da imagem")
+	progress(85, "iniciando instância")
+	want := []string{"20 criando a partir da imagem", "50 criando a partir da imagem", "85 iniciando instância"}
+	if fmt.Sprint(q.progress) != fmt.Sprint(want) {
+		t.Errorf("progress %q, want %q", q.progress, want)
+	}
+	if len(q.logs) != 2 || q.logs[0].Message != "Etapa: criando a partir da imagem" || q.logs[1].Message != "Etapa: iniciando instância" {
+		t.Errorf("logs %+v", q.logs)
+	}
+	if job.Progress != 85 || job.Stage != "iniciando instância" {
+		t.Errorf("job at %d %q", job.Progress, job.Stage)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"aexon/internal/auth"
 	"context"
 	"database/sql"
+	"encoding/csv"
 	"errors"
 	"fmt"
 	"log"
@@ -21,14 +22,19 @@ import (
 
 	"aexon/internal/api"
 	"aexon/internal/db"
+	"aexon/internal/events"
+	"aexon/internal/monitor"
+	"aexon/internal/network"
 	"aexon/internal/provider/axhv"
 	"aexon/internal/provider/axhv/pb"
 	"aexon/internal/scheduler"
 	"aexon/internal/service"
 	"aexon/internal/types"
 	"aexon/internal/utils"
+	"aexon/internal/worker"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
 // ============================================================================
@@ -51,6 +57,7 @@ const (
 	ErrCodeTemplateNotFound
 	ErrCodeInvalidQuota
 	ErrCodeInsufficientResources
+	ErrCodeInstanceExists
 
 	// Server Errors (2000-2999)
 	ErrCodeDatabaseFailure ErrorCode = iota + 2000
@@ -123,6 +130,11 @@ func ErrInstanceNotFound(name string) *AppError {
 		WithContext("instance", name)
 }
 
+func ErrInstanceExists(name string) *AppError {
+	return NewError(ErrCodeInstanceExists, "instance name already taken", nil, 409, false).
+		WithContext("instance", name)
+}
+
 func ErrDatabaseFailure(err error) *AppError {
 	return NewError(ErrCodeDatabaseFailure, "database operation failed", err, 500, true)
 }
@@ -132,6 +144,11 @@ func ErrQuotaExceeded(details string) *AppError {
 		WithContext("details", details)
 }
 
+func ErrPlanLimit(details string) *AppError {
+	return NewError(ErrCodeInvalidQuota, "not allowed by plan", nil, 403, false).
+		WithContext("details", details)
+}
+
 func ErrJobCreation(err error) *AppError {
 	return NewError(ErrCodeJobCreationFailed, "job creation failed", err, 500, true)
 }
@@ -188,6 +205,48 @@ type CreateNetworkRequest struct {
 	Subnet      string `json:"subnet" binding:"required"`
 }
 
+type CreateSecurityGroupRequest struct {
+	Name        string                 `json:"name" binding:"required"`
+	Description string                 `json:"description"`
+	Rules       []db.SecurityGroupRule `json:"rules"`
+}
+
+type AttachSecurityGroupRequest struct {
+	GroupID string `json:"group_id" binding:"required"`
+}
+
+type AllocateFloatingIPRequest struct {
+	NetworkID   string `json:"network_id"` // Optional: any public pool when empty
+	Description string `json:"description"`
+}
+
+type AttachFloatingIPRequest struct {
+	Instance string `json:"instance" binding:"required"`
+}
+
+type SetTrafficQuotaRequest struct {
+	MonthlyBytes uint64 `json:"monthly_bytes" binding:"required"`
+	Action       string `json:"action" binding:"required"` // throttle, notify or stop
+	ThrottleMbps int    `json:"throttle_mbps"`             // Default: 1
+}
+
+type ProjectRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+type ProjectMemberRequest struct {
+	Role string `json:"role" binding:"required"` // owner, admin, operator or viewer
+}
+
+type ProjectInvitationRequest struct {
+	Email string `json:"email" binding:"required"`
+	Role  string `json:"role" binding:"required"`
+}
+
+type AcceptInvitationRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
 // ============================================================================
 // METRICS
 // ============================================================================
@@ -246,13 +305,15 @@ func (m *Metrics) Snapshot() map[string]interface{} {
 type Handlers struct {
 	axhvClient      *axhv.Client
 	backupScheduler *scheduler.BackupScheduler
+	netManager      *network.Manager
 	metrics         *Metrics
 }
 
-func NewHandlers(axhvClient *axhv.Client, backupScheduler *scheduler.BackupScheduler) *Handlers {
+func NewHandlers(axhvClient *axhv.Client, backupScheduler *scheduler.BackupScheduler, netManager *network.Manager) *Handlers {
 	return &Handlers{
 		axhvClient:      axhvClient,
 		backupScheduler: backupScheduler,
+		netManager:      netManager,
 		metrics:         NewMetrics(),
 	}
 }
@@ -295,13 +356,32 @@ func (h *Handlers) writeError(c *gin.Context, appErr *AppError) {
 	c.JSON(appErr.HTTPStatus, response)
 }
 
+// InstanceAccess resolves :name within the caller's tenant scope so every
+// per-instance route answers 404 for instances owned by someone else,
+// including routes that only talk to AxHV.
+func (h *Handlers) InstanceAccess() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("name")
+		if _, err := db.NewInstanceRepository(db.GetService()).Get(c.Request.Context(), name); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				h.writeError(c, ErrInstanceNotFound(name))
+			} else {
+				h.writeError(c, ErrDatabaseFailure(err))
+			}
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
 // Instance Handlers
 func (h *Handlers) GetInstance(c *gin.Context) {
 	name := c.Param("name")
 
-	instance, err := db.GetInstance(name)
+	instance, err := db.NewInstanceRepository(db.GetService()).Get(c.Request.Context(), name)
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if errors.Is(err, sql.ErrNoRows) {
 			h.writeError(c, ErrInstanceNotFound(name))
 			return
 		}
@@ -381,7 +461,7 @@ func parseSizeToBytes(s string) int64 {
 }
 
 func (h *Handlers) ListInstances(c *gin.Context) {
-	instances, err := db.ListInstances()
+	instances, err := db.NewInstanceRepository(db.GetService()).List(c.Request.Context())
 	if err != nil {
 		log.Printf("Error listing instances: %v", err)
 		h.writeError(c, ErrDatabaseFailure(err))
@@ -417,6 +497,7 @@ func (h *Handlers) CreateInstance(c *gin.Context) {
 		h.writeError(c, ErrInvalidJSON(err))
 		return
 	}
+	auth.AuditTarget(c, "/instances/"+req.Name)
 
 	// Validate and merge template
 	enhancedUserData, appErr := h.processTemplate(req)
@@ -425,6 +506,17 @@ func (h *Handlers) CreateInstance(c *gin.Context) {
 		return
 	}
 
+	// Instance names are unique across projects, so the check must look
+	// past the caller's scope; Create below catches a racing request
+	instances := db.NewInstanceRepository(db.GetService())
+	if _, err := instances.Get(db.WithoutScope(c.Request.Context()), req.Name); err == nil {
+		h.writeError(c, ErrInstanceExists(req.Name))
+		return
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		h.writeError(c, ErrDatabaseFailure(err))
+		return
+	}
+
 	// Allocate IP using DB locking (IPAM)
 	var ip string
 	var err error
@@ -435,6 +527,10 @@ func (h *Handlers) CreateInstance(c *gin.Context) {
 		ip, err = db.GetService().AllocateIP(c.Request.Context(), req.Name)
 	}
 
+	if errors.Is(err, db.ErrPlanLimit) {
+		h.writeError(c, ErrPlanLimit(err.Error()))
+		return
+	}
 	if err != nil {
 		log.Printf("IP Allocation failed for %s: %v", req.Name, err)
 		h.writeError(c, NewError(ErrCodeInstanceCreationFailed, "failed to allocate IP", err, 500, false))
@@ -442,11 +538,14 @@ func (h *Handlers) CreateInstance(c *gin.Context) {
 	}
 
 	// Defer release logic in case of failure later (requires careful handling of success path)
-	// We will release if we panic or return early with error.
+	// We will release if we panic or return early with error. Only the
+	// lease just taken is freed: another one may exist under the same name.
 	success := false
 	defer func() {
 		if !success {
-			db.GetService().ReleaseIP(context.Background(), req.Name)
+			if err := db.GetService().ReleaseLease(context.Background(), ip, req.Name); err != nil {
+				log.Printf("Error releasing IP %s of %s: %v", ip, req.Name, err)
+			}
 		}
 	}()
 
@@ -462,8 +561,16 @@ func (h *Handlers) CreateInstance(c *gin.Context) {
 		BackupEnabled:   false,
 	}
 
+	// Resolve the gateway of the pool the lease came from
+	gateway := "172.16.0.1" // AxHV native pool
+	netDef, err := db.GetService().GetLeaseNetwork(c.Request.Context(), ip)
+	if err != nil {
+		log.Printf("Error resolving network for %s: %v", req.Name, err)
+	} else {
+		gateway = netDef.Gateway
+	}
+
 	// Map to Protobuf - use V2 if direct values provided, else legacy
-	gateway := "172.16.0.1" // Gateway is constant for now
 	var pbReq *pb.CreateVmRequest
 
 	if req.VCPU > 0 || req.MemoryMiB > 0 || req.DiskSizeGB > 0 {
@@ -488,6 +595,47 @@ func (h *Handlers) CreateInstance(c *gin.Context) {
 		h.writeError(c, NewError(ErrCodeInstanceCreationFailed, "failed to map request", err, 400, false))
 		return
 	}
+	plan, err := db.NewPlanRepository(db.GetService()).Effective(c.Request.Context())
+	if err != nil {
+		h.writeError(c, ErrDatabaseFailure(err))
+		return
+	}
+	maxTCP, maxUDP := plan.PortForwardLimits()
+	if err := axhv.CheckPortForwards(pbReq, maxTCP, maxUDP); err != nil {
+		h.writeError(c, ErrPlanLimit(err.Error()))
+		return
+	}
+
+	// Record the instance before creating the VM, so that its quota check
+	// and the row are one transaction; it is removed again on failure
+	if instance.Limits == nil {
+		instance.Limits = make(map[string]string)
+	}
+	instance.Limits["volatile.ip_address"] = ip
+	instance.Limits["bandwidth_limit_mbps"] = strconv.Itoa(int(pbReq.BandwidthLimitMbps))
+	instance.VCPU = int(pbReq.Vcpu)
+	instance.MemoryMiB = int(pbReq.MemoryMib)
+	instance.DiskGB = int(pbReq.DiskSizeGb)
+
+	if err := instances.Create(c.Request.Context(), &instance); err != nil {
+		if errors.Is(err, db.ErrQuotaExceeded) {
+			h.writeError(c, ErrQuotaExceeded(err.Error()))
+			return
+		}
+		if db.IsUniqueViolation(err) {
+			h.writeError(c, ErrInstanceExists(req.Name))
+			return
+		}
+		h.writeError(c, ErrDatabaseFailure(err))
+		return
+	}
+	defer func() {
+		if !success {
+			if err := instances.Delete(context.Background(), req.Name); err != nil {
+				log.Printf("Error removing instance record of %s: %v", req.Name, err)
+			}
+		}
+	}()
 
 	// Call AxHV gRPC
 	log.Printf("[DEBUG] Calling AxHV CreateVm with: ID=%s, Kernel=%s, Rootfs=%s, IP=%s", pbReq.Id, pbReq.KernelPath, pbReq.RootfsPath, pbReq.GuestIp)
@@ -503,25 +651,25 @@ func (h *Handlers) CreateInstance(c *gin.Context) {
 		return
 	}
 
-	// Persist to DB
-	// Note: We already allocated the IP which updated the ip_leases table with instance_name.
-	// We should also insert into instances table as before.
-	// Update limits with the allocated IP and bandwidth to keep consistency
-	if instance.Limits == nil {
-		instance.Limits = make(map[string]string)
+	// Move the TAP from axhv-br0 onto the custom network bridge
+	if netDef != nil && h.netManager != nil {
+		if err := h.netManager.AttachInstance(c.Request.Context(), req.Name, *netDef); err != nil {
+			log.Printf("[Network] Failed to attach %s to %s: %v", req.Name, netDef.Name, err)
+		}
 	}
-	instance.Limits["volatile.ip_address"] = ip
-	instance.Limits["bandwidth_limit_mbps"] = strconv.Itoa(int(pbReq.BandwidthLimitMbps))
-
-	if err := db.CreateInstance(&instance); err != nil {
-		// If DB fails, we should try to cleanup the VM? Ideally yes.
-		// For now, fail
-		h.writeError(c, ErrDatabaseFailure(err))
-		return
+	if h.netManager != nil {
+		if err := h.netManager.RefreshLeases(c.Request.Context()); err != nil {
+			log.Printf("[Network] Failed to refresh DHCP/DNS leases: %v", err)
+		}
+		// A floating IP bound to this name (e.g. a recreated VM) follows the new lease
+		if err := h.netManager.SyncFloatingIPs(c.Request.Context()); err != nil {
+			log.Printf("[Network] Failed to sync floating IPs: %v", err)
+		}
 	}
 
 	success = true
 	h.metrics.RecordInstanceCreated()
+	h.meterUsage(c.Request.Context(), req.Name, db.UsageRunning)
 
 	c.JSON(201, gin.H{"status": "created", "ip": ip, "vm_id": grpcResp.VmId})
 }
@@ -545,11 +693,20 @@ func (h *Handlers) DeleteInstance(c *gin.Context) {
 	if err := db.GetService().ReleaseIP(c.Request.Context(), name); err != nil {
 		log.Printf("Error releasing IP for %s: %v", name, err)
 	}
+	if err := h.netManager.RefreshLeases(c.Request.Context()); err != nil {
+		log.Printf("[Network] Failed to refresh DHCP/DNS leases: %v", err)
+	}
+	if err := h.netManager.SyncFloatingIPs(c.Request.Context()); err != nil {
+		log.Printf("[Network] Failed to sync floating IPs: %v", err)
+	}
 
-	if err := db.DeleteInstance(name); err != nil {
+	if err := db.NewInstanceRepository(db.GetService()).Delete(c.Request.Context(), name); err != nil {
 		h.writeError(c, ErrDatabaseFailure(err))
 		return
 	}
+	if err := db.NewUsageRepository(db.GetService()).Close(c.Request.Context(), name, time.Now()); err != nil {
+		log.Printf("[Usage] Failed to close usage of %s: %v", name, err)
+	}
 
 	h.metrics.RecordInstanceDeleted()
 
@@ -595,9 +752,29 @@ func (h *Handlers) UpdateInstanceState(c *gin.Context) {
 		return
 	}
 
+	// A paused VM keeps its resources, so it is still metered as running
+	switch req.Action {
+	case "start", "reboot", "resume":
+		h.meterUsage(ctx, name, db.UsageRunning)
+	case "stop":
+		h.meterUsage(ctx, name, db.UsageStopped)
+	}
+
 	c.JSON(200, gin.H{"status": "executed", "action": req.Action})
 }
 
+// meterUsage records a state transition the request caused, without
+// waiting for the usage meter to notice it. Failures are only logged.
+func (h *Handlers) meterUsage(ctx context.Context, name, state string) {
+	inst, err := db.NewInstanceRepository(db.GetService()).Get(ctx, name)
+	if err == nil {
+		err = db.NewUsageRepository(db.GetService()).Observe(ctx, inst, state, time.Now())
+	}
+	if err != nil {
+		log.Printf("[Usage] Failed to record %s as %s: %v", name, state, err)
+	}
+}
+
 func (h *Handlers) UpdateInstanceLimits(c *gin.Context) {
 	name := c.Param("name")
 	var req InstanceLimitsRequest
@@ -613,26 +790,16 @@ func (h *Handlers) UpdateInstanceLimits(c *gin.Context) {
 		return
 	}
 
-	// Get current instance from DB
-	instance, err := db.GetInstance(name)
-	if err != nil {
+	// Growth is checked against the owner's and project's quotas
+	_, err := db.NewInstanceRepository(db.GetService()).Resize(c.Request.Context(), name, req.VCPU, req.MemoryMiB)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
 		h.writeError(c, ErrInstanceNotFound(name))
 		return
-	}
-
-	// Update limits map
-	if instance.Limits == nil {
-		instance.Limits = make(map[string]string)
-	}
-	if req.VCPU > 0 {
-		instance.Limits["limits.cpu"] = strconv.Itoa(req.VCPU)
-	}
-	if req.MemoryMiB > 0 {
-		instance.Limits["limits.memory"] = fmt.Sprintf("%dMB", req.MemoryMiB)
-	}
-
-	// Save to DB
-	if err := db.UpdateInstanceStatusAndLimits(name, instance.Limits); err != nil {
+	case errors.Is(err, db.ErrQuotaExceeded):
+		h.writeError(c, ErrQuotaExceeded(err.Error()))
+		return
+	case err != nil:
 		h.writeError(c, ErrDatabaseFailure(err))
 		return
 	}
@@ -658,7 +825,8 @@ func (h *Handlers) UpdateBackupConfig(c *gin.Context) {
 		return
 	}
 
-	if err := db.UpdateInstanceBackupConfig(name, req.Enabled, req.Schedule, req.Retention); err != nil {
+	err := db.NewInstanceRepository(db.GetService()).UpdateBackupConfig(c.Request.Context(), name, req.Enabled, req.Schedule, req.Retention)
+	if err != nil {
 		h.writeError(c, ErrDatabaseFailure(err))
 		return
 	}
@@ -712,7 +880,7 @@ func (h *Handlers) DeleteFile(c *gin.Context) {
 
 // Job Handlers
 func (h *Handlers) ListJobs(c *gin.Context) {
-	jobs, err := db.ListRecentJobs(50)
+	jobs, err := db.NewJobRepository(db.GetService()).List(c.Request.Context(), 50)
 	if err != nil {
 		h.writeError(c, ErrDatabaseFailure(err))
 		return
@@ -722,14 +890,168 @@ func (h *Handlers) ListJobs(c *gin.Context) {
 
 func (h *Handlers) GetJob(c *gin.Context) {
 	id := c.Param("id")
-	job, err := db.GetJob(id)
+	job, err := db.NewJobRepository(db.GetService()).Get(c.Request.Context(), id)
+	if err != nil {
+		h.writeError(c, NewError(ErrCodeInstanceNotFound, "job not found", err, 404, false))
+		return
+	}
+	c.JSON(200, job)
+}
+
+// GetJobLogs serves the log lines of a job, or of the steps of a workflow,
+// oldest first, with its progress. Pass the ID of the last line seen as
+// after to page, or to poll for new lines.
+func (h *Handlers) GetJobLogs(c *gin.Context) {
+	ctx := c.Request.Context()
+	repo := db.NewJobRepository(db.GetService())
+	job, err := repo.Get(ctx, c.Param("id"))
 	if err != nil {
 		h.writeError(c, NewError(ErrCodeInstanceNotFound, "job not found", err, 404, false))
 		return
 	}
+
+	after, err := strconv.ParseInt(c.DefaultQuery("after", "0"), 10, 64)
+	if err != nil || after < 0 {
+		c.JSON(400, gin.H{"error": "invalid after"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "200"))
+	if err != nil || limit < 1 || limit > 1000 {
+		c.JSON(400, gin.H{"error": "limit must be between 1 and 1000"})
+		return
+	}
+
+	logs, err := repo.Logs(ctx, job.ID, after, limit)
+	if err != nil {
+		h.writeError(c, ErrDatabaseFailure(err))
+		return
+	}
+	c.JSON(200, gin.H{
+		"job_id":   job.ID,
+		"status":   job.Status,
+		"progress": job.Progress,
+		"stage":    job.Stage,
+		"logs":     logs,
+	})
+}
+
+// CancelJob cancels a pending or running job, or a workflow with its
+// steps. A running job is stopped through its context, in whichever
+// process runs it.
+func (h *Handlers) CancelJob(c *gin.Context) {
+	id := c.Param("id")
+	ctx := c.Request.Context()
+	repo := db.NewJobRepository(db.GetService())
+
+	reason := "canceled via API"
+	if scope, ok := db.ScopeFrom(ctx); ok && scope.UserID > 0 {
+		reason = fmt.Sprintf("canceled by user %d", scope.UserID)
+	}
+	if err := repo.MarkCanceled(ctx, id, reason); err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			h.writeError(c, NewError(ErrCodeInstanceNotFound, "job not found", err, 404, false))
+		case errors.Is(err, db.ErrJobFinished):
+			c.JSON(409, gin.H{"error": err.Error()})
+		default:
+			h.writeError(c, ErrDatabaseFailure(err))
+		}
+		return
+	}
+	worker.CancelJob(id)
+
+	job, err := repo.Get(ctx, id)
+	if err != nil {
+		h.writeError(c, ErrDatabaseFailure(err))
+		return
+	}
+	for _, step := range job.Steps {
+		worker.CancelJob(step.ID)
+	}
+	events.Publish(events.Event{
+		Type:      events.JobCanceled,
+		JobID:     job.ID,
+		Target:    job.Target,
+		Payload:   job,
+		Timestamp: time.Now().Unix(),
+		ProjectID: job.ProjectID,
+	})
 	c.JSON(200, job)
 }
 
+// WorkflowRequest is the body of CreateWorkflow.
+type WorkflowRequest struct {
+	Target string            `json:"target"` // Instance the workflow is about, if any
+	Steps  []db.WorkflowStep `json:"steps" binding:"required"`
+}
+
+// CreateWorkflow queues a workflow for the caller's project. Each step runs
+// as a job once the steps it depends on completed; when one fails for
+// good, those completed are rolled back. Every target must be an instance
+// the caller can see.
+func (h *Handlers) CreateWorkflow(c *gin.Context) {
+	var req WorkflowRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.writeError(c, ErrInvalidJSON(err))
+		return
+	}
+	if err := db.ValidateWorkflow(req.Steps); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Steps the workers cannot run would only fail once queued
+	targets := []string{}
+	if req.Target != "" {
+		targets = append(targets, req.Target)
+	}
+	for _, step := range req.Steps {
+		actions := []db.JobAction{{Type: step.Type, Target: step.Target}}
+		if step.Rollback != nil {
+			actions = append(actions, *step.Rollback)
+		}
+		for _, a := range actions {
+			if !worker.Supports(a.Type) {
+				c.JSON(400, gin.H{"error": fmt.Sprintf("step %q: unsupported job type %q", step.Name, a.Type)})
+				return
+			}
+			if a.Target == "" {
+				h.writeError(c, ErrMissingField("steps.target"))
+				return
+			}
+			targets = append(targets, a.Target)
+		}
+	}
+
+	ctx := c.Request.Context()
+	instances := db.NewInstanceRepository(db.GetService())
+	for _, target := range targets {
+		if _, err := instances.Get(ctx, target); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				h.writeError(c, ErrInstanceNotFound(target))
+			} else {
+				h.writeError(c, ErrDatabaseFailure(err))
+			}
+			return
+		}
+	}
+
+	repo := db.NewJobRepository(db.GetService())
+	wf := &db.Job{ID: uuid.NewString(), Target: req.Target}
+	if err := repo.CreateWorkflow(ctx, wf, req.Steps); err != nil {
+		h.writeError(c, ErrDatabaseFailure(err))
+		return
+	}
+	worker.DispatchJob(wf.ID)
+
+	job, err := repo.Get(ctx, wf.ID)
+	if err != nil {
+		h.writeError(c, ErrDatabaseFailure(err))
+		return
+	}
+	c.JSON(202, job)
+}
+
 // Template Handlers
 func (h *Handlers) ListTemplates(c *gin.Context) {
 	templates := service.GetTemplates()
@@ -801,10 +1123,6 @@ func (h *Handlers) GetClusterMembers(c *gin.Context) {
 	c.JSON(501, gin.H{"error": "Cluster operations not supported in AxHV v2"})
 }
 
-func (h *Handlers) StreamTelemetry(c *gin.Context) {
-	// NOT IMPLEMENTED
-}
-
 func (h *Handlers) GetMetrics(c *gin.Context) {
 	c.JSON(200, h.metrics.Snapshot())
 }
@@ -828,6 +1146,11 @@ func (h *Handlers) ListISOs(c *gin.Context) {
 		h.writeError(c, NewError(ErrCodeStorageOperationFailed, "failed to list ISOs", err, 500, true))
 		return
 	}
+	isos, err = db.NewISORepository(db.GetService()).Visible(c.Request.Context(), isos)
+	if err != nil {
+		h.writeError(c, ErrDatabaseFailure(err))
+		return
+	}
 
 	var isoInfos []gin.H
 	for _, isoName := range isos {
@@ -857,6 +1180,18 @@ func (h *Handlers) DeleteISO(c *gin.Context) {
 		return
 	}
 
+	if err := db.NewISORepository(db.GetService()).Delete(c.Request.Context(), name); err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			h.writeError(c, NewError(ErrCodeISONotFound, "ISO not found", nil, 404, false))
+		case errors.Is(err, db.ErrSharedResource):
+			c.JSON(403, gin.H{"error": err.Error()})
+		default:
+			h.writeError(c, ErrDatabaseFailure(err))
+		}
+		return
+	}
+
 	if err := storageService.DeleteISO(name); err != nil {
 		log.Printf("Error deleting ISO %s: %v", name, err)
 		h.writeError(c, NewError(ErrCodeStorageOperationFailed, "failed to delete ISO", err, 500, true))
@@ -944,9 +1279,12 @@ func (h *Handlers) parseMemory(limits map[string]string) int64 {
 type Application struct {
 	lxcClient       interface{} // Place holder, unused
 	backupScheduler *scheduler.BackupScheduler
+	netManager      *network.Manager
 	handlers        *Handlers
+	workers         *worker.Pool
 	router          *gin.Engine
 	server          *http.Server
+	stopBackground  context.CancelFunc
 	state           atomic.Uint32
 	wg              sync.WaitGroup
 }
@@ -958,6 +1296,28 @@ const (
 	stateStopped  uint32 = 3
 )
 
+// checkProductionDefaults refuses to run a production deployment (AXION_ENV
+// set to production) with default credentials or weak settings.
+func checkProductionDefaults() error {
+	if !auth.ProductionMode() {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	problems, err := auth.GetAuthService().InsecureDefaults(ctx)
+	if err != nil {
+		return fmt.Errorf("checking security settings: %w", err)
+	}
+	if os.Getenv("DB_PASSWORD") == "" {
+		problems = append(problems, "DB_PASSWORD is not set (default password in use)")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("refusing to start in production mode with insecure settings: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
 func NewApplication() (*Application, error) {
 	// Initialize database
 	if _, err := db.InitService(nil); err != nil {
@@ -979,22 +1339,20 @@ func NewApplication() (*Application, error) {
 	}
 	log.Println("✓ AxHV connection established")
 	// Initialize auth service
-	auth.Init(nil) // Uses default config
-
-	// Seed DB with admin if empty
-	go func() {
-		// Wait for DB to be potentially migrated? Migration runs in InitService? Yes.
-		// Use background context with timeout
-		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
-		defer cancel()
-		if err := auth.GetAuthService().SeedAdmin(ctx); err != nil {
-			log.Printf("[Main] Error seeding admin: %v", err)
-		}
-	}()
+	if err := auth.Init(nil); err != nil { // Uses default config
+		return nil, fmt.Errorf("auth initialization failed: %w", err)
+	}
+	if err := checkProductionDefaults(); err != nil {
+		return nil, err
+	}
 
-	// Initialize workers - DISABLED
-	// worker.Init(2, lxcClient)
-	// log.Println("✓ Worker pool initialized")
+	// Without users, the first administrator is created through /setup
+	setupCtx, cancelSetup := context.WithTimeout(context.Background(), time.Minute)
+	err = auth.GetAuthService().StartSetup(setupCtx)
+	cancelSetup()
+	if err != nil {
+		return nil, fmt.Errorf("first-run setup failed: %w", err)
+	}
 
 	// Initialize API broadcaster
 	api.InitBroadcaster()
@@ -1005,12 +1363,21 @@ func NewApplication() (*Application, error) {
 	// log.Println("✓ Backup scheduler initialized")
 	var backupScheduler *scheduler.BackupScheduler // nil
 
+	// Initialize host network manager
+	netDriver := network.DefaultDriver()
+	netManager := network.NewManager(netDriver)
+	if guest := network.DefaultGuestServices(netDriver); guest != nil {
+		netManager.SetGuestServices(guest)
+	}
+	log.Println("✓ Network manager initialized")
+
 	// Initialize handlers
-	handlers := NewHandlers(axhvClient, backupScheduler)
+	handlers := NewHandlers(axhvClient, backupScheduler, netManager)
 
 	app := &Application{
 		lxcClient:       nil, // REMOVED
 		backupScheduler: backupScheduler,
+		netManager:      netManager,
 		handlers:        handlers,
 	}
 	app.state.Store(stateCreated)
@@ -1018,15 +1385,99 @@ func NewApplication() (*Application, error) {
 	return app, nil
 }
 
+// auditActions names what each mutating route is recorded as in the audit
+// log. Handlers add targets and details the path does not carry.
+var auditActions = map[string]string{
+	"POST /api/v1/setup":         "auth.setup",
+	"POST /api/v1/login":         "auth.login",
+	"POST /api/v1/register":      "auth.register",
+	"POST /api/v1/refresh":       "auth.refresh",
+	"POST /api/v1/revoke":        "auth.logout",
+	"POST /api/v1/login/2fa":     "auth.login.2fa",
+	"POST /api/v1/logout-all":    "auth.logout_all",
+	"POST /api/v1/auth/password": "auth.password.change",
+
+	"POST /api/v1/auth/2fa/enroll":         "auth.2fa.enroll",
+	"POST /api/v1/auth/2fa/confirm":        "auth.2fa.confirm",
+	"POST /api/v1/auth/2fa/disable":        "auth.2fa.disable",
+	"POST /api/v1/auth/2fa/recovery-codes": "auth.2fa.recovery_codes",
+	"PUT /api/v1/auth/2fa/policy":          "auth.2fa.policy",
+	"POST /api/v1/api-tokens":              "api_token.create",
+	"DELETE /api/v1/api-tokens/:id":        "api_token.revoke",
+	"POST /api/v1/auth/keys/rotate":        "signing_key.rotate",
+
+	"POST /api/v1/instances":                               "instance.create",
+	"DELETE /api/v1/instances/:name":                       "instance.delete",
+	"POST /api/v1/instances/:name/action":                  "instance.action",
+	"PUT /api/v1/instances/:name/limits":                   "instance.resize",
+	"PUT /api/v1/instances/:name/backup":                   "instance.backup_config",
+	"POST /api/v1/instances/:name/snapshots":               "snapshot.create",
+	"POST /api/v1/instances/:name/snapshots/:snap/restore": "snapshot.restore",
+	"DELETE /api/v1/instances/:name/snapshots/:snap":       "snapshot.delete",
+	"POST /api/v1/instances/:name/files":                   "instance.file.upload",
+	"DELETE /api/v1/instances/:name/files":                 "instance.file.delete",
+	"POST /api/v1/isos":                                    "iso.upload",
+	"DELETE /api/v1/isos/:name":                            "iso.delete",
+	"POST /api/v1/jobs/:id/cancel":                         "job.cancel",
+	"POST /api/v1/workflows":                               "workflow.create",
+
+	"POST /api/v1/networks":                              "network.create",
+	"DELETE /api/v1/networks/:id":                        "network.delete",
+	"POST /api/v1/security-groups":                       "security_group.create",
+	"DELETE /api/v1/security-groups/:id":                 "security_group.delete",
+	"POST /api/v1/security-groups/:id/rules":             "security_group.rule.add",
+	"DELETE /api/v1/security-groups/:id/rules/:rule_id":  "security_group.rule.delete",
+	"POST /api/v1/instances/:name/security-groups":       "security_group.attach",
+	"DELETE /api/v1/instances/:name/security-groups/:id": "security_group.detach",
+	"POST /api/v1/floating-ips":                          "floating_ip.allocate",
+	"DELETE /api/v1/floating-ips/:id":                    "floating_ip.release",
+	"POST /api/v1/floating-ips/:id/attach":               "floating_ip.attach",
+	"POST /api/v1/floating-ips/:id/detach":               "floating_ip.detach",
+	"PUT /api/v1/instances/:name/traffic/quota":          "traffic.quota.set",
+	"DELETE /api/v1/instances/:name/traffic/quota":       "traffic.quota.delete",
+
+	"POST /api/v1/projects":                                  "project.create",
+	"PATCH /api/v1/projects/:id":                             "project.update",
+	"DELETE /api/v1/projects/:id":                            "project.delete",
+	"PUT /api/v1/projects/:id/members/:user_id":              "project.member.set",
+	"POST /api/v1/projects/:id/leave":                        "project.leave",
+	"DELETE /api/v1/projects/:id/members/:user_id":           "project.member.remove",
+	"POST /api/v1/projects/:id/invitations":                  "project.invitation.create",
+	"DELETE /api/v1/projects/:id/invitations/:invitation_id": "project.invitation.revoke",
+	"POST /api/v1/invitations/accept":                        "project.invitation.accept",
+	"PUT /api/v1/roles/:role/permissions":                    "role.permissions.set",
+	"POST /api/v1/users":                                     "user.create",
+	"PATCH /api/v1/users/:id":                                "user.update",
+	"DELETE /api/v1/users/:id":                               "user.delete",
+	"POST /api/v1/users/:id/password-reset":                  "user.password_reset",
+	"PUT /api/v1/quotas/:scope/:id":                          "quota.set",
+	"DELETE /api/v1/quotas/:scope/:id":                       "quota.delete",
+	"POST /api/v1/plans":                                     "plan.create",
+	"PUT /api/v1/plans/:id":                                  "plan.update",
+	"DELETE /api/v1/plans/:id":                               "plan.delete",
+	"PUT /api/v1/plans/assignments/:scope/:id":               "plan.assign",
+	"PUT /api/v1/billing/prices/:plan_id":                    "billing.prices.set",
+	"DELETE /api/v1/billing/prices/:plan_id":                 "billing.prices.delete",
+	"POST /api/v1/branding/upload-logo":                      "branding.logo.upload",
+	"PUT /api/v1/branding/settings":                          "branding.update",
+}
+
 func (a *Application) setupRouter() {
 	r := gin.Default()
 	a.router = r
 
+	// Only trusted proxies may name the client in X-Forwarded-For; it is the
+	// address that rate limiting and the audit log see
+	if err := r.SetTrustedProxies(auth.GetAuthService().TrustedProxies()); err != nil {
+		log.Printf("⚠ Invalid TRUSTED_PROXIES, trusting none: %v", err)
+		r.SetTrustedProxies(nil)
+	}
+
 	// CORS
 	r.Use(func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS, PATCH")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, "+auth.ProjectHeader)
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
 			return
@@ -1034,65 +1485,182 @@ func (a *Application) setupRouter() {
 		c.Next()
 	})
 
+	// Public keys verifying the tokens, for services that check them offline
+	r.GET("/.well-known/jwks.json", auth.JWKSHandler)
+
+	// Branding, for plans that include it
+	api.RegisterBrandingRoutes(r.Group("/api/v1", auth.AuditMiddleware(auditActions)),
+		auth.AuthMiddleware(), auth.RequirePermission(auth.PermBrandingManage))
+
+	// Live job, workflow and traffic events of the caller's project. Instances
+	// run on AxHV, so there are no LXD instance metrics to stream.
+	api.RegisterTelemetryRoutes(r.Group("/api/v1", auth.AuditMiddleware(auditActions)), nil,
+		auth.AuthMiddleware(), auth.RequirePermission(auth.PermJobsRead))
+
 	api := r.Group("/api/v1")
+	api.Use(auth.AuditMiddleware(auditActions))
 	h := a.handlers
 
 	// Auth
+	api.GET("/setup", auth.SetupStatusHandler)
+	api.POST("/setup", auth.SetupHandler)
 	api.POST("/login", auth.LoginHandler)
 	api.POST("/register", auth.RegisterHandler)
 	api.POST("/refresh", auth.RefreshTokenHandler)
 	api.POST("/revoke", auth.RevokeTokenHandler)
-	api.GET("/auth/metrics", auth.GetAuthMetricsHandler)
+	api.POST("/login/2fa", auth.VerifyMFAHandler)
+	api.GET("/auth/oidc/login", auth.OIDCLoginHandler)
+	api.GET("/auth/oidc/callback", auth.OIDCCallbackHandler)
+	api.POST("/logout-all", auth.AuthMiddleware(), auth.RequirePermission(auth.PermSessionsRevoke), auth.LogoutAllHandler)
+	api.POST("/auth/password", auth.AuthMiddleware(), auth.RequirePermission(auth.PermPasswordChange), auth.ChangePasswordHandler)
+
+	// Two-factor authentication
+	api.GET("/auth/2fa", auth.AuthMiddleware(), auth.RequirePermission(auth.PermMFAManage), auth.MFAStatusHandler)
+	api.POST("/auth/2fa/enroll", auth.AuthMiddleware(), auth.RequirePermission(auth.PermMFAManage), auth.EnrollMFAHandler)
+	api.POST("/auth/2fa/confirm", auth.AuthMiddleware(), auth.RequirePermission(auth.PermMFAManage), auth.ConfirmMFAHandler)
+	api.POST("/auth/2fa/disable", auth.AuthMiddleware(), auth.RequirePermission(auth.PermMFAManage), auth.DisableMFAHandler)
+	api.POST("/auth/2fa/recovery-codes", auth.AuthMiddleware(), auth.RequirePermission(auth.PermMFAManage), auth.RegenerateRecoveryCodesHandler)
+	api.GET("/auth/2fa/policy", auth.AuthMiddleware(), auth.RequirePermission(auth.PermMFAPolicy), auth.GetMFAPolicyHandler)
+	api.PUT("/auth/2fa/policy", auth.AuthMiddleware(), auth.RequirePermission(auth.PermMFAPolicy), auth.SetMFAPolicyHandler)
+
+	// API tokens
+	api.GET("/api-tokens", auth.AuthMiddleware(), auth.RequirePermission(auth.PermAPITokensManage), auth.ListAPITokensHandler)
+	api.POST("/api-tokens", auth.AuthMiddleware(), auth.RequirePermission(auth.PermAPITokensManage), auth.CreateAPITokenHandler)
+	api.DELETE("/api-tokens/:id", auth.AuthMiddleware(), auth.RequirePermission(auth.PermAPITokensManage), auth.RevokeAPITokenHandler)
+	api.GET("/auth/keys", auth.AuthMiddleware(), auth.RequirePermission(auth.PermSigningKeys), auth.ListSigningKeysHandler)
+	api.POST("/auth/keys/rotate", auth.AuthMiddleware(), auth.RequirePermission(auth.PermSigningKeys), auth.RotateSigningKeyHandler)
+	api.GET("/auth/metrics", auth.AuthMiddleware(), auth.RequirePermission(auth.PermSystemRead), auth.GetAuthMetricsHandler)
 
 	// Instances
-	api.GET("/instances", auth.AuthMiddleware(), h.ListInstances)
-	api.POST("/instances", auth.AuthMiddleware(), h.CreateInstance)
-	api.GET("/instances/:name", auth.AuthMiddleware(), h.GetInstance)
-	api.DELETE("/instances/:name", auth.AuthMiddleware(), h.DeleteInstance)
-	api.POST("/instances/:name/action", auth.AuthMiddleware(), h.UpdateInstanceState)
-	api.PUT("/instances/:name/limits", auth.AuthMiddleware(), h.UpdateInstanceLimits)
-	api.PUT("/instances/:name/backup", auth.AuthMiddleware(), h.UpdateBackupConfig)
+	api.GET("/instances", auth.AuthMiddleware(), auth.RequirePermission(auth.PermInstancesRead), h.ListInstances)
+	api.POST("/instances", auth.AuthMiddleware(), auth.RequirePermission(auth.PermInstancesCreate), h.CreateInstance)
+	api.GET("/instances/:name", auth.AuthMiddleware(), auth.RequirePermission(auth.PermInstancesRead), h.InstanceAccess(), h.GetInstance)
+	api.DELETE("/instances/:name", auth.AuthMiddleware(), auth.RequirePermission(auth.PermInstancesDelete), h.InstanceAccess(), h.DeleteInstance)
+	api.POST("/instances/:name/action", auth.AuthMiddleware(), auth.RequirePermission(auth.PermInstancesOperate), h.InstanceAccess(), h.UpdateInstanceState)
+	api.PUT("/instances/:name/limits", auth.AuthMiddleware(), auth.RequirePermission(auth.PermInstancesResize), h.InstanceAccess(), h.UpdateInstanceLimits)
+	api.PUT("/instances/:name/backup", auth.AuthMiddleware(), auth.RequirePermission(auth.PermBackupsManage), h.InstanceAccess(), h.UpdateBackupConfig)
 
 	// Snapshots (Stubbed)
-	api.GET("/instances/:name/snapshots", auth.AuthMiddleware(), h.ListSnapshots)
-	api.POST("/instances/:name/snapshots", auth.AuthMiddleware(), h.CreateSnapshot)
-	api.POST("/instances/:name/snapshots/:snap/restore", auth.AuthMiddleware(), h.RestoreSnapshot)
-	api.DELETE("/instances/:name/snapshots/:snap", auth.AuthMiddleware(), h.DeleteSnapshot)
+	api.GET("/instances/:name/snapshots", auth.AuthMiddleware(), auth.RequirePermission(auth.PermSnapshotsRead), h.InstanceAccess(), h.ListSnapshots)
+	api.POST("/instances/:name/snapshots", auth.AuthMiddleware(), auth.RequirePermission(auth.PermSnapshotsCreate), h.InstanceAccess(), h.CreateSnapshot)
+	api.POST("/instances/:name/snapshots/:snap/restore", auth.AuthMiddleware(), auth.RequirePermission(auth.PermBackupsRestore), h.InstanceAccess(), h.RestoreSnapshot)
+	api.DELETE("/instances/:name/snapshots/:snap", auth.AuthMiddleware(), auth.RequirePermission(auth.PermSnapshotsDelete), h.InstanceAccess(), h.DeleteSnapshot)
 
 	// Files (Stubbed)
-	api.GET("/instances/:name/files", auth.AuthMiddleware(), h.ListFiles)
-	api.GET("/instances/:name/file", auth.AuthMiddleware(), h.DownloadFile)
-	api.POST("/instances/:name/files", auth.AuthMiddleware(), h.UploadFile)
-	api.DELETE("/instances/:name/files", auth.AuthMiddleware(), h.DeleteFile)
+	api.GET("/instances/:name/files", auth.AuthMiddleware(), auth.RequirePermission(auth.PermFilesRead), h.InstanceAccess(), h.ListFiles)
+	api.GET("/instances/:name/file", auth.AuthMiddleware(), auth.RequirePermission(auth.PermFilesRead), h.InstanceAccess(), h.DownloadFile)
+	api.POST("/instances/:name/files", auth.AuthMiddleware(), auth.RequirePermission(auth.PermFilesWrite), h.InstanceAccess(), h.UploadFile)
+	api.DELETE("/instances/:name/files", auth.AuthMiddleware(), auth.RequirePermission(auth.PermFilesWrite), h.InstanceAccess(), h.DeleteFile)
 
 	// Metrics
-	api.GET("/instances/:name/metrics", auth.AuthMiddleware(), h.GetInstanceMetrics)
-	api.GET("/instances/:name/metrics/history", auth.AuthMiddleware(), h.GetInstanceMetricsHistory)
-	api.GET("/instances/:name/logs", auth.AuthMiddleware(), h.GetInstanceLogs)
+	api.GET("/instances/:name/metrics", auth.AuthMiddleware(), auth.RequirePermission(auth.PermInstancesRead), h.InstanceAccess(), h.GetInstanceMetrics)
+	api.GET("/instances/:name/metrics/history", auth.AuthMiddleware(), auth.RequirePermission(auth.PermInstancesRead), h.InstanceAccess(), h.GetInstanceMetricsHistory)
+	api.GET("/instances/:name/logs", auth.AuthMiddleware(), auth.RequirePermission(auth.PermInstancesRead), h.InstanceAccess(), h.GetInstanceLogs)
 
 	// Cluster
-	api.GET("/cluster", auth.AuthMiddleware(), h.GetClusterMembers)
+	api.GET("/cluster", auth.AuthMiddleware(), auth.RequirePermission(auth.PermClusterRead), h.GetClusterMembers)
 
 	// ISOs
-	api.GET("/isos", auth.AuthMiddleware(), h.ListISOs)
-	api.POST("/isos", auth.AuthMiddleware(), h.UploadISO)
-	api.DELETE("/isos/:name", auth.AuthMiddleware(), h.DeleteISO)
+	api.GET("/isos", auth.AuthMiddleware(), auth.RequirePermission(auth.PermISOsRead), h.ListISOs)
+	api.POST("/isos", auth.AuthMiddleware(), auth.RequirePermission(auth.PermISOsManage), h.UploadISO)
+	api.DELETE("/isos/:name", auth.AuthMiddleware(), auth.RequirePermission(auth.PermISOsManage), h.DeleteISO)
 
 	// Jobs
-	api.GET("/jobs", auth.AuthMiddleware(), h.ListJobs)
-	api.GET("/jobs/:id", auth.AuthMiddleware(), h.GetJob)
+	api.GET("/jobs", auth.AuthMiddleware(), auth.RequirePermission(auth.PermJobsRead), h.ListJobs)
+	api.GET("/jobs/:id", auth.AuthMiddleware(), auth.RequirePermission(auth.PermJobsRead), h.GetJob)
+	api.GET("/jobs/:id/logs", auth.AuthMiddleware(), auth.RequirePermission(auth.PermJobsRead), h.GetJobLogs)
+	api.POST("/jobs/:id/cancel", auth.AuthMiddleware(), auth.RequirePermission(auth.PermJobsCancel), h.CancelJob)
+	api.POST("/workflows", auth.AuthMiddleware(), auth.RequirePermission(auth.PermWorkflowsCreate), h.CreateWorkflow)
 
 	// Templates
-	api.GET("/templates", auth.AuthMiddleware(), h.ListTemplates)
+	api.GET("/templates", auth.AuthMiddleware(), auth.RequirePermission(auth.PermTemplatesRead), h.ListTemplates)
 
 	// App Metrics
-	api.GET("/metrics", auth.AuthMiddleware(), h.GetMetrics)
+	api.GET("/metrics", auth.AuthMiddleware(), auth.RequirePermission(auth.PermSystemRead), h.GetMetrics)
 
 	// Admin Networks
-	api.GET("/networks", auth.AuthMiddleware(), h.ListNetworks)
-	api.POST("/networks", auth.AuthMiddleware(), h.CreateNetwork)
-	api.GET("/networks/:id", auth.AuthMiddleware(), h.GetNetwork)
-	api.DELETE("/networks/:id", auth.AuthMiddleware(), h.DeleteNetwork)
+	api.GET("/networks", auth.AuthMiddleware(), auth.RequirePermission(auth.PermNetworksRead), h.ListNetworks)
+	api.POST("/networks", auth.AuthMiddleware(), auth.RequirePermission(auth.PermNetworksManage), h.CreateNetwork)
+	api.GET("/networks/:id", auth.AuthMiddleware(), auth.RequirePermission(auth.PermNetworksRead), h.GetNetwork)
+	api.DELETE("/networks/:id", auth.AuthMiddleware(), auth.RequirePermission(auth.PermNetworksManage), h.DeleteNetwork)
+
+	// Security Groups
+	api.GET("/security-groups", auth.AuthMiddleware(), auth.RequirePermission(auth.PermSecurityGroupsRead), h.ListSecurityGroups)
+	api.POST("/security-groups", auth.AuthMiddleware(), auth.RequirePermission(auth.PermSecurityGroupsManage), h.CreateSecurityGroup)
+	api.GET("/security-groups/:id", auth.AuthMiddleware(), auth.RequirePermission(auth.PermSecurityGroupsRead), h.GetSecurityGroup)
+	api.DELETE("/security-groups/:id", auth.AuthMiddleware(), auth.RequirePermission(auth.PermSecurityGroupsManage), h.DeleteSecurityGroup)
+	api.POST("/security-groups/:id/rules", auth.AuthMiddleware(), auth.RequirePermission(auth.PermSecurityGroupsManage), h.AddSecurityGroupRule)
+	api.DELETE("/security-groups/:id/rules/:rule_id", auth.AuthMiddleware(), auth.RequirePermission(auth.PermSecurityGroupsManage), h.DeleteSecurityGroupRule)
+	api.GET("/instances/:name/security-groups", auth.AuthMiddleware(), auth.RequirePermission(auth.PermSecurityGroupsRead), h.InstanceAccess(), h.ListInstanceSecurityGroups)
+	api.POST("/instances/:name/security-groups", auth.AuthMiddleware(), auth.RequirePermission(auth.PermSecurityGroupsAttach), h.InstanceAccess(), h.AttachSecurityGroup)
+	api.DELETE("/instances/:name/security-groups/:id", auth.AuthMiddleware(), auth.RequirePermission(auth.PermSecurityGroupsAttach), h.InstanceAccess(), h.DetachSecurityGroup)
+	api.GET("/instances/:name/firewall", auth.AuthMiddleware(), auth.RequirePermission(auth.PermSecurityGroupsRead), h.InstanceAccess(), h.GetInstanceFirewall)
+
+	// Floating IPs
+	api.GET("/floating-ips", auth.AuthMiddleware(), auth.RequirePermission(auth.PermFloatingIPsRead), h.ListFloatingIPs)
+	api.POST("/floating-ips", auth.AuthMiddleware(), auth.RequirePermission(auth.PermFloatingIPsManage), h.AllocateFloatingIP)
+	api.GET("/floating-ips/:id", auth.AuthMiddleware(), auth.RequirePermission(auth.PermFloatingIPsRead), h.GetFloatingIP)
+	api.DELETE("/floating-ips/:id", auth.AuthMiddleware(), auth.RequirePermission(auth.PermFloatingIPsManage), h.ReleaseFloatingIP)
+	api.POST("/floating-ips/:id/attach", auth.AuthMiddleware(), auth.RequirePermission(auth.PermFloatingIPsAttach), h.AttachFloatingIP)
+	api.POST("/floating-ips/:id/detach", auth.AuthMiddleware(), auth.RequirePermission(auth.PermFloatingIPsAttach), h.DetachFloatingIP)
+
+	// Traffic accounting
+	api.GET("/instances/:name/traffic", auth.AuthMiddleware(), auth.RequirePermission(auth.PermTrafficRead), h.InstanceAccess(), h.GetInstanceTraffic)
+	api.GET("/instances/:name/traffic/history", auth.AuthMiddleware(), auth.RequirePermission(auth.PermTrafficRead), h.InstanceAccess(), h.GetInstanceTrafficHistory)
+	api.PUT("/instances/:name/traffic/quota", auth.AuthMiddleware(), auth.RequirePermission(auth.PermTrafficManage), h.InstanceAccess(), h.SetTrafficQuota)
+	api.DELETE("/instances/:name/traffic/quota", auth.AuthMiddleware(), auth.RequirePermission(auth.PermTrafficManage), h.InstanceAccess(), h.DeleteTrafficQuota)
+
+	// Projects
+	api.GET("/projects", auth.AuthMiddleware(), auth.RequirePermission(auth.PermProjectsList), h.ListProjects)
+	api.POST("/projects", auth.AuthMiddleware(), auth.RequirePermission(auth.PermProjectsCreate), h.CreateProject)
+	api.GET("/projects/:id", auth.AuthMiddleware(), auth.ScopeToProject("id"), auth.RequirePermission(auth.PermProjectsRead), h.GetProject)
+	api.PATCH("/projects/:id", auth.AuthMiddleware(), auth.ScopeToProject("id"), auth.RequirePermission(auth.PermProjectsUpdate), h.UpdateProject)
+	api.DELETE("/projects/:id", auth.AuthMiddleware(), auth.ScopeToProject("id"), auth.RequirePermission(auth.PermProjectsDelete), h.DeleteProject)
+	api.GET("/projects/:id/members", auth.AuthMiddleware(), auth.ScopeToProject("id"), auth.RequirePermission(auth.PermMembersRead), h.ListProjectMembers)
+	api.PUT("/projects/:id/members/:user_id", auth.AuthMiddleware(), auth.ScopeToProject("id"), auth.RequirePermission(auth.PermMembersManage), h.UpdateProjectMember)
+	api.POST("/projects/:id/leave", auth.AuthMiddleware(), auth.ScopeToProject("id"), auth.RequirePermission(auth.PermProjectsLeave), h.LeaveProject)
+	api.DELETE("/projects/:id/members/:user_id", auth.AuthMiddleware(), auth.ScopeToProject("id"), auth.RequirePermission(auth.PermMembersManage), h.RemoveProjectMember)
+	api.GET("/projects/:id/invitations", auth.AuthMiddleware(), auth.ScopeToProject("id"), auth.RequirePermission(auth.PermMembersManage), h.ListProjectInvitations)
+	api.POST("/projects/:id/invitations", auth.AuthMiddleware(), auth.ScopeToProject("id"), auth.RequirePermission(auth.PermMembersManage), h.CreateProjectInvitation)
+	api.DELETE("/projects/:id/invitations/:invitation_id", auth.AuthMiddleware(), auth.ScopeToProject("id"), auth.RequirePermission(auth.PermMembersManage), h.RevokeProjectInvitation)
+	api.POST("/invitations/accept", auth.AuthMiddleware(), auth.RequirePermission(auth.PermInvitationsJoin), h.AcceptProjectInvitation)
+
+	// Roles
+	api.GET("/roles", auth.AuthMiddleware(), auth.RequirePermission(auth.PermRolesManage), auth.ListRolesHandler)
+	api.PUT("/roles/:role/permissions", auth.AuthMiddleware(), auth.RequirePermission(auth.PermRolesManage), auth.SetRolePermissionsHandler)
+
+	// Users
+	api.GET("/users", auth.AuthMiddleware(), auth.RequirePermission(auth.PermUsersRead), auth.ListUsersHandler)
+	api.POST("/users", auth.AuthMiddleware(), auth.RequirePermission(auth.PermUsersManage), auth.CreateUserHandler)
+	api.GET("/users/:id", auth.AuthMiddleware(), auth.RequirePermission(auth.PermUsersRead), auth.GetUserHandler)
+	api.PATCH("/users/:id", auth.AuthMiddleware(), auth.RequirePermission(auth.PermUsersManage), auth.UpdateUserHandler)
+	api.DELETE("/users/:id", auth.AuthMiddleware(), auth.RequirePermission(auth.PermUsersManage), auth.DeleteUserHandler)
+	api.POST("/users/:id/password-reset", auth.AuthMiddleware(), auth.RequirePermission(auth.PermUsersManage), auth.ResetUserPasswordHandler)
+
+	// Quotas
+	api.GET("/quotas/usage", auth.AuthMiddleware(), auth.RequirePermission(auth.PermQuotasRead), h.GetQuotaUsage)
+	api.GET("/quotas", auth.AuthMiddleware(), auth.RequirePermission(auth.PermQuotasManage), h.ListQuotas)
+	api.PUT("/quotas/:scope/:id", auth.AuthMiddleware(), auth.RequirePermission(auth.PermQuotasManage), h.SetQuota)
+	api.DELETE("/quotas/:scope/:id", auth.AuthMiddleware(), auth.RequirePermission(auth.PermQuotasManage), h.DeleteQuota)
+
+	// Plans
+	api.GET("/plans", auth.AuthMiddleware(), auth.RequirePermission(auth.PermPlansRead), h.ListPlans)
+	api.GET("/plans/current", auth.AuthMiddleware(), auth.RequirePermission(auth.PermPlansRead), h.GetCurrentPlan)
+	api.POST("/plans", auth.AuthMiddleware(), auth.RequirePermission(auth.PermPlansManage), h.CreatePlan)
+	api.PUT("/plans/:id", auth.AuthMiddleware(), auth.RequirePermission(auth.PermPlansManage), h.UpdatePlan)
+	api.DELETE("/plans/:id", auth.AuthMiddleware(), auth.RequirePermission(auth.PermPlansManage), h.DeletePlan)
+	api.PUT("/plans/assignments/:scope/:id", auth.AuthMiddleware(), auth.RequirePermission(auth.PermPlansManage), h.AssignPlan)
+
+	// Usage metering and billing
+	api.GET("/billing/usage", auth.AuthMiddleware(), auth.RequirePermission(auth.PermBillingRead), h.GetBillingUsage)
+	api.GET("/billing/invoices", auth.AuthMiddleware(), auth.RequirePermission(auth.PermBillingRead), h.ExportInvoices)
+	api.GET("/billing/prices", auth.AuthMiddleware(), auth.RequirePermission(auth.PermBillingRead), h.ListPriceSheets)
+	api.PUT("/billing/prices/:plan_id", auth.AuthMiddleware(), auth.RequirePermission(auth.PermBillingManage), h.SetPriceSheet)
+	api.DELETE("/billing/prices/:plan_id", auth.AuthMiddleware(), auth.RequirePermission(auth.PermBillingManage), h.DeletePriceSheet)
+
+	// Audit log
+	api.GET("/audit", auth.AuthMiddleware(), auth.RequirePermission(auth.PermAuditRead), auth.ListAuditEventsHandler)
+	api.GET("/audit/verify", auth.AuthMiddleware(), auth.RequirePermission(auth.PermAuditRead), auth.VerifyAuditLogHandler)
 }
 
 func (a *Application) Start() error {
@@ -1104,6 +1672,27 @@ func (a *Application) Start() error {
 	// scheduler.RunStartupSync(db.GetService().GetRawDB(), a.lxcClient)
 	// log.Println("✓ Startup sync completed")
 
+	// Materialise network pools on the host
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	if err := a.netManager.Reconcile(ctx); err != nil {
+		log.Printf("⚠ Network reconciliation incomplete: %v", err)
+	} else {
+		log.Println("✓ Network reconciliation completed")
+	}
+	if err := a.netManager.SyncFirewall(ctx); err != nil {
+		log.Printf("⚠ Security group sync failed: %v", err)
+	}
+	if err := a.netManager.SyncFloatingIPs(ctx); err != nil {
+		log.Printf("⚠ Floating IP sync failed: %v", err)
+	}
+	if err := a.netManager.SyncThrottles(ctx); err != nil {
+		log.Printf("⚠ Throttle sync failed: %v", err)
+	}
+	cancel()
+
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	a.stopBackground = stopBackground
+
 	// Start background services
 	a.wg.Add(1)
 	go func() {
@@ -1112,6 +1701,46 @@ func (a *Application) Start() error {
 	}()
 	log.Println("✓ Historical collector started (DISABLED)")
 
+	// Expire token revocations and login attempts
+	auth.StartBackgroundServices(bgCtx)
+
+	interval, _ := time.ParseDuration(os.Getenv("AXION_TRAFFIC_INTERVAL"))
+	traffic := monitor.NewTrafficCollector(a.handlers.axhvClient, a.netManager, interval)
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		traffic.Run(bgCtx)
+	}()
+	log.Println("✓ Traffic collector started")
+
+	// Start usage meter
+	meterInterval, _ := time.ParseDuration(os.Getenv("AXION_USAGE_INTERVAL"))
+	meter := monitor.NewUsageMeter(a.handlers.axhvClient, meterInterval)
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		meter.Run(bgCtx)
+	}()
+	log.Println("✓ Usage meter started")
+
+	// Start job workers. Jobs are claimed from the jobs table, so those
+	// queued before a restart (and their retries) run after it.
+	numWorkers, _ := strconv.Atoi(os.Getenv("AXION_JOB_WORKERS"))
+	if numWorkers <= 0 {
+		numWorkers = 2
+	}
+	// Limits hold across every process sharing the queue, e.g.
+	// AXION_JOB_MAX_RUNNING=8 AXION_JOB_TYPE_LIMITS=create_instance=2
+	var limits db.JobLimits
+	limits.Running, _ = strconv.Atoi(os.Getenv("AXION_JOB_MAX_RUNNING"))
+	perType, err := db.ParseJobTypeLimits(os.Getenv("AXION_JOB_TYPE_LIMITS"))
+	if err != nil {
+		log.Printf("⚠ Invalid AXION_JOB_TYPE_LIMITS, ignoring: %v", err)
+	}
+	limits.PerType = perType
+	a.workers = worker.Init(numWorkers, worker.NewAxHVProvider(a.handlers.axhvClient), limits)
+	log.Println("✓ Worker pool initialized")
+
 	// Start backup scheduler
 	// a.backupScheduler.Start()
 	// a.backupScheduler.SyncJobs()
@@ -1156,11 +1785,21 @@ func (a *Application) Shutdown(ctx context.Context) error {
 	}
 	log.Println("✓ HTTP server stopped")
 
+	// Stop guest DHCP/DNS listeners
+	a.netManager.Close()
+
+	// Let running jobs finish; pending ones stay queued in the database
+	if err := a.workers.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("job workers: %w", err))
+	}
+	log.Println("✓ Job workers drained")
+
 	// 2. Stop backup scheduler
 	// Note: Add Stop() method to scheduler if available
 	log.Println("✓ Backup scheduler stopped")
 
 	// 3. Wait for background services
+	a.stopBackground()
 	done := make(chan struct{})
 	go func() {
 		a.wg.Wait()
@@ -1220,12 +1859,22 @@ func (h *Handlers) CreateNetwork(c *gin.Context) {
 		return
 	}
 
-	if err := db.GetService().CreateNetwork(c.Request.Context(), req); err != nil {
+	created, err := db.GetService().CreateNetwork(c.Request.Context(), req)
+	if err != nil {
 		c.JSON(500, gin.H{"error": "Failed to create network", "details": err.Error()})
 		return
 	}
+	h.metrics.RecordNetworkCreated()
+	auth.AuditTarget(c, "/networks/"+created.ID)
 
-	c.JSON(201, gin.H{"status": "created"})
+	// Bridge/NAT are derived from the whole table, so reconcile everything
+	if err := h.netManager.Reconcile(c.Request.Context()); err != nil {
+		log.Printf("[Network] Reconcile after create failed: %v", err)
+		c.JSON(201, gin.H{"status": "created", "id": created.ID, "warning": err.Error()})
+		return
+	}
+
+	c.JSON(201, gin.H{"status": "created", "id": created.ID})
 }
 
 func (h *Handlers) GetNetwork(c *gin.Context) {
@@ -1250,6 +1899,10 @@ func (h *Handlers) DeleteNetwork(c *gin.Context) {
 			c.JSON(404, gin.H{"error": "Network not found"})
 			return
 		}
+		if errors.Is(err, db.ErrSharedResource) {
+			c.JSON(403, gin.H{"error": err.Error()})
+			return
+		}
 		// Check for specific error string "active IP allocations"
 		// Ideally use custom error types, but string matching is fast for now
 		if err.Error() == "network has active IP allocations" ||
@@ -1260,6 +1913,1165 @@ func (h *Handlers) DeleteNetwork(c *gin.Context) {
 		c.JSON(500, gin.H{"error": "Failed to delete network", "details": err.Error()})
 		return
 	}
+
+	if err := h.netManager.Reconcile(c.Request.Context()); err != nil {
+		log.Printf("[Network] Reconcile after delete failed: %v", err)
+	}
+	c.JSON(200, gin.H{"status": "deleted"})
+}
+
+// ============================================================================
+// SECURITY GROUP HANDLERS
+// ============================================================================
+
+// syncFirewall re-renders the filter table after any security group change.
+// The change is already persisted, so a failure is reported as a warning.
+func (h *Handlers) syncFirewall(c *gin.Context, code int, body gin.H) {
+	if err := h.netManager.SyncFirewall(c.Request.Context()); err != nil {
+		log.Printf("[Network] Firewall sync failed: %v", err)
+		body["warning"] = err.Error()
+	}
+	c.JSON(code, body)
+}
+
+func (h *Handlers) ListSecurityGroups(c *gin.Context) {
+	groups, err := db.NewSecurityGroupRepository(db.GetService()).List(c.Request.Context())
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch security groups", "details": err.Error()})
+		return
+	}
+	c.JSON(200, groups)
+}
+
+func (h *Handlers) CreateSecurityGroup(c *gin.Context) {
+	var req CreateSecurityGroupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	for i := range req.Rules {
+		if err := req.Rules[i].Validate(); err != nil {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("rule %d: %v", i, err)})
+			return
+		}
+	}
+
+	group := db.SecurityGroup{Name: req.Name, Description: req.Description, Rules: req.Rules}
+	if err := db.NewSecurityGroupRepository(db.GetService()).Create(c.Request.Context(), &group); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to create security group", "details": err.Error()})
+		return
+	}
+	auth.AuditTarget(c, "/security-groups/"+group.ID)
+	c.JSON(201, group)
+}
+
+func (h *Handlers) GetSecurityGroup(c *gin.Context) {
+	group, err := db.NewSecurityGroupRepository(db.GetService()).Get(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(404, gin.H{"error": "Security group not found"})
+			return
+		}
+		c.JSON(500, gin.H{"error": "Failed to fetch security group", "details": err.Error()})
+		return
+	}
+	c.JSON(200, group)
+}
+
+func (h *Handlers) DeleteSecurityGroup(c *gin.Context) {
+	err := db.NewSecurityGroupRepository(db.GetService()).Delete(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(404, gin.H{"error": "Security group not found"})
+			return
+		}
+		if errors.Is(err, db.ErrSharedResource) {
+			c.JSON(403, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(500, gin.H{"error": "Failed to delete security group", "details": err.Error()})
+		return
+	}
+	h.syncFirewall(c, 200, gin.H{"status": "deleted"})
+}
+
+func (h *Handlers) AddSecurityGroupRule(c *gin.Context) {
+	var rule db.SecurityGroupRule
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	if err := rule.Validate(); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	repo := db.NewSecurityGroupRepository(db.GetService())
+	if _, err := repo.Get(c.Request.Context(), c.Param("id")); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(404, gin.H{"error": "Security group not found"})
+			return
+		}
+		c.JSON(500, gin.H{"error": "Failed to fetch security group", "details": err.Error()})
+		return
+	}
+
+	rule.GroupID = c.Param("id")
+	if err := repo.AddRule(c.Request.Context(), &rule); err != nil {
+		if errors.Is(err, db.ErrSharedResource) {
+			c.JSON(403, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(500, gin.H{"error": "Failed to create rule", "details": err.Error()})
+		return
+	}
+	auth.AuditTarget(c, "/security-groups/"+rule.GroupID+"/rules/"+rule.ID)
+	h.syncFirewall(c, 201, gin.H{"status": "created", "rule": rule})
+}
+
+func (h *Handlers) DeleteSecurityGroupRule(c *gin.Context) {
+	err := db.NewSecurityGroupRepository(db.GetService()).DeleteRule(c.Request.Context(), c.Param("id"), c.Param("rule_id"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(404, gin.H{"error": "Rule not found"})
+			return
+		}
+		if errors.Is(err, db.ErrSharedResource) {
+			c.JSON(403, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(500, gin.H{"error": "Failed to delete rule", "details": err.Error()})
+		return
+	}
+	h.syncFirewall(c, 200, gin.H{"status": "deleted"})
+}
+
+func (h *Handlers) ListInstanceSecurityGroups(c *gin.Context) {
+	groups, err := db.NewSecurityGroupRepository(db.GetService()).ListByInstance(c.Request.Context(), c.Param("name"))
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch security groups", "details": err.Error()})
+		return
+	}
+	c.JSON(200, groups)
+}
+
+func (h *Handlers) AttachSecurityGroup(c *gin.Context) {
+	var req AttachSecurityGroupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	name := c.Param("name")
+	ctx := c.Request.Context()
+	repo := db.NewSecurityGroupRepository(db.GetService())
+	if _, err := repo.Get(ctx, req.GroupID); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(404, gin.H{"error": "Security group not found"})
+			return
+		}
+		c.JSON(500, gin.H{"error": "Failed to fetch security group", "details": err.Error()})
+		return
+	}
+	if err := repo.Attach(ctx, name, req.GroupID); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to attach security group", "details": err.Error()})
+		return
+	}
+	h.syncFirewall(c, 200, gin.H{"status": "attached"})
+}
+
+func (h *Handlers) DetachSecurityGroup(c *gin.Context) {
+	err := db.NewSecurityGroupRepository(db.GetService()).Detach(c.Request.Context(), c.Param("name"), c.Param("id"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(404, gin.H{"error": "Security group not attached"})
+			return
+		}
+		c.JSON(500, gin.H{"error": "Failed to detach security group", "details": err.Error()})
+		return
+	}
+	h.syncFirewall(c, 200, gin.H{"status": "detached"})
+}
+
+// GetInstanceFirewall shows the merged rule set actually rendered for the
+// instance, with the default policy for each direction.
+func (h *Handlers) GetInstanceFirewall(c *gin.Context) {
+	name := c.Param("name")
+	groups, err := db.NewSecurityGroupRepository(db.GetService()).ListByInstance(c.Request.Context(), name)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch security groups", "details": err.Error()})
+		return
+	}
+
+	var rules []db.SecurityGroupRule
+	names := make([]string, 0, len(groups))
+	for _, g := range groups {
+		names = append(names, g.Name)
+		rules = append(rules, g.Rules...)
+	}
+	fw := network.BuildFirewall(name, rules)
+
+	ingressPolicy, egressPolicy := "accept", "accept"
+	if len(groups) > 0 {
+		ingressPolicy = "drop"
+	}
+	if fw.EgressRestricted() {
+		egressPolicy = "drop"
+	}
+
+	c.JSON(200, gin.H{
+		"instance":       name,
+		"interface":      fw.Tap,
+		"groups":         names,
+		"ingress_policy": ingressPolicy,
+		"egress_policy":  egressPolicy,
+		"ingress":        fw.Ingress,
+		"egress":         fw.Egress,
+	})
+}
+
+// ============================================================================
+// FLOATING IP HANDLERS
+// ============================================================================
+
+// syncFloatingIPs re-programs 1:1 NAT after a binding change. Like the
+// firewall, the change is persisted first and a failure is a warning.
+func (h *Handlers) syncFloatingIPs(c *gin.Context, code int, body gin.H) {
+	if err := h.netManager.SyncFloatingIPs(c.Request.Context()); err != nil {
+		log.Printf("[Network] Floating IP sync failed: %v", err)
+		body["warning"] = err.Error()
+	}
+	c.JSON(code, body)
+}
+
+func (h *Handlers) ListFloatingIPs(c *gin.Context) {
+	fips, err := db.NewFloatingIPRepository(db.GetService()).List(c.Request.Context())
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch floating IPs", "details": err.Error()})
+		return
+	}
+	c.JSON(200, fips)
+}
+
+func (h *Handlers) AllocateFloatingIP(c *gin.Context) {
+	var req AllocateFloatingIPRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request"})
+			return
+		}
+	}
+
+	fip, err := db.NewFloatingIPRepository(db.GetService()).Allocate(c.Request.Context(), req.NetworkID, req.Description)
+	if err != nil {
+		switch {
+		case err == sql.ErrNoRows:
+			c.JSON(404, gin.H{"error": "Network not found"})
+		case errors.Is(err, db.ErrNotPublicNetwork):
+			c.JSON(400, gin.H{"error": err.Error()})
+		case errors.Is(err, db.ErrNoPublicIP):
+			c.JSON(409, gin.H{"error": err.Error()})
+		case errors.Is(err, db.ErrQuotaExceeded):
+			h.writeError(c, ErrQuotaExceeded(err.Error()))
+		default:
+			c.JSON(500, gin.H{"error": "Failed to allocate floating IP", "details": err.Error()})
+		}
+		return
+	}
+	auth.AuditTarget(c, "/floating-ips/"+fip.ID)
+	c.JSON(201, fip)
+}
+
+func (h *Handlers) GetFloatingIP(c *gin.Context) {
+	fip, err := db.NewFloatingIPRepository(db.GetService()).Get(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(404, gin.H{"error": "Floating IP not found"})
+			return
+		}
+		c.JSON(500, gin.H{"error": "Failed to fetch floating IP", "details": err.Error()})
+		return
+	}
+	c.JSON(200, fip)
+}
+
+func (h *Handlers) ReleaseFloatingIP(c *gin.Context) {
+	err := db.NewFloatingIPRepository(db.GetService()).Release(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(404, gin.H{"error": "Floating IP not found"})
+			return
+		}
+		c.JSON(500, gin.H{"error": "Failed to release floating IP", "details": err.Error()})
+		return
+	}
+	h.syncFloatingIPs(c, 200, gin.H{"status": "released"})
+}
+
+// AttachFloatingIP binds the address to an instance name. Attaching an
+// address that is already bound moves it to the new instance.
+func (h *Handlers) AttachFloatingIP(c *gin.Context) {
+	var req AttachFloatingIPRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	if _, err := db.NewInstanceRepository(db.GetService()).Get(c.Request.Context(), req.Instance); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			h.writeError(c, ErrInstanceNotFound(req.Instance))
+		} else {
+			h.writeError(c, ErrDatabaseFailure(err))
+		}
+		return
+	}
+
+	err := db.NewFloatingIPRepository(db.GetService()).Attach(c.Request.Context(), c.Param("id"), req.Instance)
+	if err != nil {
+		switch {
+		case err == sql.ErrNoRows:
+			c.JSON(404, gin.H{"error": "Floating IP not found"})
+		case errors.Is(err, db.ErrInstanceHasFloatingIP):
+			c.JSON(409, gin.H{"error": err.Error()})
+		default:
+			c.JSON(500, gin.H{"error": "Failed to attach floating IP", "details": err.Error()})
+		}
+		return
+	}
+	h.syncFloatingIPs(c, 200, gin.H{"status": "attached", "instance": req.Instance})
+}
+
+func (h *Handlers) DetachFloatingIP(c *gin.Context) {
+	err := db.NewFloatingIPRepository(db.GetService()).Detach(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(404, gin.H{"error": "Floating IP not found"})
+			return
+		}
+		c.JSON(500, gin.H{"error": "Failed to detach floating IP", "details": err.Error()})
+		return
+	}
+	h.syncFloatingIPs(c, 200, gin.H{"status": "detached"})
+}
+
+// ============================================================================
+// TRAFFIC HANDLERS
+// ============================================================================
+
+// GetInstanceTraffic returns the usage of one billing period (?period=YYYY-MM,
+// current month by default) together with the quota, if any.
+func (h *Handlers) GetInstanceTraffic(c *gin.Context) {
+	name := c.Param("name")
+	if _, err := db.NewInstanceRepository(db.GetService()).Get(c.Request.Context(), name); err != nil {
+		h.writeError(c, ErrInstanceNotFound(name))
+		return
+	}
+
+	period := db.TrafficPeriod(time.Now())
+	if p := c.Query("period"); p != "" {
+		t, err := time.Parse("2006-01", p)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid period, expected YYYY-MM"})
+			return
+		}
+		period = db.TrafficPeriod(t)
+	}
+
+	repo := db.NewTrafficRepository(db.GetService())
+	usage, err := repo.GetUsage(c.Request.Context(), name, period)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch traffic", "details": err.Error()})
+		return
+	}
+
+	resp := gin.H{
+		"instance":       name,
+		"period":         period.Format("2006-01"),
+		"rx_bytes":       usage.RxBytes,
+		"tx_bytes":       usage.TxBytes,
+		"total_bytes":    usage.Total(),
+		"quota":          nil,
+		"quota_exceeded": false,
+	}
+	quota, err := repo.GetQuota(c.Request.Context(), name)
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(500, gin.H{"error": "Failed to fetch traffic quota", "details": err.Error()})
+		return
+	}
+	if quota != nil {
+		resp["quota"] = quota
+		resp["quota_exceeded"] = usage.Total() >= quota.MonthlyBytes
+	}
+	c.JSON(200, resp)
+}
+
+// GetInstanceTrafficHistory returns the last twelve recorded periods.
+func (h *Handlers) GetInstanceTrafficHistory(c *gin.Context) {
+	name := c.Param("name")
+	usage, err := db.NewTrafficRepository(db.GetService()).ListUsage(c.Request.Context(), name, 12)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch traffic history", "details": err.Error()})
+		return
+	}
+	c.JSON(200, usage)
+}
+
+func (h *Handlers) SetTrafficQuota(c *gin.Context) {
+	name := c.Param("name")
+	var req SetTrafficQuotaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	if _, err := db.NewInstanceRepository(db.GetService()).Get(c.Request.Context(), name); err != nil {
+		h.writeError(c, ErrInstanceNotFound(name))
+		return
+	}
+
+	quota := &db.TrafficQuota{
+		InstanceName: name,
+		MonthlyBytes: req.MonthlyBytes,
+		Action:       req.Action,
+		ThrottleMbps: req.ThrottleMbps,
+	}
+	if err := quota.Validate(); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if err := db.NewTrafficRepository(db.GetService()).SetQuota(c.Request.Context(), quota); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to save traffic quota", "details": err.Error()})
+		return
+	}
+
+	// Setting a quota re-arms it, which may lift an active throttle.
+	body := gin.H{"quota": quota}
+	if err := h.netManager.SyncThrottles(c.Request.Context()); err != nil {
+		log.Printf("[Network] Throttle sync failed: %v", err)
+		body["warning"] = err.Error()
+	}
+	c.JSON(200, body)
+}
+
+func (h *Handlers) DeleteTrafficQuota(c *gin.Context) {
+	name := c.Param("name")
+	if err := db.NewTrafficRepository(db.GetService()).DeleteQuota(c.Request.Context(), name); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(404, gin.H{"error": "Traffic quota not found"})
+			return
+		}
+		c.JSON(500, gin.H{"error": "Failed to delete traffic quota", "details": err.Error()})
+		return
+	}
+
+	body := gin.H{"status": "deleted"}
+	if err := h.netManager.SyncThrottles(c.Request.Context()); err != nil {
+		log.Printf("[Network] Throttle sync failed: %v", err)
+		body["warning"] = err.Error()
+	}
+	c.JSON(200, body)
+}
+
+// ============================================================================
+// PROJECT HANDLERS
+// ============================================================================
+
+// projectID parses the :id path parameter; on failure the response is
+// already written.
+func projectID(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid project ID"})
+		return 0, false
+	}
+	return id, true
+}
+
+// writeProjectError maps project repository errors to responses. Projects
+// the caller is not a member of are reported as missing.
+func writeProjectError(c *gin.Context, err error, notFound, failure string) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(404, gin.H{"error": notFound})
+	case errors.Is(err, db.ErrProjectRole):
+		c.JSON(403, gin.H{"error": err.Error()})
+	case errors.Is(err, db.ErrInvalidProjectRole), errors.Is(err, db.ErrInvitationInvalid):
+		c.JSON(400, gin.H{"error": err.Error()})
+	case errors.Is(err, db.ErrLastOwner), errors.Is(err, db.ErrPersonalProject), errors.Is(err, db.ErrProjectNotEmpty):
+		c.JSON(409, gin.H{"error": err.Error()})
+	default:
+		c.JSON(500, gin.H{"error": failure, "details": err.Error()})
+	}
+}
+
+func validProjectName(c *gin.Context, name string) bool {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 64 {
+		c.JSON(400, gin.H{"error": "Project name must have 1 to 64 characters"})
+		return false
+	}
+	return true
+}
+
+// ListProjects returns the projects the caller belongs to, with its role.
+func (h *Handlers) ListProjects(c *gin.Context) {
+	scope, _ := db.ScopeFrom(c.Request.Context())
+	projects, err := db.NewProjectRepository(db.GetService()).ListForUser(c.Request.Context(), scope.UserID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch projects", "details": err.Error()})
+		return
+	}
+	if projects == nil {
+		projects = []db.Project{}
+	}
+	c.JSON(200, gin.H{"projects": projects, "current": scope.ProjectID})
+}
+
+func (h *Handlers) CreateProject(c *gin.Context) {
+	var req ProjectRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	if !validProjectName(c, req.Name) {
+		return
+	}
+
+	project, err := db.NewProjectRepository(db.GetService()).Create(c.Request.Context(), strings.TrimSpace(req.Name))
+	if err != nil {
+		writeProjectError(c, err, "Project not found", "Failed to create project")
+		return
+	}
+	auth.AuditTarget(c, fmt.Sprintf("/projects/%d", project.ID))
+	c.JSON(201, project)
+}
+
+func (h *Handlers) GetProject(c *gin.Context) {
+	id, ok := projectID(c)
+	if !ok {
+		return
+	}
+	repo := db.NewProjectRepository(db.GetService())
+	project, err := repo.Get(c.Request.Context(), id)
+	if err != nil {
+		writeProjectError(c, err, "Project not found", "Failed to fetch project")
+		return
+	}
+	members, err := repo.ListMembers(c.Request.Context(), id)
+	if err != nil {
+		writeProjectError(c, err, "Project not found", "Failed to fetch members")
+		return
+	}
+	c.JSON(200, gin.H{"project": project, "members": members})
+}
+
+func (h *Handlers) UpdateProject(c *gin.Context) {
+	id, ok := projectID(c)
+	if !ok {
+		return
+	}
+	var req ProjectRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	if !validProjectName(c, req.Name) {
+		return
+	}
+
+	if err := db.NewProjectRepository(db.GetService()).Rename(c.Request.Context(), id, strings.TrimSpace(req.Name)); err != nil {
+		writeProjectError(c, err, "Project not found", "Failed to update project")
+		return
+	}
+	c.JSON(200, gin.H{"status": "updated"})
+}
+
+// DeleteProject removes an empty project. Its instances, networks and ISOs
+// must be deleted first.
+func (h *Handlers) DeleteProject(c *gin.Context) {
+	id, ok := projectID(c)
+	if !ok {
+		return
+	}
+	if err := db.NewProjectRepository(db.GetService()).Delete(c.Request.Context(), id); err != nil {
+		writeProjectError(c, err, "Project not found", "Failed to delete project")
+		return
+	}
+	c.JSON(200, gin.H{"status": "deleted"})
+}
+
+func (h *Handlers) ListProjectMembers(c *gin.Context) {
+	id, ok := projectID(c)
+	if !ok {
+		return
+	}
+	members, err := db.NewProjectRepository(db.GetService()).ListMembers(c.Request.Context(), id)
+	if err != nil {
+		writeProjectError(c, err, "Project not found", "Failed to fetch members")
+		return
+	}
+	c.JSON(200, members)
+}
+
+func (h *Handlers) UpdateProjectMember(c *gin.Context) {
+	id, ok := projectID(c)
+	if !ok {
+		return
+	}
+	userID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	var req ProjectMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	if err := db.NewProjectRepository(db.GetService()).SetMemberRole(c.Request.Context(), id, userID, req.Role); err != nil {
+		writeProjectError(c, err, "Member not found", "Failed to update member")
+		return
+	}
+	c.JSON(200, gin.H{"status": "updated", "user_id": userID, "role": req.Role})
+}
+
+// RemoveProjectMember removes a member; members may remove themselves to
+// leave a project.
+func (h *Handlers) RemoveProjectMember(c *gin.Context) {
+	id, ok := projectID(c)
+	if !ok {
+		return
+	}
+	userID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	if err := db.NewProjectRepository(db.GetService()).RemoveMember(c.Request.Context(), id, userID); err != nil {
+		writeProjectError(c, err, "Member not found", "Failed to remove member")
+		return
+	}
+	c.JSON(200, gin.H{"status": "removed"})
+}
+
+// LeaveProject removes the caller from a project. Unlike removing other
+// members it only needs membership, not members:manage.
+func (h *Handlers) LeaveProject(c *gin.Context) {
+	id, ok := projectID(c)
+	if !ok {
+		return
+	}
+	scope, _ := db.ScopeFrom(c.Request.Context())
+
+	if err := db.NewProjectRepository(db.GetService()).RemoveMember(c.Request.Context(), id, scope.UserID); err != nil {
+		writeProjectError(c, err, "Project not found", "Failed to leave project")
+		return
+	}
+	c.JSON(200, gin.H{"status": "left"})
+}
+
+func (h *Handlers) ListProjectInvitations(c *gin.Context) {
+	id, ok := projectID(c)
+	if !ok {
+		return
+	}
+	invitations, err := db.NewProjectRepository(db.GetService()).ListInvitations(c.Request.Context(), id)
+	if err != nil {
+		writeProjectError(c, err, "Project not found", "Failed to fetch invitations")
+		return
+	}
+	if invitations == nil {
+		invitations = []db.ProjectInvitation{}
+	}
+	c.JSON(200, invitations)
+}
+
+// CreateProjectInvitation issues an invitation token. There is no mail
+// delivery: the token is returned once and must be handed to the invitee,
+// who redeems it at POST /invitations/accept while logged in with the
+// invited email.
+func (h *Handlers) CreateProjectInvitation(c *gin.Context) {
+	id, ok := projectID(c)
+	if !ok {
+		return
+	}
+	var req ProjectInvitationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	if !strings.Contains(req.Email, "@") {
+		c.JSON(400, gin.H{"error": "Invalid email"})
+		return
+	}
+
+	inv, err := db.NewProjectRepository(db.GetService()).Invite(c.Request.Context(), id, req.Email, req.Role, db.DefaultInvitationTTL)
+	if err != nil {
+		writeProjectError(c, err, "Project not found", "Failed to create invitation")
+		return
+	}
+	auth.AuditTarget(c, fmt.Sprintf("/projects/%d/invitations/%s", id, inv.ID))
+	log.Printf("[Projects] %s invited to project %d as %s", inv.Email, id, inv.Role)
+	c.JSON(201, inv)
+}
+
+func (h *Handlers) RevokeProjectInvitation(c *gin.Context) {
+	id, ok := projectID(c)
+	if !ok {
+		return
+	}
+	err := db.NewProjectRepository(db.GetService()).RevokeInvitation(c.Request.Context(), id, c.Param("invitation_id"))
+	if err != nil {
+		writeProjectError(c, err, "Invitation not found", "Failed to revoke invitation")
+		return
+	}
+	c.JSON(200, gin.H{"status": "revoked"})
+}
+
+func (h *Handlers) AcceptProjectInvitation(c *gin.Context) {
+	var req AcceptInvitationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	project, err := db.NewProjectRepository(db.GetService()).AcceptInvitation(c.Request.Context(), req.Token)
+	if err != nil {
+		writeProjectError(c, err, "Project not found", "Failed to accept invitation")
+		return
+	}
+	auth.AuditTarget(c, fmt.Sprintf("/projects/%d", project.ID))
+	c.JSON(200, project)
+}
+
+// ============================================================================
+// QUOTA HANDLERS
+// ============================================================================
+
+// GetQuotaUsage reports the caller's and the current project's usage
+// against their quotas. Platform admins may ask about any user or project
+// with user_id and project_id.
+func (h *Handlers) GetQuotaUsage(c *gin.Context) {
+	scope, _ := db.ScopeFrom(c.Request.Context())
+	userID, projectID := scope.UserID, scope.ProjectID
+	if scope.Admin {
+		for param, dst := range map[string]*int{"user_id": &userID, "project_id": &projectID} {
+			if v := c.Query(param); v != "" {
+				id, err := strconv.Atoi(v)
+				if err != nil || id < 1 {
+					c.JSON(400, gin.H{"error": "invalid " + param})
+					return
+				}
+				*dst = id
+			}
+		}
+	}
+
+	repo := db.NewQuotaRepository(db.GetService())
+	body := gin.H{}
+	user, err := repo.Usage(c.Request.Context(), db.QuotaScopeUser, userID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch quota usage", "details": err.Error()})
+		return
+	}
+	body["user"] = user
+	if projectID > 0 {
+		project, err := repo.Usage(c.Request.Context(), db.QuotaScopeProject, projectID)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to fetch quota usage", "details": err.Error()})
+			return
+		}
+		body["project"] = project
+	}
+	c.JSON(200, body)
+}
+
+func (h *Handlers) ListQuotas(c *gin.Context) {
+	quotas, err := db.NewQuotaRepository(db.GetService()).List(c.Request.Context())
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch quotas", "details": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"quotas": quotas})
+}
+
+// quotaTarget parses the :scope and :id path parameters, id 0 naming the
+// default of the scope; on failure the response is already written.
+func quotaTarget(c *gin.Context) (string, int, bool) {
+	scope := c.Param("scope")
+	if scope != db.QuotaScopeUser && scope != db.QuotaScopeProject {
+		c.JSON(400, gin.H{"error": db.ErrInvalidQuotaScope.Error()})
+		return "", 0, false
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id < 0 {
+		c.JSON(400, gin.H{"error": "Invalid quota ID"})
+		return "", 0, false
+	}
+	return scope, id, true
+}
+
+// SetQuota replaces the limits of a user or project; omitted or null
+// limits are unlimited.
+func (h *Handlers) SetQuota(c *gin.Context) {
+	scope, id, ok := quotaTarget(c)
+	if !ok {
+		return
+	}
+	var limits db.QuotaLimits
+	if err := c.ShouldBindJSON(&limits); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	for _, l := range []*int{limits.Instances, limits.VCPU, limits.MemoryMiB, limits.DiskGB, limits.PublicIPs, limits.Snapshots} {
+		if l != nil && *l < 0 {
+			c.JSON(400, gin.H{"error": "Quota limits cannot be negative"})
+			return
+		}
+	}
+
+	quota, err := db.NewQuotaRepository(db.GetService()).Set(c.Request.Context(), scope, id, limits)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to save quota", "details": err.Error()})
+		return
+	}
+	c.JSON(200, quota)
+}
+
+// DeleteQuota removes a quota, so the user or project falls back to the
+// default of its scope.
+func (h *Handlers) DeleteQuota(c *gin.Context) {
+	scope, id, ok := quotaTarget(c)
+	if !ok {
+		return
+	}
+	if err := db.NewQuotaRepository(db.GetService()).Delete(c.Request.Context(), scope, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(404, gin.H{"error": "Quota not found"})
+			return
+		}
+		c.JSON(500, gin.H{"error": "Failed to delete quota", "details": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"status": "deleted"})
+}
+
+// ============================================================================
+// PLAN HANDLERS
+// ============================================================================
+
+func (h *Handlers) ListPlans(c *gin.Context) {
+	plans, err := db.NewPlanRepository(db.GetService()).List(c.Request.Context())
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch plans", "details": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"plans": plans})
+}
+
+// GetCurrentPlan returns the plan governing the caller; platform admins
+// are not limited by a plan and get null.
+func (h *Handlers) GetCurrentPlan(c *gin.Context) {
+	plan, err := db.NewPlanRepository(db.GetService()).Effective(c.Request.Context())
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to resolve plan", "details": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"plan": plan})
+}
+
+func (h *Handlers) CreatePlan(c *gin.Context) {
+	h.savePlan(c, 0)
+}
+
+func (h *Handlers) UpdatePlan(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id < 1 {
+		c.JSON(400, gin.H{"error": "Invalid plan ID"})
+		return
+	}
+	h.savePlan(c, id)
+}
+
+// savePlan creates (id 0) or replaces a plan from the request body;
+// omitted or null limits are unlimited.
+func (h *Handlers) savePlan(c *gin.Context, id int) {
+	var plan db.Plan
+	if err := c.ShouldBindJSON(&plan); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	plan.ID = id
+	if plan.Name = strings.TrimSpace(plan.Name); plan.Name == "" {
+		c.JSON(400, gin.H{"error": "Plan name is required"})
+		return
+	}
+	for _, l := range []*int{plan.Instances, plan.VCPU, plan.MemoryMiB, plan.DiskGB, plan.PublicIPs,
+		plan.Snapshots, plan.MaxTCPForwards, plan.MaxUDPForwards} {
+		if l != nil && *l < 0 {
+			c.JSON(400, gin.H{"error": "Plan limits cannot be negative"})
+			return
+		}
+	}
+	for _, n := range plan.NetworkIDs {
+		if _, err := uuid.Parse(n); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid network ID: " + n})
+			return
+		}
+	}
+
+	if err := db.NewPlanRepository(db.GetService()).Save(c.Request.Context(), &plan); err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			c.JSON(404, gin.H{"error": "Plan not found"})
+		case db.IsUniqueViolation(err):
+			c.JSON(409, gin.H{"error": "A plan with this name already exists"})
+		default:
+			c.JSON(500, gin.H{"error": "Failed to save plan", "details": err.Error()})
+		}
+		return
+	}
+	c.JSON(200, plan)
+}
+
+// DeletePlan removes a plan; its users and projects fall back to the
+// default plan.
+func (h *Handlers) DeletePlan(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id < 1 {
+		c.JSON(400, gin.H{"error": "Invalid plan ID"})
+		return
+	}
+	if err := db.NewPlanRepository(db.GetService()).Delete(c.Request.Context(), id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(404, gin.H{"error": "Plan not found"})
+			return
+		}
+		c.JSON(500, gin.H{"error": "Failed to delete plan", "details": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"status": "deleted"})
+}
+
+// AssignPlan puts a user or project on the plan named by plan_id, or back
+// on the default plan when plan_id is null.
+func (h *Handlers) AssignPlan(c *gin.Context) {
+	scope, id, ok := quotaTarget(c)
+	if !ok {
+		return
+	}
+	if id == 0 {
+		c.JSON(400, gin.H{"error": "Set is_default on a plan to change the default"})
+		return
+	}
+	var req struct {
+		PlanID *int `json:"plan_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	repo := db.NewPlanRepository(db.GetService())
+	if req.PlanID != nil {
+		if _, err := repo.Get(c.Request.Context(), *req.PlanID); errors.Is(err, sql.ErrNoRows) {
+			c.JSON(404, gin.H{"error": "Plan not found"})
+			return
+		} else if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to fetch plan", "details": err.Error()})
+			return
+		}
+	}
+	if err := repo.Assign(c.Request.Context(), scope, id, req.PlanID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(404, gin.H{"error": "No such " + scope})
+			return
+		}
+		c.JSON(500, gin.H{"error": "Failed to assign plan", "details": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"scope": scope, "scope_id": id, "plan_id": req.PlanID})
+}
+
+// ============================================================================
+// BILLING HANDLERS
+// ============================================================================
+
+// billingQuery parses the period (YYYY-MM, the current month by default)
+// and group_by (user or project) parameters; on failure the response is
+// already written.
+func billingQuery(c *gin.Context) (time.Time, string, bool) {
+	period := db.TrafficPeriod(time.Now())
+	if v := c.Query("period"); v != "" {
+		p, err := time.Parse("2006-01", v)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid period, want YYYY-MM"})
+			return time.Time{}, "", false
+		}
+		period = p
+	}
+	groupBy := c.DefaultQuery("group_by", db.QuotaScopeUser)
+	if groupBy != db.QuotaScopeUser && groupBy != db.QuotaScopeProject {
+		c.JSON(400, gin.H{"error": "group_by must be user or project"})
+		return time.Time{}, "", false
+	}
+	return period, groupBy, true
+}
+
+// ownBillingScope returns the only scope ID the caller may see: its own
+// user or current project. Holders of billing:manage see every scope.
+func ownBillingScope(c *gin.Context, groupBy string) (id int, all bool) {
+	if auth.Allowed(c, auth.PermBillingManage) {
+		return 0, true
+	}
+	scope, _ := db.ScopeFrom(c.Request.Context())
+	if groupBy == db.QuotaScopeProject {
+		return scope.ProjectID, false
+	}
+	return scope.UserID, false
+}
+
+// GetBillingUsage reports the vCPU-hours, memory and disk GB-hours and
+// traffic of a month by user or project.
+func (h *Handlers) GetBillingUsage(c *gin.Context) {
+	period, groupBy, ok := billingQuery(c)
+	if !ok {
+		return
+	}
+	summaries, err := db.NewUsageRepository(db.GetService()).Summarize(c.Request.Context(), period, groupBy, time.Now())
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to summarize usage", "details": err.Error()})
+		return
+	}
+	if own, all := ownBillingScope(c, groupBy); !all {
+		mine := []db.UsageSummary{}
+		for _, s := range summaries {
+			if own > 0 && s.ScopeID == own {
+				mine = append(mine, s)
+			}
+		}
+		summaries = mine
+	}
+	c.JSON(200, gin.H{"period": period.Format("2006-01"), "usage": summaries})
+}
+
+// ExportInvoices prices a month's usage with the price sheet of each
+// user's or project's plan, as JSON or, with format=csv, one CSV row per
+// invoice line.
+func (h *Handlers) ExportInvoices(c *gin.Context) {
+	period, groupBy, ok := billingQuery(c)
+	if !ok {
+		return
+	}
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		c.JSON(400, gin.H{"error": "format must be json or csv"})
+		return
+	}
+
+	invoices, err := db.NewPriceSheetRepository(db.GetService()).Invoices(c.Request.Context(), period, groupBy, time.Now())
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to build invoices", "details": err.Error()})
+		return
+	}
+	if own, all := ownBillingScope(c, groupBy); !all {
+		mine := []db.Invoice{}
+		for _, inv := range invoices {
+			if own > 0 && inv.ScopeID == own {
+				mine = append(mine, inv)
+			}
+		}
+		invoices = mine
+	}
+
+	if format == "json" {
+		c.JSON(200, gin.H{"period": period.Format("2006-01"), "invoices": invoices})
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="invoices-%s-%s.csv"`, groupBy, period.Format("2006-01")))
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Status(200)
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"period", "scope", "scope_id", "plan", "resource", "quantity", "unit", "unit_price", "amount", "currency"})
+	for _, inv := range invoices {
+		for _, l := range inv.Lines {
+			w.Write([]string{
+				inv.PeriodStart.Format("2006-01"), inv.Scope, strconv.Itoa(inv.ScopeID), inv.Plan,
+				l.Resource, strconv.FormatFloat(l.Quantity, 'f', -1, 64), l.Unit,
+				strconv.FormatFloat(l.UnitPrice, 'f', -1, 64), strconv.FormatFloat(l.Amount, 'f', 2, 64), inv.Currency,
+			})
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Printf("[Billing] Writing invoices CSV failed: %v", err)
+	}
+}
+
+func (h *Handlers) ListPriceSheets(c *gin.Context) {
+	sheets, err := db.NewPriceSheetRepository(db.GetService()).List(c.Request.Context())
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch price sheets", "details": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"price_sheets": sheets})
+}
+
+// SetPriceSheet replaces the prices of a plan.
+func (h *Handlers) SetPriceSheet(c *gin.Context) {
+	planID, err := strconv.Atoi(c.Param("plan_id"))
+	if err != nil || planID < 1 {
+		c.JSON(400, gin.H{"error": "Invalid plan ID"})
+		return
+	}
+	var sheet db.PriceSheet
+	if err := c.ShouldBindJSON(&sheet); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	sheet.PlanID = planID
+	if sheet.Currency = strings.ToUpper(strings.TrimSpace(sheet.Currency)); sheet.Currency == "" {
+		sheet.Currency = "USD"
+	}
+	if len(sheet.Currency) != 3 {
+		c.JSON(400, gin.H{"error": "Currency must be an ISO 4217 code"})
+		return
+	}
+	if sheet.VCPUHour < 0 || sheet.MemoryGBHour < 0 || sheet.DiskGBHour < 0 || sheet.TrafficGB < 0 {
+		c.JSON(400, gin.H{"error": "Prices cannot be negative"})
+		return
+	}
+
+	if _, err := db.NewPlanRepository(db.GetService()).Get(c.Request.Context(), planID); errors.Is(err, sql.ErrNoRows) {
+		c.JSON(404, gin.H{"error": "Plan not found"})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch plan", "details": err.Error()})
+		return
+	}
+	if err := db.NewPriceSheetRepository(db.GetService()).Set(c.Request.Context(), &sheet); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to save price sheet", "details": err.Error()})
+		return
+	}
+	c.JSON(200, sheet)
+}
+
+// DeletePriceSheet removes the prices of a plan; its invoices then show
+// quantities only.
+func (h *Handlers) DeletePriceSheet(c *gin.Context) {
+	planID, err := strconv.Atoi(c.Param("plan_id"))
+	if err != nil || planID < 1 {
+		c.JSON(400, gin.H{"error": "Invalid plan ID"})
+		return
+	}
+	if err := db.NewPriceSheetRepository(db.GetService()).Delete(c.Request.Context(), planID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(404, gin.H{"error": "Price sheet not found"})
+			return
+		}
+		c.JSON(500, gin.H{"error": "Failed to delete price sheet", "details": err.Error()})
+		return
+	}
 	c.JSON(200, gin.H{"status": "deleted"})
 }
 
@@ -1304,6 +3116,7 @@ func main() {
 ║    GET  /instances           - List all instances              ║
 ║    POST /instances           - Create instance                 ║
 ║    GET  /ws/terminal/:name   - WebSocket terminal              ║
+║    GET  /ws/telemetry        - Live job events                 ║
 ╚════════════════════════════════════════════════════════════════╝`)
 
 	// Graceful shutdown
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"aexon/internal/auth"
+	"aexon/internal/db"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// routeDirectory makes the caller a "member" of every project, granted the
+// permissions set per request.
+type routeDirectory struct {
+	granted []string
+}
+
+func (d *routeDirectory) DefaultProject(ctx context.Context, userID int) (int, string, error) {
+	return 1, "member", nil
+}
+
+func (d *routeDirectory) ProjectRole(ctx context.Context, projectID, userID int) (string, error) {
+	return "member", nil
+}
+
+func (d *routeDirectory) RolePermissions(ctx context.Context) (map[string][]string, error) {
+	return map[string][]string{"member": d.granted}, nil
+}
+
+type memoryAuditLog struct {
+	mu     sync.Mutex
+	events []*db.AuditEvent
+}
+
+func (l *memoryAuditLog) Append(ctx context.Context, e *db.AuditEvent) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, e)
+	return nil
+}
+
+func (l *memoryAuditLog) last() *db.AuditEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.events) == 0 {
+		return nil
+	}
+	return l.events[len(l.events)-1]
+}
+
+func TestRoutePermissions(t *testing.T) {
+	routes := []struct {
+		method, path, permission string // Empty permission: public route
+	}{
+		{"GET", "/.well-known/jwks.json", ""},
+		{"GET", "/api/v1/setup", ""},
+		{"POST", "/api/v1/setup", ""},
+		{"POST", "/api/v1/login", ""},
+		{"POST", "/api/v1/register", ""},
+		{"POST", "/api/v1/refresh", ""},
+		{"POST", "/api/v1/revoke", ""},
+		{"POST", "/api/v1/login/2fa", ""},
+		{"GET", "/api/v1/auth/oidc/login", ""},
+		{"GET", "/api/v1/auth/oidc/callback", ""},
+		{"POST", "/api/v1/logout-all", auth.PermSessionsRevoke},
+		{"POST", "/api/v1/auth/password", auth.PermPasswordChange},
+		{"GET", "/api/v1/auth/2fa", auth.PermMFAManage},
+		{"POST", "/api/v1/auth/2fa/enroll", auth.PermMFAManage},
+		{"POST", "/api/v1/auth/2fa/confirm", auth.PermMFAManage},
+		{"POST", "/api/v1/auth/2fa/disable", auth.PermMFAManage},
+		{"POST", "/api/v1/auth/2fa/recovery-codes", auth.PermMFAManage},
+		{"GET", "/api/v1/auth/2fa/policy", auth.PermMFAPolicy},
+		{"PUT", "/api/v1/auth/2fa/policy", auth.PermMFAPolicy},
+		{"GET", "/api/v1/api-tokens", auth.PermAPITokensManage},
+		{"POST", "/api/v1/api-tokens", auth.PermAPITokensManage},
+		{"DELETE", "/api/v1/api-tokens/:id", auth.PermAPITokensManage},
+		{"GET", "/api/v1/auth/keys", auth.PermSigningKeys},
+		{"POST", "/api/v1/auth/keys/rotate", auth.PermSigningKeys},
+		{"GET", "/api/v1/auth/metrics", auth.PermSystemRead},
+
+		{"GET", "/api/v1/instances", auth.PermInstancesRead},
+		{"POST", "/api/v1/instances", auth.PermInstancesCreate},
+		{"GET", "/api/v1/instances/:name", auth.PermInstancesRead},
+		{"DELETE", "/api/v1/instances/:name", auth.PermInstancesDelete},
+		{"POST", "/api/v1/instances/:name/action", auth.PermInstancesOperate},
+		{"PUT", "/api/v1/instances/:name/limits", auth.PermInstancesResize},
+		{"PUT", "/api/v1/instances/:name/backup", auth.PermBackupsManage},
+
+		{"GET", "/api/v1/instances/:name/snapshots", auth.PermSnapshotsRead},
+		{"POST", "/api/v1/instances/:name/snapshots", auth.PermSnapshotsCreate},
+		{"POST", "/api/v1/instances/:name/snapshots/:snap/restore", auth.PermBackupsRestore},
+		{"DELETE", "/api/v1/instances/:name/snapshots/:snap", auth.PermSnapshotsDelete},
+
+		{"GET", "/api/v1/instances/:name/files", auth.PermFilesRead},
+		{"GET", "/api/v1/instances/:name/file", auth.PermFilesRead},
+		{"POST", "/api/v1/instances/:name/files", auth.PermFilesWrite},
+		{"DELETE", "/api/v1/instances/:name/files", auth.PermFilesWrite},
+
+		{"GET", "/api/v1/instances/:name/metrics", auth.PermInstancesRead},
+		{"GET", "/api/v1/instances/:name/metrics/history", auth.PermInstancesRead},
+		{"GET", "/api/v1/instances/:name/logs", auth.PermInstancesRead},
+
+		{"GET", "/api/v1/cluster", auth.PermClusterRead},
+		{"GET", "/api/v1/isos", auth.PermISOsRead},
+		{"POST", "/api/v1/isos", auth.PermISOsManage},
+		{"DELETE", "/api/v1/isos/:name", auth.PermISOsManage},
+		{"GET", "/api/v1/jobs", auth.PermJobsRead},
+		{"GET", "/api/v1/jobs/:id", auth.PermJobsRead},
+		{"GET", "/api/v1/jobs/:id/logs", auth.PermJobsRead},
+		{"POST", "/api/v1/jobs/:id/cancel", auth.PermJobsCancel},
+		{"GET", "/api/v1/ws/telemetry", auth.PermJobsRead},
+		{"POST", "/api/v1/workflows", auth.PermWorkflowsCreate},
+		{"GET", "/api/v1/templates", auth.PermTemplatesRead},
+		{"GET", "/api/v1/metrics", auth.PermSystemRead},
+
+		{"GET", "/api/v1/networks", auth.PermNetworksRead},
+		{"POST", "/api/v1/networks", auth.PermNetworksManage},
+		{"GET", "/api/v1/networks/:id", auth.PermNetworksRead},
+		{"DELETE", "/api/v1/networks/:id", auth.PermNetworksManage},
+
+		{"GET", "/api/v1/security-groups", auth.PermSecurityGroupsRead},
+		{"POST", "/api/v1/security-groups", auth.PermSecurityGroupsManage},
+		{"GET", "/api/v1/security-groups/:id", auth.PermSecurityGroupsRead},
+		{"DELETE", "/api/v1/security-groups/:id", auth.PermSecurityGroupsManage},
+		{"POST", "/api/v1/security-groups/:id/rules", auth.PermSecurityGroupsManage},
+		{"DELETE", "/api/v1/security-groups/:id/rules/:rule_id", auth.PermSecurityGroupsManage},
+		{"GET", "/api/v1/instances/:name/security-groups", auth.PermSecurityGroupsRead},
+		{"POST", "/api/v1/instances/:name/security-groups", auth.PermSecurityGroupsAttach},
+		{"DELETE", "/api/v1/instances/:name/security-groups/:id", auth.PermSecurityGroupsAttach},
+		{"GET", "/api/v1/instances/:name/firewall", auth.PermSecurityGroupsRead},
+
+		{"GET", "/api/v1/floating-ips", auth.PermFloatingIPsRead},
+		{"POST", "/api/v1/floating-ips", auth.PermFloatingIPsManage},
+		{"GET", "/api/v1/floating-ips/:id", auth.PermFloatingIPsRead},
+		{"DELETE", "/api/v1/floating-ips/:id", auth.PermFloatingIPsManage},
+		{"POST", "/api/v1/floating-ips/:id/attach", auth.PermFloatingIPsAttach},
+		{"POST", "/api/v1/floating-ips/:id/detach", auth.PermFloatingIPsAttach},
+
+		{"GET", "/api/v1/instances/:name/traffic", auth.PermTrafficRead},
+		{"GET", "/api/v1/instances/:name/traffic/history", auth.PermTrafficRead},
+		{"PUT", "/api/v1/instances/:name/traffic/quota", auth.PermTrafficManage},
+		{"DELETE", "/api/v1/instances/:name/traffic/quota", auth.PermTrafficManage},
+
+		{"GET", "/api/v1/projects", auth.PermProjectsList},
+		{"POST", "/api/v1/projects", auth.PermProjectsCreate},
+		{"GET", "/api/v1/projects/:id", auth.PermProjectsRead},
+		{"PATCH", "/api/v1/projects/:id", auth.PermProjectsUpdate},
+		{"DELETE", "/api/v1/projects/:id", auth.PermProjectsDelete},
+		{"GET", "/api/v1/projects/:id/members", auth.PermMembersRead},
+		{"PUT", "/api/v1/projects/:id/members/:user_id", auth.PermMembersManage},
+		{"POST", "/api/v1/projects/:id/leave", auth.PermProjectsLeave},
+		{"DELETE", "/api/v1/projects/:id/members/:user_id", auth.PermMembersManage},
+		{"GET", "/api/v1/projects/:id/invitations", auth.PermMembersManage},
+		{"POST", "/api/v1/projects/:id/invitations", auth.PermMembersManage},
+		{"DELETE", "/api/v1/projects/:id/invitations/:invitation_id", auth.PermMembersManage},
+		{"POST", "/api/v1/invitations/accept", auth.PermInvitationsJoin},
+
+		{"GET", "/api/v1/roles", auth.PermRolesManage},
+		{"PUT", "/api/v1/roles/:role/permissions", auth.PermRolesManage},
+
+		{"GET", "/api/v1/users", auth.PermUsersRead},
+		{"POST", "/api/v1/users", auth.PermUsersManage},
+		{"GET", "/api/v1/users/:id", auth.PermUsersRead},
+		{"PATCH", "/api/v1/users/:id", auth.PermUsersManage},
+		{"DELETE", "/api/v1/users/:id", auth.PermUsersManage},
+		{"POST", "/api/v1/users/:id/password-reset", auth.PermUsersManage},
+
+		{"GET", "/api/v1/audit", auth.PermAuditRead},
+		{"GET", "/api/v1/audit/verify", auth.PermAuditRead},
+		{"GET", "/api/v1/quotas/usage", auth.PermQuotasRead},
+		{"GET", "/api/v1/quotas", auth.PermQuotasManage},
+		{"PUT", "/api/v1/quotas/:scope/:id", auth.PermQuotasManage},
+		{"DELETE", "/api/v1/quotas/:scope/:id", auth.PermQuotasManage},
+		{"GET", "/api/v1/plans", auth.PermPlansRead},
+		{"GET", "/api/v1/plans/current", auth.PermPlansRead},
+		{"POST", "/api/v1/plans", auth.PermPlansManage},
+		{"PUT", "/api/v1/plans/:id", auth.PermPlansManage},
+		{"DELETE", "/api/v1/plans/:id", auth.PermPlansManage},
+		{"PUT", "/api/v1/plans/assignments/:scope/:id", auth.PermPlansManage},
+		{"POST", "/api/v1/branding/upload-logo", auth.PermBrandingManage},
+		{"GET", "/api/v1/branding/settings", auth.PermBrandingManage},
+		{"PUT", "/api/v1/branding/settings", auth.PermBrandingManage},
+		{"GET", "/api/v1/billing/usage", auth.PermBillingRead},
+		{"GET", "/api/v1/billing/invoices", auth.PermBillingRead},
+		{"GET", "/api/v1/billing/prices", auth.PermBillingRead},
+		{"PUT", "/api/v1/billing/prices/:plan_id", auth.PermBillingManage},
+		{"DELETE", "/api/v1/billing/prices/:plan_id", auth.PermBillingManage},
+	}
+
+	gin.SetMode(gin.TestMode)
+	// Route checks never reach a handler; the database stays unused
+	cfg := db.DefaultConfig()
+	cfg.ConnectTimeout = time.Second
+	db.InitService(cfg)
+	auth.InitAuthService(&auth.Config{
+		SecretKey:     []byte("route-permission-test-secret-0123456789"),
+		TokenDuration: time.Hour,
+	})
+
+	d := &routeDirectory{}
+	defer auth.SetDirectory(d)()
+	audit := &memoryAuditLog{}
+	defer auth.SetAuditLog(audit)()
+
+	a := &Application{handlers: &Handlers{}}
+	a.setupRouter()
+
+	// Every registered route must be listed above
+	listed := make(map[string]bool)
+	for _, r := range routes {
+		listed[r.method+" "+r.path] = true
+	}
+	for _, r := range a.router.Routes() {
+		if !listed[r.Method+" "+r.Path] {
+			t.Errorf("%s %s has no entry in the permission table", r.Method, r.Path)
+		}
+		delete(listed, r.Method+" "+r.Path)
+	}
+	for route := range listed {
+		t.Errorf("%s is listed but not registered", route)
+	}
+	for _, r := range a.router.Routes() {
+		if r.Method != "GET" && auditActions[r.Method+" "+r.Path] == "" {
+			t.Errorf("%s %s has no audit action", r.Method, r.Path)
+		}
+	}
+
+	token, err := auth.GetAuthService().GenerateAccessToken("7", "user@example.com", "user", nil)
+	if err != nil {
+		t.Fatalf("token: %v", err)
+	}
+
+	for _, r := range routes {
+		if r.permission == "" {
+			continue
+		}
+		t.Run(r.method+" "+r.path, func(t *testing.T) {
+			path := strings.NewReplacer(":name", "vm", ":snap", "s", ":id", "1", ":rule_id", "1",
+				":user_id", "2", ":invitation_id", "x", ":role", "viewer", ":scope", "user").Replace(r.path)
+
+			w := httptest.NewRecorder()
+			a.router.ServeHTTP(w, httptest.NewRequest(r.method, path, nil))
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("anonymous request: status %d, want 401", w.Code)
+			}
+			if want := auditActions[r.method+" "+r.path]; want != "" {
+				e := audit.last()
+				if e == nil || e.Action != want || e.Outcome != db.AuditDenied {
+					t.Errorf("anonymous request recorded as %+v, want denied %s", e, want)
+				}
+			}
+
+			// Everything but the route's permission must not be enough
+			d.granted = nil
+			for _, p := range auth.Catalog {
+				if p.Name != r.permission {
+					d.granted = append(d.granted, p.Name)
+				}
+			}
+			req := httptest.NewRequest(r.method, path, nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			w = httptest.NewRecorder()
+			a.router.ServeHTTP(w, req)
+
+			var body struct {
+				Required string `json:"required"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &body)
+			if w.Code != http.StatusForbidden || body.Required != r.permission {
+				t.Errorf("without %s: status %d requiring %q, want 403", r.permission, w.Code, body.Required)
+			}
+		})
+	}
+}
+
+func TestCreateWorkflow(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := &Handlers{}
+
+	tests := []struct {
+		name, body string
+		err        string // Part of the response body
+	}{
+		{"invalid json", `{"steps":`, "invalid json"},
+		{"no steps", `{"steps":[]}`, ""},
+		{"cycle", `{"steps":[
+			{"name":"stop","type":"state_change","target":"vm","depends_on":["start"]},
+			{"name":"start","type":"state_change","target":"vm","depends_on":["stop"]}]}`, "cycle"},
+		{"nested workflow", `{"steps":[{"name":"inner","type":"workflow","target":"vm"}]}`, "invalid type"},
+		// Without workers, no job type can run
+		{"unsupported type", `{"steps":[{"name":"snap","type":"create_snapshot","target":"vm"}]}`, "unsupported job type"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/api/v1/workflows", strings.NewReader(tt.body))
+		c.Request.Header.Set("Content-Type", "application/json")
+		h.CreateWorkflow(c)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tt.err) {
+			t.Errorf("%s: %d %s, want 400 with %q", tt.name, w.Code, w.Body.String(), tt.err)
+		}
+	}
+}